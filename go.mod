@@ -7,3 +7,5 @@ require (
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 )
+
+require golang.org/x/text v0.3.0 // indirect
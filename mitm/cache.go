@@ -0,0 +1,257 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DefaultCacheSize is how many responses a DNSCache
+// keeps, unless it has a MaxEntries.
+const DefaultCacheSize = 1024
+
+// A DNSCache keeps the upstream's responses to forwarded queries for as
+// long as their records may be cached, so that repeated queries are
+// answered without another round trip upstream, which would slow the
+// victim down and make more traffic than a real resolver would.
+//
+// Responses are kept by the name, type and class of their question,
+// and by their DO and CD bits, so that a query wanting DNSSEC records
+// (see WantsDNSSEC) or unvalidated answers is never given a response
+// fetched for a query which did not. Only successful and NXDOMAIN
+// responses to single-question queries are kept, for the smallest TTL
+// of their records; those with no records at all to take a TTL from
+// are not kept. Negative responses are kept for the TTL of their SOA
+// record or its MINIMUM field, whichever is smaller (RFC 2308, section
+// 5). Expired responses are evicted when next looked up.
+//
+// The fields must not be changed once the cache is in use. A DNSCache is
+// safe for concurrent use, and a nil *DNSCache caches nothing.
+type DNSCache struct {
+	// MaxEntries is how many responses are kept, the least recently
+	// used being evicted to make room. If zero, DefaultCacheSize is used.
+	MaxEntries int
+	// Clock, if set, is what responses are aged and expired by.
+	// Otherwise SystemClock is used.
+	Clock Clock
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+}
+
+// A cacheKey identifies the question a cached response answers,
+// and the DNSSEC bits it was asked with.
+type cacheKey struct {
+	name   string
+	typ    layers.DNSType
+	class  layers.DNSClass
+	do, cd bool
+}
+
+// dnsCD is the Checking Disabled (CD) bit of the header's Z field
+// as gopacket decodes it (RFC 4035, section 3.2.2).
+const dnsCD = 1
+
+// A cacheEntry is a response kept in a DNSCache.
+type cacheEntry struct {
+	key      cacheKey
+	response *layers.DNS
+	stored   time.Time
+	expires  time.Time
+}
+
+// cacheKeyFor returns the key for dns's question, and whether it has
+// exactly one question to key it by. Responses echo the DO and CD bits
+// of the query, so a response has the same key as its query.
+func cacheKeyFor(dns *layers.DNS) (cacheKey, bool) {
+	questions := questionsOf(dns)
+	if len(questions) != 1 {
+		return cacheKey{}, false
+	}
+	q := questions[0]
+	return cacheKey{normalizeDomain(string(q.Name)), q.Type, q.Class, WantsDNSSEC(dns), dns.Z&dnsCD != 0}, true
+}
+
+// Lookup returns the raw response cached for the raw DNS query, and
+// whether there is one, as by Get.
+func (c *DNSCache) Lookup(query []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	dns, ok := decodeRawDNS(query)
+	if !ok {
+		return nil, false
+	}
+	response, ok := c.Get(dns)
+	if !ok {
+		return nil, false
+	}
+	b, err := SerializeDNS(response)
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// Get returns the response cached for query, and whether there is one.
+// The response is rewritten to carry the query's ID and questions, and
+// its TTLs are counted down by however long it has been cached, so that
+// it looks freshly fetched.
+func (c *DNSCache) Get(query *layers.DNS) (*layers.DNS, bool) {
+	if c == nil || !IsQuery(query) {
+		return nil, false
+	}
+	key, ok := cacheKeyFor(query)
+	if !ok {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := clockNow(c.Clock)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	// entry.response is never changed once cached, so copy what is.
+	response := *entry.response
+	response.ID = query.ID
+	response.Questions, response.QDCount = query.Questions, query.QDCount
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	response.Answers = agedRecords(entry.response.Answers, elapsed)
+	response.Authorities = agedRecords(entry.response.Authorities, elapsed)
+	response.Additionals = agedRecords(entry.response.Additionals, elapsed)
+	return &response, true
+}
+
+// agedRecords returns a copy of records with elapsed seconds taken off
+// their TTLs. OPT records are left as they are, since their TTL field
+// holds EDNS flags rather than a TTL.
+func agedRecords(records []layers.DNSResourceRecord, elapsed uint32) []layers.DNSResourceRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	aged := make([]layers.DNSResourceRecord, len(records))
+	copy(aged, records)
+	for i := range aged {
+		if aged[i].Type == layers.DNSTypeOPT {
+			continue
+		}
+		if aged[i].TTL > elapsed {
+			aged[i].TTL -= elapsed
+		} else {
+			aged[i].TTL = 0
+		}
+	}
+	return aged
+}
+
+// Store caches the raw DNS response, if it may be cached, as by Put.
+func (c *DNSCache) Store(response []byte) {
+	if c == nil {
+		return
+	}
+	if dns, ok := decodeRawDNS(response); ok {
+		c.Put(dns)
+	}
+}
+
+// Put caches response, if it may be cached, evicting the least recently
+// used response if the cache is full. It must not be changed afterwards.
+func (c *DNSCache) Put(response *layers.DNS) {
+	if c == nil || !IsResponse(response) || response.TC ||
+		(response.ResponseCode != layers.DNSResponseCodeNoErr && response.ResponseCode != layers.DNSResponseCodeNXDomain) {
+		return
+	}
+	key, ok := cacheKeyFor(response)
+	if !ok {
+		return
+	}
+	ttl, ok := minTTL(response)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.lru = list.New()
+		c.entries = make(map[cacheKey]*list.Element)
+	}
+	now := clockNow(c.Clock)
+	entry := &cacheEntry{key: key, response: response, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	max := c.MaxEntries
+	if max <= 0 {
+		max = DefaultCacheSize
+	}
+	for c.lru.Len() > max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns how many responses are cached, including any
+// which have expired but not yet been looked up again.
+func (c *DNSCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// minTTL returns the smallest TTL of the records in dns's answer and
+// authority sections, and whether there are any. In a negative response,
+// one without answers, an SOA record's TTL counts as no more than its
+// MINIMUM field, as for negative caching (RFC 2308, section 5).
+func minTTL(dns *layers.DNS) (uint32, bool) {
+	var ttl uint32
+	found := false
+	negative := len(dns.Answers) == 0
+	for _, section := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities} {
+		for _, rr := range section {
+			rrTTL := rr.TTL
+			if negative && rr.Type == layers.DNSTypeSOA && rr.SOA.Minimum < rrTTL {
+				rrTTL = rr.SOA.Minimum
+			}
+			if !found || rrTTL < ttl {
+				ttl, found = rrTTL, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// decodeRawDNS decodes b as a DNS message,
+// reporting whether it is well-formed.
+func decodeRawDNS(b []byte) (*layers.DNS, bool) {
+	pkt := gopacket.NewPacket(b, layers.LayerTypeDNS, gopacket.Default)
+	if pkt.ErrorLayer() != nil {
+		return nil, false
+	}
+	dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	return dns, ok
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestForwarderCache(t *testing.T) {
+	upstream, queries := fakeUpstream(t, answerWith(t, net.ParseIP("3.23.25.235")))
+	clock := newFakeClock()
+	fwd := &Forwarder{Upstream: upstream, Cache: &DNSCache{Clock: clock}}
+
+	// forward sends a query for domain with id and returns the response,
+	// reporting whether the query reached the upstream.
+	forward := func(domain string, id uint16) (*layers.DNS, bool) {
+		t.Helper()
+		query := dnsWithDomainQuestions([]string{domain})
+		query.ID = id
+		b, err := SerializeDNS(query)
+		if err != nil {
+			t.Fatalf("failed to serialize query: %v", err)
+		}
+		response, err := fwd.Forward(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		select {
+		case <-queries:
+			return decodeDNS(t, response), true
+		default:
+			return decodeDNS(t, response), false
+		}
+	}
+
+	if _, forwarded := forward("eecs388.org", 0x388); !forwarded {
+		t.Fatal("expected the first query to reach the upstream")
+	}
+
+	clock.Advance(100 * time.Second)
+	response, forwarded := forward("EECS388.org", 0x1234)
+	if forwarded {
+		t.Error("expected the second query to be answered from the cache")
+	}
+	if response.ID != 0x1234 {
+		t.Errorf("expected the cached response to carry ID %#x but got %#x", 0x1234, response.ID)
+	}
+	if len(response.Questions) != 1 || string(response.Questions[0].Name) != "EECS388.org" {
+		t.Errorf("expected the cached response to echo the question as asked but got %v", response.Questions)
+	}
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Fatalf("expected the cached answer but got %v", response.Answers)
+	}
+	if ttl := response.Answers[0].TTL; ttl != DefaultTTL-100 {
+		t.Errorf("expected the TTL to have counted down to %d but got %d", DefaultTTL-100, ttl)
+	}
+
+	clock.Advance((DefaultTTL - 100) * time.Second)
+	if _, forwarded := forward("eecs388.org", 0x388); !forwarded {
+		t.Error("expected the query to reach the upstream once the cached answer expired")
+	}
+}
+
+func TestDNSCacheGetPut(t *testing.T) {
+	clock := newFakeClock()
+	cache := &DNSCache{Clock: clock}
+
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	answer, err := AnswerForQuestionTTL(query.Questions[0], net.ParseIP("3.23.25.235"), 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cache.Put(BuildResponse(query, []layers.DNSResourceRecord{answer}))
+
+	clock.Advance(2 * time.Second)
+	response, ok := cache.Get(query)
+	if !ok {
+		t.Fatal("expected the response to be cached")
+	}
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) || response.Answers[0].TTL != 3 {
+		t.Errorf("expected the cached answer with 3 seconds left but got %v", response.Answers)
+	}
+
+	// The class is part of the key.
+	chaos := dnsWithDomainQuestions([]string{"eecs388.org"})
+	chaos.Questions[0].Class = layers.DNSClassCH
+	if _, ok := cache.Get(chaos); ok {
+		t.Error("expected nothing to be cached for a CHAOS-class question")
+	}
+
+	clock.Advance(3 * time.Second)
+	if _, ok := cache.Get(query); ok {
+		t.Error("expected the response to be gone once its TTL elapsed")
+	}
+	if n := cache.Len(); n != 0 {
+		t.Errorf("expected the expired response to be evicted but %d are cached", n)
+	}
+}
+
+func TestDNSCacheEviction(t *testing.T) {
+	cache := &DNSCache{MaxEntries: 2}
+	answer := answerWith(t, net.ParseIP("3.23.25.235"))
+	for _, domain := range []string{"a.eecs388.org", "b.eecs388.org"} {
+		cache.Store(answer(serializeQuery(t, domain)))
+	}
+	// Using a makes b the least recently used.
+	if _, ok := cache.Lookup(serializeQuery(t, "a.eecs388.org")); !ok {
+		t.Fatal("expected a.eecs388.org to be cached")
+	}
+	cache.Store(answer(serializeQuery(t, "c.eecs388.org")))
+
+	if n := cache.Len(); n != 2 {
+		t.Errorf("expected 2 cached responses but got %d", n)
+	}
+	for _, v := range []struct {
+		domain string
+		cached bool
+	}{
+		{"a.eecs388.org", true},
+		{"b.eecs388.org", false},
+		{"c.eecs388.org", true},
+	} {
+		if _, ok := cache.Lookup(serializeQuery(t, v.domain)); ok != v.cached {
+			t.Errorf("expected %s cached to be %v but got %v", v.domain, v.cached, ok)
+		}
+	}
+}
+
+func TestDNSCacheUncacheable(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	empty, _ := SerializeDNS(BuildResponse(query, nil))
+	servfail, _ := SerializeDNS(ServFailResponse(query))
+	answer, _ := AnswerForQuestionTTL(query.Questions[0], net.ParseIP("3.23.25.235"), 0)
+	zeroTTL, _ := SerializeDNS(BuildResponse(query, []layers.DNSResourceRecord{answer}))
+
+	for _, v := range []struct {
+		name     string
+		response []byte
+	}{
+		{"no records", empty},
+		{"SERVFAIL", servfail},
+		{"zero TTL", zeroTTL},
+		{"query", serializeQuery(t, "eecs388.org")},
+		{"two questions", answerWith(t, net.ParseIP("3.23.25.235"))(serializeQuery(t, "eecs388.org", "bank.com"))},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			var cache DNSCache
+			cache.Store(v.response)
+			if n := cache.Len(); n != 0 {
+				t.Errorf("expected nothing to be cached but got %d responses", n)
+			}
+		})
+	}
+}
+
+func TestDNSCacheNegativeTTL(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		rcode    layers.DNSResponseCode
+		ttl, min uint32
+		expected time.Duration
+	}{
+		{"NXDOMAIN with a smaller MINIMUM", layers.DNSResponseCodeNXDomain, 3600, 60, 60 * time.Second},
+		{"NXDOMAIN with a smaller TTL", layers.DNSResponseCodeNXDomain, 30, 300, 30 * time.Second},
+		{"NODATA with a smaller MINIMUM", layers.DNSResponseCodeNoErr, 3600, 60, 60 * time.Second},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			clock := newFakeClock()
+			cache := &DNSCache{Clock: clock}
+			query := dnsWithDomainQuestions([]string{"eecs388.org"})
+			soa := NegativeSOA{}.recordFor(query.Questions[0])
+			soa.TTL, soa.SOA.Minimum = v.ttl, v.min
+			response := BuildResponse(query, nil)
+			response.ResponseCode = v.rcode
+			response.Authorities, response.NSCount = []layers.DNSResourceRecord{soa}, 1
+			cache.Put(response)
+
+			clock.Advance(v.expected - time.Second)
+			if _, ok := cache.Get(query); !ok {
+				t.Fatalf("expected the response to be cached for %s", v.expected)
+			}
+			clock.Advance(time.Second)
+			if _, ok := cache.Get(query); ok {
+				t.Errorf("expected the response to expire after %s", v.expected)
+			}
+		})
+	}
+}
+
+func TestDNSCacheDNSSECBits(t *testing.T) {
+	cache := &DNSCache{}
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	answer, _ := AnswerForQuestionTTL(query.Questions[0], net.ParseIP("3.23.25.235"), DefaultTTL)
+	cache.Put(BuildResponse(query, []layers.DNSResourceRecord{answer}))
+
+	do := withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, true)
+	if _, ok := cache.Get(do); ok {
+		t.Error("expected a query with DO set not to be given a response cached without it")
+	}
+	cd := dnsWithDomainQuestions([]string{"eecs388.org"})
+	cd.Z |= dnsCD
+	if _, ok := cache.Get(cd); ok {
+		t.Error("expected a query with CD set not to be given a response cached without it")
+	}
+	if _, ok := cache.Get(query); !ok {
+		t.Error("expected a query without DO or CD to be given the cached response")
+	}
+}
+
+func TestDNSCacheNil(t *testing.T) {
+	var cache *DNSCache
+	cache.Store(answerWith(t, net.ParseIP("3.23.25.235"))(serializeQuery(t, "eecs388.org")))
+	if _, ok := cache.Lookup(serializeQuery(t, "eecs388.org")); ok {
+		t.Error("expected a nil cache to cache nothing")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const (
+	// dnsQueryFilter is the BPF filter for DNS queries, so that the
+	// kernel only hands us packets we may want to respond to.
+	dnsQueryFilter = "udp and dst port 53"
+	// dnsFilter is the BPF filter for DNS messages in either direction.
+	dnsFilter = "udp and port 53"
+	// captureSnapLen is how many bytes of each packet are captured,
+	// enough for any DNS query sent over UDP on Ethernet.
+	captureSnapLen = 1600
+	// captureTimeout is how long a read from the capture handle may
+	// block, bounding how long cancellation can take to be noticed.
+	captureTimeout = 100 * time.Millisecond
+)
+
+// CaptureDNSQueries captures DNS queries on the network interface iface,
+// calling handler with each one that has a question table can answer
+// (see SpoofTable.MatchesQuery) and is from a victim of config, which
+// may be nil (see SpoofConfig.Victims).
+// Packets which do not decode are skipped.
+// It returns nil once ctx is done, or an error if capturing could not start.
+func CaptureDNSQueries(ctx context.Context, iface string, table *SpoofTable, config *SpoofConfig, handler func(packet gopacket.Packet)) error {
+	handle, err := pcap.OpenLive(iface, captureSnapLen, true, captureTimeout)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(dnsQueryFilter); err != nil {
+		return err
+	}
+
+	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+	dispatchDNSQueries(ctx, packets, table, config, handler)
+	return nil
+}
+
+// dispatchDNSQueries calls handler with each packet received from
+// packets which is a well-formed DNS query from a victim of config that
+// table matches, until packets is closed or ctx is done.
+func dispatchDNSQueries(ctx context.Context, packets <-chan gopacket.Packet, table *SpoofTable, config *SpoofConfig, handler func(packet gopacket.Packet)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+			if pkt.ErrorLayer() != nil {
+				continue
+			}
+			dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+			if !ok || !table.MatchesQuery(dns) || !config.victim(packetSource(pkt)) {
+				continue
+			}
+			handler(pkt)
+		}
+	}
+}
+
+// A Sniffer reads packets from Source and calls Handler with each one
+// carrying a DNS message, queries and responses alike, so that a live
+// capture can be wired up to the DNS functions without writing the read
+// loop each time. Packets which do not decode are skipped.
+//
+// Source may read from anything, e.g. a pcap handle (see SniffDNS) or a
+// pcapgo.Reader over a saved capture. A Sniffer must not be changed once
+// running.
+type Sniffer struct {
+	Source  *gopacket.PacketSource
+	Handler func(packet gopacket.Packet, dns *layers.DNS)
+}
+
+// Run calls s.Handler with each DNS packet read from s.Source, in order,
+// until ctx is done or the source runs out of packets, and returns nil.
+//
+// Source keeps a packet read ahead, which is lost once ctx is done;
+// it is up to the caller to close whatever Source reads from.
+func (s *Sniffer) Run(ctx context.Context) error {
+	packets := s.Source.Packets()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt, ok := <-packets:
+			if !ok {
+				return nil
+			}
+			if pkt.ErrorLayer() != nil {
+				continue
+			}
+			if dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+				s.Handler(pkt, dns)
+			}
+		}
+	}
+}
+
+// SniffDNS captures DNS messages in either direction on the network
+// interface iface, calling handler with each one, as by Sniffer.Run.
+// It returns nil once ctx is done, or an error if capturing could not start.
+func SniffDNS(ctx context.Context, iface string, handler func(packet gopacket.Packet, dns *layers.DNS)) error {
+	handle, err := pcap.OpenLive(iface, captureSnapLen, true, captureTimeout)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(dnsFilter); err != nil {
+		return err
+	}
+
+	s := &Sniffer{Source: gopacket.NewPacketSource(handle, handle.LinkType()), Handler: handler}
+	return s.Run(ctx)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestDispatchDNSQueries(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", nil)
+
+	matching := capturedIPv4Query(t, "eecs388.org")
+	other := capturedIPv4Query(t, "umich.edu")
+	// Cut the matching query off partway through its DNS layer.
+	malformed := gopacket.NewPacket(matching.Data()[:len(matching.Data())-8], layers.LayerTypeEthernet, gopacket.Default)
+
+	packets := make(chan gopacket.Packet, 3)
+	packets <- malformed
+	packets <- other
+	packets <- matching
+	close(packets)
+
+	var handled []gopacket.Packet
+	dispatchDNSQueries(context.Background(), packets, &table, nil, func(pkt gopacket.Packet) {
+		handled = append(handled, pkt)
+	})
+
+	if len(handled) != 1 || handled[0] != matching {
+		t.Errorf("expected only the matching query to be handled but got %d packets", len(handled))
+	}
+}
+
+func TestDispatchDNSQueriesCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dispatchDNSQueries(ctx, make(chan gopacket.Packet), &SpoofTable{}, nil, func(gopacket.Packet) {})
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("dispatchDNSQueries did not return after its context was cancelled")
+	}
+}
+
+func TestSniffer(t *testing.T) {
+	arp, err := ARPRequest(net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88}, net.ParseIP("10.38.8.2"), net.ParseIP("10.38.8.53"))
+	if err != nil {
+		t.Fatalf("failed to build ARP request: %v", err)
+	}
+	query := capturedIPv4Query(t, "eecs388.org").Data()
+
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(captureSnapLen, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("failed to write pcap header: %v", err)
+	}
+	for _, data := range [][]byte{arp, query, query[:len(query)-8]} {
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+		if err := w.WritePacket(ci, data); err != nil {
+			t.Fatalf("failed to write packet: %v", err)
+		}
+	}
+	r, err := pcapgo.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("failed to read pcap: %v", err)
+	}
+
+	var handled []string
+	s := &Sniffer{
+		Source: gopacket.NewPacketSource(r, r.LinkType()),
+		Handler: func(pkt gopacket.Packet, dns *layers.DNS) {
+			handled = append(handled, QueriedDomains(dns)...)
+		},
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(handled) != 1 || handled[0] != "eecs388.org" {
+		t.Errorf("expected only the DNS query for eecs388.org to be handled but got %v", handled)
+	}
+}
+
+// blockingSource is a gopacket.PacketDataSource
+// which never has a packet until it is closed.
+type blockingSource chan struct{}
+
+func (s blockingSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	<-s
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func TestSnifferCancel(t *testing.T) {
+	source := make(blockingSource)
+	defer close(source)
+	s := &Sniffer{
+		Source:  gopacket.NewPacketSource(source, layers.LinkTypeEthernet),
+		Handler: func(gopacket.Packet, *layers.DNS) {},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected nil error after cancellation, got %v", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Sniffer.Run did not return after its context was cancelled")
+	}
+}
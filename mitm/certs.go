@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leafValidity is how long the certificates minted by a
+// CertAuthority are valid for (though never past the CA's own).
+const leafValidity = 7 * 24 * time.Hour
+
+// leafRenewal is how long before a cached certificate expires
+// that a CertAuthority mints a new one to take its place.
+const leafRenewal = 24 * time.Hour
+
+// A CertAuthority mints certificates for whatever hosts the victim
+// connects to, signed by our own CA, so that TLS connections can be
+// terminated and intercepted. Once the victim trusts the CA, they
+// cannot tell our certificates from the real ones.
+//
+// Certificates are cached, so each host's is only minted once, until
+// it is within leafRenewal of expiring. A CertAuthority is safe for
+// concurrent use.
+type CertAuthority struct {
+	// Clock, if set, is what certificates are minted and checked for
+	// expiry by. Otherwise SystemClock is used. It must not be changed
+	// once the CertAuthority is in use.
+	Clock Clock
+
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+// NewCertAuthority returns a CertAuthority which signs
+// certificates as cert, using its private key key.
+func NewCertAuthority(cert *x509.Certificate, key crypto.Signer) *CertAuthority {
+	return &CertAuthority{cert: cert, key: key, leaves: make(map[string]*tls.Certificate)}
+}
+
+// LoadCertAuthority returns a CertAuthority using the PEM-encoded CA
+// certificate and private key in certFile and keyFile.
+func LoadCertAuthority(certFile, keyFile string) (*CertAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA private key cannot sign")
+	}
+	return NewCertAuthority(cert, key), nil
+}
+
+// LeafFor returns a certificate for host (a DNS name or IP address)
+// signed by the CA, along with the CA's certificate to chain it to.
+func (ca *CertAuthority) LeafFor(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return nil, errors.New("no host to mint a certificate for")
+	}
+
+	now := clockNow(ca.Clock)
+	if leaf, ok := ca.cached(host, now); ok {
+		return leaf, nil
+	}
+	// Minting is slow, so it is done without holding ca.mu, and
+	// concurrent calls for one host may each mint a certificate.
+	leaf, err := ca.mint(host, now)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if cached, ok := ca.leaves[host]; ok && ca.fresh(cached, now) {
+		return cached, nil
+	}
+	ca.leaves[host] = leaf
+	return leaf, nil
+}
+
+// cached returns the certificate cached for host, if there is one
+// which is fresh at now.
+func (ca *CertAuthority) cached(host string, now time.Time) (*tls.Certificate, bool) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	leaf, ok := ca.leaves[host]
+	if !ok || !ca.fresh(leaf, now) {
+		return nil, false
+	}
+	return leaf, true
+}
+
+// fresh returns whether leaf is far enough from expiring at now to keep
+// using. A certificate which expires with the CA is as fresh as any new
+// one could be.
+func (ca *CertAuthority) fresh(leaf *tls.Certificate, now time.Time) bool {
+	return now.Add(leafRenewal).Before(leaf.Leaf.NotAfter) || !leaf.Leaf.NotAfter.Before(ca.cert.NotAfter)
+}
+
+// mint returns a new certificate for host signed by the CA,
+// valid from shortly before now.
+func (ca *CertAuthority) mint(host string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	// Backdate a little, in case the victim's clock is behind ours.
+	notBefore := now.Add(-time.Hour)
+	notAfter := notBefore.Add(leafValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// GetCertificate returns the certificate for the host named by the
+// client's SNI, or the address it connected to if it sent none.
+// It is meant for use as tls.Config.GetCertificate.
+func (ca *CertAuthority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := hello.ServerName
+	if host == "" && hello.Conn != nil {
+		host, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+	}
+	return ca.LeafFor(host)
+}
+
+// TLSConfig returns a configuration for a TLS server which
+// presents the CA's certificate for whichever host is asked for.
+func (ca *CertAuthority) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: ca.GetCertificate}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCA returns a CertAuthority with a freshly generated CA,
+// along with a pool trusting it.
+func newTestCA(t *testing.T) (*CertAuthority, *x509.CertPool) {
+	t.Helper()
+	return newTestCAValidFor(t, 24*time.Hour)
+}
+
+// newTestCAValidFor is newTestCA for a CA which expires after validity.
+func newTestCAValidFor(t *testing.T, validity time.Duration) (*CertAuthority, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(388),
+		Subject:               pkix.Name{CommonName: "EECS 388 Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return NewCertAuthority(cert, key), pool
+}
+
+func TestCertAuthorityLeafFor(t *testing.T) {
+	ca, roots := newTestCA(t)
+
+	for _, host := range []string{"example.com", "10.38.8.3"} {
+		host := host
+		t.Run(host, func(t *testing.T) {
+			leaf, err := ca.LeafFor(host)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+				t.Errorf("certificate for %s does not chain to the CA: %v", host, err)
+			}
+			if leaf.Leaf.NotAfter.After(ca.cert.NotAfter) {
+				t.Errorf("certificate outlives the CA")
+			}
+
+			again, _ := ca.LeafFor(host)
+			if again != leaf {
+				t.Errorf("expected the certificate for %s to be cached", host)
+			}
+		})
+	}
+}
+
+func TestCertAuthorityLeafForRenewal(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		validity time.Duration
+		advance  time.Duration
+		renewed  bool
+	}{
+		{"fresh", 30 * 24 * time.Hour, 5 * 24 * time.Hour, false},
+		{"close to expiry", 30 * 24 * time.Hour, 6*24*time.Hour + time.Minute, true},
+		{"expiring with the CA", 24 * time.Hour, 12 * time.Hour, false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			ca, _ := newTestCAValidFor(t, v.validity)
+			clock := &fakeClock{now: time.Now()}
+			ca.Clock = clock
+
+			leaf, err := ca.LeafFor("example.com")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			clock.Advance(v.advance)
+			again, err := ca.LeafFor("example.com")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if renewed := again != leaf; renewed != v.renewed {
+				t.Errorf("expected renewed to be %v but got %v", v.renewed, renewed)
+			}
+			if v.renewed && !again.Leaf.NotAfter.After(leaf.Leaf.NotAfter) {
+				t.Errorf("expected the new certificate to outlive the old one")
+			}
+		})
+	}
+}
+
+func TestCertAuthorityTLSConfig(t *testing.T) {
+	ca, roots := newTestCA(t)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "intercepted")
+	}))
+	s.TLS = ca.TLSConfig()
+	s.StartTLS()
+	defer s.Close()
+
+	for _, host := range []string{"example.com", "bank.com"} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: host},
+		}}
+		resp, err := client.Get(s.URL)
+		if err != nil {
+			t.Errorf("client for %s did not accept the minted certificate: %v", host, err)
+			continue
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "intercepted" {
+			t.Errorf("client for %s expected response body %q but got %q", host, "intercepted", b)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// A Clock tells the time to code whose behaviour depends on it, such as
+// how long cached answers live or how fast rate limits refill, so that
+// tests can stand in a fake one and move time on without sleeping.
+// Socket deadlines are kept by the operating system, so always follow
+// the real time whatever the Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the system's own time,
+// used wherever no other Clock is given.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// clockNow returns the time on c, or on SystemClock if c is nil.
+func clockNow(c Clock) time.Time {
+	if c == nil {
+		return SystemClock.Now()
+	}
+	return c.Now()
+}
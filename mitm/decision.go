@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A Decision is what a DecisionFunc decides to do with a question:
+// one of Spoof(ip), Forward, Drop or NXDomain.
+type Decision struct {
+	// Action is ActionSpoof, ActionForward, ActionDrop or ActionNXDomain.
+	Action SpoofAction
+	// IP is the address a spoofed question is answered with. A question
+	// decided ActionSpoof without one is forwarded instead.
+	IP net.IP
+}
+
+// Spoof returns the Decision to answer a question with ip. If ip is nil,
+// as net.ParseIP returns for an address which does not parse, that is
+// Forward, so that a typo lets the real answer through rather than
+// denying the name exists.
+func Spoof(ip net.IP) Decision {
+	if ip == nil {
+		return Forward
+	}
+	return Decision{Action: ActionSpoof, IP: ip}
+}
+
+var (
+	// Forward is the Decision to leave a question to the real resolver.
+	Forward = Decision{Action: ActionForward}
+	// Drop is the Decision to discard a query without any response.
+	Drop = Decision{Action: ActionDrop}
+	// NXDomain is the Decision to deny that a question's name exists.
+	NXDomain = Decision{Action: ActionNXDomain}
+)
+
+// A DecisionFunc decides what to do with the question q of a query from
+// src, e.g. by the time of day, or by what src was sent before. src is
+// nil where the query's source is unknown, as for a packet replayed by
+// ReplayPcap without an IP layer.
+// Installed as a SpoofConfig's Decide, it replaces the table's entries
+// as the policy of the DNS servers and the Injector, and must be safe
+// for concurrent use.
+type DecisionFunc func(src net.Addr, q layers.DNSQuestion) Decision
+
+// DefaultDecision is the DecisionFunc which decides as the table's entries
+// do when there is no Decide: a question for a name in the table is spoofed
+// with the entry's first address, or with NXDOMAIN if the name is denied,
+// and any other is forwarded. It is there for custom policies to fall
+// back on; entries' other answers, such as TXT or shuffled addresses,
+// are not given.
+func (t *SpoofTable) DefaultDecision(src net.Addr, q layers.DNSQuestion) Decision {
+	if q.Class != layers.DNSClassIN || !t.spoofsType(q.Type) || t.isProtected(q) {
+		return Forward
+	}
+	entry, ok := t.LookupEntry(q)
+	switch {
+	case !ok:
+		return Forward
+	case entry.Deny:
+		return NXDomain
+	}
+	if addrs := entry.addresses(); len(addrs) > 0 {
+		return Spoof(addrs[0])
+	}
+	return Forward
+}
+
+// spoofedResponseFrom is spoofedResponse for a query from src, decided
+// by decide if it is not nil. Like spoofedResponse, it reports whether
+// the query should be answered with the returned response rather than
+// forwarded; a nil response and true means it should be dropped.
+func (t *SpoofTable) spoofedResponseFrom(decide DecisionFunc, src net.Addr, query *layers.DNS, ttl uint32, udp bool) (*layers.DNS, bool) {
+	if decide == nil {
+		return t.spoofedResponse(query, ttl, udp)
+	}
+	if !isStandardQuery(query) || WantsDNSSEC(query) {
+		return BuildResponse(query, nil), false
+	}
+	var answers []layers.DNSResourceRecord
+	nxdomain := false
+	for _, q := range uniqueQuestions(questionsOf(query)) {
+		d := decide(src, q)
+		switch d.Action {
+		case ActionDrop:
+			return nil, true
+		case ActionNXDomain:
+			nxdomain = true
+		case ActionSpoof:
+			if d.IP == nil {
+				continue
+			}
+			records, err := DirectAnswer(q, d.IP, ttl)
+			if err != nil {
+				continue
+			}
+			answers = append(answers, records...)
+		}
+	}
+	if nxdomain {
+		return NXDomainResponseSOA(query, t.SOA), true
+	}
+	return BuildResponse(query, answers), len(answers) > 0
+}
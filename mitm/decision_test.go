@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// decideByName is a DecisionFunc for tests which decides by the
+// question's name, recording the source of every query it is asked about.
+type decideByName struct {
+	mu      sync.Mutex
+	sources []net.Addr
+}
+
+func (d *decideByName) decide(src net.Addr, q layers.DNSQuestion) Decision {
+	d.mu.Lock()
+	d.sources = append(d.sources, src)
+	d.mu.Unlock()
+	switch string(q.Name) {
+	case "spoof.eecs388.org":
+		return Spoof(net.ParseIP("3.23.25.235"))
+	case "drop.eecs388.org":
+		return Drop
+	case "nxdomain.eecs388.org":
+		return NXDomain
+	case "typo.eecs388.org":
+		return Spoof(net.ParseIP("3.23.25"))
+	}
+	return Forward
+}
+
+func TestServeDNSDecide(t *testing.T) {
+	upstream, _ := fakeUpstream(t, answerWith(t, net.ParseIP("10.38.8.4")))
+	var d decideByName
+	var table SpoofTable
+	addr := serveTestDNS(t, &table, &SpoofConfig{Decide: d.decide}, &Forwarder{Upstream: upstream, Timeout: time.Second})
+
+	for _, v := range []struct {
+		domain string
+		rcode  layers.DNSResponseCode
+		ip     net.IP
+	}{
+		{"spoof.eecs388.org", layers.DNSResponseCodeNoErr, net.ParseIP("3.23.25.235")},
+		{"forward.eecs388.org", layers.DNSResponseCodeNoErr, net.ParseIP("10.38.8.4")},
+		{"nxdomain.eecs388.org", layers.DNSResponseCodeNXDomain, nil},
+		{"typo.eecs388.org", layers.DNSResponseCodeNoErr, net.ParseIP("10.38.8.4")},
+	} {
+		response := decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, v.domain)))
+		if response.ResponseCode != v.rcode {
+			t.Errorf("expected response code %s for %s but got %s", v.rcode, v.domain, response.ResponseCode)
+		}
+		if v.ip == nil {
+			if len(response.Answers) != 0 {
+				t.Errorf("expected no answers for %s but got %v", v.domain, response.Answers)
+			}
+			continue
+		}
+		if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(v.ip) {
+			t.Errorf("expected a single answer for %s pointing to %s but got %v", v.domain, v.ip, response.Answers)
+		}
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(serializeQuery(t, "drop.eecs388.org"))
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Errorf("expected the dropped query to go unanswered but got %d bytes", n)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, src := range d.sources {
+		if ip := addrIP(src); !ip.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("expected the decision to be asked about queries from 127.0.0.1 but got %v", src)
+		}
+	}
+}
+
+func TestServeDNSTCPDecideDrop(t *testing.T) {
+	var d decideByName
+	var table SpoofTable
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeDNSTCP(ctx, ln, &table, &SpoofConfig{Decide: d.decide}, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	query := serializeQuery(t, "drop.eecs388.org")
+	if _, err := conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	if b, err := io.ReadAll(conn); err != nil || len(b) != 0 {
+		t.Errorf("expected the connection to be closed without a response but got %x (%v)", b, err)
+	}
+}
+
+func TestInjectorDecide(t *testing.T) {
+	var d decideByName
+	var table SpoofTable
+
+	for _, v := range []struct {
+		domain   string
+		injected bool
+		rcode    layers.DNSResponseCode
+	}{
+		{"spoof.eecs388.org", true, layers.DNSResponseCodeNoErr},
+		{"nxdomain.eecs388.org", true, layers.DNSResponseCodeNXDomain},
+		{"forward.eecs388.org", false, 0},
+		{"drop.eecs388.org", false, 0},
+	} {
+		var w capturingWriter
+		in := &Injector{Writer: &w, Config: &SpoofConfig{Decide: d.decide}}
+		injected, err := in.InjectSpoofed(context.Background(), capturedIPv4Query(t, v.domain), &table)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if injected != v.injected {
+			t.Errorf("expected injected to be %v for %s but got %v", v.injected, v.domain, injected)
+			continue
+		}
+		if !injected {
+			if len(w.packets) != 0 {
+				t.Errorf("expected no packets to be written for %s but got %d", v.domain, len(w.packets))
+			}
+			continue
+		}
+		dns := gopacket.NewPacket(w.packets[0], layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if dns.ResponseCode != v.rcode {
+			t.Errorf("expected response code %s for %s but got %s", v.rcode, v.domain, dns.ResponseCode)
+		}
+	}
+
+	for _, src := range d.sources {
+		if udp, ok := src.(*net.UDPAddr); !ok || !udp.IP.Equal(net.ParseIP("10.38.8.2")) || udp.Port != 38838 {
+			t.Errorf("expected the decision to be asked about queries from 10.38.8.2:38838 but got %v", src)
+		}
+	}
+}
+
+func TestDefaultDecision(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Deny("bank.com")
+
+	for _, v := range []struct {
+		domain   string
+		expected Decision
+	}{
+		{"eecs388.org", Spoof(net.ParseIP("3.23.25.235"))},
+		{"bank.com", NXDomain},
+		{"umich.edu", Forward},
+	} {
+		d := table.DefaultDecision(nil, questionFor(v.domain))
+		if d.Action != v.expected.Action || !d.IP.Equal(v.expected.IP) {
+			t.Errorf("expected decision %+v for %s but got %+v", v.expected, v.domain, d)
+		}
+	}
+}
+
+func TestSpoofInvalidIP(t *testing.T) {
+	if d := Spoof(net.ParseIP("typo")); d.Action != ActionForward || d.IP != nil {
+		t.Errorf("expected an address which does not parse to be forwarded but got %+v", d)
+	}
+	if NXDomain.Action == ActionSpoof {
+		t.Errorf("expected NXDomain to be told apart from a spoof")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// An InjectionContext describes where forged replies are injected:
+// the interface on the victim's network, our own addresses on it, and
+// the victim's. Use DiscoverInjection rather than filling it in by hand.
+type InjectionContext struct {
+	// Interface is the name of the interface to capture and inject on.
+	Interface string
+	// MAC and IP are our own addresses on Interface.
+	MAC net.HardwareAddr
+	IP  net.IP
+	// Network is the subnet of Interface the victim is on.
+	Network *net.IPNet
+	// Victim is the victim's IP address, or nil if none was given.
+	Victim net.IP
+	// VictimMAC is the victim's MAC address,
+	// or nil if it was not resolved.
+	VictimMAC net.HardwareAddr
+}
+
+// Victims returns a filter matching just ic's victim,
+// or nil (matching everyone) if ic has none.
+func (ic *InjectionContext) Victims() *VictimFilter {
+	if ic == nil || ic.Victim == nil {
+		return nil
+	}
+	bits := 8 * len(ic.Victim)
+	f := &VictimFilter{Nets: []*net.IPNet{{IP: ic.Victim, Mask: net.CIDRMask(bits, bits)}}}
+	if ic.VictimMAC != nil {
+		f.MACs = []net.HardwareAddr{ic.VictimMAC}
+	}
+	return f
+}
+
+// A NetInterface is a network interface DiscoverInjection may pick.
+type NetInterface struct {
+	Name  string
+	MAC   net.HardwareAddr
+	Flags net.Flags
+	Addrs []*net.IPNet
+}
+
+// An ARPProber resolves the MAC address of ip, a host on ic's network.
+// PcapARPProber is the one used unless told otherwise.
+type ARPProber interface {
+	ResolveMAC(ctx context.Context, ic *InjectionContext, ip net.IP) (net.HardwareAddr, error)
+}
+
+// DiscoverInjection returns the InjectionContext for attacking victim,
+// an IP address, so that nobody has to look up interface names and MAC
+// addresses by hand. The interface picked is the one whose subnet holds
+// victim (the most specific, if several do), and the victim's MAC address
+// is resolved by prober, or by a PcapARPProber if prober is nil. Only
+// IPv4 victims' MAC addresses are resolved; for IPv6, VictimMAC is nil.
+//
+// If victim is "auto", the first interface which is up with an IPv4
+// address is picked, and the context has no victim.
+func DiscoverInjection(ctx context.Context, victim string, prober ARPProber) (*InjectionContext, error) {
+	ifaces, err := systemInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	if prober == nil {
+		prober = PcapARPProber{}
+	}
+	return discoverInjection(ctx, ifaces, victim, prober)
+}
+
+// systemInterfaces returns the network interfaces of this machine.
+func systemInterfaces() ([]NetInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var result []NetInterface
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("addresses of %s: %w", iface.Name, err)
+		}
+		ni := NetInterface{Name: iface.Name, MAC: iface.HardwareAddr, Flags: iface.Flags}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ni.Addrs = append(ni.Addrs, ipnet)
+			}
+		}
+		result = append(result, ni)
+	}
+	return result, nil
+}
+
+// discoverInjection implements DiscoverInjection over ifaces.
+func discoverInjection(ctx context.Context, ifaces []NetInterface, victim string, prober ARPProber) (*InjectionContext, error) {
+	var target net.IP
+	if victim != "auto" {
+		if target = net.ParseIP(victim); target == nil {
+			return nil, fmt.Errorf("invalid victim address %q", victim)
+		}
+		if ip4 := target.To4(); ip4 != nil {
+			target = ip4
+		}
+	}
+	iface, network, err := selectInterface(ifaces, target)
+	if err != nil {
+		return nil, err
+	}
+	ic := &InjectionContext{
+		Interface: iface.Name,
+		MAC:       iface.MAC,
+		IP:        network.IP,
+		Network:   network,
+		Victim:    target,
+	}
+	if target == nil || target.To4() == nil {
+		return ic, nil
+	}
+	if ic.VictimMAC, err = prober.ResolveMAC(ctx, ic, target); err != nil {
+		return nil, fmt.Errorf("resolving MAC address of %s on %s: %w", target, ic.Interface, err)
+	}
+	return ic, nil
+}
+
+// selectInterface returns the interface of ifaces to inject on, and its
+// address on the victim's network, as described by DiscoverInjection.
+// A nil victim picks the first usable interface with an IPv4 address.
+// Interfaces which are down, loopback or without a MAC address are
+// never picked.
+func selectInterface(ifaces []NetInterface, victim net.IP) (NetInterface, *net.IPNet, error) {
+	var best NetInterface
+	var bestNet *net.IPNet
+	bestOnes := -1
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || len(iface.MAC) == 0 {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			ones, _ := addr.Mask.Size()
+			sameFamily := (addr.IP.To4() != nil) == (victim == nil || victim.To4() != nil)
+			if !sameFamily || (victim != nil && !addr.Contains(victim)) || ones <= bestOnes {
+				continue
+			}
+			best, bestNet, bestOnes = iface, addr, ones
+			if victim == nil {
+				return best, bestNet, nil
+			}
+		}
+	}
+	if bestNet == nil {
+		if victim == nil {
+			return NetInterface{}, nil, errors.New("no interface is up with an IPv4 address")
+		}
+		return NetInterface{}, nil, fmt.Errorf("no interface is on a network with %s", victim)
+	}
+	return best, bestNet, nil
+}
+
+const (
+	// DefaultARPTimeout is how long a PcapARPProber
+	// waits for a reply, unless told otherwise.
+	DefaultARPTimeout = 3 * time.Second
+	// arpRetryInterval is how often an unanswered ARP request is resent.
+	arpRetryInterval = 500 * time.Millisecond
+)
+
+// A PcapARPProber resolves MAC addresses by sending ARP requests on the
+// context's interface through pcap and capturing the reply through the
+// same handle.
+type PcapARPProber struct {
+	// Timeout, if positive, is how long to wait for a reply;
+	// otherwise DefaultARPTimeout is used.
+	Timeout time.Duration
+}
+
+// ResolveMAC opens its own pcap handle on ic.Interface, captures only
+// ARP through it, and sends requests for ip until a reply arrives or the
+// timeout passes (see resolveMAC).
+func (p PcapARPProber) ResolveMAC(ctx context.Context, ic *InjectionContext, ip net.IP) (net.HardwareAddr, error) {
+	handle, err := pcap.OpenLive(ic.Interface, captureSnapLen, false, captureTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter("arp"); err != nil {
+		return nil, err
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultARPTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return resolveMAC(ctx, handle, ic, ip)
+}
+
+// A packetHandle sends and receives raw packets, as *pcap.Handle does.
+type packetHandle interface {
+	PacketWriter
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+}
+
+// resolveMAC sends ARP requests for ip from ic's addresses through h,
+// every arpRetryInterval until a reply is read back from h or ctx is done.
+func resolveMAC(ctx context.Context, h packetHandle, ic *InjectionContext, ip net.IP) (net.HardwareAddr, error) {
+	request, err := ARPRequest(ic.MAC, ic.IP, ip)
+	if err != nil {
+		return nil, err
+	}
+	var sent time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if time.Since(sent) >= arpRetryInterval {
+			if err := h.WritePacketData(request); err != nil {
+				return nil, err
+			}
+			sent = time.Now()
+		}
+		data, _, err := h.ReadPacketData()
+		if errors.Is(err, pcap.NextErrorTimeoutExpired) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		if mac, ok := arpReplyFrom(pkt, ip); ok {
+			return mac, nil
+		}
+	}
+}
+
+// ARPRequest returns the raw bytes of an Ethernet broadcast ARP request
+// from srcMAC and srcIP asking for the MAC address of the IPv4 address ip.
+func ARPRequest(srcMAC net.HardwareAddr, srcIP, ip net.IP) ([]byte, error) {
+	src4, ip4 := srcIP.To4(), ip.To4()
+	if src4 == nil || ip4 == nil {
+		return nil, fmt.Errorf("cannot ARP for %s from %s: not both IPv4 addresses", ip, srcIP)
+	}
+	if len(srcMAC) != 6 {
+		return nil, fmt.Errorf("%s is not an Ethernet MAC address", srcMAC)
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: src4,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    ip4,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, arp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// arpReplyFrom returns the MAC address pkt says ip has,
+// and whether pkt is an ARP reply from ip.
+func arpReplyFrom(pkt gopacket.Packet, ip net.IP) (net.HardwareAddr, bool) {
+	arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Operation != layers.ARPReply || !bytes.Equal(arp.SourceProtAddress, ip.To4()) {
+		return nil, false
+	}
+	return net.HardwareAddr(arp.SourceHwAddress), true
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	ourMAC    = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	victimMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88}
+)
+
+// ifaceAddr returns the address of an interface given in CIDR notation,
+// such as "10.38.8.1/24", keeping the host part as net.Interface does.
+func ifaceAddr(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", cidr, err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: ipnet.Mask}
+}
+
+// fakeProber is an ARPProber which answers from a fixed table,
+// recording the contexts it is asked in.
+type fakeProber struct {
+	macs     map[string]net.HardwareAddr
+	contexts []InjectionContext
+}
+
+func (p *fakeProber) ResolveMAC(ctx context.Context, ic *InjectionContext, ip net.IP) (net.HardwareAddr, error) {
+	p.contexts = append(p.contexts, *ic)
+	mac, ok := p.macs[ip.String()]
+	if !ok {
+		return nil, errors.New("no reply")
+	}
+	return mac, nil
+}
+
+func TestSelectInterface(t *testing.T) {
+	ifaces := []NetInterface{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []*net.IPNet{ifaceAddr(t, "127.0.0.1/8")}},
+		{Name: "eth1", MAC: ourMAC, Addrs: []*net.IPNet{ifaceAddr(t, "10.39.9.1/24")}},
+		{Name: "tun0", Flags: net.FlagUp, Addrs: []*net.IPNet{ifaceAddr(t, "10.38.8.1/24")}},
+		{Name: "eth0", MAC: ourMAC, Flags: net.FlagUp, Addrs: []*net.IPNet{ifaceAddr(t, "2001:db8::1/64"), ifaceAddr(t, "10.38.0.1/16")}},
+		{Name: "eth2", MAC: ourMAC, Flags: net.FlagUp, Addrs: []*net.IPNet{ifaceAddr(t, "10.38.8.7/24")}},
+	}
+
+	for _, v := range []struct {
+		name   string
+		victim string
+		iface  string
+		ip     string
+	}{
+		{"auto", "", "eth0", "10.38.0.1"},
+		{"most specific subnet", "10.38.8.2", "eth2", "10.38.8.7"},
+		{"wider subnet", "10.38.20.2", "eth0", "10.38.0.1"},
+		{"IPv6", "2001:db8::388", "eth0", "2001:db8::1"},
+		{"down interface", "10.39.9.2", "", ""},
+		{"loopback", "127.0.0.2", "", ""},
+		{"no subnet", "3.23.25.235", "", ""},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			victim := net.ParseIP(v.victim)
+			iface, network, err := selectInterface(ifaces, victim)
+			if v.iface == "" {
+				if err == nil {
+					t.Errorf("expected no interface for %s but got %s", v.victim, iface.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if iface.Name != v.iface || !network.IP.Equal(net.ParseIP(v.ip)) {
+				t.Errorf("expected %s with address %s but got %s with %s", v.iface, v.ip, iface.Name, network.IP)
+			}
+		})
+	}
+}
+
+func TestDiscoverInjection(t *testing.T) {
+	ifaces := []NetInterface{
+		{Name: "eth0", MAC: ourMAC, Flags: net.FlagUp, Addrs: []*net.IPNet{ifaceAddr(t, "10.38.8.1/24"), ifaceAddr(t, "2001:db8::1/64")}},
+	}
+	prober := &fakeProber{macs: map[string]net.HardwareAddr{"10.38.8.2": victimMAC}}
+
+	ic, err := discoverInjection(context.Background(), ifaces, "10.38.8.2", prober)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ic.Interface != "eth0" || !bytes.Equal(ic.MAC, ourMAC) || !ic.IP.Equal(net.ParseIP("10.38.8.1")) {
+		t.Errorf("expected to inject on eth0 as %s at 10.38.8.1 but got %+v", ourMAC, ic)
+	}
+	if !ic.Victim.Equal(net.ParseIP("10.38.8.2")) || !bytes.Equal(ic.VictimMAC, victimMAC) {
+		t.Errorf("expected victim 10.38.8.2 at %s but got %s at %s", victimMAC, ic.Victim, ic.VictimMAC)
+	}
+	if len(prober.contexts) != 1 || prober.contexts[0].Interface != "eth0" {
+		t.Errorf("expected a single probe on eth0 but got %+v", prober.contexts)
+	}
+	if f := ic.Victims(); !f.Matches(net.ParseIP("10.38.8.2"), victimMAC) || f.Matches(net.ParseIP("10.38.8.3"), nil) {
+		t.Errorf("expected the victim filter to match just the victim but got %+v", f)
+	}
+
+	ic, err = discoverInjection(context.Background(), ifaces, "auto", prober)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ic.Interface != "eth0" || ic.Victim != nil || ic.VictimMAC != nil || ic.Victims() != nil {
+		t.Errorf("expected eth0 with no victim but got %+v", ic)
+	}
+
+	ic, err = discoverInjection(context.Background(), ifaces, "2001:db8::388", prober)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ic.IP.Equal(net.ParseIP("2001:db8::1")) || ic.VictimMAC != nil {
+		t.Errorf("expected an IPv6 victim to be left unresolved but got %+v", ic)
+	}
+	if len(prober.contexts) != 1 {
+		t.Errorf("expected no further probes but got %+v", prober.contexts[1:])
+	}
+
+	for _, victim := range []string{"10.38.8.3", "3.23.25.235", "not an address"} {
+		if ic, err := discoverInjection(context.Background(), ifaces, victim, prober); err == nil {
+			t.Errorf("expected an error discovering %q but got %+v", victim, ic)
+		}
+	}
+}
+
+// fakeARPHandle is a packetHandle on which every ARP request written is
+// answered first by a bystander and then by the host asked about, if it
+// is in macs.
+type fakeARPHandle struct {
+	t       *testing.T
+	macs    map[string]net.HardwareAddr
+	written [][]byte
+	replies [][]byte
+}
+
+func (h *fakeARPHandle) WritePacketData(data []byte) error {
+	h.written = append(h.written, data)
+	arp, ok := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		h.t.Fatalf("expected an ARP packet to be written")
+	}
+	h.replies = append(h.replies, h.reply(arp, net.IP{10, 38, 8, 99}, net.HardwareAddr{0x02, 0, 0, 0, 0, 0x99}))
+	if mac, ok := h.macs[net.IP(arp.DstProtAddress).String()]; ok {
+		h.replies = append(h.replies, h.reply(arp, arp.DstProtAddress, mac))
+	}
+	return nil
+}
+
+func (h *fakeARPHandle) reply(request *layers.ARP, ip net.IP, mac net.HardwareAddr) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: mac, DstMAC: request.SourceHwAddress, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   mac,
+			SourceProtAddress: ip,
+			DstHwAddress:      request.SourceHwAddress,
+			DstProtAddress:    request.SourceProtAddress,
+		})
+	if err != nil {
+		h.t.Fatalf("failed to serialize ARP reply: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func (h *fakeARPHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(h.replies) == 0 {
+		return nil, gopacket.CaptureInfo{}, errors.New("no more packets")
+	}
+	data := h.replies[0]
+	h.replies = h.replies[1:]
+	return data, gopacket.CaptureInfo{}, nil
+}
+
+func TestResolveMAC(t *testing.T) {
+	ic := &InjectionContext{Interface: "eth0", MAC: ourMAC, IP: net.ParseIP("10.38.8.1")}
+	h := &fakeARPHandle{t: t, macs: map[string]net.HardwareAddr{"10.38.8.2": victimMAC}}
+
+	mac, err := resolveMAC(context.Background(), h, ic, net.ParseIP("10.38.8.2"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(mac, victimMAC) {
+		t.Errorf("expected %s but got %s", victimMAC, mac)
+	}
+	if len(h.written) != 1 {
+		t.Fatalf("expected a single ARP request but got %d", len(h.written))
+	}
+	pkt := gopacket.NewPacket(h.written[0], layers.LayerTypeEthernet, gopacket.Default)
+	eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	arp := pkt.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !bytes.Equal(eth.DstMAC, layers.EthernetBroadcast) || !bytes.Equal(eth.SrcMAC, ourMAC) {
+		t.Errorf("expected a broadcast from %s but got one from %s to %s", ourMAC, eth.SrcMAC, eth.DstMAC)
+	}
+	if arp.Operation != layers.ARPRequest || !net.IP(arp.SourceProtAddress).Equal(ic.IP) || !net.IP(arp.DstProtAddress).Equal(net.ParseIP("10.38.8.2")) {
+		t.Errorf("expected a request from 10.38.8.1 for 10.38.8.2 but got %+v", arp)
+	}
+
+	// Errors reading from the handle are returned.
+	if _, err := resolveMAC(context.Background(), h, ic, net.ParseIP("10.38.8.3")); err == nil {
+		t.Errorf("expected an error resolving an address nobody answers for")
+	}
+	if _, err := resolveMAC(context.Background(), h, ic, net.ParseIP("2001:db8::388")); err == nil {
+		t.Errorf("expected an error resolving an IPv6 address")
+	}
+}
+
+func TestInjectorFramesForContext(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	query := capturedQuery(t, "eecs388.org",
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()})
+
+	var w capturingWriter
+	in := &Injector{Writer: &w, Context: &InjectionContext{MAC: ourMAC, VictimMAC: victimMAC}}
+	if _, err := in.InjectSpoofed(context.Background(), query, &table); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.packets) != 1 {
+		t.Fatalf("expected a single packet to be written but got %d", len(w.packets))
+	}
+	pkt := gopacket.NewPacket(w.packets[0], layers.LayerTypeEthernet, gopacket.Default)
+	eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok || !bytes.Equal(eth.SrcMAC, ourMAC) || !bytes.Equal(eth.DstMAC, victimMAC) {
+		t.Fatalf("expected a frame from %s to %s but got %v", ourMAC, victimMAC, eth)
+	}
+	dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok || len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected the spoofed answer within the frame but got %v", dns)
+	}
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"golang.org/x/net/idna"
 )
 
 // ProduceIPPacket returns the bytes of an IP packet with the
@@ -15,10 +24,29 @@ func ProduceIPPacket(ip *layers.IPv4, udp *layers.UDP, dns *layers.DNS) []byte {
 	// Set up some basic constants for the context of this function.
 	ip.Version = 4
 	ip.Protocol = layers.IPProtocolUDP
+	return produceUDPPacket(ip, udp, dns)
+}
+
+// ProduceIPv6Packet is like ProduceIPPacket,
+// but for a packet carried over IPv6.
+func ProduceIPv6Packet(ip *layers.IPv6, udp *layers.UDP, dns *layers.DNS) []byte {
+	ip.Version = 6
+	ip.NextHeader = layers.IPProtocolUDP
+	return produceUDPPacket(ip, udp, dns)
+}
+
+// ipLayer is a network layer which can carry UDP:
+// *layers.IPv4 or *layers.IPv6.
+type ipLayer interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
 
+// produceUDPPacket implements ProduceIPPacket and ProduceIPv6Packet.
+func produceUDPPacket(ip ipLayer, udp *layers.UDP, dns *layers.DNS) []byte {
 	// The checksum for the level 4 header (which includes UDP) depends on
 	// what level 3 protocol encapsulates it; let UDP know it will be wrapped
-	// inside IPv4.
+	// inside ip, whose addresses are part of it.
 	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
 		log.Panic(err)
 	}
@@ -33,24 +61,1138 @@ func ProduceIPPacket(ip *layers.IPv4, udp *layers.UDP, dns *layers.DNS) []byte {
 	}
 
 	buf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buf, serializeOpts, ip, udp, dns); err != nil {
+	if err := gopacket.SerializeLayers(buf, serializeOpts, ip, udp, dnsLayer(dns)); err != nil {
 		log.Panic(err)
 	}
 	return buf.Bytes()
 }
 
-// HasQuestionForDomain should return whether the DNS packet
+// SerializeDNSResponse returns the raw bytes of a complete reply to the
+// captured DNS query packet, carrying answers (see BuildResponse).
+// The reply goes back the way query came: its MAC addresses (if query
+// has an Ethernet layer), IP addresses and UDP ports are those of query
+// swapped, and its lengths and checksums are filled in, so the bytes
+// are ready to be injected with pcap.
+//
+// An error is returned if query is not a DNS query over UDP over
+// IPv4 or IPv6.
+func SerializeDNSResponse(query gopacket.Packet, answers []layers.DNSResourceRecord) ([]byte, error) {
+	dns, ok := query.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok {
+		return nil, errors.New("packet has no DNS layer")
+	}
+	return serializeReply(query, BuildResponse(dns, answers))
+}
+
+// serializeReply returns the raw bytes of a packet carrying response
+// back the way the captured query came, as in SerializeDNSResponse.
+// Responses too big for UDP are truncated (see TruncateForUDP).
+func serializeReply(query gopacket.Packet, response *layers.DNS) ([]byte, error) {
+	qudp, ok := query.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return nil, errors.New("packet has no UDP layer")
+	}
+	if dns, ok := query.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+		var err error
+		if response, err = TruncateForUDP(dns, response); err != nil {
+			return nil, err
+		}
+	}
+	udp := &layers.UDP{SrcPort: qudp.DstPort, DstPort: qudp.SrcPort}
+
+	var toSerialize []gopacket.SerializableLayer
+	if eth, ok := query.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		toSerialize = append(toSerialize, &layers.Ethernet{
+			SrcMAC:       eth.DstMAC,
+			DstMAC:       eth.SrcMAC,
+			EthernetType: eth.EthernetType,
+		})
+	}
+	switch ip := query.NetworkLayer().(type) {
+	case *layers.IPv4:
+		reply := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    ip.DstIP,
+			DstIP:    ip.SrcIP,
+		}
+		if err := udp.SetNetworkLayerForChecksum(reply); err != nil {
+			return nil, err
+		}
+		toSerialize = append(toSerialize, reply)
+	case *layers.IPv6:
+		reply := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolUDP,
+			SrcIP:      ip.DstIP,
+			DstIP:      ip.SrcIP,
+		}
+		if err := udp.SetNetworkLayerForChecksum(reply); err != nil {
+			return nil, err
+		}
+		toSerialize = append(toSerialize, reply)
+	default:
+		return nil, errors.New("packet has no IPv4 or IPv6 layer")
+	}
+	toSerialize = append(toSerialize, udp, dnsLayer(response))
+
+	serializeOpts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, serializeOpts, toSerialize...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// HasQuestionForDomain returns whether the DNS packet
 // represented by dns contains a question for domain.
+// The question's type is not considered, so AAAA questions
+// are reported just like A questions.
+//
+// Names are compared as described by domainMatches.
 //
-// Hint: hover your cursor over layers.DNS for more
-//       information; also try scrolling to the bottom
-//       of that popup and view its online documentation!
+// A nil or malformed dns (see questionsOf) never has a question
+// for domain, so truncated packets cannot crash a capture loop.
 func HasQuestionForDomain(dns *layers.DNS, domain string) bool {
-	panic("HasQuestionForDomain unimplemented!")
+	return len(QuestionsForDomain(dns, domain)) > 0
+}
+
+// HasQuestionForDomainTyped is like HasQuestionForDomain, but only
+// considers questions of type qtype and class qclass, so that e.g.
+// A questions for domain can be spoofed while its PTR or TXT questions
+// are passed through untouched.
+func HasQuestionForDomainTyped(dns *layers.DNS, domain string, qtype layers.DNSType, qclass layers.DNSClass) bool {
+	for _, q := range QuestionsForDomain(dns, domain) {
+		if q.Type == qtype && q.Class == qclass {
+			return true
+		}
+	}
+	return false
+}
+
+// QuestionsForDomain returns every question in the DNS packet
+// represented by dns which is for domain, in the order they appear.
+// Names are compared as in HasQuestionForDomain.
+func QuestionsForDomain(dns *layers.DNS, domain string) []layers.DNSQuestion {
+	var matched []layers.DNSQuestion
+	for _, q := range questionsOf(dns) {
+		if domainMatches(string(q.Name), domain) {
+			matched = append(matched, q)
+		}
+	}
+	return matched
+}
+
+// QueriedDomains returns the name of every question in the DNS packet
+// represented by dns, as it appears in the packet, in order. A packet
+// with no questions, or a nil or malformed one (see questionsOf), gives
+// an empty slice rather than nil.
+func QueriedDomains(dns *layers.DNS) []string {
+	questions := questionsOf(dns)
+	domains := make([]string, len(questions))
+	for i, q := range questions {
+		domains[i] = string(q.Name)
+	}
+	return domains
+}
+
+// HasQuestionForAnyDomain returns the first of domains which the DNS
+// packet represented by dns contains a question for, and true;
+// or the empty string and false if there is no such domain.
+// Names are compared as in HasQuestionForDomain, and the search
+// stops as soon as a question matches.
+func HasQuestionForAnyDomain(dns *layers.DNS, domains []string) (string, bool) {
+	normalized := make([]string, len(domains))
+	for i, d := range domains {
+		normalized[i] = normalizeDomain(d)
+	}
+	for _, q := range questionsOf(dns) {
+		name := normalizeDomain(string(q.Name))
+		for i, d := range normalized {
+			if normalizedMatches(name, d) {
+				return domains[i], true
+			}
+		}
+	}
+	return "", false
+}
+
+// isStandardQuery returns whether dns is a standard query
+// (rather than a response, or e.g. a dynamic update).
+func isStandardQuery(dns *layers.DNS) bool {
+	return IsQuery(dns) && dns.OpCode == layers.DNSOpCodeQuery
+}
+
+// IsQuery returns whether the DNS packet represented by dns is a query,
+// i.e. its QR bit is unset. A nil packet is neither a query nor a response.
+func IsQuery(dns *layers.DNS) bool {
+	return dns != nil && !dns.QR
+}
+
+// IsResponse returns whether the DNS packet represented by dns is a
+// response, i.e. its QR bit is set. Packets captured in both directions
+// should be checked with it before spoofing, so as not to answer answers.
+func IsResponse(dns *layers.DNS) bool {
+	return dns != nil && dns.QR
+}
+
+// questionsOf returns the questions in dns, or none if dns is nil or
+// malformed: a QDCount which disagrees with the number of questions
+// means the packet was truncated or built by an adversary.
+func questionsOf(dns *layers.DNS) []layers.DNSQuestion {
+	if dns == nil || int(dns.QDCount) != len(dns.Questions) {
+		return nil
+	}
+	return dns.Questions
+}
+
+// uniqueQuestions returns questions without any which repeat an earlier
+// question for the same name (as compared by domainMatches), type and class.
+func uniqueQuestions(questions []layers.DNSQuestion) []layers.DNSQuestion {
+	type key struct {
+		name  string
+		qtype layers.DNSType
+		class layers.DNSClass
+	}
+	seen := make(map[key]bool, len(questions))
+	unique := questions[:0:0]
+	for _, q := range questions {
+		k := key{normalizeDomain(string(q.Name)), q.Type, q.Class}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		unique = append(unique, q)
+	}
+	return unique
+}
+
+// domainMatches returns whether the queried name refers to domain.
+// DNS names are case-insensitive, and resolvers may send a fully-qualified
+// name with a trailing dot, so both sides are normalized before comparing.
+// Only whole names match: "eecs388.orgcom" is not a match for "eecs388.org",
+// and the root name never matches anything.
+//
+// A domain of the form "*.eecs388.org" is a wildcard matching any name
+// with one or more labels in front of "eecs388.org", but not the bare
+// "eecs388.org" itself.
+func domainMatches(name, domain string) bool {
+	return normalizedMatches(normalizeDomain(name), normalizeDomain(domain))
+}
+
+// normalizedMatches is domainMatches for names which have
+// already been passed through normalizeDomain.
+func normalizedMatches(name, domain string) bool {
+	if name == "" {
+		return false
+	}
+	if strings.HasPrefix(domain, "*.") {
+		// Keep the leading dot so the match falls on a label boundary:
+		// "evil-eecs388.org" must not match "*.eecs388.org".
+		suffix := domain[1:]
+		return len(name) > len(suffix) && strings.HasSuffix(name, suffix)
+	}
+	return name == domain
+}
+
+// wildcardsFor returns the wildcard domains which could match the
+// normalized name, from most to least specific. For "a.b.eecs388.org"
+// these are "*.b.eecs388.org", "*.eecs388.org" and "*.org".
+func wildcardsFor(name string) []string {
+	var wildcards []string
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return wildcards
+		}
+		name = name[i+1:]
+		wildcards = append(wildcards, "*."+name)
+	}
+}
+
+// maxLabelLength is the longest a label of a DNS name may be, in bytes.
+const maxLabelLength = 63
+
+// normalizeDomain lowercases name and strips a single trailing dot.
+// ASCII names only have their ASCII letters folded (RFC 4343).
+//
+// Internationalized names are mapped and converted to their ASCII
+// (punycode) form by domainToASCII, as a browser would before sending
+// them, so that a domain written in Unicode matches the names queries
+// carry. A name domainToASCII rejects is left in Unicode, so matches
+// nothing sent over the wire.
+func normalizeDomain(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, strings.TrimSuffix(name, "."))
+	if !isASCII(name) {
+		if ascii, err := domainToASCII(name); err == nil {
+			name = strings.TrimSuffix(ascii, ".")
+		}
+	}
+	return name
+}
+
+// domainToASCII returns domain in the ASCII (punycode) form sent in
+// queries, as looked up by idna.Lookup: "bücher.example" becomes
+// "xn--bcher-kva.example". A leading "*." of a wildcard is kept.
+//
+// Of an ASCII name, only the "xn--" labels are passed to idna.Lookup,
+// to check they are valid punycode; it would reject the rest of names
+// such as SRV owners, whose labels hold underscores. An error is also
+// returned if domain is not valid UTF-8 or a label is too long.
+func domainToASCII(domain string) (string, error) {
+	if !utf8.ValidString(domain) {
+		return "", fmt.Errorf("%q is not valid UTF-8", domain)
+	}
+	rest := strings.TrimPrefix(domain, "*.")
+	wildcard := domain[:len(domain)-len(rest)]
+	ascii := rest
+	if isASCII(rest) {
+		for _, label := range strings.Split(rest, ".") {
+			if len(label) >= 4 && strings.EqualFold(label[:4], "xn--") {
+				if _, err := idna.Lookup.ToASCII(label); err != nil {
+					return "", fmt.Errorf("label %q of %q: %w", label, domain, err)
+				}
+			}
+		}
+	} else {
+		var err error
+		if ascii, err = idna.Lookup.ToASCII(rest); err != nil {
+			return "", fmt.Errorf("%q: %w", domain, err)
+		}
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) > maxLabelLength {
+			return "", fmt.Errorf("label %q of %q is longer than %d bytes", label, domain, maxLabelLength)
+		}
+	}
+	return wildcard + ascii, nil
 }
 
-// AnswerForQuestion should return an answer corresponding
+// isASCII returns whether s holds only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultTTL is the number of seconds clients may cache forged answers
+// for, when no TTL is given. Leaving it at 0 makes some clients refuse
+// to cache the answer and immediately query again.
+const DefaultTTL = 300
+
+// ErrUnsupportedType is returned when asked to answer
+// a question whose type we cannot produce an answer for.
+var ErrUnsupportedType = errors.New("unsupported question type")
+
+// AnswerForQuestion returns an answer corresponding
 // to question which points to the IP address ip.
-func AnswerForQuestion(question layers.DNSQuestion, ip net.IP) layers.DNSResourceRecord {
-	panic("AnswerForQuestion unimplemented!")
+// It is equivalent to AnswerForQuestionTTL with DefaultTTL.
+func AnswerForQuestion(question layers.DNSQuestion, ip net.IP) (layers.DNSResourceRecord, error) {
+	return AnswerForQuestionTTL(question, ip, DefaultTTL)
+}
+
+// An Allowlist maps the only domains SpoofIfAllowed may answer to the
+// addresses to answer them with. Its keys are normalized, as
+// NewAllowlist leaves them, so that each question is a direct lookup.
+type Allowlist map[string]net.IP
+
+// NewAllowlist returns the Allowlist of the domains in allow, which may
+// be written with any case and a trailing dot, or as wildcards such as
+// "*.eecs388.org".
+func NewAllowlist(allow map[string]net.IP) Allowlist {
+	list := make(Allowlist, len(allow))
+	for domain, ip := range allow {
+		list[normalizeDomain(domain)] = ip
+	}
+	return list
+}
+
+// SpoofIfAllowed returns the answer to question (see AnswerForQuestion)
+// pointing to the address allow maps its name to, and whether there is
+// one. Names are matched against allow as by HasQuestionForDomain, so
+// that nothing outside the allowlist is ever answered; as in a
+// SpoofTable, a name takes precedence over wildcards.
+func SpoofIfAllowed(question layers.DNSQuestion, allow Allowlist) (layers.DNSResourceRecord, bool) {
+	name := normalizeDomain(string(question.Name))
+	if name == "" {
+		return layers.DNSResourceRecord{}, false
+	}
+	for _, domain := range append([]string{name}, wildcardsFor(name)...) {
+		ip, ok := allow[domain]
+		if !ok {
+			continue
+		}
+		answer, err := AnswerForQuestion(question, ip)
+		return answer, err == nil
+	}
+	return layers.DNSResourceRecord{}, false
+}
+
+// AnswerForQuestionTTL returns an answer corresponding to question
+// which points to the IP address ip, and may be cached by the client
+// for ttl seconds.
+//
+// A questions get an A record and AAAA questions get an AAAA record
+// (see AnswerForQuestionV6); ip must be of the matching family.
+// Any other question type results in ErrUnsupportedType, so that
+// callers never emit a malformed answer.
+func AnswerForQuestionTTL(question layers.DNSQuestion, ip net.IP, ttl uint32) (layers.DNSResourceRecord, error) {
+	switch question.Type {
+	case layers.DNSTypeA:
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return layers.DNSResourceRecord{}, fmt.Errorf("%s is not an IPv4 address", ip)
+		}
+		return layers.DNSResourceRecord{
+			Name:  question.Name,
+			Type:  layers.DNSTypeA,
+			Class: layers.DNSClassIN,
+			TTL:   ttl,
+			IP:    ip4,
+		}, nil
+	case layers.DNSTypeAAAA:
+		answer, err := AnswerForQuestionV6(question, ip)
+		answer.TTL = ttl
+		return answer, err
+	default:
+		return layers.DNSResourceRecord{}, fmt.Errorf("%w: %s", ErrUnsupportedType, question.Type)
+	}
+}
+
+// AnswerForQuestionMulti returns one A record per address in ips,
+// each answering question, as a resolver returning a full round-robin
+// set would. Entries of ips which are not IPv4 addresses are skipped,
+// so the result may be shorter than ips (or empty).
+// The records may be cached for DefaultTTL seconds.
+func AnswerForQuestionMulti(question layers.DNSQuestion, ips []net.IP) []layers.DNSResourceRecord {
+	question.Type = layers.DNSTypeA
+	answers := make([]layers.DNSResourceRecord, 0, len(ips))
+	for _, ip := range ips {
+		answer, err := AnswerForQuestionTTL(question, ip, DefaultTTL)
+		if err != nil {
+			continue
+		}
+		answers = append(answers, answer)
+	}
+	return answers
+}
+
+// AnswerForQuestionV6 returns an AAAA-type answer corresponding
+// to question which points to the IPv6 address ip.
+//
+// IPv4 addresses (including IPv4-mapped ones such as those returned
+// by net.ParseIP) are rejected rather than silently widened, as is
+// a question which is not of type AAAA.
+func AnswerForQuestionV6(question layers.DNSQuestion, ip net.IP) (layers.DNSResourceRecord, error) {
+	if question.Type != layers.DNSTypeAAAA {
+		return layers.DNSResourceRecord{}, fmt.Errorf("question for %q has type %s, not AAAA", question.Name, question.Type)
+	}
+	if len(ip) != net.IPv6len || ip.To4() != nil {
+		return layers.DNSResourceRecord{}, fmt.Errorf("%s is not an IPv6 address", ip)
+	}
+	return layers.DNSResourceRecord{
+		Name:  question.Name,
+		Type:  layers.DNSTypeAAAA,
+		Class: layers.DNSClassIN,
+		IP:    ip,
+	}, nil
+}
+
+// AnswerCNAMEForQuestion returns an answer corresponding to question
+// which redirects the client to the hostname target instead of an IP.
+func AnswerCNAMEForQuestion(question layers.DNSQuestion, target string) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{
+		Name:  question.Name,
+		Type:  layers.DNSTypeCNAME,
+		Class: layers.DNSClassIN,
+		TTL:   DefaultTTL,
+		CNAME: []byte(target),
+	}
+}
+
+// AnswerPTRForQuestion returns a PTR answer to question, a reverse
+// lookup, which names host as the owner of the address.
+func AnswerPTRForQuestion(question layers.DNSQuestion, host string, ttl uint32) (layers.DNSResourceRecord, error) {
+	if question.Type != layers.DNSTypePTR {
+		return layers.DNSResourceRecord{}, fmt.Errorf("question for %q has type %s, not PTR", question.Name, question.Type)
+	}
+	return layers.DNSResourceRecord{
+		Name:  question.Name,
+		Type:  layers.DNSTypePTR,
+		Class: layers.DNSClassIN,
+		TTL:   ttl,
+		PTR:   []byte(host),
+	}, nil
+}
+
+// ReverseName returns the name a reverse (PTR) lookup of ip asks about:
+// "235.25.23.3.in-addr.arpa" for 3.23.25.235, or the nibble-reversed
+// ip6.arpa name for an IPv6 address. It returns "" for an invalid ip.
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	if len(ip) != net.IPv6len {
+		return ""
+	}
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
+
+// maxTXTString is the longest character-string a TXT record can hold.
+const maxTXTString = 255
+
+// AnswerTXTForQuestion returns a TXT answer to question holding txts
+// in order, which may be cached by the client for ttl seconds.
+//
+// A TXT character-string holds at most 255 bytes, so longer strings
+// are split across several consecutive ones, which clients join back
+// together (as is done for long SPF and DKIM records).
+func AnswerTXTForQuestion(question layers.DNSQuestion, txts []string, ttl uint32) (layers.DNSResourceRecord, error) {
+	if question.Type != layers.DNSTypeTXT {
+		return layers.DNSResourceRecord{}, fmt.Errorf("question for %q has type %s, not TXT", question.Name, question.Type)
+	}
+	var encoded [][]byte
+	for _, txt := range txts {
+		for len(txt) > maxTXTString {
+			encoded = append(encoded, []byte(txt[:maxTXTString]))
+			txt = txt[maxTXTString:]
+		}
+		encoded = append(encoded, []byte(txt))
+	}
+	return layers.DNSResourceRecord{
+		Name:  question.Name,
+		Type:  layers.DNSTypeTXT,
+		Class: layers.DNSClassIN,
+		TTL:   ttl,
+		TXTs:  encoded,
+	}, nil
+}
+
+// BuildSpoofedResponse returns a complete DNS response to query which
+// answers every question for domain with ip.
+// It is equivalent to BuildSpoofedResponseTTL with DefaultTTL.
+func BuildSpoofedResponse(query *layers.DNS, domain string, ip net.IP) *layers.DNS {
+	return BuildSpoofedResponseTTL(query, domain, ip, DefaultTTL)
+}
+
+// BuildSpoofedResponseTTL returns a complete DNS response to query which
+// answers every question for domain with ip, cacheable for ttl seconds.
+// It is equivalent to BuildSpoofedResponseWith using DirectAnswer.
+func BuildSpoofedResponseTTL(query *layers.DNS, domain string, ip net.IP, ttl uint32) *layers.DNS {
+	return BuildSpoofedResponseWith(query, domain, ip, ttl, DirectAnswer)
+}
+
+// BuildSpoofedResponseMulti returns a complete DNS response to query
+// which answers every question for domain with one record per address
+// in ips, cacheable for ttl seconds, as a round-robin resolver would.
+// Addresses of the wrong family for a question are skipped.
+//
+// If rng is non-nil, each question's records are shuffled with it, so
+// that clients which always take the first record do not all land on
+// the same address. It otherwise behaves like BuildSpoofedResponseWith.
+func BuildSpoofedResponseMulti(query *layers.DNS, domain string, ips []net.IP, ttl uint32, rng *rand.Rand) *layers.DNS {
+	if query == nil {
+		return nil
+	}
+	var answers []layers.DNSResourceRecord
+	for _, q := range uniqueQuestions(QuestionsForDomain(query, domain)) {
+		records := answersForIPs(q, ips, ttl)
+		if rng != nil {
+			rng.Shuffle(len(records), swapAnswers(records))
+		}
+		answers = append(answers, records...)
+	}
+	return BuildResponse(query, answers)
+}
+
+// answersForIPs returns a record answering question for each address
+// in ips which DirectAnswer accepts, in order.
+func answersForIPs(question layers.DNSQuestion, ips []net.IP, ttl uint32) []layers.DNSResourceRecord {
+	var answers []layers.DNSResourceRecord
+	for _, ip := range ips {
+		records, err := DirectAnswer(question, ip, ttl)
+		if err != nil {
+			continue
+		}
+		answers = append(answers, records...)
+	}
+	return answers
+}
+
+// swapAnswers returns a swap function over answers for rand.Shuffle.
+func swapAnswers(answers []layers.DNSResourceRecord) func(i, j int) {
+	return func(i, j int) {
+		answers[i], answers[j] = answers[j], answers[i]
+	}
+}
+
+// An AnswerStrategy produces the answer records pointing question
+// at ip, cacheable for ttl seconds.
+type AnswerStrategy func(question layers.DNSQuestion, ip net.IP, ttl uint32) ([]layers.DNSResourceRecord, error)
+
+// DirectAnswer is an AnswerStrategy which answers question with a
+// single record for ip, as AnswerForQuestionTTL does.
+func DirectAnswer(question layers.DNSQuestion, ip net.IP, ttl uint32) ([]layers.DNSResourceRecord, error) {
+	answer, err := AnswerForQuestionTTL(question, ip, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []layers.DNSResourceRecord{answer}, nil
+}
+
+// CNAMEAnswer returns an AnswerStrategy which answers with a chain
+// of two records: a CNAME from the question's name to alias, then a
+// record for alias pointing to ip (see CNAMEAnswerForQuestion).
+func CNAMEAnswer(alias string) AnswerStrategy {
+	return func(question layers.DNSQuestion, ip net.IP, ttl uint32) ([]layers.DNSResourceRecord, error) {
+		return CNAMEAnswerForQuestion(question, alias, ip, ttl)
+	}
+}
+
+// CNAMEAnswerForQuestion returns the answer chain for question which
+// points its name at alias with a CNAME record, followed by a record
+// for alias pointing to ip. Both records may be cached for ttl seconds.
+func CNAMEAnswerForQuestion(question layers.DNSQuestion, alias string, ip net.IP, ttl uint32) ([]layers.DNSResourceRecord, error) {
+	cname := AnswerCNAMEForQuestion(question, alias)
+	cname.TTL = ttl
+
+	aliased := question
+	aliased.Name = []byte(alias)
+	answer, err := AnswerForQuestionTTL(aliased, ip, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []layers.DNSResourceRecord{cname, answer}, nil
+}
+
+// BuildSpoofedResponseWith returns a complete DNS response to query
+// which answers every question for domain using strategy to point it
+// at ip, with answers cacheable for ttl seconds.
+//
+// The response carries the query's transaction ID and echoes all of its
+// questions; questions for other domains (or which strategy cannot
+// answer) are left unanswered. A question asked more than once is only
+// answered once, so the answer section holds no duplicate records.
+//
+// A nil query, as from a packet whose DNS layer did not decode, has no
+// response: nil is returned rather than a response with no ID to match.
+func BuildSpoofedResponseWith(query *layers.DNS, domain string, ip net.IP, ttl uint32, strategy AnswerStrategy) *layers.DNS {
+	if query == nil {
+		return nil
+	}
+	var answers []layers.DNSResourceRecord
+	for _, q := range uniqueQuestions(QuestionsForDomain(query, domain)) {
+		records, err := strategy(q, ip, ttl)
+		if err != nil {
+			continue
+		}
+		answers = append(answers, records...)
+	}
+	return BuildResponse(query, answers)
+}
+
+// BuildSelectiveResponse returns a complete DNS response to query which
+// answers only the first question for domain with ip, as DirectAnswer
+// does, so that a packet asking several questions has just the target's
+// spoofed while the rest are left for the real resolver. The response
+// echoes all of the query's questions and carries its transaction ID.
+//
+// The returned bool is false, and the response nil, if no question
+// for domain can be answered with ip.
+func BuildSelectiveResponse(query *layers.DNS, domain string, ip net.IP) (*layers.DNS, bool) {
+	for _, q := range QuestionsForDomain(query, domain) {
+		answer, err := AnswerForQuestionTTL(q, ip, DefaultTTL)
+		if err != nil {
+			continue
+		}
+		return BuildResponse(query, []layers.DNSResourceRecord{answer}), true
+	}
+	return nil, false
+}
+
+// ServFailResponse returns a SERVFAIL response to query, telling the
+// client that its question could not be answered rather than leaving
+// it to wait out its own timeout.
+func ServFailResponse(query *layers.DNS) *layers.DNS {
+	response := BuildResponse(query, nil)
+	response.ResponseCode = layers.DNSResponseCodeServFail
+	return response
+}
+
+// FormErrResponse returns a FORMERR response to the raw DNS query which
+// could not be decoded, telling the client that its query was malformed
+// rather than leaving it to wait out its own timeout. The response echoes
+// the query's ID, opcode and RD bit, and its first question if that much
+// of it decodes. The returned bool is false if query is too short to hold
+// even an ID, since the client could not match a response to it.
+func FormErrResponse(query []byte) (*layers.DNS, bool) {
+	if len(query) < 2 {
+		return nil, false
+	}
+	response := &layers.DNS{
+		ID:           binary.BigEndian.Uint16(query),
+		QR:           true,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeFormErr,
+	}
+	if len(query) < dnsHeaderLen {
+		return response, true
+	}
+	response.OpCode = layers.DNSOpCode(query[2] >> 3 & 0xf)
+	response.RD = query[2]&1 != 0
+	if binary.BigEndian.Uint16(query[4:]) == 0 {
+		return response, true
+	}
+	// Decode again claiming only the first question, since whatever
+	// is malformed may well lie beyond it.
+	first := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(first[4:], 1)
+	for i := 6; i < dnsHeaderLen; i++ {
+		first[i] = 0
+	}
+	if dns, ok := decodeRawDNS(first); ok && len(dns.Questions) == 1 && encodableQuestions(dns.Questions) {
+		response.Questions, response.QDCount = dns.Questions, 1
+	}
+	return response, true
+}
+
+// encodableQuestions returns whether every name in questions can be
+// encoded again as it was decoded, so that a response echoing them is
+// well-formed. Labels holding a dot cannot: gopacket joins labels with
+// dots when decoding and splits on them when encoding, so "a.b" as one
+// label would be echoed as two, and an empty label would end the name.
+// Neither can names which only fit in a query through compression, as
+// they are echoed uncompressed.
+func encodableQuestions(questions []layers.DNSQuestion) bool {
+	for _, q := range questions {
+		if len(q.Name) == 0 {
+			continue
+		}
+		// The length bytes of the first label and the root, less the
+		// dots they stand in for, add 2 bytes to the name.
+		if len(q.Name)+2 > maxNameLength {
+			return false
+		}
+		for _, label := range bytes.Split(q.Name, []byte(".")) {
+			if len(label) == 0 || len(label) > maxLabelLength {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dnsHeaderLen is the length of the fixed header of a DNS message.
+const dnsHeaderLen = 12
+
+// maxNameLength is the longest a DNS name may be in wire format, in bytes.
+const maxNameLength = 255
+
+// NXDomainResponse returns an authoritative NXDOMAIN response to query,
+// telling the client that the domains it asked about do not exist.
+// It carries the default synthetic SOA record, as by NXDomainResponseSOA.
+func NXDomainResponse(query *layers.DNS) *layers.DNS {
+	return NXDomainResponseSOA(query, NegativeSOA{})
+}
+
+// NXDomainResponseSOA is like NXDomainResponse, but carries the SOA
+// record described by soa in its authority section. Resolvers cache the
+// NXDOMAIN for as long as the SOA says (RFC 2308); some ignore one
+// without an SOA altogether, and the client asks again at once.
+func NXDomainResponseSOA(query *layers.DNS, soa NegativeSOA) *layers.DNS {
+	response := BuildResponse(query, nil)
+	response.AA = true
+	response.ResponseCode = layers.DNSResponseCodeNXDomain
+	if questions := questionsOf(query); len(questions) > 0 {
+		response.Authorities = []layers.DNSResourceRecord{soa.recordFor(questions[0])}
+		response.NSCount = 1
+	}
+	return response
+}
+
+// NoDataResponseSOA returns an authoritative response to query with no
+// answers, telling the client that the names it asked about exist but
+// have no records of the types asked for (NODATA; RFC 2308, section 2.2).
+// Like NXDomainResponseSOA, it carries the SOA record described by soa.
+func NoDataResponseSOA(query *layers.DNS, soa NegativeSOA) *layers.DNS {
+	response := NXDomainResponseSOA(query, soa)
+	response.ResponseCode = layers.DNSResponseCodeNoErr
+	return response
+}
+
+// DefaultNegativeTTL is the number of seconds clients may cache
+// forged NXDOMAIN answers for, when no TTL is given.
+const DefaultNegativeTTL = 300
+
+// A NegativeSOA describes the synthetic SOA record NXDOMAIN responses
+// carry, for the parent zone of the name asked about: "bank.com" for
+// "login.bank.com". The zero value describes a plausible one.
+type NegativeSOA struct {
+	// MName is the zone's primary name server.
+	// If empty, "ns1." followed by the zone is used.
+	MName string
+	// RName is the mailbox of the zone's administrator, written as a
+	// name. If empty, "hostmaster." followed by the zone is used.
+	RName string
+	// TTL is how many seconds the NXDOMAIN may be cached for, used
+	// as both the record's TTL and its minimum field. If zero,
+	// DefaultNegativeTTL is used.
+	TTL uint32
+}
+
+// recordFor returns the SOA record for the parent zone of question's name.
+func (s NegativeSOA) recordFor(question layers.DNSQuestion) layers.DNSResourceRecord {
+	zone := parentZone(strings.TrimSuffix(string(question.Name), "."))
+	mname, rname, ttl := s.MName, s.RName, s.TTL
+	if mname == "" {
+		mname = joinName("ns1", zone)
+	}
+	if rname == "" {
+		rname = joinName("hostmaster", zone)
+	}
+	if ttl == 0 {
+		ttl = DefaultNegativeTTL
+	}
+	return layers.DNSResourceRecord{
+		Name:  []byte(zone),
+		Type:  layers.DNSTypeSOA,
+		Class: layers.DNSClassIN,
+		TTL:   ttl,
+		SOA: layers.DNSSOA{
+			MName:   []byte(mname),
+			RName:   []byte(rname),
+			Serial:  2022101401,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  604800,
+			Minimum: ttl,
+		},
+	}
+}
+
+// parentZone returns name with its first label removed,
+// or "" (the root) if it has only one.
+func parentZone(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// joinName returns label prefixed to zone, or label alone if zone is the root.
+func joinName(label, zone string) string {
+	if zone == "" {
+		return label
+	}
+	return label + "." + zone
+}
+
+// TruncatedResponse returns an empty response to query with the TC bit
+// set, telling the client that the answer did not fit and that it
+// should ask again over TCP.
+func TruncatedResponse(query *layers.DNS) *layers.DNS {
+	response := BuildResponse(query, nil)
+	response.TC = true
+	return response
+}
+
+// SerializeDNS returns the wire format of dns, with its section
+// counts fixed up to match the records it holds. Records of types
+// gopacket cannot serialize, such as HTTPS, are written from their Data.
+func SerializeDNS(dns *layers.DNS) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := dnsLayer(dns).SerializeTo(buf, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dnsLayer returns dns ready to be serialized. If it holds records of
+// types gopacket cannot serialize, it is wrapped in a rawRecordsDNS.
+func dnsLayer(dns *layers.DNS) gopacket.SerializableLayer {
+	for _, section := range [][]layers.DNSResourceRecord{dns.Answers, dns.Authorities, dns.Additionals} {
+		for _, rr := range section {
+			if !gopacketEncodes(rr.Type) {
+				return rawRecordsDNS{dns}
+			}
+		}
+	}
+	return dns
+}
+
+// gopacketEncodes returns whether gopacket can serialize records of type t.
+func gopacketEncodes(t layers.DNSType) bool {
+	switch t {
+	case layers.DNSTypeA, layers.DNSTypeAAAA, layers.DNSTypeNS, layers.DNSTypeCNAME,
+		layers.DNSTypePTR, layers.DNSTypeSOA, layers.DNSTypeMX, layers.DNSTypeTXT,
+		layers.DNSTypeSRV, layers.DNSTypeURI, layers.DNSTypeOPT:
+		return true
+	}
+	return false
+}
+
+// rawRecordsDNS serializes a DNS message holding records gopacket
+// cannot serialize, writing those from their Data as raw RDATA. Its
+// section counts are always fixed up to match the records it holds.
+type rawRecordsDNS struct {
+	*layers.DNS
+}
+
+func (d rawRecordsDNS) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	// The header and questions are left to gopacket, and each record
+	// is appended after them in turn.
+	head := *d.DNS
+	head.Answers, head.Authorities, head.Additionals = nil, nil, nil
+	buf := gopacket.NewSerializeBuffer()
+	if err := head.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return err
+	}
+	msg := append([]byte(nil), buf.Bytes()...)
+	for i, section := range [][]layers.DNSResourceRecord{d.Answers, d.Authorities, d.Additionals} {
+		for _, rr := range section {
+			var err error
+			if msg, err = appendRecord(msg, rr); err != nil {
+				return err
+			}
+		}
+		binary.BigEndian.PutUint16(msg[6+2*i:], uint16(len(section)))
+	}
+
+	bytes, err := b.PrependBytes(len(msg))
+	if err != nil {
+		return err
+	}
+	copy(bytes, msg)
+	return nil
+}
+
+// appendRecord appends rr to msg in wire format: by gopacket if it can
+// serialize rr's type, or else from rr's Data.
+func appendRecord(msg []byte, rr layers.DNSResourceRecord) ([]byte, error) {
+	if gopacketEncodes(rr.Type) {
+		buf := gopacket.NewSerializeBuffer()
+		single := &layers.DNS{Answers: []layers.DNSResourceRecord{rr}}
+		if err := single.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			return nil, err
+		}
+		return append(msg, buf.Bytes()[dnsHeaderLen:]...), nil
+	}
+	if len(rr.Data) > 0xffff {
+		return nil, fmt.Errorf("RDATA of %s record for %q is %d bytes long", rr.Type, rr.Name, len(rr.Data))
+	}
+	msg, err := appendName(msg, string(rr.Name))
+	if err != nil {
+		return nil, err
+	}
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:], uint16(rr.Type))
+	binary.BigEndian.PutUint16(fixed[2:], uint16(rr.Class))
+	binary.BigEndian.PutUint32(fixed[4:], rr.TTL)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rr.Data)))
+	return append(append(msg, fixed[:]...), rr.Data...), nil
+}
+
+// maxUDPMessage is the largest DNS message which may be sent over UDP
+// to clients which do not use EDNS0 (RFC 1035, section 4.2.1).
+const maxUDPMessage = 512
+
+// UDPPayloadSize returns the size of the largest response to query
+// which may be sent over UDP: the payload size query advertises with
+// EDNS0 (see EDNSOPT), or else 512 bytes.
+func UDPPayloadSize(query *layers.DNS) int {
+	if opt, ok := EDNSOPT(query, 0); ok {
+		return int(opt.Class)
+	}
+	return maxUDPMessage
+}
+
+// TruncateForUDP returns response if it fits in a UDP message to query
+// (see UDPPayloadSize). Otherwise it returns a copy of response with the
+// TC bit set, keeping only as many answers as fit, so that the client
+// retries over TCP instead of receiving a message it cannot use.
+func TruncateForUDP(query, response *layers.DNS) (*layers.DNS, error) {
+	return fitAnswers(response, UDPPayloadSize(query))
+}
+
+// fitAnswers returns response if its wire format is at most limit bytes
+// long, or else a copy with the TC bit set and as many answers as fit.
+func fitAnswers(response *layers.DNS, limit int) (*layers.DNS, error) {
+	b, err := SerializeDNS(response)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= limit {
+		return response, nil
+	}
+
+	truncated := *response
+	truncated.TC = true
+	answers := response.Answers
+	// Find the most answers that fit.
+	var fitErr error
+	n := sort.Search(len(answers), func(n int) bool {
+		truncated.Answers = answers[:n+1]
+		b, err := SerializeDNS(&truncated)
+		if err != nil {
+			fitErr = err
+			return true
+		}
+		return len(b) > limit
+	})
+	if fitErr != nil {
+		return nil, fitErr
+	}
+	truncated.Answers = answers[:n]
+	truncated.ANCount = uint16(n)
+	return &truncated, nil
+}
+
+// maxTCPMessage is the largest DNS message which
+// fits behind the 2-byte length prefix used over TCP.
+const maxTCPMessage = 0xffff
+
+// SerializeDNSResponseTCP returns the response to query carrying answers
+// (see BuildResponse) framed for DNS-over-TCP: its wire format preceded by
+// its length as 2 big-endian bytes. TCP lifts the 512-byte limit of UDP,
+// so the TC bit is left unset unless even a TCP message cannot hold every
+// answer, in which case as many as fit are kept.
+func SerializeDNSResponseTCP(query *layers.DNS, answers []layers.DNSResourceRecord) ([]byte, error) {
+	response, err := fitAnswers(BuildResponse(query, answers), maxTCPMessage)
+	if err != nil {
+		return nil, err
+	}
+	b, err := SerializeDNS(response)
+	if err != nil {
+		return nil, err
+	}
+	return frameTCP(b)
+}
+
+// frameTCP returns msg preceded by its length, as DNS messages are
+// sent over TCP, or an error if msg is too long to frame.
+func frameTCP(msg []byte) ([]byte, error) {
+	if len(msg) > maxTCPMessage {
+		return nil, fmt.Errorf("DNS message of %d bytes is too long for TCP", len(msg))
+	}
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	return framed, nil
+}
+
+// BuildResponse returns a NoError response to query carrying answers.
+// As real resolvers do, the response carries the query's transaction ID
+// (without which the client discards it) and echoes all of its questions.
+// If the query used EDNS0, so does the response (see EDNSOPT).
+func BuildResponse(query *layers.DNS, answers []layers.DNSResourceRecord) *layers.DNS {
+	var additionals []layers.DNSResourceRecord
+	if opt, ok := EDNSOPT(query, 0); ok {
+		additionals = append(additionals, opt)
+	}
+	return &layers.DNS{
+		ID:           query.ID,
+		QR:           true,
+		OpCode:       query.OpCode,
+		RD:           query.RD,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeNoErr,
+		QDCount:      uint16(len(query.Questions)),
+		ANCount:      uint16(len(answers)),
+		ARCount:      uint16(len(additionals)),
+		Questions:    query.Questions,
+		Answers:      answers,
+		Additionals:  additionals,
+	}
+}
+
+// dnsTypeRRSIG is the type of the records which sign an RRset
+// (RFC 4034, section 3), which gopacket does not know about.
+const dnsTypeRRSIG layers.DNSType = 46
+
+// rrsigCovers returns the type of the RRset rr signs, and whether rr is
+// an RRSIG record long enough to say.
+func rrsigCovers(rr layers.DNSResourceRecord) (layers.DNSType, bool) {
+	if rr.Type != dnsTypeRRSIG || len(rr.Data) < 2 {
+		return 0, false
+	}
+	return layers.DNSType(binary.BigEndian.Uint16(rr.Data)), true
+}
+
+// ednsDO is the DNSSEC OK (DO) bit of an OPT record's TTL field
+// (RFC 3225, section 3).
+const ednsDO = 1 << 15
+
+// WantsDNSSEC returns whether query set the DO bit in its OPT record,
+// asking for DNSSEC records along with its answers. A validating client
+// would reject our unsigned answers to such a query, and likely make
+// a visible fuss about it.
+func WantsDNSSEC(query *layers.DNS) bool {
+	for _, rr := range query.Additionals {
+		if rr.Type == layers.DNSTypeOPT && rr.TTL&ednsDO != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// clearDNSSEC clears the DO bit of every OPT record in query.
+func clearDNSSEC(query *layers.DNS) {
+	for i := range query.Additionals {
+		if query.Additionals[i].Type == layers.DNSTypeOPT {
+			query.Additionals[i].TTL &^= ednsDO
+		}
+	}
+}
+
+// minEDNSPayloadSize is the smallest UDP payload size EDNS0 allows;
+// smaller advertised sizes are treated as this (RFC 6891, section 6.2.5).
+const minEDNSPayloadSize = 512
+
+// EDNSOPT returns the OPT pseudo-record for a response to query,
+// and whether query carried one of its own. Strict clients discard
+// responses to EDNS0 queries which lack one.
+//
+// The record advertises payloadSize as our UDP payload size, or the
+// query's own if payloadSize is 0. It carries no options and leaves the
+// DO bit unset, since our answers are never DNSSEC-signed.
+func EDNSOPT(query *layers.DNS, payloadSize uint16) (layers.DNSResourceRecord, bool) {
+	for _, rr := range query.Additionals {
+		if rr.Type != layers.DNSTypeOPT {
+			continue
+		}
+		if payloadSize == 0 {
+			payloadSize = uint16(rr.Class)
+		}
+		if payloadSize < minEDNSPayloadSize {
+			payloadSize = minEDNSPayloadSize
+		}
+		return layers.DNSResourceRecord{
+			Type:  layers.DNSTypeOPT,
+			Class: layers.DNSClass(payloadSize),
+		}, true
+	}
+	return layers.DNSResourceRecord{}, false
 }
@@ -2,9 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
@@ -26,6 +34,20 @@ func dnsWithDomainQuestions(domains []string) *layers.DNS {
 	}
 }
 
+// roundTripDNS serializes dns and decodes the result, as a client would.
+func roundTripDNS(t *testing.T, dns *layers.DNS) *layers.DNS {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, dnsLayer(dns)); err != nil {
+		t.Fatalf("failed to serialize DNS layer: %v", err)
+	}
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeDNS, gopacket.Default)
+	if err := pkt.ErrorLayer(); err != nil {
+		t.Fatalf("failed to decode serialized DNS layer: %v", err.Error())
+	}
+	return pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+}
+
 func TestHasQuestionForDomain(t *testing.T) {
 	for _, v := range []struct {
 		name      string
@@ -51,15 +73,199 @@ func TestHasQuestionForDomain(t *testing.T) {
 	}
 }
 
+func TestHasQuestionForDomainNormalized(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		questions []string
+		domain    string
+		expected  bool
+	}{
+		{"packet with mixed-case domain", []string{"EeCs388.OrG"}, "eecs388.org", true},
+		{"packet with trailing-dot domain", []string{"eecs388.org."}, "eecs388.org", true},
+		{"packet with mixed-case trailing-dot domain", []string{"EeCs388.OrG."}, "eecs388.org", true},
+		{"packet with upper-case domain", []string{"EECS388.org"}, "eecs388.org", true},
+		{"packet with upper-case trailing-dot domain", []string{"EECS388.ORG."}, "eecs388.org", true},
+		{"packet with Kelvin sign in correct domain", []string{"ban\u212a.com"}, "bank.com", true},
+		{"packet with non-ASCII lookalike of correct domain", []string{"b\u0430nk.com"}, "bank.com", false},
+		{"target with trailing dot", []string{"eecs388.org"}, "eecs388.org.", true},
+		{"packet and target with trailing dot", []string{"eecs388.org."}, "eecs388.org.", true},
+		{"packet with two trailing dots", []string{"eecs388.org.."}, "eecs388.org", false},
+		{"packet with empty name", []string{""}, "eecs388.org", false},
+		{"packet with root name", []string{"."}, "eecs388.org", false},
+		{"packet with root name and empty target", []string{"."}, "", false},
+		{"target with mixed case and trailing dot", []string{"eecs388.org"}, "EECS388.ORG.", true},
+		{"packet with mixed-case different domain", []string{"WRONG.com."}, "eecs388.org", false},
+		{"packet with mixed-case prefix of correct domain", []string{"EECS388.orgcom"}, "eecs388.org", false},
+		{"packet with prefix of correct domain and trailing dot", []string{"eecs388.orgcom."}, "eecs388.org", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got := HasQuestionForDomain(dnsWithDomainQuestions(v.questions), v.domain)
+			if got != v.expected {
+				t.Errorf("expected HasQuestionForDomain(dns, %q) to return %v, got %v", v.domain, v.expected, got)
+			}
+		})
+	}
+}
+
+func TestHasQuestionForWildcardDomain(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		questions []string
+		domain    string
+		expected  bool
+	}{
+		{"apex of wildcard", []string{"eecs388.org"}, "*.eecs388.org", false},
+		{"one-level subdomain", []string{"login.eecs388.org"}, "*.eecs388.org", true},
+		{"multi-level subdomain", []string{"a.b.api.eecs388.org"}, "*.eecs388.org", true},
+		{"mixed-case subdomain with trailing dot", []string{"LOGIN.Eecs388.org."}, "*.eecs388.org", true},
+		{"name ending in domain without label boundary", []string{"noteecs388.org"}, "*.eecs388.org", false},
+		{"hyphenated near miss", []string{"evil-eecs388.org"}, "*.eecs388.org", false},
+		{"empty leading label", []string{".eecs388.org"}, "*.eecs388.org", false},
+		{"subdomain of different domain", []string{"login.eecs388.com"}, "*.eecs388.org", false},
+		{"literal wildcard query for plain domain", []string{"*.eecs388.org"}, "eecs388.org", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got := HasQuestionForDomain(dnsWithDomainQuestions(v.questions), v.domain)
+			if got != v.expected {
+				t.Errorf("expected HasQuestionForDomain(dns, %q) to return %v, got %v", v.domain, v.expected, got)
+			}
+		})
+	}
+}
+
+func TestHasQuestionForDomainMalformed(t *testing.T) {
+	if HasQuestionForDomain(nil, "eecs388.org") {
+		t.Errorf("expected HasQuestionForDomain(nil, ...) to return false")
+	}
+	if _, found := HasQuestionForAnyDomain(nil, []string{"eecs388.org"}); found {
+		t.Errorf("expected HasQuestionForAnyDomain(nil, ...) to return false")
+	}
+
+	for _, qdcount := range []uint16{0, 2, 65535} {
+		dns := dnsWithDomainQuestions([]string{"eecs388.org"})
+		dns.QDCount = qdcount
+		if HasQuestionForDomain(dns, "eecs388.org") {
+			t.Errorf("expected HasQuestionForDomain to return false with QDCount %d and 1 question", qdcount)
+		}
+	}
+}
+
+func TestHasQuestionForAnyDomain(t *testing.T) {
+	targets := []string{"eecs388.org", "bank.com"}
+	for _, v := range []struct {
+		name      string
+		questions []string
+		domains   []string
+		expected  string
+		found     bool
+	}{
+		{"packet with no questions", nil, targets, "", false},
+		{"no target domains", []string{"eecs388.org"}, nil, "", false},
+		{"packet with first domain", []string{"eecs388.org"}, targets, "eecs388.org", true},
+		{"packet with second domain", []string{"bank.com"}, targets, "bank.com", true},
+		{"packet with different domain", []string{"wrong.com"}, targets, "", false},
+		{"packet with prefix of correct domain", []string{"eecs388.orgcom"}, targets, "", false},
+		{"first question wins", []string{"wrong.com", "bank.com", "eecs388.org"}, targets, "bank.com", true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got, found := HasQuestionForAnyDomain(dnsWithDomainQuestions(v.questions), v.domains)
+			if got != v.expected || found != v.found {
+				t.Errorf("expected HasQuestionForAnyDomain(dns, %q) to return (%q, %v), got (%q, %v)", v.domains, v.expected, v.found, got, found)
+			}
+		})
+	}
+}
+
+func TestQuestionsForDomain(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		questions []string
+		domain    string
+		expected  []string
+	}{
+		{"packet with no questions", nil, "eecs388.org", nil},
+		{"packet with only other domains", []string{"wrong.com", "eecs388.orgcom"}, "eecs388.org", nil},
+		{"packet with one matching question", []string{"wrong.com", "eecs388.org", "bank.com"}, "eecs388.org", []string{"eecs388.org"}},
+		{"packet with several matching questions", []string{"EECS388.org", "wrong.com", "eecs388.org."}, "eecs388.org", []string{"EECS388.org", "eecs388.org."}},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got := QuestionsForDomain(dnsWithDomainQuestions(v.questions), v.domain)
+			if len(got) != len(v.expected) {
+				t.Fatalf("expected %d matching questions, got %d", len(v.expected), len(got))
+			}
+			for i, q := range got {
+				if string(q.Name) != v.expected[i] {
+					t.Errorf("expected question %d to be for %q, got %q", i, v.expected[i], q.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestQueriedDomains(t *testing.T) {
+	for _, v := range []struct {
+		name      string
+		questions []string
+	}{
+		{"packet with no questions", []string{}},
+		{"packet with one question", []string{"eecs388.org"}},
+		{"packet with several questions", []string{"EECS388.org", "bank.com", "www.umich.edu"}},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got := QueriedDomains(roundTripDNS(t, dnsWithDomainQuestions(v.questions)))
+			if got == nil || !reflect.DeepEqual(got, v.questions) {
+				t.Errorf("expected domains %q, got %#v", v.questions, got)
+			}
+		})
+	}
+
+	if got := QueriedDomains(nil); got == nil || len(got) != 0 {
+		t.Errorf("expected an empty slice for a nil packet, got %#v", got)
+	}
+}
+
+func TestIsQueryIsResponse(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	response := BuildResponse(query, nil)
+	for _, v := range []struct {
+		name     string
+		dns      *layers.DNS
+		query    bool
+		response bool
+	}{
+		{"query packet", roundTripDNS(t, query), true, false},
+		{"response packet", roundTripDNS(t, response), false, true},
+		{"nil packet", nil, false, false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if got := IsQuery(v.dns); got != v.query {
+				t.Errorf("expected IsQuery to be %v, got %v", v.query, got)
+			}
+			if got := IsResponse(v.dns); got != v.response {
+				t.Errorf("expected IsResponse to be %v, got %v", v.response, got)
+			}
+		})
+	}
+}
+
 func TestAnswerForQuestion(t *testing.T) {
 	domain := []byte("eecs388.org")
 	ip := net.ParseIP("3.23.25.235")
 
-	answer := AnswerForQuestion(layers.DNSQuestion{
+	answer, err := AnswerForQuestion(layers.DNSQuestion{
 		Name:  domain,
 		Type:  layers.DNSTypeA,
 		Class: layers.DNSClassIN,
 	}, ip)
+	if err != nil {
+		t.Fatalf("unexpected error answering A question: %v", err)
+	}
 
 	if !bytes.Equal(answer.Name, domain) {
 		t.Errorf("expected name %q in answer, got %q. The name tells the client which domain this answer is for!", domain, answer.Name)
@@ -74,3 +280,1016 @@ func TestAnswerForQuestion(t *testing.T) {
 		t.Errorf("expected IP %s in answer, got %s", ip, answer.IP)
 	}
 }
+
+func TestHasQuestionForDomainAAAA(t *testing.T) {
+	dns := &layers.DNS{
+		QDCount: 1,
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte("eecs388.org"),
+			Type:  layers.DNSTypeAAAA,
+			Class: layers.DNSClassIN,
+		}},
+	}
+	if !HasQuestionForDomain(dns, "eecs388.org") {
+		t.Errorf("expected HasQuestionForDomain to report a match for an AAAA question")
+	}
+}
+
+func TestSpoofIfAllowed(t *testing.T) {
+	allow := NewAllowlist(map[string]net.IP{
+		"eecs388.org":     net.ParseIP("3.23.25.235"),
+		"*.bank.com":      net.ParseIP("10.38.8.4"),
+		"login.bank.com.": net.ParseIP("10.38.8.5"),
+	})
+
+	for _, v := range []struct {
+		name    string
+		allowed bool
+		ip      net.IP
+	}{
+		{"eecs388.org", true, net.ParseIP("3.23.25.235")},
+		{"EECS388.org.", true, net.ParseIP("3.23.25.235")},
+		{"www.bank.com", true, net.ParseIP("10.38.8.4")},
+		{"login.bank.com", true, net.ParseIP("10.38.8.5")},
+		{"umich.edu", false, nil},
+		{"www.eecs388.org", false, nil},
+		{"eecs388.orgcom", false, nil},
+		{"bank.com", false, nil},
+		{"", false, nil},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			answer, ok := SpoofIfAllowed(questionFor(v.name), allow)
+			if ok != v.allowed {
+				t.Fatalf("expected allowed to be %v but got %v", v.allowed, ok)
+			}
+			if ok && !answer.IP.Equal(v.ip) {
+				t.Errorf("expected answer for %s but got %s", v.ip, answer.IP)
+			}
+			if ok && string(answer.Name) != v.name {
+				t.Errorf("expected answer for %q but got %q", v.name, answer.Name)
+			}
+		})
+	}
+}
+
+func TestSpoofIfAllowedUnanswerable(t *testing.T) {
+	allow := NewAllowlist(map[string]net.IP{"eecs388.org": net.ParseIP("3.23.25.235")})
+	question := questionFor("eecs388.org")
+	question.Type = layers.DNSTypeMX
+	if _, ok := SpoofIfAllowed(question, allow); ok {
+		t.Errorf("expected an MX question not to be answered")
+	}
+}
+
+func TestAnswerForQuestionV6(t *testing.T) {
+	domain := []byte("eecs388.org")
+	for _, v := range []struct {
+		name    string
+		qtype   layers.DNSType
+		ip      net.IP
+		wantErr bool
+	}{
+		{"AAAA question with IPv6 address", layers.DNSTypeAAAA, net.ParseIP("2001:db8::388"), false},
+		{"AAAA question with IPv4 address", layers.DNSTypeAAAA, net.IPv4(3, 23, 25, 235).To4(), true},
+		{"AAAA question with IPv4-mapped address", layers.DNSTypeAAAA, net.ParseIP("3.23.25.235"), true},
+		{"A question with IPv6 address", layers.DNSTypeA, net.ParseIP("2001:db8::388"), true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			answer, err := AnswerForQuestionV6(layers.DNSQuestion{
+				Name:  domain,
+				Type:  v.qtype,
+				Class: layers.DNSClassIN,
+			}, v.ip)
+			if v.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got answer %v", answer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(answer.Name, domain) {
+				t.Errorf("expected name %q in answer, got %q", domain, answer.Name)
+			}
+			if answer.Type != layers.DNSTypeAAAA {
+				t.Errorf("expected resource record type AAAA, got %s", answer.Type)
+			}
+			if answer.Class != layers.DNSClassIN {
+				t.Errorf("expected resource record class IN, got %s", answer.Class)
+			}
+			if !answer.IP.Equal(v.ip) {
+				t.Errorf("expected IP %s in answer, got %s", v.ip, answer.IP)
+			}
+		})
+	}
+}
+
+func TestAnswerForQuestionByType(t *testing.T) {
+	domain := []byte("eecs388.org")
+	for _, v := range []struct {
+		name     string
+		qtype    layers.DNSType
+		ip       net.IP
+		expected layers.DNSType
+		wantErr  error
+	}{
+		{"A question with IPv4 address", layers.DNSTypeA, net.ParseIP("3.23.25.235"), layers.DNSTypeA, nil},
+		{"AAAA question with IPv6 address", layers.DNSTypeAAAA, net.ParseIP("2001:db8::388"), layers.DNSTypeAAAA, nil},
+		{"MX question", layers.DNSTypeMX, net.ParseIP("3.23.25.235"), 0, ErrUnsupportedType},
+		{"TXT question", layers.DNSTypeTXT, net.ParseIP("3.23.25.235"), 0, ErrUnsupportedType},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			answer, err := AnswerForQuestion(layers.DNSQuestion{
+				Name:  domain,
+				Type:  v.qtype,
+				Class: layers.DNSClassIN,
+			}, v.ip)
+			if v.wantErr != nil {
+				if !errors.Is(err, v.wantErr) {
+					t.Errorf("expected error %v, got %v", v.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if answer.Type != v.expected {
+				t.Errorf("expected resource record type %s, got %s", v.expected, answer.Type)
+			}
+			if !answer.IP.Equal(v.ip) {
+				t.Errorf("expected IP %s in answer, got %s", v.ip, answer.IP)
+			}
+		})
+	}
+}
+
+func TestAnswerForQuestionAWithIPv6(t *testing.T) {
+	_, err := AnswerForQuestion(layers.DNSQuestion{
+		Name:  []byte("eecs388.org"),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+	}, net.ParseIP("2001:db8::388"))
+	if err == nil {
+		t.Errorf("expected an error answering an A question with an IPv6 address")
+	}
+}
+
+func TestBuildResponse(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"eecs388.org", "bank.com"})
+	query.ID = 0x388
+	answers := []layers.DNSResourceRecord{
+		{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.IPv4(3, 23, 25, 235)},
+		{Name: []byte("bank.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.IPv4(10, 38, 8, 4)},
+	}
+
+	response := BuildResponse(query, answers)
+
+	if !response.QR {
+		t.Errorf("expected QR to be set on the response")
+	}
+	if response.ID != query.ID {
+		t.Errorf("expected transaction ID %#x, got %#x", query.ID, response.ID)
+	}
+	if response.ANCount != 2 || len(response.Answers) != 2 {
+		t.Errorf("expected ANCount 2 with 2 answers, got ANCount %d with %d answers", response.ANCount, len(response.Answers))
+	}
+	if response.QDCount != 2 || len(response.Questions) != 2 {
+		t.Errorf("expected both questions to be echoed, got QDCount %d with %d questions", response.QDCount, len(response.Questions))
+	}
+}
+
+func TestBuildSpoofedResponse(t *testing.T) {
+	ip := net.ParseIP("3.23.25.235")
+	query := dnsWithDomainQuestions([]string{"wrong.com", "eecs388.org"})
+	query.ID = 0x388
+	query.RD = true
+
+	decoded := roundTripDNS(t, BuildSpoofedResponse(query, "eecs388.org", ip))
+
+	if decoded.ID != query.ID {
+		t.Errorf("expected transaction ID %#x, got %#x", query.ID, decoded.ID)
+	}
+	if !decoded.QR {
+		t.Errorf("expected QR to be set on the response")
+	}
+	if !decoded.RA {
+		t.Errorf("expected RA to be set on the response")
+	}
+	if !decoded.RD {
+		t.Errorf("expected RD to be echoed from the query")
+	}
+	if decoded.ResponseCode != layers.DNSResponseCodeNoErr {
+		t.Errorf("expected response code %s, got %s", layers.DNSResponseCodeNoErr, decoded.ResponseCode)
+	}
+	if decoded.QDCount != 2 || len(decoded.Questions) != 2 {
+		t.Errorf("expected both questions to be echoed, got QDCount %d and %d questions", decoded.QDCount, len(decoded.Questions))
+	}
+	if decoded.ANCount != 1 || len(decoded.Answers) != 1 {
+		t.Fatalf("expected a single answer, got ANCount %d and %d answers", decoded.ANCount, len(decoded.Answers))
+	}
+	if string(decoded.Answers[0].Name) != "eecs388.org" {
+		t.Errorf("expected answer for %q, got %q", "eecs388.org", decoded.Answers[0].Name)
+	}
+	if !decoded.Answers[0].IP.Equal(ip) {
+		t.Errorf("expected IP %s in answer, got %s", ip, decoded.Answers[0].IP)
+	}
+}
+
+func TestBuildSpoofedResponseNoMatch(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"wrong.com"})
+	response := BuildSpoofedResponse(query, "eecs388.org", net.ParseIP("3.23.25.235"))
+	if response.ANCount != 0 || len(response.Answers) != 0 {
+		t.Errorf("expected no answers for a non-matching query, got %d", len(response.Answers))
+	}
+}
+
+func TestBuildSpoofedResponseNilQuery(t *testing.T) {
+	if response := BuildSpoofedResponse(nil, "eecs388.org", net.ParseIP("3.23.25.235")); response != nil {
+		t.Errorf("expected no response to a nil query, got %v", response)
+	}
+	if response := BuildSpoofedResponseMulti(nil, "eecs388.org", []net.IP{net.ParseIP("3.23.25.235")}, DefaultTTL, nil); response != nil {
+		t.Errorf("expected no response to a nil query, got %v", response)
+	}
+	if HasQuestionForDomain(&layers.DNS{}, "eecs388.org") {
+		t.Errorf("expected a query without questions to have no question for %q", "eecs388.org")
+	}
+}
+
+func TestAnswerForQuestionTTL(t *testing.T) {
+	question := layers.DNSQuestion{
+		Name:  []byte("eecs388.org"),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+	}
+	for _, ttl := range []uint32{3600, 0} {
+		answer, err := AnswerForQuestionTTL(question, net.ParseIP("3.23.25.235"), ttl)
+		if err != nil {
+			t.Fatalf("unexpected error with TTL %d: %v", ttl, err)
+		}
+		if answer.TTL != ttl {
+			t.Errorf("expected TTL %d in answer, got %d", ttl, answer.TTL)
+		}
+	}
+}
+
+func TestAnswerForQuestionDefaultTTL(t *testing.T) {
+	answer, err := AnswerForQuestion(layers.DNSQuestion{
+		Name:  []byte("eecs388.org"),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+	}, net.ParseIP("3.23.25.235"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if answer.TTL != DefaultTTL {
+		t.Errorf("expected default TTL %d in answer, got %d", DefaultTTL, answer.TTL)
+	}
+}
+
+func TestBuildSpoofedResponseTTL(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	decoded := roundTripDNS(t, BuildSpoofedResponseTTL(query, "eecs388.org", net.ParseIP("3.23.25.235"), 3600))
+	if len(decoded.Answers) != 1 {
+		t.Fatalf("expected a single answer, got %d", len(decoded.Answers))
+	}
+	if decoded.Answers[0].TTL != 3600 {
+		t.Errorf("expected TTL %d in answer, got %d", 3600, decoded.Answers[0].TTL)
+	}
+}
+
+func TestAnswerCNAMEForQuestion(t *testing.T) {
+	domain := []byte("eecs388.org")
+	target := "evil.eecs388.org"
+
+	answer := AnswerCNAMEForQuestion(layers.DNSQuestion{
+		Name:  domain,
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+	}, target)
+
+	if !bytes.Equal(answer.Name, domain) {
+		t.Errorf("expected name %q in answer, got %q", domain, answer.Name)
+	}
+	if answer.Type != layers.DNSTypeCNAME {
+		t.Errorf("expected resource record type CNAME, got %s", answer.Type)
+	}
+	if answer.Class != layers.DNSClassIN {
+		t.Errorf("expected resource record class IN, got %s", answer.Class)
+	}
+	if string(answer.CNAME) != target {
+		t.Errorf("expected CNAME %q in answer, got %q", target, answer.CNAME)
+	}
+}
+
+func TestBuildSpoofedResponseCNAMEChain(t *testing.T) {
+	ip := net.ParseIP("3.23.25.235")
+	alias := "cdn.attacker.example"
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+
+	decoded := roundTripDNS(t, BuildSpoofedResponseWith(query, "eecs388.org", ip, 600, CNAMEAnswer(alias)))
+
+	if decoded.ANCount != 2 || len(decoded.Answers) != 2 {
+		t.Fatalf("expected a CNAME and an A record, got ANCount %d with %d answers", decoded.ANCount, len(decoded.Answers))
+	}
+	cname, a := decoded.Answers[0], decoded.Answers[1]
+	if cname.Type != layers.DNSTypeCNAME {
+		t.Errorf("expected first answer to be a CNAME record, got %s", cname.Type)
+	}
+	if string(cname.Name) != "eecs388.org" {
+		t.Errorf("expected CNAME record for %q, got %q", "eecs388.org", cname.Name)
+	}
+	if string(cname.CNAME) != alias {
+		t.Errorf("expected CNAME to point to %q, got %q", alias, cname.CNAME)
+	}
+	if a.Type != layers.DNSTypeA {
+		t.Errorf("expected second answer to be an A record, got %s", a.Type)
+	}
+	if string(a.Name) != alias {
+		t.Errorf("expected A record for alias %q, got %q", alias, a.Name)
+	}
+	if !a.IP.Equal(ip) {
+		t.Errorf("expected alias to point to %s, got %s", ip, a.IP)
+	}
+	for i, answer := range decoded.Answers {
+		if answer.TTL != 600 {
+			t.Errorf("expected TTL %d on answer %d, got %d", 600, i, answer.TTL)
+		}
+	}
+}
+
+// answerIPs returns the addresses of answers, in order.
+func answerIPs(answers []layers.DNSResourceRecord) []string {
+	ips := make([]string, len(answers))
+	for i, answer := range answers {
+		ips[i] = answer.IP.String()
+	}
+	return ips
+}
+
+func TestBuildSpoofedResponseMulti(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("3.23.25.235"),
+		net.ParseIP("10.38.8.4"),
+		net.ParseIP("2001:db8::388"),
+		net.ParseIP("10.38.8.5"),
+	}
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+
+	decoded := roundTripDNS(t, BuildSpoofedResponseMulti(query, "eecs388.org", ips, 600, nil))
+	expected := []string{"3.23.25.235", "10.38.8.4", "10.38.8.5"}
+	if decoded.ANCount != 3 || len(decoded.Answers) != 3 {
+		t.Fatalf("expected an A record per IPv4 address, got ANCount %d with %d answers", decoded.ANCount, len(decoded.Answers))
+	}
+	if got := answerIPs(decoded.Answers); strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected answers %v in order without shuffling, got %v", expected, got)
+	}
+}
+
+func TestBuildSpoofedResponseMultiShuffle(t *testing.T) {
+	var ips []net.IP
+	for i := 1; i <= 8; i++ {
+		ips = append(ips, net.IPv4(10, 38, 8, byte(i)))
+	}
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	rng := rand.New(rand.NewSource(388))
+
+	orders := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		response := BuildSpoofedResponseMulti(query, "eecs388.org", ips, DefaultTTL, rng)
+		got := answerIPs(response.Answers)
+		if len(got) != len(ips) {
+			t.Fatalf("expected %d answers, got %v", len(ips), got)
+		}
+		sorted := append([]string(nil), got...)
+		sort.Strings(sorted)
+		for j, ip := range sorted {
+			if expected := fmt.Sprintf("10.38.8.%d", j+1); ip != expected {
+				t.Fatalf("expected every address to appear once, got %v", got)
+			}
+		}
+		orders[strings.Join(got, " ")] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("expected the answer order to vary across responses, got %v", orders)
+	}
+}
+
+func TestBuildSpoofedResponseMultipleQuestions(t *testing.T) {
+	ip := net.ParseIP("3.23.25.235")
+	for _, v := range []struct {
+		name      string
+		questions []layers.DNSQuestion
+		answers   []layers.DNSType
+	}{
+		{"target is second of three", []layers.DNSQuestion{
+			{Name: []byte("wrong.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("bank.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		}, []layers.DNSType{layers.DNSTypeA}},
+		{"target asked twice", []layers.DNSQuestion{
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("wrong.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("EECS388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		}, []layers.DNSType{layers.DNSTypeA}},
+		{"target asked for two types", []layers.DNSQuestion{
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeMX, Class: layers.DNSClassIN},
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		}, []layers.DNSType{layers.DNSTypeA}},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			query := &layers.DNS{
+				QDCount:   uint16(len(v.questions)),
+				Questions: v.questions,
+			}
+			decoded := roundTripDNS(t, BuildSpoofedResponse(query, "eecs388.org", ip))
+
+			if decoded.QDCount != uint16(len(v.questions)) || len(decoded.Questions) != len(v.questions) {
+				t.Errorf("expected all %d questions to be echoed, got QDCount %d with %d questions", len(v.questions), decoded.QDCount, len(decoded.Questions))
+			}
+			for i, q := range decoded.Questions {
+				if string(q.Name) != string(v.questions[i].Name) {
+					t.Errorf("expected question %d to be for %q, got %q", i, v.questions[i].Name, q.Name)
+				}
+			}
+			if decoded.ANCount != uint16(len(v.answers)) || len(decoded.Answers) != len(v.answers) {
+				t.Fatalf("expected ANCount %d, got ANCount %d with %d answers", len(v.answers), decoded.ANCount, len(decoded.Answers))
+			}
+			for i, a := range decoded.Answers {
+				if a.Type != v.answers[i] {
+					t.Errorf("expected answer %d to have type %s, got %s", i, v.answers[i], a.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildSelectiveResponse(t *testing.T) {
+	ip := net.ParseIP("3.23.25.235")
+	query := &layers.DNS{
+		ID:      0x388,
+		QDCount: 2,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("wrong.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}
+
+	response, ok := BuildSelectiveResponse(query, "eecs388.org", ip)
+	if !ok {
+		t.Fatal("expected a response for a query with a matching question")
+	}
+	decoded := roundTripDNS(t, response)
+
+	if decoded.ID != query.ID {
+		t.Errorf("expected transaction ID %#x, got %#x", query.ID, decoded.ID)
+	}
+	if !decoded.QR {
+		t.Errorf("expected QR to be set on the response")
+	}
+	if decoded.QDCount != 2 || len(decoded.Questions) != 2 {
+		t.Errorf("expected both questions to be echoed, got QDCount %d and %d questions", decoded.QDCount, len(decoded.Questions))
+	}
+	if decoded.ANCount != 1 || len(decoded.Answers) != 1 {
+		t.Fatalf("expected a single answer, got ANCount %d and %d answers", decoded.ANCount, len(decoded.Answers))
+	}
+	if string(decoded.Answers[0].Name) != "eecs388.org" {
+		t.Errorf("expected answer for %q, got %q", "eecs388.org", decoded.Answers[0].Name)
+	}
+	if !decoded.Answers[0].IP.Equal(ip) {
+		t.Errorf("expected IP %s in answer, got %s", ip, decoded.Answers[0].IP)
+	}
+
+	if response, ok := BuildSelectiveResponse(query, "bank.com", ip); ok || response != nil {
+		t.Errorf("expected no response for a query without a matching question, got %v", response)
+	}
+}
+
+// withEDNS returns dns with an OPT record advertising payloadSize
+// added to its additionals.
+func withEDNS(dns *layers.DNS, payloadSize uint16, do bool) *layers.DNS {
+	var ttl uint32
+	if do {
+		ttl = 1 << 15
+	}
+	dns.Additionals = append(dns.Additionals, layers.DNSResourceRecord{
+		Type:  layers.DNSTypeOPT,
+		Class: layers.DNSClass(payloadSize),
+		TTL:   ttl,
+		OPT:   []layers.DNSOPT{{Code: layers.DNSOptionCodeNSID}},
+	})
+	dns.ARCount = uint16(len(dns.Additionals))
+	return dns
+}
+
+func TestBuildSpoofedResponseEDNS(t *testing.T) {
+	for _, v := range []struct {
+		name        string
+		query       *layers.DNS
+		hasOPT      bool
+		payloadSize uint16
+	}{
+		{"no OPT", dnsWithDomainQuestions([]string{"eecs388.org"}), false, 0},
+		{"OPT", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, false), true, 4096},
+		{"OPT with DO", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 1232, true), true, 1232},
+		{"OPT below minimum", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 100, false), true, 512},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			response := roundTripDNS(t, BuildSpoofedResponse(v.query, "eecs388.org", net.ParseIP("3.23.25.235")))
+			if !v.hasOPT {
+				if len(response.Additionals) != 0 {
+					t.Errorf("expected no additionals but got %v", response.Additionals)
+				}
+				return
+			}
+			if len(response.Additionals) != 1 || response.Additionals[0].Type != layers.DNSTypeOPT {
+				t.Fatalf("expected a single OPT additional but got %v", response.Additionals)
+			}
+			opt := response.Additionals[0]
+			if uint16(opt.Class) != v.payloadSize {
+				t.Errorf("expected payload size %d but got %d", v.payloadSize, opt.Class)
+			}
+			if opt.TTL&(1<<15) != 0 {
+				t.Errorf("expected DO bit to be unset")
+			}
+			if len(opt.OPT) != 0 {
+				t.Errorf("expected no EDNS options to be echoed but got %v", opt.OPT)
+			}
+			if len(response.Answers) != 1 {
+				t.Errorf("expected a single answer but got %v", response.Answers)
+			}
+		})
+	}
+}
+
+func TestResponsesEchoEDNS(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	for _, v := range []struct {
+		name     string
+		response func(query *layers.DNS) *layers.DNS
+	}{
+		{"spoofed", func(query *layers.DNS) *layers.DNS {
+			response, _ := table.SpoofedResponse(query, DefaultTTL)
+			return response
+		}},
+		{"NXDOMAIN", NXDomainResponse},
+		{"SERVFAIL", ServFailResponse},
+		{"truncated", TruncatedResponse},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			query := withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 1232, false)
+			response := roundTripDNS(t, v.response(query))
+			if len(response.Additionals) != 1 || response.Additionals[0].Type != layers.DNSTypeOPT {
+				t.Fatalf("expected a single OPT additional but got %v", response.Additionals)
+			}
+			if size := response.Additionals[0].Class; size != 1232 {
+				t.Errorf("expected payload size %d to be echoed but got %d", 1232, size)
+			}
+		})
+	}
+}
+
+func TestEDNSOPTPayloadSize(t *testing.T) {
+	query := withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, false)
+	opt, ok := EDNSOPT(query, 1232)
+	if !ok {
+		t.Fatalf("expected an OPT record for an EDNS0 query")
+	}
+	if opt.Class != 1232 {
+		t.Errorf("expected configured payload size %d but got %d", 1232, opt.Class)
+	}
+}
+
+func TestHasQuestionForDomainTyped(t *testing.T) {
+	withType := func(qtype layers.DNSType, qclass layers.DNSClass) *layers.DNS {
+		dns := dnsWithDomainQuestions([]string{"eecs388.org"})
+		dns.Questions[0].Type = qtype
+		dns.Questions[0].Class = qclass
+		return dns
+	}
+
+	for _, v := range []struct {
+		name     string
+		dns      *layers.DNS
+		domain   string
+		expected bool
+	}{
+		{"matching type and class", withType(layers.DNSTypeA, layers.DNSClassIN), "eecs388.org", true},
+		{"wrong type", withType(layers.DNSTypeTXT, layers.DNSClassIN), "eecs388.org", false},
+		{"PTR type", withType(layers.DNSTypePTR, layers.DNSClassIN), "eecs388.org", false},
+		{"wrong class", withType(layers.DNSTypeA, layers.DNSClassCH), "eecs388.org", false},
+		{"wrong domain", withType(layers.DNSTypeA, layers.DNSClassIN), "umich.edu", false},
+		{"nil packet", nil, "eecs388.org", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if got := HasQuestionForDomainTyped(v.dns, v.domain, layers.DNSTypeA, layers.DNSClassIN); got != v.expected {
+				t.Errorf("expected %v for A/IN question for %s but got %v", v.expected, v.domain, got)
+			}
+		})
+	}
+}
+
+// capturedQuery returns a DNS query for domain as it would be captured
+// off the wire, from client to server, with the given layers beneath it.
+func capturedQuery(t *testing.T, domain string, lower ...gopacket.SerializableLayer) gopacket.Packet {
+	t.Helper()
+	udp := &layers.UDP{SrcPort: 38838, DstPort: 53}
+	for _, l := range lower {
+		if ip, ok := l.(gopacket.NetworkLayer); ok {
+			udp.SetNetworkLayerForChecksum(ip)
+		}
+	}
+	query := dnsWithDomainQuestions([]string{domain})
+	query.ID = 0x388
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append(lower, udp, query)...); err != nil {
+		t.Fatalf("failed to serialize query: %v", err)
+	}
+	first := lower[0].(gopacket.Layer).LayerType()
+	return gopacket.NewPacket(buf.Bytes(), first, gopacket.Default)
+}
+
+func TestSerializeDNSResponse(t *testing.T) {
+	clientMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88}
+	serverMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x53}
+	answer, _ := AnswerForQuestion(layers.DNSQuestion{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}, net.ParseIP("3.23.25.235"))
+
+	for _, v := range []struct {
+		name   string
+		query  gopacket.Packet
+		client net.IP
+		server net.IP
+		hasEth bool
+	}{
+		{
+			"Ethernet and IPv4",
+			capturedQuery(t, "eecs388.org",
+				&layers.Ethernet{SrcMAC: clientMAC, DstMAC: serverMAC, EthernetType: layers.EthernetTypeIPv4},
+				&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()}),
+			net.ParseIP("10.38.8.2"), net.ParseIP("10.38.8.53"), true,
+		},
+		{
+			"bare IPv4",
+			capturedQuery(t, "eecs388.org",
+				&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()}),
+			net.ParseIP("10.38.8.2"), net.ParseIP("10.38.8.53"), false,
+		},
+		{
+			"Ethernet and IPv6",
+			capturedQuery(t, "eecs388.org",
+				&layers.Ethernet{SrcMAC: clientMAC, DstMAC: serverMAC, EthernetType: layers.EthernetTypeIPv6},
+				&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::388"), DstIP: net.ParseIP("2001:db8::53")}),
+			net.ParseIP("2001:db8::388"), net.ParseIP("2001:db8::53"), true,
+		},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			b, err := SerializeDNSResponse(v.query, []layers.DNSResourceRecord{answer})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			reply := gopacket.NewPacket(b, v.query.Layers()[0].LayerType(), gopacket.Default)
+			if err := reply.ErrorLayer(); err != nil {
+				t.Fatalf("reply did not decode: %v", err.Error())
+			}
+
+			if v.hasEth {
+				eth := reply.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+				if !bytes.Equal(eth.SrcMAC, serverMAC) || !bytes.Equal(eth.DstMAC, clientMAC) {
+					t.Errorf("expected MACs %v -> %v but got %v -> %v", serverMAC, clientMAC, eth.SrcMAC, eth.DstMAC)
+				}
+			}
+			src, dst := reply.NetworkLayer().NetworkFlow().Endpoints()
+			if !net.IP(src.Raw()).Equal(v.server) || !net.IP(dst.Raw()).Equal(v.client) {
+				t.Errorf("expected IPs %v -> %v but got %v -> %v", v.server, v.client, src, dst)
+			}
+			udp := reply.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if udp.SrcPort != 53 || udp.DstPort != 38838 {
+				t.Errorf("expected ports 53 -> 38838 but got %d -> %d", udp.SrcPort, udp.DstPort)
+			}
+			if udp.Checksum == 0 {
+				t.Errorf("expected UDP checksum to be computed")
+			}
+			dns := reply.Layer(layers.LayerTypeDNS).(*layers.DNS)
+			if !dns.QR || dns.ID != 0x388 {
+				t.Errorf("expected a response with ID %#x but got QR %v and ID %#x", 0x388, dns.QR, dns.ID)
+			}
+			if len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+				t.Errorf("expected a single answer for 3.23.25.235 but got %v", dns.Answers)
+			}
+		})
+	}
+}
+
+func TestProduceIPv6Packet(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	answer, err := AnswerForQuestion(query.Questions[0], net.ParseIP("3.23.25.235"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b := ProduceIPv6Packet(
+		&layers.IPv6{HopLimit: 64, SrcIP: net.ParseIP("2001:db8::53"), DstIP: net.ParseIP("2001:db8::388")},
+		&layers.UDP{SrcPort: 53, DstPort: 38838},
+		BuildResponse(query, []layers.DNSResourceRecord{answer}))
+
+	pkt := gopacket.NewPacket(b, layers.LayerTypeIPv6, gopacket.Default)
+	if err := pkt.ErrorLayer(); err != nil {
+		t.Fatalf("packet did not decode: %v", err.Error())
+	}
+	ip := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if ip.Version != 6 || ip.NextHeader != layers.IPProtocolUDP {
+		t.Errorf("expected version 6 and next header UDP but got %d and %s", ip.Version, ip.NextHeader)
+	}
+	if int(ip.Length) != len(ip.Payload) {
+		t.Errorf("expected payload length %d but got %d", len(ip.Payload), ip.Length)
+	}
+	checkUDPv6Checksum(t, ip, pkt.Layer(layers.LayerTypeUDP).(*layers.UDP))
+	dns := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected a single answer for 3.23.25.235 but got %v", dns.Answers)
+	}
+}
+
+func TestNXDomainResponseSOA(t *testing.T) {
+	for _, v := range []struct {
+		name    string
+		domain  string
+		soa     NegativeSOA
+		zone    string
+		mname   string
+		rname   string
+		minimum uint32
+	}{
+		{"defaults", "login.bank.com", NegativeSOA{}, "bank.com", "ns1.bank.com", "hostmaster.bank.com", DefaultNegativeTTL},
+		{"configured", "login.bank.com", NegativeSOA{MName: "ns.eecs388.org", RName: "admin.eecs388.org", TTL: 60}, "bank.com", "ns.eecs388.org", "admin.eecs388.org", 60},
+		{"top-level domain", "bank", NegativeSOA{}, "", "ns1", "hostmaster", DefaultNegativeTTL},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			b, err := SerializeDNS(NXDomainResponseSOA(dnsWithDomainQuestions([]string{v.domain}), v.soa))
+			if err != nil {
+				t.Fatalf("failed to serialize response: %v", err)
+			}
+			response := decodeDNS(t, b)
+			if response.ResponseCode != layers.DNSResponseCodeNXDomain || !response.AA {
+				t.Errorf("expected an authoritative %s but got %s with AA %v", layers.DNSResponseCodeNXDomain, response.ResponseCode, response.AA)
+			}
+			if len(response.Answers) != 0 || len(response.Additionals) != 0 {
+				t.Errorf("expected the SOA record alone, in the authority section, but got answers %v and additionals %v", response.Answers, response.Additionals)
+			}
+			if response.NSCount != 1 || len(response.Authorities) != 1 {
+				t.Fatalf("expected a single authority record but got %d: %v", response.NSCount, response.Authorities)
+			}
+			soa := response.Authorities[0]
+			if soa.Type != layers.DNSTypeSOA || string(soa.Name) != v.zone {
+				t.Errorf("expected an SOA record for %q but got %s for %q", v.zone, soa.Type, soa.Name)
+			}
+			if string(soa.SOA.MName) != v.mname || string(soa.SOA.RName) != v.rname {
+				t.Errorf("expected MNAME %q and RNAME %q but got %q and %q", v.mname, v.rname, soa.SOA.MName, soa.SOA.RName)
+			}
+			if soa.TTL != v.minimum || soa.SOA.Minimum != v.minimum {
+				t.Errorf("expected TTL and minimum %d but got %d and %d", v.minimum, soa.TTL, soa.SOA.Minimum)
+			}
+		})
+	}
+}
+
+func TestSerializeDNSResponseNotDNS(t *testing.T) {
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()},
+		&layers.UDP{SrcPort: 38838, DstPort: 9999},
+		gopacket.Payload("not dns"))
+	pkt := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	if _, err := SerializeDNSResponse(pkt, nil); err == nil {
+		t.Errorf("expected an error for a packet without a DNS layer")
+	}
+}
+
+func TestWantsDNSSEC(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		query    *layers.DNS
+		expected bool
+	}{
+		{"no OPT", dnsWithDomainQuestions([]string{"eecs388.org"}), false},
+		{"DO unset", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, false), false},
+		{"DO set", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, true), true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if got := WantsDNSSEC(roundTripDNS(t, v.query)); got != v.expected {
+				t.Errorf("expected WantsDNSSEC to be %v but got %v", v.expected, got)
+			}
+		})
+	}
+}
+
+func TestAnswerForQuestionMulti(t *testing.T) {
+	question := layers.DNSQuestion{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+	ips := []net.IP{
+		net.ParseIP("3.23.25.235"),
+		net.ParseIP("2001:db8::388"),
+		net.ParseIP("3.23.25.236"),
+		net.ParseIP("3.23.25.237"),
+	}
+
+	answers := AnswerForQuestionMulti(question, ips)
+	expected := []net.IP{ips[0], ips[2], ips[3]}
+	if len(answers) != len(expected) {
+		t.Fatalf("expected %d answers but got %d: %v", len(expected), len(answers), answers)
+	}
+	for i, answer := range answers {
+		if !answer.IP.Equal(expected[i]) {
+			t.Errorf("answer %d: expected IP %v but got %v", i, expected[i], answer.IP)
+		}
+		if string(answer.Name) != "eecs388.org" {
+			t.Errorf("answer %d: expected name %q but got %q", i, "eecs388.org", answer.Name)
+		}
+		if answer.Type != layers.DNSTypeA || answer.Class != layers.DNSClassIN {
+			t.Errorf("answer %d: expected type A and class IN but got %s and %s", i, answer.Type, answer.Class)
+		}
+	}
+}
+
+func TestSerializeDNSResponseTCP(t *testing.T) {
+	query := dnsWithDomainQuestions([]string{"eecs388.org"})
+	query.ID = 0x388
+
+	manyIPs := make([]net.IP, 5000)
+	for i := range manyIPs {
+		manyIPs[i] = net.IPv4(10, 38, byte(i>>8), byte(i))
+	}
+
+	for _, v := range []struct {
+		name      string
+		ipCount   int
+		truncated bool
+	}{
+		{"small answer set", 3, false},
+		{"larger than UDP allows", 100, false},
+		{"larger than TCP allows", len(manyIPs), true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			answers := AnswerForQuestionMulti(query.Questions[0], manyIPs[:v.ipCount])
+			b, err := SerializeDNSResponseTCP(query, answers)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			length := int(binary.BigEndian.Uint16(b))
+			if length != len(b)-2 {
+				t.Fatalf("length prefix is %d but payload is %d bytes", length, len(b)-2)
+			}
+			response := decodeDNS(t, b[2:])
+			if response.ID != 0x388 {
+				t.Errorf("expected transaction ID %#x but got %#x", 0x388, response.ID)
+			}
+			if response.TC != v.truncated {
+				t.Errorf("expected TC bit %v but got %v", v.truncated, response.TC)
+			}
+			if !v.truncated && len(response.Answers) != v.ipCount {
+				t.Errorf("expected %d answers but got %d", v.ipCount, len(response.Answers))
+			}
+			if v.truncated && (len(response.Answers) == 0 || len(response.Answers) >= v.ipCount) {
+				t.Errorf("expected answers to be cut down to fit, but got %d of %d", len(response.Answers), v.ipCount)
+			}
+		})
+	}
+}
+
+func TestTruncateForUDP(t *testing.T) {
+	manyIPs := make([]net.IP, 200)
+	for i := range manyIPs {
+		manyIPs[i] = net.IPv4(10, 38, 8, byte(i))
+	}
+
+	for _, v := range []struct {
+		name      string
+		query     *layers.DNS
+		ipCount   int
+		limit     int
+		truncated bool
+	}{
+		{"small answer set", dnsWithDomainQuestions([]string{"eecs388.org"}), 3, 512, false},
+		{"larger than 512 bytes", dnsWithDomainQuestions([]string{"eecs388.org"}), 40, 512, true},
+		{"within EDNS payload size", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, false), 40, 4096, false},
+		{"larger than EDNS payload size", withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 1232, false), len(manyIPs), 1232, true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if size := UDPPayloadSize(v.query); size != v.limit {
+				t.Errorf("expected UDP payload size %d but got %d", v.limit, size)
+			}
+			answers := AnswerForQuestionMulti(v.query.Questions[0], manyIPs[:v.ipCount])
+			response, err := TruncateForUDP(v.query, BuildResponse(v.query, answers))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			b, err := SerializeDNS(response)
+			if err != nil {
+				t.Fatalf("failed to serialize response: %v", err)
+			}
+			if len(b) > v.limit {
+				t.Errorf("expected response to fit in %d bytes but it is %d", v.limit, len(b))
+			}
+
+			decoded := decodeDNS(t, b)
+			if decoded.TC != v.truncated {
+				t.Errorf("expected TC bit %v but got %v", v.truncated, decoded.TC)
+			}
+			if !v.truncated && len(decoded.Answers) != v.ipCount {
+				t.Errorf("expected %d answers but got %d", v.ipCount, len(decoded.Answers))
+			}
+			if v.truncated && (len(decoded.Answers) == 0 || len(decoded.Answers) >= v.ipCount) {
+				t.Errorf("expected answers to be cut down to fit, but got %d of %d", len(decoded.Answers), v.ipCount)
+			}
+		})
+	}
+}
+
+func TestDomainToASCII(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		domain   string
+		expected string
+		err      bool
+	}{
+		{"Unicode", "bücher.example", "xn--bcher-kva.example", false},
+		{"Unicode uppercase", "Bücher.example", "xn--bcher-kva.example", false},
+		{"decomposed", "bu\u0308cher.example", "xn--bcher-kva.example", false},
+		{"full-width", "ｂüｃｈｅｒ.example", "xn--bcher-kva.example", false},
+		{"non-Latin", "例え.テスト", "xn--r8jz45g.xn--zckzah", false},
+		{"emoji", "💩.la", "xn--ls8h.la", false},
+		{"already punycode", "xn--mnchen-3ya.de", "xn--mnchen-3ya.de", false},
+		{"ASCII", "eecs388.org", "eecs388.org", false},
+		{"ASCII with underscores", "_sip._tcp.eecs388.org", "_sip._tcp.eecs388.org", false},
+		{"wildcard", "*.bücher.example", "*.xn--bcher-kva.example", false},
+		{"trailing dot", "bücher.example.", "xn--bcher-kva.example.", false},
+		{"ideographic full stop", "bücher。example", "xn--bcher-kva.example", false},
+		{"Kelvin sign", "ban\u212a.com", "bank.com", false},
+		{"disallowed character", "bü_cher.example", "", true},
+		{"invalid punycode digit", "xn--bcher_kva.example", "", true},
+		{"truncated punycode", "xn--bcher-kva9.example", "", true},
+		{"invalid UTF-8", "bü\xfccher.example", "", true},
+		{"label too long", strings.Repeat("a", 60) + "ü.example", "", true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got, err := domainToASCII(v.domain)
+			if v.err {
+				if err == nil {
+					t.Errorf("expected an error converting %q but got %q", v.domain, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != v.expected {
+				t.Errorf("expected %q to convert to %q but got %q", v.domain, v.expected, got)
+			}
+		})
+	}
+}
+
+func TestSpoofTableIDN(t *testing.T) {
+	var table SpoofTable
+	table.Add("bücher.example", net.ParseIP("3.23.25.235"))
+	table.Add("xn--mnchen-3ya.de", net.ParseIP("10.38.8.4"))
+	table.Add("*.例え.テスト", net.ParseIP("10.38.8.5"))
+
+	for _, v := range []struct {
+		name   string
+		domain string
+		ip     net.IP
+	}{
+		{"Unicode rule, punycode question", "xn--bcher-kva.example", net.ParseIP("3.23.25.235")},
+		{"Unicode rule, uppercase punycode question", "XN--BCHER-KVA.example.", net.ParseIP("3.23.25.235")},
+		{"punycode rule, Unicode question", "münchen.de", net.ParseIP("10.38.8.4")},
+		{"Unicode wildcard, punycode question", "www.xn--r8jz45g.xn--zckzah", net.ParseIP("10.38.8.5")},
+		{"lookalike", "xn--bcher-kva.exampl\u212a", nil},
+		{"Cyrillic lookalike", "bücher.\u0435xample", nil},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			ip, ok := table.Lookup(questionFor(v.domain))
+			if ok != (v.ip != nil) || !ip.Equal(v.ip) {
+				t.Errorf("expected %q to be spoofed to %v but got %v (found %v)", v.domain, v.ip, ip, ok)
+			}
+		})
+	}
+}
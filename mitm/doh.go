@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// clientHelloFilter is the BPF filter for TLS connections being set
+// up, so that the kernel only hands us packets which may carry a
+// ClientHello: those to port 443 with a payload. libpcap can only look
+// into the TCP header of IPv4 packets, so every IPv6 packet to port 443
+// is let through, and those without a ClientHello are skipped by
+// clientHelloSNI.
+const clientHelloFilter = "tcp dst port 443 and (ip6 or tcp[tcpflags] & tcp-push != 0)"
+
+// DefaultDoHProviders are the hostnames of well-known public
+// DNS-over-HTTPS resolvers, as sent in the SNI of their connections.
+var DefaultDoHProviders = []string{
+	"dns.google",
+	"dns.google.com",
+	"cloudflare-dns.com",
+	"*.cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.quad9.net",
+	"*.dns.quad9.net",
+	"doh.opendns.com",
+	"dns.nextdns.io",
+	"dns.adguard.com",
+	"doh.cleanbrowsing.org",
+}
+
+// A DoHConnection is a TLS connection to a DNS-over-HTTPS resolver.
+type DoHConnection struct {
+	Client net.IP
+	Server net.IP
+	// SNI is the server name the client asked for in its ClientHello.
+	SNI string
+}
+
+// A DoHDetector spots victims resolving names over DNS-over-HTTPS, which
+// bypasses our spoofing on port 53 entirely, by looking for the server
+// name of a known resolver in TLS ClientHellos sniffed off the wire.
+// Each connection found is reported and, as configured, cut off, so that
+// the client falls back to classic DNS.
+//
+// The fields must not be changed once the detector is in use.
+type DoHDetector struct {
+	// Providers are the hostnames of DoH resolvers to look for on
+	// top of DefaultDoHProviders. They may be wildcards, as in SpoofTable.
+	Providers []string
+	// Writer, if set, is used to inject TCP RSTs both ways
+	// on each connection found, tearing it down.
+	Writer PacketWriter
+	// Table, if set, has the resolver's hostname added to it for each
+	// connection found, spoofed to BlackholeIP, so that the client
+	// cannot connect to it again.
+	Table *SpoofTable
+	// BlackholeIP is the unroutable address resolvers are spoofed to.
+	// If nil, 0.0.0.0 is used.
+	BlackholeIP net.IP
+	// OnDetect, if set, is called with each connection found.
+	// Otherwise they are logged with the log package.
+	OnDetect func(DoHConnection)
+}
+
+// Inspect looks at the captured packet for a TLS ClientHello to a DoH
+// resolver, reporting whether it found one, and if so reports the
+// connection and acts on it as d is configured to. Any error
+// acting on it is returned.
+func (d *DoHDetector) Inspect(pkt gopacket.Packet) (bool, error) {
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false, nil
+	}
+	sni, ok := clientHelloSNI(tcp.Payload)
+	if !ok || !d.isProvider(sni) {
+		return false, nil
+	}
+
+	conn := DoHConnection{SNI: sni}
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		conn.Client, conn.Server = ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		conn.Client, conn.Server = ip.SrcIP, ip.DstIP
+	}
+	if d.OnDetect != nil {
+		d.OnDetect(conn)
+	} else {
+		log.Printf("DNS-over-HTTPS from %s to %s (%s)", conn.Client, conn.Server, conn.SNI)
+	}
+
+	if d.Table != nil {
+		ip := d.BlackholeIP
+		if ip == nil {
+			ip = net.IPv4zero
+		}
+		d.Table.Add(sni, ip)
+	}
+	if d.Writer == nil {
+		return true, nil
+	}
+	for _, toClient := range []bool{true, false} {
+		data, err := serializeReset(pkt, toClient)
+		if err != nil {
+			return true, err
+		}
+		if err := d.Writer.WritePacketData(data); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// isProvider returns whether sni is the hostname of a DoH resolver.
+func (d *DoHDetector) isProvider(sni string) bool {
+	name := normalizeDomain(sni)
+	for _, providers := range [][]string{DefaultDoHProviders, d.Providers} {
+		for _, p := range providers {
+			if normalizedMatches(name, normalizeDomain(p)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CaptureDoH captures TLS connections being set up on the network
+// interface iface, passing each packet to d.Inspect. Errors acting on a
+// connection are logged. It returns nil once ctx is done, or an error
+// if capturing could not start.
+func CaptureDoH(ctx context.Context, iface string, d *DoHDetector) error {
+	handle, err := pcap.OpenLive(iface, captureSnapLen, true, captureTimeout)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(clientHelloFilter); err != nil {
+		return err
+	}
+
+	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pkt, ok := <-packets:
+			if !ok {
+				return nil
+			}
+			if _, err := d.Inspect(pkt); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// serializeReset returns the raw bytes of a TCP RST tearing down the
+// connection the captured TCP packet belongs to, as if sent by its
+// destination back to its source if toClient is set, or by its source
+// on to its destination otherwise. The RST's sequence number is the one
+// its recipient expects next, so that it is accepted.
+func serializeReset(pkt gopacket.Packet, toClient bool) ([]byte, error) {
+	ptcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, errors.New("packet has no TCP layer")
+	}
+	next := ptcp.Seq + uint32(len(ptcp.Payload))
+	tcp := &layers.TCP{SrcPort: ptcp.SrcPort, DstPort: ptcp.DstPort, Seq: next, RST: true}
+	if toClient {
+		tcp = &layers.TCP{SrcPort: ptcp.DstPort, DstPort: ptcp.SrcPort, Seq: ptcp.Ack, Ack: next, RST: true, ACK: true}
+	}
+
+	var toSerialize []gopacket.SerializableLayer
+	if eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		reply := &layers.Ethernet{SrcMAC: eth.SrcMAC, DstMAC: eth.DstMAC, EthernetType: eth.EthernetType}
+		if toClient {
+			reply.SrcMAC, reply.DstMAC = eth.DstMAC, eth.SrcMAC
+		}
+		toSerialize = append(toSerialize, reply)
+	}
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		reply := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: ip.SrcIP, DstIP: ip.DstIP}
+		if toClient {
+			reply.SrcIP, reply.DstIP = ip.DstIP, ip.SrcIP
+		}
+		if err := tcp.SetNetworkLayerForChecksum(reply); err != nil {
+			return nil, err
+		}
+		toSerialize = append(toSerialize, reply)
+	case *layers.IPv6:
+		reply := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: ip.SrcIP, DstIP: ip.DstIP}
+		if toClient {
+			reply.SrcIP, reply.DstIP = ip.DstIP, ip.SrcIP
+		}
+		if err := tcp.SetNetworkLayerForChecksum(reply); err != nil {
+			return nil, err
+		}
+		toSerialize = append(toSerialize, reply)
+	default:
+		return nil, errors.New("packet has no IPv4 or IPv6 layer")
+	}
+	toSerialize = append(toSerialize, tcp)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, toSerialize...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// clientHelloSNI returns the host name in the server_name extension of
+// the TLS ClientHello at the start of payload (RFC 8446, section 4.1.2;
+// RFC 6066, section 3), and whether there is one. Only a ClientHello
+// which fits in the first record is found, as is usual.
+func clientHelloSNI(payload []byte) (string, bool) {
+	// The record header: content type 22 (handshake), version, length.
+	if len(payload) < 5 || payload[0] != 22 {
+		return "", false
+	}
+	record, ok := readVector(payload[3:], 2)
+	if !ok {
+		return "", false
+	}
+	// The handshake header: type 1 (ClientHello), 24-bit length.
+	if len(record) < 4 || record[0] != 1 {
+		return "", false
+	}
+	hello := record[4:]
+	if n := int(record[1])<<16 | int(record[2])<<8 | int(record[3]); n < len(hello) {
+		hello = hello[:n]
+	}
+
+	// Skip the version and random, then the session ID,
+	// cipher suites and compression methods.
+	if len(hello) < 34 {
+		return "", false
+	}
+	rest := hello[34:]
+	for _, lenBytes := range []int{1, 2, 1} {
+		v, ok := readVector(rest, lenBytes)
+		if !ok {
+			return "", false
+		}
+		rest = rest[lenBytes+len(v):]
+	}
+
+	extensions, ok := readVector(rest, 2)
+	if !ok {
+		return "", false
+	}
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions)
+		data, ok := readVector(extensions[2:], 2)
+		if !ok {
+			return "", false
+		}
+		extensions = extensions[4+len(data):]
+		if typ != 0 {
+			continue
+		}
+		// server_name: a list of (type, name) pairs,
+		// of which type 0 is a host name.
+		names, ok := readVector(data, 2)
+		for ok && len(names) >= 3 {
+			var name []byte
+			if name, ok = readVector(names[1:], 2); ok && names[0] == 0 {
+				return string(name), true
+			}
+			names = names[3+len(name):]
+		}
+		return "", false
+	}
+	return "", false
+}
+
+// readVector returns the contents of the variable-length vector at the
+// start of b, which are preceded by their length as a big-endian integer
+// of lenBytes bytes (RFC 8446, section 3.4). It reports false if b is
+// too short to hold them.
+func readVector(b []byte, lenBytes int) ([]byte, bool) {
+	if len(b) < lenBytes {
+		return nil, false
+	}
+	var n int
+	for _, c := range b[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	if len(b) < lenBytes+n {
+		return nil, false
+	}
+	return b[lenBytes : lenBytes+n], true
+}
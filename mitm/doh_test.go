@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// clientHello returns the TLS record carrying the ClientHello which
+// crypto/tls sends when connecting to serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+	defer client.Close()
+
+	record := make([]byte, 5)
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatalf("failed to read ClientHello record header: %v", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(record[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("failed to read ClientHello: %v", err)
+	}
+	return append(record, body...)
+}
+
+// capturedTLS returns payload as if captured on its way
+// from 10.38.8.2:51234 to a server at 8.8.8.8:443.
+func capturedTLS(t *testing.T, payload []byte) gopacket.Packet {
+	t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("8.8.8.8").To4()}
+	tcp := &layers.TCP{SrcPort: 51234, DstPort: 443, Seq: 1000, Ack: 2000, PSH: true, ACK: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88},
+			DstMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip, tcp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatalf("failed to serialize packet: %v", err)
+	}
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestClientHelloSNI(t *testing.T) {
+	hello := clientHello(t, "dns.google")
+	if sni, ok := clientHelloSNI(hello); !ok || sni != "dns.google" {
+		t.Errorf("expected SNI %q but got %q (found %v)", "dns.google", sni, ok)
+	}
+	for i := 0; i < len(hello); i++ {
+		if sni, ok := clientHelloSNI(hello[:i]); ok {
+			t.Errorf("expected no SNI in a ClientHello cut off after %d bytes but got %q", i, sni)
+		}
+	}
+	if _, ok := clientHelloSNI([]byte("GET / HTTP/1.1\r\n\r\n")); ok {
+		t.Errorf("expected no SNI in a plain HTTP request")
+	}
+}
+
+func TestDoHDetector(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		sni      string
+		detected bool
+	}{
+		{"built-in provider", "dns.google", true},
+		{"built-in wildcard", "mozilla.cloudflare-dns.com", true},
+		{"user provider", "doh.bank.com", true},
+		{"other server", "www.google.com", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			var w capturingWriter
+			var table SpoofTable
+			var found []DoHConnection
+			d := &DoHDetector{
+				Providers: []string{"doh.bank.com"},
+				Writer:    &w,
+				Table:     &table,
+				OnDetect:  func(c DoHConnection) { found = append(found, c) },
+			}
+
+			hello := clientHello(t, v.sni)
+			detected, err := d.Inspect(capturedTLS(t, hello))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if detected != v.detected {
+				t.Fatalf("expected detected %v but got %v", v.detected, detected)
+			}
+			if !v.detected {
+				if len(found) != 0 || len(w.packets) != 0 {
+					t.Errorf("expected nothing reported or injected but got %d reports and %d packets", len(found), len(w.packets))
+				}
+				if _, ok := table.Lookup(questionFor(v.sni)); ok {
+					t.Errorf("expected %q not to be spoofed", v.sni)
+				}
+				return
+			}
+
+			if len(found) != 1 || found[0].SNI != v.sni || !found[0].Client.Equal(net.ParseIP("10.38.8.2")) || !found[0].Server.Equal(net.ParseIP("8.8.8.8")) {
+				t.Errorf("expected the connection from 10.38.8.2 to 8.8.8.8 for %q to be reported but got %+v", v.sni, found)
+			}
+			if ip, ok := table.Lookup(questionFor(v.sni)); !ok || !ip.Equal(net.IPv4zero) {
+				t.Errorf("expected %q to be spoofed to 0.0.0.0 but got %v", v.sni, ip)
+			}
+
+			if len(w.packets) != 2 {
+				t.Fatalf("expected 2 RSTs to be injected but got %d packets", len(w.packets))
+			}
+			for i, expected := range []struct {
+				src, dst         string
+				srcPort, dstPort layers.TCPPort
+				seq              uint32
+			}{
+				{"8.8.8.8", "10.38.8.2", 443, 51234, 2000},
+				{"10.38.8.2", "8.8.8.8", 51234, 443, 1000 + uint32(len(hello))},
+			} {
+				rst := gopacket.NewPacket(w.packets[i], layers.LayerTypeEthernet, gopacket.Default)
+				ip := rst.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				tcp := rst.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				if !ip.SrcIP.Equal(net.ParseIP(expected.src)) || !ip.DstIP.Equal(net.ParseIP(expected.dst)) {
+					t.Errorf("expected RST %d from %s to %s but got %v -> %v", i, expected.src, expected.dst, ip.SrcIP, ip.DstIP)
+				}
+				if !tcp.RST || tcp.SrcPort != expected.srcPort || tcp.DstPort != expected.dstPort || tcp.Seq != expected.seq {
+					t.Errorf("expected RST %d from port %d to %d with seq %d but got RST %v from %d to %d with seq %d",
+						i, expected.srcPort, expected.dstPort, expected.seq, tcp.RST, tcp.SrcPort, tcp.DstPort, tcp.Seq)
+				}
+				if sum := checksum(append(pseudoHeader(ip), tcp.Contents...)); sum != 0 {
+					t.Errorf("expected a valid TCP checksum on RST %d", i)
+				}
+			}
+		})
+	}
+}
+
+// pseudoHeader returns the IPv4 pseudo-header a TCP checksum covers.
+func pseudoHeader(ip *layers.IPv4) []byte {
+	b := append(append([]byte(nil), ip.SrcIP.To4()...), ip.DstIP.To4()...)
+	b = append(b, 0, byte(ip.Protocol))
+	return append(b, byte(len(ip.Payload)>>8), byte(len(ip.Payload)))
+}
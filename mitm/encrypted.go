@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// dnsMessageType is the media type of DNS-over-HTTPS
+	// requests and responses (RFC 8484, section 6).
+	dnsMessageType = "application/dns-message"
+	// dotPort is the port DNS-over-TLS is spoken on by default.
+	dotPort = "853"
+	// maxIdleTLSConns is how many DNS-over-TLS connections
+	// a Forwarder keeps open for reuse.
+	maxIdleTLSConns = 4
+)
+
+// forwardHTTPS POSTs the raw DNS query to the DNS-over-HTTPS resolver
+// at the URL upstream and returns its raw response (RFC 8484, section 4.1).
+func (f *Forwarder) forwardHTTPS(upstream string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := f.dohClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS resolver replied %s", resp.Status)
+	}
+	// Parameters such as a charset are allowed, if pointless.
+	ct := resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(ct); err != nil || mediaType != dnsMessageType {
+		return nil, fmt.Errorf("DNS-over-HTTPS resolver replied with Content-Type %q", ct)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxTCPMessage))
+}
+
+// dohClient returns the client DNS-over-HTTPS queries are sent with,
+// which keeps connections to the resolver alive between queries.
+func (f *Forwarder) dohClient() *http.Client {
+	f.httpOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = f.TLSConfig
+		f.httpClient = &http.Client{Transport: transport}
+	})
+	return f.httpClient
+}
+
+// forwardTLS sends the raw DNS query to the DNS-over-TLS resolver at
+// the URL upstream and returns its raw response (RFC 7858, section 3.3).
+// An idle connection is reused if there is one; if it turns out to have
+// been closed by the resolver, the query is retried on a new one.
+func (f *Forwarder) forwardTLS(upstream string, query []byte) ([]byte, error) {
+	framed, err := frameTCP(query)
+	if err != nil {
+		return nil, err
+	}
+	if conn := f.takeIdle(upstream); conn != nil {
+		if response, err := f.exchangeTLS(upstream, conn, framed); err == nil {
+			return response, nil
+		}
+	}
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), dotPort)
+	}
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: f.timeout()}, Config: f.TLSConfig}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return f.exchangeTLS(upstream, conn.(*tls.Conn), framed)
+}
+
+// exchangeTLS writes the length-prefixed query to conn and reads back
+// the response, then keeps conn for reuse with upstream. conn is closed
+// on error.
+func (f *Forwarder) exchangeTLS(upstream string, conn *tls.Conn, framed []byte) ([]byte, error) {
+	response, err := func() ([]byte, error) {
+		if err := conn.SetDeadline(time.Now().Add(f.timeout())); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(framed); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	f.putIdle(upstream, conn)
+	return response, nil
+}
+
+// takeIdle returns an idle DNS-over-TLS connection
+// to upstream, or nil if there is none.
+func (f *Forwarder) takeIdle(upstream string) *tls.Conn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	idle := f.idle[upstream]
+	if len(idle) == 0 {
+		return nil
+	}
+	conn := idle[len(idle)-1]
+	f.idle[upstream] = idle[:len(idle)-1]
+	return conn
+}
+
+// putIdle keeps conn to upstream for reuse,
+// or closes it if enough are kept already.
+func (f *Forwarder) putIdle(upstream string, conn *tls.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.idle[upstream]) >= maxIdleTLSConns {
+		conn.Close()
+		return
+	}
+	if f.idle == nil {
+		f.idle = make(map[string][]*tls.Conn)
+	}
+	f.idle[upstream] = append(f.idle[upstream], conn)
+}
+
+// CloseIdleConnections closes the connections to encrypted upstreams
+// kept for reuse; those carrying queries in flight are left alone.
+// f may still be used afterwards, and dials afresh.
+func (f *Forwarder) CloseIdleConnections() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	idle := f.idle
+	f.idle = nil
+	f.mu.Unlock()
+	for _, conns := range idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	f.dohClient().CloseIdleConnections()
+}
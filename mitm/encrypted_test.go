@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// answerWith returns a reply function, as for fakeUpstream, which
+// answers the question of each query with ip.
+func answerWith(t *testing.T, ip net.IP) func(query []byte) []byte {
+	return func(query []byte) []byte {
+		dns := decodeDNS(t, query)
+		var answers []layers.DNSResourceRecord
+		for _, q := range dns.Questions {
+			if answer, err := AnswerForQuestion(q, ip); err == nil {
+				answers = append(answers, answer)
+			}
+		}
+		response, err := SerializeDNS(BuildResponse(dns, answers))
+		if err != nil {
+			t.Errorf("failed to serialize response: %v", err)
+		}
+		return response
+	}
+}
+
+// trusting returns a TLS configuration which trusts s's certificate.
+func trusting(s *httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	return &tls.Config{RootCAs: pool}
+}
+
+// checkForwarded checks that response answers query
+// for eecs388.org with ip.
+func checkForwarded(t *testing.T, response []byte, ip string) {
+	t.Helper()
+	dns := decodeDNS(t, response)
+	if dns.ID != 0x388 {
+		t.Errorf("expected response ID %#x but got %#x", 0x388, dns.ID)
+	}
+	if len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP(ip)) {
+		t.Errorf("expected an answer for %s but got %v", ip, dns.Answers)
+	}
+}
+
+func TestForwarderDoH(t *testing.T) {
+	reply := answerWith(t, net.ParseIP("3.23.25.235"))
+	var conns int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dnsMessageType {
+			t.Errorf("resolver expected a POST of %s to /dns-query but got %s %s of %q",
+				dnsMessageType, r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(reply(query))
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	fwd := &Forwarder{Upstream: s.URL + "/dns-query", TLSConfig: trusting(s), Fallback: "127.0.0.1:1"}
+	for i := 0; i < 3; i++ {
+		response, err := fwd.Forward(serializeQuery(t, "eecs388.org"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		checkForwarded(t, response, "3.23.25.235")
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected 1 connection to be reused for every query but got %d", n)
+	}
+}
+
+func TestForwarderDoHContentType(t *testing.T) {
+	reply := answerWith(t, net.ParseIP("3.23.25.235"))
+	for _, v := range []struct {
+		contentType string
+		ok          bool
+	}{
+		{"application/dns-message", true},
+		{"Application/DNS-Message; charset=binary", true},
+		{"text/html; charset=utf-8", false},
+		{"", false},
+	} {
+		v := v
+		t.Run(v.contentType, func(t *testing.T) {
+			s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query, _ := io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", v.contentType)
+				w.Write(reply(query))
+			}))
+			defer s.Close()
+
+			fwd := &Forwarder{Upstream: s.URL, TLSConfig: trusting(s), Fallback: "127.0.0.1:1", Timeout: 100 * time.Millisecond}
+			response, err := fwd.Forward(serializeQuery(t, "eecs388.org"))
+			if (err == nil) != v.ok {
+				t.Fatalf("expected a reply with Content-Type %q to be accepted to be %v but got error %v", v.contentType, v.ok, err)
+			}
+			if v.ok {
+				checkForwarded(t, response, "3.23.25.235")
+			}
+		})
+	}
+}
+
+func TestForwarderDoT(t *testing.T) {
+	// Borrow an httptest server's certificate for our own TLS listener.
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	defer s.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", s.TLS)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	reply := answerWith(t, net.ParseIP("3.23.25.235"))
+	var conns int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				for {
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					framed, _ := frameTCP(reply(query))
+					conn.Write(framed)
+				}
+			}()
+		}
+	}()
+
+	fwd := &Forwarder{Upstream: "tls://" + ln.Addr().String(), TLSConfig: trusting(s), Fallback: "127.0.0.1:1"}
+	for i := 0; i < 3; i++ {
+		response, err := fwd.Forward(serializeQuery(t, "eecs388.org"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		checkForwarded(t, response, "3.23.25.235")
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("expected 1 connection to be reused for every query but got %d", n)
+	}
+}
+
+func TestForwarderEncryptedFallback(t *testing.T) {
+	hung := make(chan struct{})
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer slow.Close()
+	defer close(hung)
+	down := httptest.NewTLSServer(http.NotFoundHandler())
+	down.Close()
+	fallback, queries := fakeUpstream(t, answerWith(t, net.ParseIP("10.38.8.4")))
+
+	for _, v := range []struct {
+		name     string
+		upstream string
+		config   *tls.Config
+	}{
+		{"DoH unreachable", down.URL + "/dns-query", nil},
+		{"DoH timeout", slow.URL + "/dns-query", trusting(slow)},
+		{"DoH untrusted", slow.URL + "/dns-query", nil},
+		{"DoT unreachable", "tls://" + down.Listener.Addr().String(), nil},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			fwd := &Forwarder{Upstream: v.upstream, TLSConfig: v.config, Timeout: 100 * time.Millisecond, Fallback: fallback}
+			query := serializeQuery(t, "eecs388.org")
+			start := time.Now()
+			response, err := fwd.Forward(query)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("expected the fallback within the timeout but took %v", elapsed)
+			}
+			checkForwarded(t, response, "10.38.8.4")
+			select {
+			case q := <-queries:
+				if !bytes.Equal(q, query) {
+					t.Errorf("fallback expected query %x but got %x", query, q)
+				}
+			default:
+				t.Error("expected the query to reach the fallback resolver")
+			}
+		})
+	}
+}
+
+func TestForwarderEncryptedFallbackFails(t *testing.T) {
+	down := httptest.NewTLSServer(http.NotFoundHandler())
+	down.Close()
+	fwd := &Forwarder{Upstream: down.URL, Timeout: 100 * time.Millisecond, Fallback: "127.0.0.1:1"}
+	if _, err := fwd.Forward(serializeQuery(t, "eecs388.org")); err == nil {
+		t.Error("expected an error when the fallback fails too")
+	}
+}
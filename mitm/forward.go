@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultUpstream is the resolver which queries
+	// we do not spoof are forwarded to.
+	DefaultUpstream = "8.8.8.8:53"
+	// DefaultForwardTimeout is how long to wait for the
+	// upstream resolver to reply to a forwarded query.
+	DefaultForwardTimeout = 2 * time.Second
+)
+
+// A Forwarder relays DNS queries we do not spoof to a real resolver,
+// so that the victim's browsing keeps working and our cover is kept.
+// The zero value forwards to DefaultUpstream with DefaultForwardTimeout.
+//
+// The upstream may instead be reached over DNS-over-HTTPS or
+// DNS-over-TLS, out of reach of any resolver on the path which would
+// mangle plain queries. Connections to it are then reused across
+// queries, so a Forwarder must not be copied or changed once in use.
+type Forwarder struct {
+	// Upstream is the host:port of the upstream resolver, spoken to
+	// over UDP; a URL such as "https://dns.google/dns-query" of a
+	// DNS-over-HTTPS resolver (RFC 8484); or a URL such as
+	// "tls://1.1.1.1" of a DNS-over-TLS resolver (RFC 7858), whose
+	// port defaults to 853.
+	Upstream string
+	// Upstreams, if set, are several resolvers, each written as for
+	// Upstream, which is then ignored. They are tried in order until
+	// one replies, so that a dead resolver does not cut the victim off.
+	// Those which fail are demoted behind the rest until they reply
+	// again (see RunHealthChecks).
+	Upstreams []string
+	Timeout   time.Duration // how long to wait for each reply
+	// StripDO clears the DO bit of queries which want DNSSEC before
+	// they are forwarded from RespondToQuery, so the upstream answers
+	// without signatures (see WantsDNSSEC).
+	StripDO bool
+	// TLSConfig, if set, is used for connections to a DNS-over-HTTPS or
+	// DNS-over-TLS Upstream, e.g. to trust its certificate. Otherwise
+	// the system's trusted roots are used.
+	TLSConfig *tls.Config
+	// Fallback is the host:port of the resolver queries are sent to over
+	// UDP if every upstream fails and any of them is encrypted.
+	// If empty, DefaultUpstream is used.
+	Fallback string
+	// Cache, if set, keeps upstream responses, so that repeated queries
+	// are answered from it rather than forwarded again.
+	Cache *DNSCache
+	// HealthCheckName is the name looked up by CheckHealth.
+	// If empty, DefaultHealthCheckName is used.
+	HealthCheckName string
+
+	httpOnce   sync.Once
+	httpClient *http.Client
+	mu         sync.Mutex
+	idle       map[string][]*tls.Conn // DNS-over-TLS connections free for reuse, by upstream
+	unhealthy  map[string]bool
+}
+
+// Forward sends the raw DNS query to the upstream resolver and returns
+// its raw response, or an error if none arrives in time. With several
+// Upstreams, each is tried in turn, healthy ones first, and given
+// Timeout to reply. A query which fails over every upstream, if any are
+// encrypted, is sent to the Fallback resolver over UDP as a last resort.
+//
+// If f has a Cache, queries it has a response for are answered from it,
+// and the upstream's responses are stored in it.
+func (f *Forwarder) Forward(query []byte) ([]byte, error) {
+	if response, ok := f.Cache.Lookup(query); ok {
+		return response, nil
+	}
+	response, err := f.forward(query)
+	if err != nil {
+		return nil, err
+	}
+	f.Cache.Store(response)
+	return response, nil
+}
+
+// forward implements Forward, less the cache.
+func (f *Forwarder) forward(query []byte) ([]byte, error) {
+	var err error
+	encrypted := false
+	for _, upstream := range f.upstreamOrder() {
+		var response []byte
+		response, err = f.forwardTo(upstream, query)
+		f.setHealthy(upstream, err == nil)
+		if err == nil {
+			return response, nil
+		}
+		encrypted = encrypted || isEncrypted(upstream)
+	}
+	if !encrypted {
+		return nil, err
+	}
+	response, fallbackErr := f.forwardUDP(f.Fallback, query)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%v, then falling back to UDP: %w", err, fallbackErr)
+	}
+	return response, nil
+}
+
+// forwardTo sends the raw DNS query to upstream, written as for
+// Forwarder.Upstream, and returns its raw response.
+func (f *Forwarder) forwardTo(upstream string, query []byte) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		return f.forwardHTTPS(upstream, query)
+	case strings.HasPrefix(upstream, "tls://"):
+		return f.forwardTLS(upstream, query)
+	default:
+		return f.forwardUDP(upstream, query)
+	}
+}
+
+// isEncrypted returns whether upstream is reached
+// over DNS-over-HTTPS or DNS-over-TLS.
+func isEncrypted(upstream string) bool {
+	return strings.HasPrefix(upstream, "https://") || strings.HasPrefix(upstream, "tls://")
+}
+
+// upstreams returns f's upstreams in the order they were configured.
+func (f *Forwarder) upstreams() []string {
+	if len(f.Upstreams) > 0 {
+		return f.Upstreams
+	}
+	return []string{f.Upstream}
+}
+
+// upstreamOrder returns f's upstreams in the order to try them:
+// the healthy ones first, then the rest, each in configured order.
+func (f *Forwarder) upstreamOrder() []string {
+	upstreams := f.upstreams()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.unhealthy) == 0 {
+		return upstreams
+	}
+	order := make([]string, 0, len(upstreams))
+	var demoted []string
+	for _, u := range upstreams {
+		if f.unhealthy[u] {
+			demoted = append(demoted, u)
+		} else {
+			order = append(order, u)
+		}
+	}
+	return append(order, demoted...)
+}
+
+// setHealthy records whether upstream last replied.
+func (f *Forwarder) setHealthy(upstream string, healthy bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if healthy {
+		delete(f.unhealthy, upstream)
+		return
+	}
+	if f.unhealthy == nil {
+		f.unhealthy = make(map[string]bool)
+	}
+	f.unhealthy[upstream] = true
+}
+
+// timeout returns how long to wait for each reply.
+func (f *Forwarder) timeout() time.Duration {
+	if f.Timeout == 0 {
+		return DefaultForwardTimeout
+	}
+	return f.Timeout
+}
+
+// forwardUDP sends the raw DNS query to the resolver at upstream (or
+// DefaultUpstream if it is empty) over UDP and returns its raw response.
+func (f *Forwarder) forwardUDP(upstream string, query []byte) ([]byte, error) {
+	if upstream == "" {
+		upstream = DefaultUpstream
+	}
+	timeout := f.timeout()
+
+	conn, err := net.DialTimeout("udp", upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// RespondToQuery returns the raw response to send for the raw DNS query.
+//
+// If any of its questions can be answered from table, the response is
+// forged from it (see SpoofTable.SpoofedResponse). Otherwise the query
+// is relayed to the upstream resolver by fwd and its response returned,
+// less any records which conflict with table (see
+// SpoofTable.ScrubResponse), or a SERVFAIL response if the upstream did
+// not reply. Responses to queries which want DNSSEC are not scrubbed,
+// unless fwd.StripDO is set, as that would break their signatures.
+// A query which cannot be decoded is answered with FORMERR
+// (see FormErrResponse), as is one asking about a name which could not
+// be echoed back intact, such as one with a dot inside a label. An error
+// is only returned if query is too short to answer even that way (or,
+// with fwd.StripDO, cannot be re-encoded).
+func RespondToQuery(query []byte, table *SpoofTable, fwd *Forwarder) ([]byte, error) {
+	response, _, err := respondToQuery(query, table.SpoofedResponse, table, fwd, false)
+	return response, err
+}
+
+// RespondToUDPQuery is like RespondToQuery, but for a query which
+// arrived over UDP, so spoofed answers may be truncated to force the
+// client over to TCP (see SpoofTable.SpoofedUDPResponse), as are those
+// too big for a UDP message (see TruncateForUDP).
+func RespondToUDPQuery(query []byte, table *SpoofTable, fwd *Forwarder) ([]byte, error) {
+	response, _, err := respondToQuery(query, table.SpoofedUDPResponse, table, fwd, true)
+	return response, err
+}
+
+// neverSpoof is a spoof function for respondToQuery
+// which forwards every query.
+func neverSpoof(*layers.DNS, uint32) (*layers.DNS, bool) {
+	return nil, false
+}
+
+// respondToQuery implements RespondToQuery and RespondToUDPQuery,
+// spoofing responses with spoof and fitting them to UDP if udp is set.
+// Forwarded responses are scrubbed of records conflicting with scrub,
+// unless it is nil. It also returns what was done with the query, for logging.
+//
+// If spoof returns a nil response and true, the query is dropped:
+// no response is returned, and neither is an error.
+func respondToQuery(query []byte, spoof func(*layers.DNS, uint32) (*layers.DNS, bool), scrub *SpoofTable, fwd *Forwarder, udp bool) ([]byte, SpoofDecision, error) {
+	pkt := gopacket.NewPacket(query, layers.LayerTypeDNS, gopacket.Default)
+	dnsLayer := pkt.Layer(layers.LayerTypeDNS)
+	if dnsLayer == nil || !encodableQuestions(dnsLayer.(*layers.DNS).Questions) {
+		formErr, ok := FormErrResponse(query)
+		if !ok {
+			return nil, SpoofDecision{}, fmt.Errorf("could not decode DNS query: %v", pkt.ErrorLayer().Error())
+		}
+		response, err := SerializeDNS(formErr)
+		return response, SpoofDecision{Action: ActionIgnore}, err
+	}
+	dns := dnsLayer.(*layers.DNS)
+	decision := SpoofDecision{Query: dns, Action: ActionSpoof}
+
+	if spoofed, ok := spoof(dns, DefaultTTL); ok {
+		if spoofed == nil {
+			decision.Action = ActionDrop
+			return nil, decision, nil
+		}
+		if udp {
+			var err error
+			if spoofed, err = TruncateForUDP(dns, spoofed); err != nil {
+				return nil, decision, err
+			}
+		}
+		decision.Response = spoofed
+		response, err := SerializeDNS(spoofed)
+		return response, decision, err
+	}
+
+	decision.Action = ActionForward
+	// A validating client would reject a scrubbed response, whose
+	// signatures no longer cover what it holds, so responses to queries
+	// which want DNSSEC are passed on as they are unless DO is stripped.
+	validating := WantsDNSSEC(dns) && !fwd.StripDO
+	if fwd.StripDO && WantsDNSSEC(dns) {
+		clearDNSSEC(dns)
+		stripped, err := SerializeDNS(dns)
+		if err != nil {
+			return nil, decision, err
+		}
+		query = stripped
+	}
+
+	response, err := fwd.Forward(query)
+	if err != nil {
+		decision.upstreamErr = err
+		response, err = SerializeDNS(ServFailResponse(dns))
+		return response, decision, err
+	}
+	if scrub != nil && !validating {
+		response = scrub.ScrubResponse(response)
+	}
+	return response, decision, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fakeUpstream starts a UDP resolver on an ephemeral port which
+// passes every query it receives to reply, sending back whatever
+// reply returns (or nothing, if it returns nil). Every query is also
+// delivered on the returned channel.
+func fakeUpstream(t *testing.T, reply func(query []byte) []byte) (string, <-chan []byte) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start fake upstream: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	queries := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			queries <- query
+			if response := reply(query); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+func serializeQuery(t *testing.T, domains ...string) []byte {
+	t.Helper()
+	query := dnsWithDomainQuestions(domains)
+	query.ID = 0x388
+	b, err := SerializeDNS(query)
+	if err != nil {
+		t.Fatalf("failed to serialize query: %v", err)
+	}
+	return b
+}
+
+func decodeDNS(t *testing.T, b []byte) *layers.DNS {
+	t.Helper()
+	pkt := gopacket.NewPacket(b, layers.LayerTypeDNS, gopacket.Default)
+	dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok {
+		t.Fatalf("response did not decode as DNS: %v", pkt.ErrorLayer())
+	}
+	return dns
+}
+
+func TestRespondToQueryForwardsNonMatching(t *testing.T) {
+	upstreamResponse := []byte("real upstream response")
+	addr, queries := fakeUpstream(t, func([]byte) []byte { return upstreamResponse })
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	query := serializeQuery(t, "umich.edu")
+	response, err := RespondToQuery(query, &table, &Forwarder{Upstream: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case received := <-queries:
+		if !bytes.Equal(received, query) {
+			t.Errorf("upstream expected query %x but got %x", query, received)
+		}
+	default:
+		t.Errorf("query was not forwarded to the upstream")
+	}
+	if !bytes.Equal(response, upstreamResponse) {
+		t.Errorf("expected upstream response %q to be returned verbatim, got %q", upstreamResponse, response)
+	}
+}
+
+func TestRespondToQuerySpoofsMatching(t *testing.T) {
+	addr, queries := fakeUpstream(t, func([]byte) []byte { return []byte("real upstream response") })
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	response, err := RespondToQuery(serializeQuery(t, "eecs388.org"), &table, &Forwarder{Upstream: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dns := decodeDNS(t, response)
+	if dns.ID != 0x388 {
+		t.Errorf("expected transaction ID %#x, got %#x", 0x388, dns.ID)
+	}
+	if len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected a single forged answer for 3.23.25.235, got %v", dns.Answers)
+	}
+	select {
+	case <-queries:
+		t.Errorf("spoofed query should not have been forwarded to the upstream")
+	default:
+	}
+}
+
+func TestRespondToUDPQueryTruncatesLargeAnswers(t *testing.T) {
+	var entry SpoofEntry
+	for i := 0; i < 40; i++ {
+		entry.IPs = append(entry.IPs, net.IPv4(10, 38, 8, byte(i)))
+	}
+	var table SpoofTable
+	table.AddEntry("eecs388.org", entry)
+	fwd := &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond}
+
+	response, err := RespondToUDPQuery(serializeQuery(t, "eecs388.org"), &table, fwd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(response) > 512 {
+		t.Errorf("expected UDP response to fit in 512 bytes but it is %d", len(response))
+	}
+	if dns := decodeDNS(t, response); !dns.TC {
+		t.Errorf("expected UDP response to have the TC bit set")
+	}
+
+	response, err = RespondToQuery(serializeQuery(t, "eecs388.org"), &table, fwd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dns := decodeDNS(t, response); dns.TC || len(dns.Answers) != 40 {
+		t.Errorf("expected all 40 answers without the TC bit, got %d answers with TC %v", len(dns.Answers), dns.TC)
+	}
+}
+
+func TestRespondToQueryUpstreamTimeout(t *testing.T) {
+	addr, _ := fakeUpstream(t, func([]byte) []byte { return nil })
+
+	var table SpoofTable
+	response, err := RespondToQuery(serializeQuery(t, "umich.edu"), &table, &Forwarder{Upstream: addr, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dns := decodeDNS(t, response)
+	if dns.ResponseCode != layers.DNSResponseCodeServFail {
+		t.Errorf("expected response code %s on upstream timeout, got %s", layers.DNSResponseCodeServFail, dns.ResponseCode)
+	}
+	if dns.ID != 0x388 {
+		t.Errorf("expected transaction ID %#x, got %#x", 0x388, dns.ID)
+	}
+	if !dns.QR {
+		t.Errorf("expected QR to be set on the SERVFAIL response")
+	}
+}
+
+func TestRespondToQueryDNSSEC(t *testing.T) {
+	upstreamResponse := []byte("real upstream response")
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	for _, v := range []struct {
+		name      string
+		do        bool
+		stripDO   bool
+		forwarded bool
+	}{
+		{"DO unset", false, false, false},
+		{"DO set", true, false, true},
+		{"DO set and stripped", true, true, true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			addr, queries := fakeUpstream(t, func([]byte) []byte { return upstreamResponse })
+
+			query, err := SerializeDNS(withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, v.do))
+			if err != nil {
+				t.Fatalf("failed to serialize query: %v", err)
+			}
+			response, err := RespondToQuery(query, &table, &Forwarder{Upstream: addr, Timeout: time.Second, StripDO: v.stripDO})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !v.forwarded {
+				if dns := decodeDNS(t, response); len(dns.Answers) != 1 {
+					t.Errorf("expected a single forged answer, got %v", dns.Answers)
+				}
+				return
+			}
+			if !bytes.Equal(response, upstreamResponse) {
+				t.Errorf("expected upstream response %q, got %q", upstreamResponse, response)
+			}
+			var received []byte
+			select {
+			case received = <-queries:
+			default:
+				t.Fatalf("query was not forwarded to the upstream")
+			}
+			if v.stripDO {
+				if WantsDNSSEC(decodeDNS(t, received)) {
+					t.Errorf("expected forwarded query to have the DO bit cleared")
+				}
+			} else if !bytes.Equal(received, query) {
+				t.Errorf("upstream expected query %x untouched but got %x", query, received)
+			}
+		})
+	}
+}
+
+func TestRespondToQueryScrubsConflictingRecords(t *testing.T) {
+	addr, _ := fakeUpstream(t, func(query []byte) []byte {
+		dns := decodeDNS(t, query)
+		answer, err := AnswerForQuestion(dns.Questions[0], net.ParseIP("141.211.243.44"))
+		if err != nil {
+			t.Errorf("failed to build answer: %v", err)
+			return nil
+		}
+		response := BuildResponse(dns, []layers.DNSResourceRecord{answer})
+		response.Authorities = []layers.DNSResourceRecord{{
+			Name: []byte("umich.edu"), Type: layers.DNSTypeNS, Class: layers.DNSClassIN,
+			TTL: DefaultTTL, NS: []byte("ns.eecs388.org"),
+		}, rrsigFor("umich.edu", layers.DNSTypeNS)}
+		// The poisoning record: the real address of a spoofed name,
+		// for the client to cache over our answer.
+		response.Additionals = []layers.DNSResourceRecord{{
+			Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN,
+			TTL: DefaultTTL, IP: net.ParseIP("10.38.8.4"),
+		}, rrsigFor("eecs388.org", layers.DNSTypeA)}
+		response.NSCount, response.ARCount = 1, 2
+		b, err := SerializeDNS(response)
+		if err != nil {
+			t.Errorf("failed to serialize response: %v", err)
+			return nil
+		}
+		return b
+	})
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	response, err := RespondToQuery(serializeQuery(t, "umich.edu"), &table, &Forwarder{Upstream: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dns := decodeDNS(t, response)
+	if len(dns.Additionals) != 0 || dns.ARCount != 0 {
+		t.Errorf("expected the additional record for eecs388.org and its RRSIG to be removed but got %d: %v", dns.ARCount, dns.Additionals)
+	}
+	if len(dns.Answers) != 1 || dns.ANCount != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("141.211.243.44")) {
+		t.Errorf("expected the upstream's answer to be kept but got %d: %v", dns.ANCount, dns.Answers)
+	}
+	if len(dns.Authorities) != 2 || dns.NSCount != 2 {
+		t.Errorf("expected the upstream's authority record and its RRSIG to be kept but got %d: %v", dns.NSCount, dns.Authorities)
+	}
+}
+
+func TestRespondToQueryDNSSECNotScrubbed(t *testing.T) {
+	query, err := SerializeDNS(withEDNS(dnsWithDomainQuestions([]string{"eecs388.org"}), 4096, true))
+	if err != nil {
+		t.Fatalf("failed to serialize query: %v", err)
+	}
+	upstreamResponse, err := SerializeDNS(BuildResponse(decodeDNS(t, query), []layers.DNSResourceRecord{{
+		Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN,
+		TTL: DefaultTTL, IP: net.ParseIP("10.38.8.4"),
+	}, rrsigFor("eecs388.org", layers.DNSTypeA)}))
+	if err != nil {
+		t.Fatalf("failed to serialize response: %v", err)
+	}
+	addr, _ := fakeUpstream(t, func([]byte) []byte { return upstreamResponse })
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	response, err := RespondToQuery(query, &table, &Forwarder{Upstream: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(response, upstreamResponse) {
+		t.Errorf("expected upstream response %x unchanged, got %x", upstreamResponse, response)
+	}
+}
+
+// rrsigFor returns an RRSIG record covering the RRset of name and
+// rtype. Only its type covered is meaningful.
+func rrsigFor(name string, rtype layers.DNSType) layers.DNSResourceRecord {
+	data := make([]byte, 18, 18+len(name)+2)
+	binary.BigEndian.PutUint16(data, uint16(rtype))
+	data, _ = appendName(data, name)
+	return layers.DNSResourceRecord{
+		Name: []byte(name), Type: dnsTypeRRSIG, Class: layers.DNSClassIN,
+		TTL: DefaultTTL, Data: append(data, 0x38, 0x8),
+	}
+}
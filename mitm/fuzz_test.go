@@ -0,0 +1,84 @@
+//go:build go1.18
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FuzzRespondToQuery feeds arbitrary bytes through the path a query
+// takes through the server: decoding, deciding whether to spoof,
+// building the response and serializing it. Nothing may panic, and
+// every response produced must decode as a DNS response again.
+//
+// Queries which are not spoofed are forwarded to a closed port, so they
+// are answered with SERVFAIL (see ServFailResponse) without waiting.
+func FuzzRespondToQuery(f *testing.F) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.AddEntry("*.bank.com", SpoofEntry{
+		IPs:   []net.IP{net.ParseIP("10.38.8.4"), net.ParseIP("2001:db8::388")},
+		HTTPS: HTTPSRecord,
+	})
+	table.Deny("umich.edu")
+	table.AddPTR(net.ParseIP("3.23.25.235"), "eecs388.org")
+	fwd := &Forwarder{Upstream: "127.0.0.1:1", Timeout: 10 * time.Millisecond}
+
+	for _, domains := range [][]string{
+		{"eecs388.org"},
+		{"www.bank.com", "wrong.com"},
+		{"umich.edu"},
+		{"235.25.23.3.in-addr.arpa"},
+		{},
+	} {
+		query := dnsWithDomainQuestions(domains)
+		query.ID = 0x388
+		b, err := SerializeDNS(query)
+		if err != nil {
+			f.Fatalf("failed to serialize seed query for %v: %v", domains, err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0x03, 0x88})
+	// A header claiming far more questions than the packet holds.
+	f.Add([]byte{0x03, 0x88, 0x01, 0x00, 0xff, 0xff, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, query []byte) {
+		pkt := gopacket.NewPacket(query, layers.LayerTypeDNS, gopacket.Default)
+		dns, _ := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		HasQuestionForDomain(dns, "eecs388.org")
+		QueriedDomains(dns)
+		for _, built := range []*layers.DNS{
+			BuildSpoofedResponse(dns, "eecs388.org", net.ParseIP("3.23.25.235")),
+			BuildSpoofedResponseMulti(dns, "*.bank.com", []net.IP{net.ParseIP("10.38.8.4")}, DefaultTTL, nil),
+		} {
+			if built != nil {
+				SerializeDNS(built)
+			}
+		}
+		if selective, ok := BuildSelectiveResponse(dns, "eecs388.org", net.ParseIP("3.23.25.235")); ok {
+			SerializeDNS(selective)
+		}
+
+		response, _, err := respondToQuery(query, table.SpoofedUDPResponse, &table, fwd, true)
+		if err != nil || response == nil {
+			return
+		}
+		decoded, ok := gopacket.NewPacket(response, layers.LayerTypeDNS, gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok {
+			t.Fatalf("response %x to query %x does not decode as DNS", response, query)
+		}
+		if !decoded.QR {
+			t.Errorf("response %x to query %x is not marked as a response", response, query)
+		}
+		if len(query) >= 2 && decoded.ID != uint16(query[0])<<8|uint16(query[1]) {
+			t.Errorf("response to query %x has ID %#x", query, decoded.ID)
+		}
+	})
+}
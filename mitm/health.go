@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DefaultHealthCheckName is the name health checks look up,
+// unless the Forwarder has a HealthCheckName.
+const DefaultHealthCheckName = "example.com"
+
+// RunHealthChecks checks the health of f's upstreams as by CheckHealth
+// straight away, then every interval until ctx is done, so that a dead
+// upstream is demoted before queries have to wait on it, and one which
+// recovers is promoted again.
+func (f *Forwarder) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f.CheckHealth()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHealth looks up HealthCheckName on each of f's upstreams at once,
+// demoting those which do not reply within Timeout behind those which
+// do (see Forwarder.Upstreams). Any reply counts, whatever its RCODE,
+// since it shows the upstream is there to answer.
+func (f *Forwarder) CheckHealth() {
+	name := f.HealthCheckName
+	if name == "" {
+		name = DefaultHealthCheckName
+	}
+	var wg sync.WaitGroup
+	for _, upstream := range f.upstreams() {
+		upstream := upstream
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.setHealthy(upstream, f.probe(upstream, name))
+		}()
+	}
+	wg.Wait()
+}
+
+// probe reports whether upstream replies to a query for name.
+func (f *Forwarder) probe(upstream, name string) bool {
+	query := &layers.DNS{
+		ID:      uint16(rand.Intn(1 << 16)),
+		RD:      true,
+		OpCode:  layers.DNSOpCodeQuery,
+		QDCount: 1,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}
+	b, err := SerializeDNS(query)
+	if err != nil {
+		return false
+	}
+	response, err := f.forwardTo(upstream, b)
+	if err != nil {
+		return false
+	}
+	pkt := gopacket.NewPacket(response, layers.LayerTypeDNS, gopacket.Default)
+	dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	return ok && IsResponse(dns) && dns.ID == query.ID
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyUpstream starts a fake upstream, as by fakeUpstream,
+// which only answers while alive is set.
+func flakyUpstream(t *testing.T, alive *int32) (string, <-chan []byte) {
+	t.Helper()
+	answer := answerWith(t, net.ParseIP("10.38.8.4"))
+	return fakeUpstream(t, func(query []byte) []byte {
+		if atomic.LoadInt32(alive) == 0 {
+			return nil
+		}
+		return answer(query)
+	})
+}
+
+func TestForwarderFailover(t *testing.T) {
+	dead, deadQueries := fakeUpstream(t, func([]byte) []byte { return nil })
+	live, _ := fakeUpstream(t, answerWith(t, net.ParseIP("3.23.25.235")))
+	fwd := &Forwarder{Upstreams: []string{dead, live}, Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	response, err := fwd.Forward(serializeQuery(t, "eecs388.org"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the second upstream to answer within 500ms but took %v", elapsed)
+	}
+	checkForwarded(t, response, "3.23.25.235")
+	<-deadQueries
+
+	// The dead upstream is now demoted, so concurrent
+	// queries go straight to the live one.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			response, err := fwd.Forward(serializeQuery(t, "eecs388.org"))
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if elapsed := time.Since(start); elapsed >= fwd.Timeout {
+				t.Errorf("expected the demoted upstream to be skipped but the query took %v", elapsed)
+			}
+			checkForwarded(t, response, "3.23.25.235")
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-deadQueries:
+		t.Error("expected no more queries to reach the demoted upstream")
+	default:
+	}
+}
+
+func TestForwarderAllUpstreamsFail(t *testing.T) {
+	dead, _ := fakeUpstream(t, func([]byte) []byte { return nil })
+	fwd := &Forwarder{Upstreams: []string{dead, "127.0.0.1:1"}, Timeout: 100 * time.Millisecond}
+	if _, err := fwd.Forward(serializeQuery(t, "eecs388.org")); err == nil {
+		t.Error("expected an error when every upstream fails")
+	}
+}
+
+func TestForwarderCheckHealth(t *testing.T) {
+	var alive int32
+	first, _ := flakyUpstream(t, &alive)
+	second, _ := fakeUpstream(t, answerWith(t, net.ParseIP("3.23.25.235")))
+	fwd := &Forwarder{Upstreams: []string{first, second}, Timeout: 100 * time.Millisecond}
+
+	fwd.CheckHealth()
+	if order := fwd.upstreamOrder(); order[0] != second {
+		t.Errorf("expected the unresponsive upstream to be demoted but got order %q", order)
+	}
+	response, err := fwd.Forward(serializeQuery(t, "eecs388.org"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkForwarded(t, response, "3.23.25.235")
+
+	atomic.StoreInt32(&alive, 1)
+	fwd.CheckHealth()
+	if order := fwd.upstreamOrder(); order[0] != first {
+		t.Errorf("expected the recovered upstream to be promoted but got order %q", order)
+	}
+	response, err = fwd.Forward(serializeQuery(t, "eecs388.org"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkForwarded(t, response, "10.38.8.4")
+}
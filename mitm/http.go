@@ -1,15 +1,212 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// upstreamClient is used for every request relayed to the real server,
+// unless the Proxy has its own TLS configuration.
+// Redirects are handed back to the client untouched rather than followed,
+// so the client sees exactly what the server sent.
+var upstreamClient = newUpstreamClient(http.DefaultTransport)
+
+// newUpstreamClient returns a client like upstreamClient
+// which makes its requests using transport.
+func newUpstreamClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// A Proxy relays requests to the real HTTP server at Upstream,
+// intercepting them along the way. It is an http.Handler, so one
+// configured Proxy can be dropped into an http.Server and shared
+// across requests.
+type Proxy struct {
+	// Upstream is the base URL of the real server, e.g. "http://10.38.8.3"
+	// or, for a server which speaks TLS, "https://10.38.8.3".
+	Upstream string
+	// Router, if set, picks the real server for each request by its
+	// Host header instead, falling back to Upstream for unknown hosts.
+	Router *HostRouter
+	// SpoofTo, if set, is what the `to` field of form-encoded
+	// POST requests is changed to (see InterceptAndRelayRequest).
+	SpoofTo string
+	// Timeout, if positive, bounds how long a request may wait on the
+	// upstream server, on top of any deadline the request's context has.
+	Timeout time.Duration
+	// Logger, if set, is told about every request relayed.
+	Logger Logger
+	// Recorder, if set, is given every request intercepted and the
+	// upstream server's response. Requests passed through untouched
+	// are streamed rather than buffered, so are not recorded.
+	Recorder Recorder
+	// TLSConfig, if set, is used for TLS connections to an https
+	// Upstream, e.g. to trust its certificate. Otherwise the system's
+	// trusted roots are used. It must not be changed once p is in use.
+	TLSConfig *tls.Config
+	// PathRewrite, if set, rewrites the path of every request
+	// relayed to the upstream server.
+	PathRewrite *PathRewrite
+	// RequestHeaders overrides headers of every request relayed to the
+	// upstream server, e.g. to force a User-Agent or drop Authorization,
+	// just as ResponseHeaders does for responses.
+	RequestHeaders map[string][]string
+	// ResponseHeaders overrides headers of every response relayed back
+	// to the client, e.g. to inject a Content-Security-Policy or strip
+	// Strict-Transport-Security. A header with a nil (or empty) value is
+	// deleted; any other value replaces whatever the server sent.
+	ResponseHeaders map[string][]string
+	// RewriteCookie, if set, is applied to every cookie set by responses
+	// relayed back to the client, as by RewriteCookies, before
+	// ResponseHeaders.
+	RewriteCookie func(*http.Cookie) bool
+	// RateLimit, if set, limits how many requests each client may make,
+	// by the IP address of r.RemoteAddr; those over it are sent a
+	// 429 Too Many Requests without reaching the upstream server.
+	// Its Forward field is not used.
+	RateLimit *RateLimiter
+	// MaxBodyBytes, if positive, is the longest request body the
+	// interceptors will buffer to rewrite; longer ones are refused with
+	// a 413 Payload Too Large without reaching the upstream server.
+	MaxBodyBytes int64
+
+	clientOnce sync.Once
+	client     *http.Client
+}
+
+// ServeHTTP relays r to the upstream server. Form-encoded and
+// multipart/form-data POST requests are intercepted as by
+// InterceptAndRelayRequest if SpoofTo is set, and WebSocket handshakes
+// are relayed as by RelayWebSocket; everything else is passed through
+// untouched. Clients over p's RateLimit are turned away instead.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !p.RateLimit.Allow(requestIP(r)) {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	if isWebSocketUpgrade(r) {
+		if err := p.RelayWebSocket(w, r); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); p.SpoofTo != "" && r.Method == http.MethodPost &&
+		contentType != "" && (isForm(contentType) || isMultipartForm(contentType)) {
+		p.InterceptAndRelayRequest(w, r, p.SpoofTo)
+		return
+	}
+	if err := p.PassthroughRequest(w, r); err != nil {
+		log.Print(err)
+	}
+}
+
 // PassthroughRequest should take the incoming request r
 // and send it to the HTTP server located at endpoint,
 // then mirror the response back to w.
-// It should make no changes to the incoming request.
-func PassthroughRequest(w http.ResponseWriter, r *http.Request, endpoint string) {
-	panic("PassthroughRequest unimplemented!")
+// It makes no changes to the incoming request beyond adding the client's
+// address to X-Forwarded-For and the proxy to Via, as proxies do.
+//
+// If the server cannot be reached, the client is sent a 502 Bad Gateway
+// (or a 504 Gateway Timeout if r's context expired first)
+// and the error is returned.
+func PassthroughRequest(w http.ResponseWriter, r *http.Request, endpoint string) error {
+	return (&Proxy{Upstream: endpoint}).PassthroughRequest(w, r)
+}
+
+// PassthroughRequest sends the incoming request r to the upstream
+// server unchanged, then mirrors the response back to w. Its status
+// code is relayed exactly, redirects included, since those are left
+// for the client to follow.
+//
+// A chunked request body is streamed through still chunked, along
+// with any trailers the client declared, rather than being buffered
+// and sent with a fixed Content-Length. The response body is always
+// streamed back as it arrives (see streamResponse), so downloads of
+// any size pass through without being held in memory.
+//
+// If the server cannot be reached, the client is sent a 502 Bad Gateway
+// (or a 504 Gateway Timeout if r's context expired first), or if r's
+// body cannot be read, a 400 Bad Request; either way the error is
+// returned, as is any error copying the response body.
+func (p *Proxy) PassthroughRequest(w http.ResponseWriter, r *http.Request) error {
+	var entry RequestLogEntry
+	defer p.logRequest(r, time.Now(), &entry)
+	r, cancel := p.withTimeout(r)
+	defer cancel()
+
+	body := &countingReader{r: r.Body}
+	// The transport may still be sending a chunked body after Do returns,
+	// so it is only counted once the response has been relayed.
+	defer func() { entry.BytesIn = body.count() }()
+	var req *http.Request
+	var err error
+	if isChunked(r) {
+		if req, err = p.newUpstreamRequest(r, body); err == nil {
+			req.TransferEncoding = []string{"chunked"}
+			// The server fills in r.Trailer's values once the body has been
+			// read to the end, which is exactly when the transport sends them.
+			req.Trailer = r.Trailer
+		}
+	} else {
+		var b []byte
+		if b, err = io.ReadAll(body); err != nil {
+			entry.Status, entry.Err = http.StatusBadRequest, fmt.Errorf("reading request body: %w", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return entry.Err
+		}
+		req, err = p.newUpstreamRequest(r, bytes.NewReader(b))
+	}
+	if err != nil {
+		entry.Err = relayError(w, err)
+		return entry.Err
+	}
+
+	resp, err := p.upstreamClient().Do(req)
+	if err != nil {
+		entry.Err = relayError(w, err)
+		return entry.Err
+	}
+	defer resp.Body.Close()
+
+	entry.Status = resp.StatusCode
+	p.rewriteResponseHeaders(r, resp.Header)
+	n, err := streamResponse(w, resp)
+	entry.BytesOut = int(n)
+	if err != nil {
+		entry.Err = fmt.Errorf("streaming response: %w", err)
+		return entry.Err
+	}
+	return nil
+}
+
+// isChunked returns whether the body of r was sent with chunked encoding.
+func isChunked(r *http.Request) bool {
+	for _, te := range r.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+	return false
 }
 
 // InterceptAndRelayRequest should take the incoming request r,
@@ -23,5 +220,472 @@ func PassthroughRequest(w http.ResponseWriter, r *http.Request, endpoint string)
 // (and should thus only call this function
 // with requests that fit these requirements).
 func InterceptAndRelayRequest(w http.ResponseWriter, r *http.Request, endpoint, spoofed string) {
-	panic("InterceptAndRelayRequest unimplemented!")
+	(&Proxy{Upstream: endpoint}).InterceptAndRelayRequest(w, r, spoofed)
+}
+
+// InterceptAndRelayRequest changes the `to` parameter in the
+// form-encoded body of r to spoofed, relays it to the upstream server,
+// and feeds the response back to the client with any occurrences of
+// spoofed replaced by the original value.
+func (p *Proxy) InterceptAndRelayRequest(w http.ResponseWriter, r *http.Request, spoofed string) {
+	p.InterceptAndRelayRequestRules(w, r, map[string]string{"to": spoofed})
+}
+
+// InterceptAndRelayRequestRules is like InterceptAndRelayRequest,
+// but rewrites several form fields in one pass: each key of rules which
+// is present in the body of r has its value replaced by the rule's value.
+// Keys not mentioned in rules are left as they are.
+func InterceptAndRelayRequestRules(w http.ResponseWriter, r *http.Request, endpoint string, rules map[string]string) {
+	(&Proxy{Upstream: endpoint}).InterceptAndRelayRequestRules(w, r, rules)
+}
+
+// InterceptAndRelayRequestRules replaces the value of each key of rules
+// present in the body of r with the rule's value, relays it to the
+// upstream server, and feeds the response back to the client with
+// every replaced value changed back to the original.
+//
+// Bodies are form-encoded unless r has a JSON Content-Type, in which
+// case keys are dot-separated paths into the JSON object (see rewriteJSON),
+// or a multipart/form-data one, in which case keys name text fields and
+// file parts are relayed untouched (see rewriteMultipart). Bodies of any
+// other Content-Type are relayed byte-for-byte. A form body which does
+// not parse is answered with 400 Bad Request rather than relayed.
+func (p *Proxy) InterceptAndRelayRequestRules(w http.ResponseWriter, r *http.Request, rules map[string]string) {
+	var entry RequestLogEntry
+	defer p.logRequest(r, time.Now(), &entry)
+	r, cancel := p.withTimeout(r)
+	defer cancel()
+
+	body, ok := p.readBody(w, r, &entry)
+	if !ok {
+		if entry.Err != nil {
+			log.Print(entry.Err)
+		}
+		return
+	}
+	entry.BytesIn = int64(len(body))
+
+	var restore []replacement
+	switch contentType := r.Header.Get("Content-Type"); {
+	case isJSON(contentType):
+		body, restore = rewriteJSON(body, rules)
+	case isMultipartForm(contentType):
+		var rewritten string
+		if body, rewritten, restore = rewriteMultipart(body, contentType, rules); rewritten != contentType {
+			// The body has a new boundary, which upstream must be told.
+			r = r.Clone(r.Context())
+			r.Header.Set("Content-Type", rewritten)
+		}
+	case isForm(contentType):
+		var err error
+		if body, restore, err = rewriteForm(body, rules); err != nil {
+			entry.Status, entry.Err = http.StatusBadRequest, err
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	}
+	entry.Modified = len(restore) > 0
+
+	resp, respBody, err := p.sendUpstream(r, body)
+	if err != nil {
+		entry.Err = relayError(w, err)
+		log.Print(entry.Err)
+		return
+	}
+	for _, rep := range restore {
+		respBody = bytes.ReplaceAll(respBody, []byte(rep.spoofed), []byte(rep.original))
+	}
+	entry.Status, entry.BytesOut = resp.StatusCode, len(respBody)
+	p.rewriteResponseHeaders(r, resp.Header)
+	writeResponse(w, resp, respBody)
+}
+
+// readBody reads the whole body of r to be rewritten. If it is longer
+// than p's MaxBodyBytes, as told by its Content-Length or found by
+// reading one more byte, the client is sent a 413 Payload Too Large
+// instead; if it cannot be read, e.g. because the client hung up
+// partway through, a 400 Bad Request. Either way, false is returned
+// and entry records why.
+func (p *Proxy) readBody(w http.ResponseWriter, r *http.Request, entry *RequestLogEntry) ([]byte, bool) {
+	reject := func(status int) ([]byte, bool) {
+		entry.Status = status
+		http.Error(w, http.StatusText(status), status)
+		return nil, false
+	}
+	if p.MaxBodyBytes <= 0 {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			entry.Err = fmt.Errorf("reading request body: %w", err)
+			return reject(http.StatusBadRequest)
+		}
+		return body, true
+	}
+	if r.ContentLength > p.MaxBodyBytes {
+		return reject(http.StatusRequestEntityTooLarge)
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, p.MaxBodyBytes+1))
+	if err != nil {
+		entry.Err = fmt.Errorf("reading request body: %w", err)
+		return reject(http.StatusBadRequest)
+	}
+	if int64(len(body)) > p.MaxBodyBytes {
+		return reject(http.StatusRequestEntityTooLarge)
+	}
+	return body, true
+}
+
+// InterceptAndRelayResponse relays the incoming request r unchanged to the
+// HTTP server located at endpoint, then feeds the response back to the
+// client with every occurrence of find in the body replaced by replace.
+func InterceptAndRelayResponse(w http.ResponseWriter, r *http.Request, endpoint, find, replace string) {
+	(&Proxy{Upstream: endpoint}).InterceptAndRelayResponse(w, r, find, replace)
+}
+
+// InterceptAndRelayResponse relays the incoming request r unchanged to
+// the upstream server, then feeds the response back to the client with
+// every occurrence of find in the body replaced by replace.
+//
+// The whole response body is buffered before substituting, so a match
+// is found even if the server streamed it across several chunks.
+// A gzip or deflate Content-Encoding is undone first so the substitution
+// sees plain text, and the body is relayed without it. Bodies in an
+// encoding we cannot undo are relayed untouched rather than corrupted.
+func (p *Proxy) InterceptAndRelayResponse(w http.ResponseWriter, r *http.Request, find, replace string) {
+	var entry RequestLogEntry
+	defer p.logRequest(r, time.Now(), &entry)
+	r, cancel := p.withTimeout(r)
+	defer cancel()
+
+	body, ok := p.readBody(w, r, &entry)
+	if !ok {
+		if entry.Err != nil {
+			log.Print(entry.Err)
+		}
+		return
+	}
+	entry.BytesIn = int64(len(body))
+
+	resp, respBody, err := p.sendUpstream(r, body)
+	if err != nil {
+		entry.Err = relayError(w, err)
+		log.Print(entry.Err)
+		return
+	}
+	if find != "" {
+		if decoded, err := decodeContent(resp.Header, respBody); err == nil {
+			resp.Header.Del("Content-Encoding")
+			entry.Modified = bytes.Contains(decoded, []byte(find))
+			respBody = bytes.ReplaceAll(decoded, []byte(find), []byte(replace))
+		}
+	}
+	entry.Status, entry.BytesOut = resp.StatusCode, len(respBody)
+	p.rewriteResponseHeaders(r, resp.Header)
+	writeResponse(w, resp, respBody)
+}
+
+// decodeContent undoes every coding listed in the Content-Encoding
+// of header, in reverse of the order they were applied.
+func decodeContent(header http.Header, body []byte) ([]byte, error) {
+	var codings []string
+	for _, v := range header.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	if len(body) == 0 {
+		return body, nil
+	}
+
+	for i := len(codings) - 1; i >= 0; i-- {
+		var rc io.ReadCloser
+		var err error
+		switch codings[i] {
+		case "gzip", "x-gzip":
+			rc, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// "deflate" is meant to be zlib-wrapped, but
+			// some servers send a raw deflate stream instead.
+			rc, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				rc, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding %q", codings[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// sendUpstream sends a copy of r with the given body to the upstream
+// server, preserving its method, URI and headers. The body is sent with
+// its exact Content-Length, so an empty one is sent as no body at all
+// rather than chunked or of unknown length.
+// It returns the server's response along with its fully-read body,
+// after passing them to p's Recorder, if any.
+func (p *Proxy) sendUpstream(r *http.Request, body []byte) (*http.Response, []byte, error) {
+	req, err := p.newUpstreamRequest(r, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, respBody, err := p.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.record(req, body, resp, respBody)
+	return resp, respBody, nil
+}
+
+// withTimeout returns r with its context bounded by p.Timeout, along
+// with a function to release the context once r has been handled.
+func (p *Proxy) withTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), p.Timeout)
+	return r.WithContext(ctx), cancel
+}
+
+// proxyURL returns the base URL the client sent r to,
+// such as "https://bank.com", as seen from the client.
+func proxyURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// upstreamFor returns the base URL of the upstream server r is relayed to.
+func (p *Proxy) upstreamFor(r *http.Request) string {
+	if upstream := p.Router.Upstream(r); upstream != "" {
+		return upstream
+	}
+	return p.Upstream
+}
+
+// newUpstreamRequest returns a copy of r with the given body
+// addressed to its upstream server (see Proxy.Router), preserving its
+// method, URI and end-to-end headers, and marking it as forwarded by us
+// (see addForwardingHeaders). Its path is rewritten by p.PathRewrite and
+// its headers by p.RequestHeaders. It shares r's context, so the
+// upstream request is abandoned if r is.
+func (p *Proxy) newUpstreamRequest(r *http.Request, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL(p.upstreamFor(r), p.PathRewrite.apply(r.URL)), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+	addForwardingHeaders(req.Header, r)
+	overrideHeaders(req.Header, p.RequestHeaders)
+	return req, nil
+}
+
+// viaPseudonym is how we identify ourselves in the Via header.
+const viaPseudonym = "mitm"
+
+// addForwardingHeaders records in header that r passed through us,
+// as a transparent proxy would: the client's address is appended to
+// X-Forwarded-For, and our pseudonym to Via. Existing values are
+// extended rather than replaced, so earlier proxies are still listed.
+func addForwardingHeaders(header http.Header, r *http.Request) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if client != "" {
+		appendHeaderList(header, "X-Forwarded-For", client)
+	}
+	appendHeaderList(header, "Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, viaPseudonym))
+}
+
+// requestIP returns the IP address of the client which sent r,
+// or nil if its RemoteAddr does not hold one.
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// appendHeaderList appends value to the comma-separated list in the
+// header key, folding any repeated lines into the one.
+func appendHeaderList(header http.Header, key, value string) {
+	if prior := header.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(key, value)
+}
+
+// do sends req to the upstream server, returning the server's
+// response along with its fully-read body.
+func (p *Proxy) do(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := p.upstreamClient().Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, respBody, nil
+}
+
+// upstreamClient returns the client requests are relayed to
+// the upstream server with.
+func (p *Proxy) upstreamClient() *http.Client {
+	if p.TLSConfig == nil {
+		return upstreamClient
+	}
+	p.clientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = p.TLSConfig
+		p.client = newUpstreamClient(transport)
+	})
+	return p.client
+}
+
+// relayError sends the client a 502 Bad Gateway for a request which
+// could not be relayed because of err, or a 504 Gateway Timeout if
+// its deadline passed first, and returns err annotated for the caller to log.
+func relayError(w http.ResponseWriter, err error) error {
+	status := relayErrorStatus(err)
+	http.Error(w, http.StatusText(status), status)
+	return fmt.Errorf("relaying to upstream: %w", err)
+}
+
+// relayErrorStatus returns the status the client is sent
+// for a request which could not be relayed because of err.
+func relayErrorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// hopHeaders are the hop-by-hop headers (RFC 7230, section 6.1), which
+// describe a single connection and so must not be relayed by a proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard, but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from header,
+// along with any others it names in its Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// upstreamURL returns the URL at endpoint which corresponds to the
+// path and query of the incoming request URL u. Both are copied exactly
+// as the client sent them, escaping and all, rather than re-encoded,
+// so e.g. an escaped slash in the path or a bare "?" survives.
+func upstreamURL(endpoint string, u *url.URL) string {
+	return strings.TrimSuffix(endpoint, "/") + u.RequestURI()
+}
+
+// rewriteResponseHeaders points any redirect in the header of the
+// response to r back at the proxy (see RewriteLocation), then applies
+// p.RewriteCookie and p.ResponseHeaders to it.
+func (p *Proxy) rewriteResponseHeaders(r *http.Request, header http.Header) {
+	RewriteLocation(header, p.upstreamFor(r), proxyURL(r))
+	if p.RewriteCookie != nil {
+		RewriteCookies(header, p.RewriteCookie)
+	}
+	overrideHeaders(header, p.ResponseHeaders)
+}
+
+// overrideHeaders applies rules, as in Proxy.RequestHeaders
+// and Proxy.ResponseHeaders, to header.
+func overrideHeaders(header http.Header, rules map[string][]string) {
+	for k, vs := range rules {
+		if len(vs) == 0 {
+			header.Del(k)
+			continue
+		}
+		header[http.CanonicalHeaderKey(k)] = vs
+	}
+}
+
+// writeResponse mirrors the end-to-end headers and status of resp back
+// to w, followed by body. Content-Length is recomputed since body may
+// have been modified.
+func writeResponse(w http.ResponseWriter, resp *http.Response, body []byte) {
+	removeHopHeaders(resp.Header)
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(resp.StatusCode)
+	// An error here means the client has gone away, so there is
+	// nobody left to tell.
+	w.Write(body)
+}
+
+// streamResponse mirrors the end-to-end headers and status of resp back
+// to w, then copies resp's body across as it arrives rather than reading
+// it all first, flushing after every write if w is an http.Flusher.
+// This way Server-Sent Events (text/event-stream) and other long-lived
+// responses reach the client as they are sent, for as long as the
+// upstream keeps the response open.
+// The upstream's Content-Length is kept if it sent one; otherwise the
+// body is sent chunked. It returns how many bytes of the body were copied.
+func streamResponse(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	removeHopHeaders(resp.Header)
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.Header().Del("Content-Length")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if f, ok := w.(http.Flusher); ok {
+		dst = flushWriter{w, f}
+	}
+	return io.Copy(dst, resp.Body)
+}
+
+// flushWriter is an io.Writer which flushes
+// everything written through it straight away.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
 }
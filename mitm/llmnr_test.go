@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestLLMNRResponse(t *testing.T) {
+	var table SpoofTable
+	table.Add("fileserver", net.ParseIP("10.38.8.4"))
+	table.Add("*.bank.com", net.ParseIP("10.38.8.5"))
+
+	for _, v := range []struct {
+		name    string
+		domain  string
+		spoofed bool
+	}{
+		{"single label", "fileserver", true},
+		{"single label case", "FileServer", true},
+		{"mismatching name", "printer", false},
+		{"not under wildcard", "bank", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			query := dnsWithDomainQuestions([]string{v.domain})
+			query.ID = 0x388
+			response, ok := LLMNRResponse(query, &table)
+			if ok != v.spoofed {
+				t.Fatalf("expected spoofed %v but got %v", v.spoofed, ok)
+			}
+			if !ok {
+				return
+			}
+			response = roundTripDNS(t, response)
+			if !response.QR || response.AA || response.RD {
+				t.Errorf("expected a response with the C and T bits clear but got QR %v, C %v, T %v", response.QR, response.AA, response.RD)
+			}
+			if response.ID != 0x388 || len(response.Questions) != 1 {
+				t.Errorf("expected the ID and question echoed but got ID %#x and %d questions", response.ID, len(response.Questions))
+			}
+			if len(response.Answers) != 1 {
+				t.Fatalf("expected 1 answer but got %d", len(response.Answers))
+			}
+			answer := response.Answers[0]
+			if answer.Type != layers.DNSTypeA || !answer.IP.Equal(net.ParseIP("10.38.8.4")) {
+				t.Errorf("expected an A record for 10.38.8.4 but got %v %v", answer.Type, answer.IP)
+			}
+			if answer.TTL != llmnrTTL {
+				t.Errorf("expected TTL %d but got %d", llmnrTTL, answer.TTL)
+			}
+		})
+	}
+}
+
+func TestServeLLMNR(t *testing.T) {
+	var table SpoofTable
+	table.Add("fileserver", net.ParseIP("10.38.8.4"))
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serveTestLinkLocal(t, ServeLLMNR, conn, &table)
+	addr := conn.LocalAddr().String()
+
+	response := decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "fileserver")))
+	if response.ID != 0x388 {
+		t.Errorf("expected response ID %#x but got %#x", 0x388, response.ID)
+	}
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("10.38.8.4")) {
+		t.Errorf("expected an answer for 10.38.8.4 but got %v", response.Answers)
+	}
+
+	client, err := net.Dial("udp4", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(serializeQuery(t, "printer")); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 512)); err == nil {
+		t.Errorf("expected no response for a mismatching name but got %d bytes", n)
+	}
+}
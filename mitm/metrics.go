@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics counts what the DNS spoofer does with the queries it sees, so
+// that its effectiveness can be watched live. *Metrics is an http.Handler
+// serving the counts in the Prometheus text exposition format.
+// The zero value is ready to use, a Metrics is safe for concurrent use,
+// and a nil *Metrics counts nothing.
+type Metrics struct {
+	// Accessed atomically, so kept first for 64-bit alignment.
+	queries          uint64
+	spoofed          uint64
+	forwarded        uint64
+	upstreamTimeouts uint64
+}
+
+// A MetricsSnapshot holds the counts of a Metrics at one moment.
+type MetricsSnapshot struct {
+	// Queries is how many DNS queries were seen.
+	Queries uint64
+	// Spoofed is how many queries matched and were answered
+	// with a forged response.
+	Spoofed uint64
+	// Forwarded is how many queries were left for the real resolver.
+	Forwarded uint64
+	// UpstreamTimeouts is how many forwarded queries the
+	// upstream resolver did not answer in time.
+	UpstreamTimeouts uint64
+}
+
+// Snapshot returns the current counts.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	if m == nil {
+		return MetricsSnapshot{}
+	}
+	return MetricsSnapshot{
+		Queries:          atomic.LoadUint64(&m.queries),
+		Spoofed:          atomic.LoadUint64(&m.spoofed),
+		Forwarded:        atomic.LoadUint64(&m.forwarded),
+		UpstreamTimeouts: atomic.LoadUint64(&m.upstreamTimeouts),
+	}
+}
+
+// recordDecision counts a query which was decided on as d.
+func (m *Metrics) recordDecision(d SpoofDecision) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.queries, 1)
+	switch d.Action {
+	case ActionSpoof:
+		atomic.AddUint64(&m.spoofed, 1)
+	case ActionForward:
+		atomic.AddUint64(&m.forwarded, 1)
+	}
+	var netErr net.Error
+	if errors.As(d.upstreamErr, &netErr) && netErr.Timeout() {
+		atomic.AddUint64(&m.upstreamTimeouts, 1)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := m.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, metric := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"dns_queries_total", "DNS queries seen.", s.Queries},
+		{"dns_queries_spoofed_total", "DNS queries answered with a forged response.", s.Spoofed},
+		{"dns_queries_forwarded_total", "DNS queries left for the real resolver.", s.Forwarded},
+		{"dns_upstream_timeouts_total", "Forwarded DNS queries the upstream resolver did not answer in time.", s.UpstreamTimeouts},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", metric.name, metric.help, metric.name, metric.name, metric.value)
+	}
+}
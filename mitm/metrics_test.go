@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeDNSMetrics(t *testing.T) {
+	metrics := &Metrics{}
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	// The upstream only answers questions for umich.edu.
+	upstream, _ := fakeUpstream(t, func(query []byte) []byte {
+		if bytes.Contains(query, []byte("umich")) {
+			return []byte("real upstream response")
+		}
+		return nil
+	})
+	addr := serveTestDNS(t, &table, &SpoofConfig{Metrics: metrics}, &Forwarder{Upstream: upstream, Timeout: 100 * time.Millisecond})
+
+	exchangeUDP(t, addr, serializeQuery(t, "eecs388.org"))
+	exchangeUDP(t, addr, serializeQuery(t, "eecs388.org"))
+	exchangeUDP(t, addr, serializeQuery(t, "umich.edu"))
+	exchangeUDP(t, addr, serializeQuery(t, "bank.com"))
+
+	expected := MetricsSnapshot{Queries: 4, Spoofed: 2, Forwarded: 2, UpstreamTimeouts: 1}
+	if s := metrics.Snapshot(); s != expected {
+		t.Errorf("expected counts %+v but got %+v", expected, s)
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	metrics := &Metrics{}
+	metrics.recordDecision(SpoofDecision{Action: ActionSpoof})
+	metrics.recordDecision(SpoofDecision{Action: ActionForward})
+	metrics.recordDecision(SpoofDecision{Action: ActionIgnore})
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("expected Prometheus text format Content-Type but got %q", ct)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE dns_queries_total counter",
+		"dns_queries_total 3",
+		"# TYPE dns_queries_spoofed_total counter",
+		"dns_queries_spoofed_total 1",
+		"# TYPE dns_queries_forwarded_total counter",
+		"dns_queries_forwarded_total 1",
+		"# TYPE dns_upstream_timeouts_total counter",
+		"dns_upstream_timeouts_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected line %q in output:\n%s", line, body)
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# HELP ") && !strings.HasPrefix(line, "# TYPE ") && len(strings.Fields(line)) != 2 {
+			t.Errorf("expected a comment or a name and value but got %q", line)
+		}
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var metrics *Metrics
+	metrics.recordDecision(SpoofDecision{Action: ActionSpoof})
+	if s := metrics.Snapshot(); s != (MetricsSnapshot{}) {
+		t.Errorf("expected a nil Metrics to count nothing but got %+v", s)
+	}
+}
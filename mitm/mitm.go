@@ -68,19 +68,30 @@ func handleDNSPacket(packet gopacket.Packet) {
 
 // sendRawUDP sends the data of an IP packet specified by data
 // to the IP address and UDP port specified by ip and port.
+// If ip is an IPv6 address, data must be an IPv6 packet
+// (see ProduceIPv6Packet).
 //
 // You do not need to modify this function.
 func sendRawUDP(ip net.IP, port layers.UDPPort, data []byte) {
-	// Opens an IPv4 socket to destination host/port.
-	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	// Opens a raw socket of ip's family to destination host/port.
+	family := unix.AF_INET
+	var addr unix.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = &unix.SockaddrInet4{
+			Port: int(port),
+			Addr: *(*[4]byte)(ip4),
+		}
+	} else {
+		// IPv6 raw sockets take the port as the protocol, so leave it unset;
+		// it is in the UDP header of data anyway.
+		family = unix.AF_INET6
+		addr = &unix.SockaddrInet6{Addr: *(*[16]byte)(ip.To16())}
+	}
+	sock, err := unix.Socket(family, unix.SOCK_RAW, unix.IPPROTO_RAW)
 	if err != nil {
 		panic(err)
 	}
-	addr := unix.SockaddrInet4{
-		Port: int(port),
-		Addr: *(*[4]byte)(ip.To4()),
-	}
-	if err := unix.Sendto(sock, data, 0, &addr); err != nil {
+	if err := unix.Sendto(sock, data, 0, addr); err != nil {
 		panic(err)
 	}
 	if err := unix.Close(sock); err != nil {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A QueryLogEntry describes one question of a DNS query that was handled.
+type QueryLogEntry struct {
+	// Timestamp is when the query arrived.
+	Timestamp time.Time `json:"timestamp"`
+	// Source is the address the query came from.
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	// Decision is what was done with the query.
+	Decision SpoofAction `json:"decision"`
+	// Answer is the address the question was answered with,
+	// if it was spoofed with one.
+	Answer net.IP `json:"answer,omitempty"`
+	// Latency is how long the response took to produce,
+	// including any round trip to the upstream resolver.
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// A QueryLogger writes each QueryLogEntry it is given to an io.Writer
+// as a line of JSON, so that there is a record of what victims looked up.
+// A QueryLogger is safe for concurrent use, and a nil *QueryLogger
+// logs nothing.
+type QueryLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewQueryLogger returns a QueryLogger writing to w.
+func NewQueryLogger(w io.Writer) *QueryLogger {
+	return &QueryLogger{w: w}
+}
+
+// Log writes entry as a line of JSON.
+func (l *QueryLogger) Log(entry QueryLogEntry) error {
+	if l == nil {
+		return nil
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(b, '\n'))
+	return err
+}
+
+// logDecision logs an entry for each question of d.Query, which came
+// from source and arrived at start. Since logging is only a record,
+// failures to write are ignored rather than holding up DNS handling.
+func (l *QueryLogger) logDecision(source string, start time.Time, d SpoofDecision) {
+	if l == nil {
+		return
+	}
+	latency := time.Since(start)
+	for _, q := range questionsOf(d.Query) {
+		l.Log(QueryLogEntry{
+			Timestamp: start,
+			Source:    source,
+			Name:      string(q.Name),
+			Type:      q.Type.String(),
+			Decision:  d.Action,
+			Answer:    answerIP(d.Response, q.Type),
+			Latency:   latency,
+		})
+	}
+}
+
+// answerIP returns the address of the first record of type qtype among
+// response's answers, or nil if response is nil or has no such record.
+func answerIP(response *layers.DNS, qtype layers.DNSType) net.IP {
+	if response == nil {
+		return nil
+	}
+	for _, answer := range response.Answers {
+		if answer.Type == qtype && answer.IP != nil {
+			return answer.IP
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer which may be read
+// while servers are still writing to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// loggedQuery is a line written by a QueryLogger, as parsed back.
+type loggedQuery struct {
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Decision  string    `json:"decision"`
+	Answer    string    `json:"answer"`
+	Latency   int64     `json:"latency_ns"`
+}
+
+// parseQueryLog parses each line of log as a loggedQuery.
+func parseQueryLog(t *testing.T, log string) []loggedQuery {
+	t.Helper()
+	var entries []loggedQuery
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	for scanner.Scan() {
+		var entry loggedQuery
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("failed to parse log line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestQueryLoggerConcurrent(t *testing.T) {
+	var buf lockedBuffer
+	l := NewQueryLogger(&buf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Log(QueryLogEntry{Name: "eecs388.org", Type: "A", Decision: ActionForward})
+		}()
+	}
+	wg.Wait()
+
+	entries := parseQueryLog(t, buf.String())
+	if len(entries) != 50 {
+		t.Fatalf("expected 50 log lines but got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Name != "eecs388.org" || entry.Decision != "forward" {
+			t.Errorf("expected a forwarded query for eecs388.org but got %+v", entry)
+		}
+	}
+}
+
+func TestQueryLoggerNil(t *testing.T) {
+	var l *QueryLogger
+	if err := l.Log(QueryLogEntry{Name: "eecs388.org"}); err != nil {
+		t.Errorf("expected a nil QueryLogger to log nothing, but got error %v", err)
+	}
+}
+
+func TestServeDNSQueryLog(t *testing.T) {
+	var buf lockedBuffer
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	upstream, _ := fakeUpstream(t, func([]byte) []byte { return []byte("real upstream response") })
+	addr := serveTestDNS(t, &table, &SpoofConfig{QueryLog: NewQueryLogger(&buf)}, &Forwarder{Upstream: upstream, Timeout: time.Second})
+
+	before := time.Now()
+	exchangeUDP(t, addr, serializeQuery(t, "eecs388.org"))
+	exchangeUDP(t, addr, serializeQuery(t, "umich.edu"))
+	exchangeUDP(t, addr, serializeQuery(t, "eecs388.org"))
+
+	entries := parseQueryLog(t, buf.String())
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 log lines but got %d:\n%s", len(entries), buf.String())
+	}
+	for i, expected := range []struct {
+		name, decision, answer string
+	}{
+		{"eecs388.org", "spoof", "3.23.25.235"},
+		{"umich.edu", "forward", ""},
+		{"eecs388.org", "spoof", "3.23.25.235"},
+	} {
+		entry := entries[i]
+		if entry.Name != expected.name || entry.Type != "A" {
+			t.Errorf("expected entry %d to be for an A question for %q but got %+v", i, expected.name, entry)
+		}
+		if entry.Decision != expected.decision {
+			t.Errorf("expected entry %d to have decision %q but got %q", i, expected.decision, entry.Decision)
+		}
+		if entry.Answer != expected.answer {
+			t.Errorf("expected entry %d to have answer %q but got %q", i, expected.answer, entry.Answer)
+		}
+		if !strings.HasPrefix(entry.Source, "127.0.0.1:") {
+			t.Errorf("expected entry %d to come from 127.0.0.1 but got %q", i, entry.Source)
+		}
+		if entry.Timestamp.Before(before) || entry.Timestamp.After(time.Now()) {
+			t.Errorf("expected entry %d to be timestamped during the test but got %v", i, entry.Timestamp)
+		}
+		if entry.Latency <= 0 {
+			t.Errorf("expected entry %d to have a positive latency but got %d", i, entry.Latency)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A RateLimiter limits how many spoofed responses each source address is
+// sent, so that a client stuck in a retry loop cannot make us flood the
+// network with forged packets. The HTTP proxy uses one likewise to limit
+// each client's requests (see Proxy.RateLimit). Every source has a token
+// bucket holding up to Burst tokens and refilled at Rate tokens per
+// second; each spoofed response takes a token, and queries arriving to
+// an empty bucket are over the limit.
+//
+// The fields must not be changed once the limiter is in use. A RateLimiter
+// is safe for concurrent use, and a nil *RateLimiter allows everything.
+type RateLimiter struct {
+	// Rate is how many spoofed responses per second each source
+	// is allowed on average. It must be positive.
+	Rate float64
+	// Burst is how many spoofed responses each source
+	// is allowed in a row. It must be at least 1.
+	Burst int
+	// Forward, if set, has queries over the limit forwarded to the
+	// real resolver. Otherwise they are dropped without a response.
+	Forward bool
+	// Clock, if set, is what buckets are refilled by.
+	// Otherwise SystemClock is used.
+	Clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// A tokenBucket holds a source's tokens as of when it last took one.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow takes a token from the bucket for ip, reporting whether
+// there was one, i.e. whether ip may be sent a spoofed response.
+func (l *RateLimiter) Allow(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	now := clockNow(l.Clock)
+	key := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.evictIdle(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*tokenBucket)
+		}
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evictIdle forgets the buckets which have been idle long enough to
+// refill, since they behave just like new ones, so that sources which
+// have gone quiet do not take up memory. To keep Allow cheap, it only
+// looks at every bucket once per refill period.
+func (l *RateLimiter) evictIdle(now time.Time) {
+	refill := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := &RateLimiter{Rate: 1, Burst: 3}
+	victim, other := net.ParseIP("10.38.8.2"), net.ParseIP("10.38.8.3")
+
+	for i := 1; i <= 3; i++ {
+		if !l.Allow(victim) {
+			t.Errorf("expected query %d within the burst to be allowed", i)
+		}
+	}
+	if l.Allow(victim) {
+		t.Errorf("expected query 4 past the burst to be suppressed")
+	}
+	if !l.Allow(other) {
+		t.Errorf("expected a different source to be unaffected")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	clock := newFakeClock()
+	l := &RateLimiter{Rate: 2, Burst: 1, Clock: clock}
+	ip := net.ParseIP("10.38.8.2")
+
+	if !l.Allow(ip) {
+		t.Fatalf("expected the first query to be allowed")
+	}
+	if l.Allow(ip) {
+		t.Fatalf("expected an immediate second query to be suppressed")
+	}
+	clock.Advance(400 * time.Millisecond)
+	if l.Allow(ip) {
+		t.Fatalf("expected a query to be suppressed before the bucket refilled")
+	}
+	clock.Advance(100 * time.Millisecond)
+	if !l.Allow(ip) {
+		t.Errorf("expected a query to be allowed once the bucket refilled")
+	}
+}
+
+func TestRateLimiterEvictsIdle(t *testing.T) {
+	clock := newFakeClock()
+	l := &RateLimiter{Rate: 100, Burst: 1, Clock: clock}
+	l.Allow(net.ParseIP("10.38.8.2"))
+	clock.Advance(20 * time.Millisecond)
+	l.Allow(net.ParseIP("10.38.8.3"))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.buckets["10.38.8.2"]; ok || len(l.buckets) != 1 {
+		t.Errorf("expected only the active source's bucket to be kept but got %v", l.buckets)
+	}
+}
+
+func TestRateLimiterNil(t *testing.T) {
+	var l *RateLimiter
+	if !l.Allow(net.ParseIP("10.38.8.2")) {
+		t.Errorf("expected a nil RateLimiter to allow everything")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A PcapRecorder writes packets to a pcap file, so there is a record
+// of exactly which queries were answered and with what. It is safe for
+// concurrent use, and must be closed to make sure every packet is written.
+type PcapRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	buf *bufio.Writer
+	w   *pcapgo.Writer
+}
+
+// NewPcapRecorder creates (or truncates) the pcap file at path to
+// record packets whose first layer is of type linkType, e.g.
+// layers.LinkTypeEthernet for packets captured on an Ethernet interface.
+func NewPcapRecorder(path string, linkType layers.LinkType) (*PcapRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	w := pcapgo.NewWriter(buf)
+	if err := w.WriteFileHeader(captureSnapLen, linkType); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PcapRecorder{f: f, buf: buf, w: w}, nil
+}
+
+// Record writes the packet with the given raw data, captured as
+// described by ci. A zero timestamp or length in ci is filled in
+// with the current time or the length of data.
+func (r *PcapRecorder) Record(ci gopacket.CaptureInfo, data []byte) error {
+	if ci.Timestamp.IsZero() {
+		ci.Timestamp = time.Now()
+	}
+	if ci.CaptureLength == 0 {
+		ci.CaptureLength = len(data)
+	}
+	if ci.Length == 0 {
+		ci.Length = len(data)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.WritePacket(ci, data)
+}
+
+// RecordPacket writes pkt as it was captured.
+func (r *PcapRecorder) RecordPacket(pkt gopacket.Packet) error {
+	return r.Record(pkt.Metadata().CaptureInfo, pkt.Data())
+}
+
+// Close writes out any packets not yet written and closes the file.
+func (r *PcapRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.buf.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
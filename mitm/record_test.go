@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestInjectorRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchanges.pcap")
+	recorder, err := NewPcapRecorder(path, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+
+	var table SpoofTable
+	table.Add("*.eecs388.org", net.ParseIP("3.23.25.235"))
+
+	domains := []string{"a.eecs388.org", "b.eecs388.org", "c.eecs388.org", "umich.edu"}
+	queries := make([]gopacket.Packet, len(domains))
+	for i, d := range domains {
+		queries[i] = capturedIPv4Query(t, d)
+	}
+	// capturingWriter is not safe for concurrent use, but the
+	// recorder must be, so give each goroutine its own writer.
+	var wg sync.WaitGroup
+	for _, q := range queries {
+		q := q
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in := &Injector{Writer: &capturingWriter{}, Recorder: recorder}
+			if _, err := in.InjectSpoofed(context.Background(), q, &table); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("failed to close recorder: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read recording: %v", err)
+	}
+
+	var queryCount, responseCount int
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		if ci.CaptureLength != len(data) || ci.Length != len(data) {
+			t.Errorf("record has lengths %d and %d but holds %d bytes", ci.CaptureLength, ci.Length, len(data))
+		}
+		if ci.Timestamp.IsZero() {
+			t.Errorf("record has no timestamp")
+		}
+		dns, ok := gopacket.NewPacket(data, r.LinkType(), gopacket.Default).Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok {
+			t.Errorf("record does not decode as DNS")
+			continue
+		}
+		if string(dns.Questions[0].Name) == "umich.edu" {
+			t.Errorf("unspoofed query for umich.edu was recorded")
+		}
+		if dns.QR {
+			responseCount++
+		} else {
+			queryCount++
+		}
+	}
+	if queryCount != 3 || responseCount != 3 {
+		t.Errorf("expected 3 queries and 3 responses to be recorded but got %d and %d", queryCount, responseCount)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A SpoofAction is what is done with a DNS query.
+type SpoofAction int
+
+const (
+	// ActionIgnore leaves the packet alone, as it is not a standard
+	// query, e.g. a response on its way back from the resolver.
+	ActionIgnore SpoofAction = iota
+	// ActionForward leaves the query for the real resolver to answer.
+	ActionForward
+	// ActionSpoof answers the query with a forged response.
+	ActionSpoof
+	// ActionDrop discards the query without any response, as for
+	// a source over its rate limit (see SpoofConfig.RateLimit).
+	ActionDrop
+	// ActionNXDomain denies that the names asked about exist. It is only
+	// ever decided by a DecisionFunc (see NXDomain); the query is then
+	// answered, and recorded, as by ActionSpoof.
+	ActionNXDomain
+)
+
+func (a SpoofAction) String() string {
+	switch a {
+	case ActionIgnore:
+		return "ignore"
+	case ActionForward:
+		return "forward"
+	case ActionSpoof:
+		return "spoof"
+	case ActionDrop:
+		return "drop"
+	case ActionNXDomain:
+		return "nxdomain"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that
+// actions are logged by name (see QueryLogger).
+func (a SpoofAction) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// A SpoofDecision records what would be done with a DNS packet.
+type SpoofDecision struct {
+	// Timestamp is when the packet was captured.
+	Timestamp time.Time
+	// Query is the DNS packet the decision was made for.
+	Query *layers.DNS
+	// Action is what would be done with Query.
+	Action SpoofAction
+	// Response is the forged response for ActionSpoof, and nil otherwise.
+	Response *layers.DNS
+
+	// upstreamErr is why the upstream resolver did not answer
+	// a forwarded query, if it did not.
+	upstreamErr error
+}
+
+// decideQuery returns what the live path would do with the DNS packet dns
+// from src when answering from table: spoof it if it is from a victim and
+// the table has an answer (as sent over UDP; see
+// SpoofTable.SpoofedUDPResponse), or drop it if config's Decide says to,
+// forward any other standard query (even one, like a CHAOS-class query,
+// the table never answers), and ignore the rest.
+func decideQuery(dns *layers.DNS, table *SpoofTable, config *SpoofConfig, src net.Addr, victim bool) SpoofDecision {
+	decision := SpoofDecision{Query: dns, Action: ActionIgnore}
+	if !isStandardQuery(dns) || len(questionsOf(dns)) == 0 {
+		return decision
+	}
+	if !victim {
+		decision.Action = ActionForward
+		return decision
+	}
+	if response, ok := table.spoofedResponseFrom(config.decider(), src, dns, DefaultTTL, true); ok {
+		decision.Action = ActionSpoof
+		if response == nil {
+			decision.Action = ActionDrop
+		}
+		decision.Response = response
+		return decision
+	}
+	decision.Action = ActionForward
+	return decision
+}
+
+// ReplayPcap reads the packets captured in the pcap file at path and
+// returns, for each DNS packet among them, what would have been done
+// with it when answering from table under config (which may be nil),
+// so the spoofer can be tried out against real traffic while offline.
+// Packets which are not DNS, or which do not decode, are skipped.
+func ReplayPcap(path string, table *SpoofTable, config *SpoofConfig) ([]SpoofDecision, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var decisions []SpoofDecision
+	packets := gopacket.NewPacketSource(r, r.LinkType())
+	for pkt := range packets.Packets() {
+		if pkt.ErrorLayer() != nil {
+			continue
+		}
+		dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS)
+		if !ok {
+			continue
+		}
+		decision := decideQuery(dns, table, config, packetAddr(pkt), config.victim(packetSource(pkt)))
+		decision.Timestamp = pkt.Metadata().Timestamp
+		decisions = append(decisions, decision)
+	}
+	return decisions, nil
+}
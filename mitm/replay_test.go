@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplayPcap(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Add("*.eecs388.org", net.ParseIP("3.23.25.236"))
+
+	// The fixture holds, a second apart from 2022-03-08 12:00:00 UTC,
+	// packets between 10.38.8.2 and its resolver 10.38.8.53:
+	// an A query for eecs388.org, the resolver's response to it,
+	// an A query for umich.edu, a CHAOS-class TXT query for version.bind,
+	// a UDP packet which is not DNS, and an A query for login.eecs388.org.
+	decisions, err := ReplayPcap("testdata/dns_queries.pcap", &table, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Date(2022, 3, 8, 12, 0, 0, 0, time.UTC)
+	expected := []struct {
+		name   string
+		offset time.Duration
+		action SpoofAction
+		ip     net.IP
+	}{
+		{"eecs388.org", 0, ActionSpoof, net.ParseIP("3.23.25.235")},
+		{"eecs388.org", time.Second, ActionIgnore, nil},
+		{"umich.edu", 2 * time.Second, ActionForward, nil},
+		{"version.bind", 3 * time.Second, ActionForward, nil},
+		{"login.eecs388.org", 5 * time.Second, ActionSpoof, net.ParseIP("3.23.25.236")},
+	}
+	if len(decisions) != len(expected) {
+		t.Fatalf("expected %d decisions but got %d", len(expected), len(decisions))
+	}
+	for i, v := range expected {
+		d := decisions[i]
+		if name := string(d.Query.Questions[0].Name); name != v.name {
+			t.Errorf("decision %d: expected question for %s but got %s", i, v.name, name)
+		}
+		if !d.Timestamp.Equal(start.Add(v.offset)) {
+			t.Errorf("decision %d: expected timestamp %v but got %v", i, start.Add(v.offset), d.Timestamp)
+		}
+		if d.Action != v.action {
+			t.Errorf("decision %d: expected action %s but got %s", i, v.action, d.Action)
+		}
+		if v.ip == nil {
+			if d.Response != nil {
+				t.Errorf("decision %d: expected no forged response but got %v", i, d.Response)
+			}
+			continue
+		}
+		if d.Response == nil || len(d.Response.Answers) != 1 || !d.Response.Answers[0].IP.Equal(v.ip) {
+			t.Errorf("decision %d: expected a forged answer for %v but got %v", i, v.ip, d.Response)
+		}
+	}
+}
+
+func TestReplayPcapMissingFile(t *testing.T) {
+	if _, err := ReplayPcap("testdata/does_not_exist.pcap", &SpoofTable{}, nil); err == nil {
+		t.Errorf("expected an error replaying a missing file")
+	}
+}
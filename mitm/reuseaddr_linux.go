@@ -0,0 +1,17 @@
+//go:build linux
+
+package main
+
+import "syscall"
+
+// reuseAddrControl sets SO_REUSEADDR on sockets before they are bound,
+// as a net.ListenConfig's Control.
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// reuseAddrControl leaves sockets as they are on platforms
+// where SO_REUSEADDR is not set (see reuseaddr_linux.go).
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A PathRewrite redirects requests whose path matches Pattern to a
+// different path on the upstream server, e.g. /old/... to /new/...
+type PathRewrite struct {
+	Pattern *regexp.Regexp
+	// Replacement is the template matches of Pattern are replaced with,
+	// as by Regexp.ReplaceAllString, so it may refer to submatches.
+	Replacement string
+}
+
+// apply returns u with its path rewritten, or u itself if rw is nil or
+// Pattern does not match. The query is kept as the client sent it.
+func (rw *PathRewrite) apply(u *url.URL) *url.URL {
+	if rw == nil || !rw.Pattern.MatchString(u.Path) {
+		return u
+	}
+	rewritten := *u
+	rewritten.Path = rw.Pattern.ReplaceAllString(u.Path, rw.Replacement)
+	// Escape the new path afresh rather than keep the old escaping.
+	rewritten.RawPath = ""
+	return &rewritten
+}
+
+// RewriteCookies passes each cookie set by the Set-Cookie headers in
+// header to transform, which may change it in place, e.g. to force a
+// known session value or clear HttpOnly, and returns whether to keep
+// it. The Set-Cookie headers are then replaced with the cookies kept,
+// in the same order. Attributes http.Cookie has no field for are kept
+// as they were; a header which does not parse as a cookie at all is
+// kept untouched.
+func RewriteCookies(header http.Header, transform func(*http.Cookie) bool) {
+	lines := header.Values("Set-Cookie")
+	if len(lines) == 0 {
+		return
+	}
+	rewritten := make([]string, 0, len(lines))
+	for _, line := range lines {
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": {line}}}).Cookies()
+		if len(cookies) == 0 {
+			rewritten = append(rewritten, line)
+			continue
+		}
+		c := cookies[0]
+		if !transform(c) {
+			continue
+		}
+		s := c.String()
+		for _, attr := range c.Unparsed {
+			s += "; " + attr
+		}
+		rewritten = append(rewritten, s)
+	}
+	header.Del("Set-Cookie")
+	for _, line := range rewritten {
+		header.Add("Set-Cookie", line)
+	}
+}
+
+// RewriteLocation rewrites an absolute URL in the Location header which
+// points under the upstream base URL to point under the proxy base URL
+// instead, so that a redirect from the upstream server does not lead the
+// client past the proxy. With upstream "http://10.38.8.3" and proxy
+// "https://bank.com", a redirect to "http://10.38.8.3/login?next=/"
+// becomes one to "https://bank.com/login?next=/". Relative locations,
+// and those elsewhere, are left alone, as is header if either base URL
+// does not parse.
+func RewriteLocation(header http.Header, upstream, proxy string) {
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+	loc, err := url.Parse(location)
+	if err != nil || !loc.IsAbs() || loc.Host == "" {
+		return
+	}
+	from, err := url.Parse(upstream)
+	if err != nil {
+		return
+	}
+	to, err := url.Parse(proxy)
+	if err != nil {
+		return
+	}
+	if !strings.EqualFold(loc.Scheme, from.Scheme) || !strings.EqualFold(hostWithPort(loc), hostWithPort(from)) {
+		return
+	}
+	base := strings.TrimSuffix(from.Path, "/")
+	if loc.Path != base && !strings.HasPrefix(loc.Path, base+"/") {
+		return
+	}
+
+	rewritten := *loc
+	rewritten.Scheme, rewritten.Host, rewritten.User = to.Scheme, to.Host, nil
+	rewritten.Path = strings.TrimSuffix(to.Path, "/") + loc.Path[len(base):]
+	// Escape the new path afresh rather than keep the old escaping.
+	rewritten.RawPath = ""
+	header.Set("Location", rewritten.String())
+}
+
+// hostWithPort returns the host and port of u,
+// filling in the default port of u's scheme if it has none.
+func hostWithPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		return u.Host + ":80"
+	case "https", "wss":
+		return u.Host + ":443"
+	}
+	return u.Host
+}
+
+// A replacement records that a request field was changed from original
+// to spoofed, so that the change can be hidden in the response.
+type replacement struct {
+	spoofed, original string
+}
+
+// sortedKeys returns the keys of rules in a fixed order, so that
+// rules are applied (and later undone) deterministically.
+func sortedKeys(rules map[string]string) []string {
+	keys := make([]string, 0, len(rules))
+	for k := range rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rewriteForm applies rules to the form-encoded body, replacing the value
+// of each key of rules present in the form. It returns the new body and
+// the replacements which were made, or an error if body is not a valid
+// form, e.g. for a bad percent-escape.
+func rewriteForm(body []byte, rules map[string]string) ([]byte, []replacement, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing form body: %w", err)
+	}
+
+	var restore []replacement
+	for _, k := range sortedKeys(rules) {
+		if _, ok := form[k]; !ok {
+			continue
+		}
+		original, spoofed := form.Get(k), rules[k]
+		if original != "" && spoofed != "" {
+			restore = append(restore, replacement{spoofed, original})
+		}
+		form.Set(k, spoofed)
+	}
+	return []byte(form.Encode()), restore, nil
+}
+
+// isForm returns whether contentType describes a form-encoded body.
+// A missing Content-Type counts, since the starter code assumes
+// intercepted requests are forms whether or not they say so.
+func isForm(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// isMultipartForm returns whether contentType describes
+// a multipart/form-data body, as sent with file uploads.
+func isMultipartForm(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// rewriteMultipart applies rules to the multipart/form-data body, whose
+// Content-Type is contentType, replacing the value of each text field
+// named by a key of rules. File parts, and parts not named in rules,
+// are copied byte-for-byte, headers and all.
+//
+// If any field is replaced, the body is re-encoded with a fresh boundary,
+// which is given in the Content-Type returned along with it and the
+// replacements which were made. Otherwise, as for a body which does not
+// parse, body and contentType are returned untouched.
+func rewriteMultipart(body []byte, contentType string, rules map[string]string) ([]byte, string, []replacement) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return body, contentType, nil
+	}
+	type part struct {
+		header textproto.MIMEHeader
+		data   []byte
+	}
+	var parts []part
+	var restore []replacement
+	changed := false
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		// Raw parts keep any Content-Transfer-Encoding as it was sent.
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return body, contentType, nil
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return body, contentType, nil
+		}
+		if spoofed, ok := rules[p.FormName()]; ok && p.FileName() == "" {
+			if original := string(data); original != "" && spoofed != "" {
+				restore = append(restore, replacement{spoofed, original})
+			}
+			data, changed = []byte(spoofed), true
+		}
+		parts = append(parts, part{p.Header, data})
+	}
+	if !changed {
+		return body, contentType, nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range parts {
+		pw, err := mw.CreatePart(p.header)
+		if err != nil {
+			return body, contentType, nil
+		}
+		pw.Write(p.data)
+	}
+	if err := mw.Close(); err != nil {
+		return body, contentType, nil
+	}
+	return buf.Bytes(), mw.FormDataContentType(), restore
+}
+
+// isJSON returns whether contentType describes a JSON body,
+// such as "application/json" or "application/vnd.api+json".
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// rewriteJSON applies rules to the JSON object in body. Each key of rules
+// is a dot-separated path such as "payment.to", and the value at that path
+// is replaced if it exists. Numbers stay numbers if the rule's value is
+// a JSON number (see isJSONNumber); anything else becomes a string.
+//
+// It returns the re-encoded body and the replacements which were made.
+// Characters such as '<' and '&' are written as they are rather than
+// escaped, as json.Marshal would. A body which is not a JSON object, or
+// in which no path matched, is returned untouched.
+func rewriteJSON(body []byte, rules map[string]string) ([]byte, []replacement) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return body, nil
+	}
+
+	var restore []replacement
+	matched := false
+	for _, path := range sortedKeys(rules) {
+		keys := strings.Split(path, ".")
+		parent, ok := jsonObjectAt(doc, keys[:len(keys)-1])
+		if !ok {
+			continue
+		}
+		leaf := keys[len(keys)-1]
+		old, ok := parent[leaf]
+		if !ok {
+			continue
+		}
+		matched = true
+
+		spoofed := rules[path]
+		var original string
+		switch v := old.(type) {
+		case string:
+			original = v
+			parent[leaf] = spoofed
+		case json.Number:
+			original = v.String()
+			if isJSONNumber(spoofed) {
+				parent[leaf] = json.Number(spoofed)
+			} else {
+				parent[leaf] = spoofed
+			}
+		default:
+			parent[leaf] = spoofed
+		}
+		if original != "" && spoofed != "" {
+			restore = append(restore, replacement{spoofed, original})
+		}
+	}
+
+	if !matched {
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return body, nil
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), restore
+}
+
+// isJSONNumber returns whether s is a number as JSON writes them,
+// unlike e.g. "NaN", "0x1p3" or "1_0", which strconv would parse
+// but json.Marshal rejects.
+func isJSONNumber(s string) bool {
+	if s == "" || (s[0] != '-' && (s[0] < '0' || s[0] > '9')) {
+		return false
+	}
+	// Valid JSON may end in whitespace, which a json.Number may not.
+	last := s[len(s)-1]
+	return last >= '0' && last <= '9' && json.Valid([]byte(s))
+}
+
+// jsonObjectAt returns the JSON object found by following keys from doc.
+func jsonObjectAt(doc map[string]interface{}, keys []string) (map[string]interface{}, bool) {
+	for _, k := range keys {
+		child, ok := doc[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		doc = child
+	}
+	return doc, true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// A HostRouter picks which real server a Proxy relays each request to
+// by the request's Host header, so that one proxy can stand in for
+// several sites at once. The zero value routes nothing. A HostRouter
+// is safe for concurrent use, so hosts may be added while it is in use.
+type HostRouter struct {
+	// Default is the base URL requests for hosts not added are relayed
+	// to. If empty, the Proxy's Upstream is used.
+	// It must not be changed once the router is in use.
+	Default string
+
+	mu     sync.RWMutex
+	routes map[string]string
+}
+
+// Add routes requests for host, a host name such as "bank.com", to the
+// real server at the base URL upstream, replacing any previous route.
+// Requests for host on any port are routed alike.
+func (hr *HostRouter) Add(host, upstream string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if hr.routes == nil {
+		hr.routes = make(map[string]string)
+	}
+	hr.routes[normalizeDomain(host)] = upstream
+}
+
+// Upstream returns the base URL of the real server for r, which is the
+// one added for its host, or Default if there is none. A nil
+// *HostRouter routes every request to "".
+func (hr *HostRouter) Upstream(r *http.Request) string {
+	if hr == nil {
+		return ""
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	if upstream, ok := hr.routes[normalizeDomain(host)]; ok {
+		return upstream
+	}
+	return hr.Default
+}
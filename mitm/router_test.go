@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHostRouter(t *testing.T) {
+	// backend returns a server which says who it is.
+	backend := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	bank, umich, fallback := backend("bank"), backend("umich"), backend("fallback")
+
+	router := &HostRouter{}
+	router.Add("bank.com", bank.URL)
+	router.Add("umich.edu", umich.URL)
+	p := &Proxy{Upstream: fallback.URL, Router: router}
+
+	for _, v := range []struct {
+		host     string
+		expected string
+	}{
+		{"bank.com", "bank"},
+		{"BANK.com:8080", "bank"},
+		{"umich.edu", "umich"},
+		{"eecs388.org", "fallback"},
+	} {
+		v := v
+		t.Run(v.host, func(t *testing.T) {
+			r := httptest.NewRequest("GET", uri, nil)
+			r.Host = v.host
+			w := httptest.NewRecorder()
+			if err := p.PassthroughRequest(w, r); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if body := w.Body.String(); body != v.expected {
+				t.Errorf("expected the request for %s to reach %s but it reached %s", v.host, v.expected, body)
+			}
+		})
+	}
+
+	router.Default = bank.URL
+	r := httptest.NewRequest("GET", uri, nil)
+	r.Host = "eecs388.org"
+	w := httptest.NewRecorder()
+	p.PassthroughRequest(w, r)
+	if body := w.Body.String(); body != "bank" {
+		t.Errorf("expected an unknown host to reach the router's default but it reached %s", body)
+	}
+}
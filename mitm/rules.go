@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultRulesInterval is how often a RulesWatcher checks
+// whether its rules file has changed, unless told otherwise.
+const DefaultRulesInterval = time.Second
+
+// LoadSpoofRules reads the spoof rules file at path, returning its
+// entries for SpoofTable.Replace. Each line of the file holds a domain
+// (which may be a wildcard, as in SpoofTable.Add) followed by the IP
+// address to spoof it to, or by NXDOMAIN to deny it:
+//
+//	eecs388.org      3.23.25.235
+//	*.bank.com       10.38.8.4
+//	login.bank.com   NXDOMAIN
+//
+// Domains may be internationalized, written either in Unicode or in
+// their ASCII (punycode) form (see domainToASCII); those which cannot
+// be converted make their line malformed.
+//
+// Blank lines and anything after a '#' are ignored. If any line is
+// malformed, an error listing every such line by number is returned.
+func LoadSpoofRules(path string) (map[string]SpoofEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := parseSpoofRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// parseSpoofRules parses rules in the format read by LoadSpoofRules.
+func parseSpoofRules(r io.Reader) (map[string]SpoofEntry, error) {
+	entries := make(map[string]SpoofEntry)
+	var malformed []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			malformed = append(malformed, fmt.Sprintf("line %d: expected a domain and an IP address or NXDOMAIN, got %q", line, text))
+			continue
+		}
+		domain, target := fields[0], fields[1]
+		if _, err := domainToASCII(domain); err != nil {
+			malformed = append(malformed, fmt.Sprintf("line %d: invalid domain: %v", line, err))
+			continue
+		}
+		if strings.EqualFold(target, "NXDOMAIN") {
+			entries[domain] = SpoofEntry{Deny: true}
+			continue
+		}
+		ip := net.ParseIP(target)
+		if ip == nil {
+			malformed = append(malformed, fmt.Sprintf("line %d: %q is not an IP address", line, target))
+			continue
+		}
+		entries[domain] = SpoofEntry{IP: ip}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(malformed) > 0 {
+		return nil, errors.New(strings.Join(malformed, "; "))
+	}
+	return entries, nil
+}
+
+// ParseHostsFile reads mappings in the format of /etc/hosts: each line
+// holds an IPv4 or IPv6 address followed by a name and any aliases, all
+// of which are spoofed to that address. Names may be internationalized,
+// as in LoadSpoofRules. Blank lines and anything after a '#' are ignored.
+//
+// A name may be mapped to one address of each family, as a standard
+// hosts file maps localhost to both 127.0.0.1 and ::1, and is then
+// spoofed to both. A name mapped to more than one address of the same
+// family keeps its last such mapping, and a warning naming the lines
+// involved is returned for it. If any line is malformed, an error
+// listing every such line by number is returned.
+func ParseHostsFile(r io.Reader) (*SpoofTable, []string, error) {
+	// A hostMapping holds a name's address of each family,
+	// and the lines they were mapped on.
+	type hostMapping struct {
+		ips   [2]net.IP
+		lines [2]int
+	}
+	mappings := make(map[string]*hostMapping)
+	var warnings, malformed []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			malformed = append(malformed, fmt.Sprintf("line %d: %q is not an IP address", line, fields[0]))
+			continue
+		}
+		if len(fields) == 1 {
+			malformed = append(malformed, fmt.Sprintf("line %d: no names for %s", line, ip))
+			continue
+		}
+		for _, name := range fields[1:] {
+			if _, err := domainToASCII(name); err != nil {
+				malformed = append(malformed, fmt.Sprintf("line %d: invalid name: %v", line, err))
+				continue
+			}
+			key := normalizeDomain(name)
+			m, ok := mappings[key]
+			if !ok {
+				m = &hostMapping{}
+				mappings[key] = m
+			}
+			family := 0
+			if ip.To4() == nil {
+				family = 1
+			}
+			if prior := m.lines[family]; prior != 0 {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s is remapped from line %d", line, name, prior))
+			}
+			m.ips[family], m.lines[family] = ip, line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(malformed) > 0 {
+		return nil, nil, errors.New(strings.Join(malformed, "; "))
+	}
+	entries := make(map[string]SpoofEntry, len(mappings))
+	for key, m := range mappings {
+		v4, v6 := m.ips[0], m.ips[1]
+		switch {
+		case v4 == nil:
+			entries[key] = SpoofEntry{IP: v6}
+		case v6 == nil:
+			entries[key] = SpoofEntry{IP: v4}
+		default:
+			entries[key] = SpoofEntry{IP: v4, IPs: []net.IP{v6}}
+		}
+	}
+	table := &SpoofTable{}
+	table.Replace(entries)
+	return table, warnings, nil
+}
+
+// A RulesWatcher keeps a SpoofTable in step with a rules file (see
+// LoadSpoofRules), so that domains can be added or removed while the
+// DNS servers keep running.
+type RulesWatcher struct {
+	// Path is the rules file.
+	Path string
+	// Table is the table the rules are loaded into.
+	Table *SpoofTable
+	// Interval is how often the file is checked for changes,
+	// or DefaultRulesInterval if 0.
+	Interval time.Duration
+	// OnError, if set, is told why a reload failed.
+	// Otherwise the error is logged.
+	OnError func(error)
+}
+
+// Run loads the rules file into w.Table, then reloads it whenever the
+// file's modification time or size changes, or the process receives
+// SIGHUP, until ctx is done. A reload which fails (e.g. because of a
+// malformed line) leaves the table as it was, and is reported to
+// w.OnError. Run returns an error only if the first load fails.
+func (w *RulesWatcher) Run(ctx context.Context) error {
+	info, err := os.Stat(w.Path)
+	if err != nil {
+		return err
+	}
+	entries, err := LoadSpoofRules(w.Path)
+	if err != nil {
+		return err
+	}
+	w.Table.Replace(entries)
+
+	interval := w.Interval
+	if interval == 0 {
+		interval = DefaultRulesInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			var current os.FileInfo
+			if current, err = os.Stat(w.Path); err == nil {
+				info = current
+				err = w.reload()
+			}
+		case <-ticker.C:
+			var current os.FileInfo
+			if current, err = os.Stat(w.Path); err == nil &&
+				(!current.ModTime().Equal(info.ModTime()) || current.Size() != info.Size()) {
+				// Remember the change even if the reload fails, so
+				// that the error is only reported once per change.
+				info = current
+				err = w.reload()
+			}
+		}
+		if err != nil {
+			w.report(err)
+		}
+	}
+}
+
+// reload loads the rules file into w.Table,
+// leaving the table as it was if that fails.
+func (w *RulesWatcher) reload() error {
+	entries, err := LoadSpoofRules(w.Path)
+	if err != nil {
+		return err
+	}
+	w.Table.Replace(entries)
+	return nil
+}
+
+// report passes err to w.OnError, or logs it.
+func (w *RulesWatcher) report(err error) {
+	err = fmt.Errorf("reloading spoof rules: %w", err)
+	if w.OnError != nil {
+		w.OnError(err)
+		return
+	}
+	log.Print(err)
+}
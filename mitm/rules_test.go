@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// writeRules writes rules to the file at path,
+// stamping it with mtime so that changes are always noticed.
+func writeRules(t *testing.T, path, rules string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatalf("failed to write rules: %v", err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("failed to set rules mtime: %v", err)
+	}
+}
+
+func TestLoadSpoofRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	writeRules(t, path, `# spoofed for the demo
+eecs388.org      3.23.25.235
+*.bank.com       10.38.8.4   # every subdomain
+
+login.bank.com   nxdomain
+`, time.Now())
+
+	entries, err := LoadSpoofRules(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var table SpoofTable
+	table.Replace(entries)
+
+	for _, v := range []struct {
+		domain string
+		ip     net.IP
+		deny   bool
+	}{
+		{"eecs388.org", net.ParseIP("3.23.25.235"), false},
+		{"www.bank.com", net.ParseIP("10.38.8.4"), false},
+		{"login.bank.com", nil, true},
+	} {
+		entry, ok := table.LookupEntry(questionFor(v.domain))
+		if !ok {
+			t.Errorf("expected an entry for %q", v.domain)
+			continue
+		}
+		if entry.Deny != v.deny || !entry.IP.Equal(v.ip) {
+			t.Errorf("expected entry for %q to have IP %v and Deny %v but got %+v", v.domain, v.ip, v.deny, entry)
+		}
+	}
+}
+
+func TestLoadSpoofRulesIDN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	writeRules(t, path, `bücher.example      3.23.25.235
+xn--mnchen-3ya.de   10.38.8.4
+`, time.Now())
+
+	entries, err := LoadSpoofRules(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var table SpoofTable
+	table.Replace(entries)
+	for _, domain := range []string{"xn--bcher-kva.example", "münchen.de"} {
+		if _, ok := table.LookupEntry(questionFor(domain)); !ok {
+			t.Errorf("expected an entry for %q", domain)
+		}
+	}
+
+	writeRules(t, path, `bücher.example      3.23.25.235
+xn--bcher_kva.example 10.38.8.4
+`, time.Now())
+	_, err = LoadSpoofRules(path)
+	if err == nil {
+		t.Fatalf("expected an error for an invalid punycode label")
+	}
+	for _, expected := range []string{"line 2", "xn--bcher_kva"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q but got %q", expected, err)
+		}
+	}
+}
+
+func TestLoadSpoofRulesMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	writeRules(t, path, `eecs388.org 3.23.25.235
+bank.com
+umich.edu not-an-ip
+`, time.Now())
+
+	_, err := LoadSpoofRules(path)
+	if err == nil {
+		t.Fatalf("expected an error for malformed rules")
+	}
+	for _, expected := range []string{path, "line 2", "line 3"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q but got %q", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected error not to mention the well-formed line 1 but got %q", err)
+	}
+}
+
+func TestRulesWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	mtime := time.Now().Add(-time.Hour)
+	writeRules(t, path, "eecs388.org 3.23.25.235\n", mtime)
+
+	var table SpoofTable
+	errs := make(chan error, 1)
+	w := &RulesWatcher{
+		Path:     path,
+		Table:    &table,
+		Interval: 10 * time.Millisecond,
+		OnError:  func(err error) { errs <- err },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- w.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Errorf("Run returned unexpected error: %v", err)
+		}
+	}()
+
+	// waitFor polls until the table's IP for domain is ip.
+	waitFor := func(domain string, ip net.IP) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if got, ok := table.Lookup(questionFor(domain)); ok && got.Equal(ip) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %q to be spoofed to %s", domain, ip)
+	}
+	waitFor("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	writeRules(t, path, "eecs388.org 10.38.8.4\nbank.com\n", mtime.Add(time.Minute))
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("expected the error to mention line 2 but got %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the malformed rules to be reported")
+	}
+	if ip, ok := table.Lookup(questionFor("eecs388.org")); !ok || !ip.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected the prior rules to be kept after a failed reload, but eecs388.org is spoofed to %v", ip)
+	}
+
+	writeRules(t, path, "umich.edu 10.38.8.5\n", mtime.Add(2*time.Minute))
+	waitFor("umich.edu", net.ParseIP("10.38.8.5"))
+	if _, ok := table.Lookup(questionFor("eecs388.org")); ok {
+		t.Errorf("expected eecs388.org to be removed with the new rules")
+	}
+}
+
+func TestRulesWatcherMissingFile(t *testing.T) {
+	w := &RulesWatcher{Path: filepath.Join(t.TempDir(), "missing"), Table: &SpoofTable{}}
+	if err := w.Run(context.Background()); err == nil {
+		t.Errorf("expected an error for a missing rules file")
+	}
+}
+
+func TestParseHostsFile(t *testing.T) {
+	hosts := `# Spoofed hosts
+3.23.25.235     eecs388.org www.eecs388.org   # with an alias
+
+10.38.8.4       bank.com
+2001:db8::388   ipv6.eecs388.org
+10.38.8.5       BANK.com.
+127.0.0.1       localhost
+::1             localhost
+`
+	table, warnings, err := ParseHostsFile(strings.NewReader(hosts))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, v := range []struct {
+		name string
+		ip   net.IP
+	}{
+		{"eecs388.org", net.ParseIP("3.23.25.235")},
+		{"www.eecs388.org", net.ParseIP("3.23.25.235")},
+		{"ipv6.eecs388.org", net.ParseIP("2001:db8::388")},
+		{"bank.com", net.ParseIP("10.38.8.5")},
+	} {
+		if ip, ok := table.Lookup(questionFor(v.name)); !ok || !ip.Equal(v.ip) {
+			t.Errorf("expected %q to be spoofed to %s but got %v", v.name, v.ip, ip)
+		}
+	}
+	if _, ok := table.Lookup(questionFor("umich.edu")); ok {
+		t.Errorf("expected umich.edu not to be spoofed")
+	}
+	for _, v := range []struct {
+		qtype layers.DNSType
+		ip    net.IP
+	}{
+		{layers.DNSTypeA, net.ParseIP("127.0.0.1")},
+		{layers.DNSTypeAAAA, net.ParseIP("::1")},
+	} {
+		q := questionFor("localhost")
+		q.Type = v.qtype
+		entry, ok := table.LookupEntry(q)
+		if !ok {
+			t.Fatalf("expected localhost to be spoofed")
+		}
+		answers, err := entry.answersFor(q, DefaultTTL)
+		if err != nil || len(answers) != 1 || !answers[0].IP.Equal(v.ip) {
+			t.Errorf("expected %s question for localhost to be answered with %s but got %v (%v)", v.qtype, v.ip, answers, err)
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "line 6") || !strings.Contains(warnings[0], "line 4") {
+		t.Errorf("expected a single warning about bank.com remapped on line 6 from line 4 but got %q", warnings)
+	}
+}
+
+func TestParseHostsFileMalformed(t *testing.T) {
+	hosts := `3.23.25.235 eecs388.org
+not-an-ip bank.com
+10.38.8.4
+`
+	_, _, err := ParseHostsFile(strings.NewReader(hosts))
+	if err == nil {
+		t.Fatalf("expected an error for a malformed hosts file")
+	}
+	for _, expected := range []string{"line 2", "line 3"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to mention %q but got %q", expected, err)
+		}
+	}
+}
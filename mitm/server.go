@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCPIdleTimeout is how long a DNS-over-TCP connection may sit
+// without a complete query before it is closed.
+const TCPIdleTimeout = 10 * time.Second
+
+// RunDNSServer listens for DNS queries over both UDP and TCP on
+// listenAddr (e.g. ":53") and serves them as by ServeDNS and ServeDNSTCP,
+// answering from table and forwarding everything else to the resolver
+// at upstream. It returns once ctx is done, or if either listener fails.
+// To stop serving gracefully instead, or to spoof only some clients,
+// use a DNSServer.
+//
+// A listenAddr with no host, or an unspecified one such as "0.0.0.0" or
+// "::", is listened on dual-stack, so clients are served over both IPv4
+// and IPv6; those over IPv4 are then seen with IPv4-mapped addresses,
+// which a SpoofConfig's Victims still match.
+func RunDNSServer(ctx context.Context, listenAddr string, table *SpoofTable, upstream string) error {
+	s := &DNSServer{Addr: listenAddr, Table: table, Forwarder: &Forwarder{Upstream: upstream}}
+	return s.ListenAndServe(ctx)
+}
+
+// A DNSServer serves DNS queries over both UDP and TCP as RunDNSServer
+// does, but can also be shut down gracefully (see Shutdown), so that
+// queries in flight are still answered and its address is free for
+// the next server at once. Its fields must not be changed once it is
+// listening, and a DNSServer cannot be restarted once shut down.
+type DNSServer struct {
+	// Addr is the address to listen on, as for RunDNSServer. With port 0,
+	// a port is picked which is free for both UDP and TCP.
+	Addr string
+	// Table is what queries are answered from.
+	Table *SpoofTable
+	// Config, if set, says whose queries are answered from Table, and
+	// how; otherwise every query Table can answer is answered.
+	Config *SpoofConfig
+	// Forwarder relays everything else to the real resolver.
+	Forwarder *Forwarder
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	ln       net.Listener
+	stop     chan struct{} // closed by Shutdown
+	stopOnce sync.Once
+	abandon  context.CancelFunc // cancels the queries in flight
+	handlers handlerGroup
+}
+
+// ListenAndServe listens on s.Addr and then serves as by Serve.
+func (s *DNSServer) ListenAndServe(ctx context.Context) error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve(ctx)
+}
+
+// Listen listens on s.Addr over UDP and TCP. The TCP listener has
+// SO_REUSEADDR set where the platform has it, so that connections a
+// server which just stopped left in TIME_WAIT do not keep its successor
+// from listening on the same address. The UDP socket does not: UDP has
+// no TIME_WAIT, and on Linux the option would let a second server bind
+// the same address and silently take a share of the queries.
+func (s *DNSServer) Listen() error {
+	var udp net.ListenConfig
+	conn, err := udp.ListenPacket(context.Background(), "udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	addr := s.Addr
+	if host, port, err := net.SplitHostPort(s.Addr); err == nil && port == "0" {
+		addr = net.JoinHostPort(host, strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port))
+	}
+	tcp := net.ListenConfig{Control: reuseAddrControl}
+	ln, err := tcp.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.mu.Lock()
+	s.conn, s.ln = conn, ln
+	s.mu.Unlock()
+	return nil
+}
+
+// LocalAddr returns the address s listens on over UDP, and on the same
+// port over TCP, or nil if it is not listening.
+func (s *DNSServer) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Serve serves the queries arriving on the sockets s listens on (see
+// Listen) as RunDNSServer does. Once ctx is done, it closes them and
+// returns nil after the queries in flight have been abandoned; if either
+// fails, it does the same and returns the error. Once Shutdown is
+// called, it returns nil at once, leaving Shutdown to finish up.
+func (s *DNSServer) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	conn, ln, stop := s.conn, s.ln, s.stopChan()
+	if conn == nil {
+		s.mu.Unlock()
+		return errors.New("DNS server is not listening")
+	}
+	if isClosed(stop) {
+		s.mu.Unlock()
+		return nil
+	}
+	handlerCtx, abandon := context.WithCancel(ctx)
+	s.abandon = abandon
+	s.mu.Unlock()
+
+	errs := make(chan error, 2)
+	go func() { errs <- serveUDP(handlerCtx, stop, conn, s.Table, s.Config, s.Forwarder, &s.handlers) }()
+	go func() { errs <- serveTCP(handlerCtx, stop, ln, s.Table, s.Config, s.Forwarder, &s.handlers) }()
+
+	err := <-errs
+	if isClosed(stop) {
+		// Shutdown drains the queries in flight and closes the sockets.
+		if err2 := <-errs; err == nil {
+			err = err2
+		}
+		return err
+	}
+	// Whichever server stops first takes the other down with it.
+	abandon()
+	conn.Close()
+	ln.Close()
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	s.handlers.wait()
+	return err
+}
+
+// Shutdown stops s gracefully: it stops reading new queries, waits for
+// those in flight to be answered, delayed responses included, and then
+// closes s's sockets along with the idle upstream connections of its
+// Forwarder (see Forwarder.CloseIdleConnections). If ctx is done first,
+// the queries still in flight are abandoned, and ctx's error returned.
+func (s *DNSServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	stop := s.stopChan()
+	s.stopOnce.Do(func() { close(stop) })
+	conn, ln := s.conn, s.ln
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.handlers.wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	if s.abandon != nil {
+		s.abandon()
+	}
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+		ln.Close()
+	}
+	s.Forwarder.CloseIdleConnections()
+	return err
+}
+
+// stopChan returns the channel Shutdown closes. s.mu must be held.
+func (s *DNSServer) stopChan() chan struct{} {
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	return s.stop
+}
+
+// activeHandlers returns how many goroutines are handling queries for s.
+func (s *DNSServer) activeHandlers() int {
+	return s.handlers.count()
+}
+
+// A handlerGroup tracks the goroutines handling queries,
+// as a sync.WaitGroup does, but can also count them.
+type handlerGroup struct {
+	wg sync.WaitGroup
+	n  int32
+}
+
+func (g *handlerGroup) add() {
+	g.wg.Add(1)
+	atomic.AddInt32(&g.n, 1)
+}
+
+func (g *handlerGroup) done() {
+	atomic.AddInt32(&g.n, -1)
+	g.wg.Done()
+}
+
+func (g *handlerGroup) wait() {
+	g.wg.Wait()
+}
+
+func (g *handlerGroup) count() int {
+	return int(atomic.LoadInt32(&g.n))
+}
+
+// isClosed returns whether the channel c is closed; a nil c never is.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// aLongTimeAgo is a deadline in the past, which
+// unblocks any read waiting on a connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ServeDNS reads DNS queries from conn and writes each one's response
+// (see RespondToUDPQuery) back to the address it came from. Every query is
+// handled on its own goroutine, so a slow upstream does not hold up
+// queries we can spoof. Datagrams which do not decode as DNS are dropped,
+// and queries from clients who are not victims of config, which may be
+// nil (see SpoofConfig.Victims), are always forwarded. Spoofed responses
+// are held back as long as SpoofTable.ResponseDelay says, and are
+// limited by config's RateLimit.
+//
+// ServeDNS closes conn and returns nil once ctx is done, after waiting
+// for queries in flight (but not for delayed responses, which are
+// dropped); any other read error is returned.
+func ServeDNS(ctx context.Context, conn net.PacketConn, table *SpoofTable, config *SpoofConfig, fwd *Forwarder) error {
+	var handlers handlerGroup
+	defer conn.Close()
+	defer handlers.wait()
+	return serveUDP(ctx, nil, conn, table, config, fwd, &handlers)
+}
+
+// serveUDP implements ServeDNS, tracking the goroutines handling queries
+// in handlers rather than waiting for them. Once ctx is done it closes
+// conn and returns nil; once stop is closed, it returns nil too, but
+// leaves conn open for the queries in flight to be answered on.
+func serveUDP(ctx context.Context, stop <-chan struct{}, conn net.PacketConn, table *SpoofTable, config *SpoofConfig, fwd *Forwarder, handlers *handlerGroup) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || isClosed(stop) {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+
+		handlers.add()
+		go func() {
+			defer handlers.done()
+			start := time.Now()
+			var delay time.Duration
+			spoof := func(query *layers.DNS, ttl uint32) (*layers.DNS, bool) {
+				response, ok := table.spoofedResponseFrom(config.decider(), addr, query, ttl, true)
+				if !ok || response == nil {
+					return response, ok
+				}
+				if limit := config.limiter(); !limit.Allow(addrIP(addr)) {
+					// Forward the query, or drop it.
+					return nil, !limit.Forward
+				}
+				delay = table.ResponseDelay(query)
+				return response, true
+			}
+			scrub := table
+			if !config.victim(addrIP(addr), nil) {
+				spoof, scrub = neverSpoof, nil
+			}
+			response, decision, err := respondToQuery(query, spoof, scrub, fwd, true)
+			if err != nil {
+				return
+			}
+			config.observe(addr.String(), start, decision)
+			if response == nil {
+				return
+			}
+			if err := sleepContext(ctx, delay); err != nil {
+				return
+			}
+			conn.WriteTo(response, addr)
+		}()
+	}
+}
+
+// sleepContext waits for d to pass, returning early
+// with ctx's error if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ServeDNSTCP accepts DNS-over-TCP connections on ln, as clients make
+// when a UDP response came back truncated. Each query on a connection
+// is read after its 2-byte length prefix, answered as by RespondToQuery,
+// and the response written back with a length prefix of its own.
+// Connections may carry any number of queries, and are closed once
+// they have been idle for TCPIdleTimeout. As in ServeDNS, queries from
+// clients who are not victims of config are always forwarded.
+//
+// ServeDNSTCP closes ln and returns nil once ctx is done, after closing
+// every open connection; any other accept error is returned.
+func ServeDNSTCP(ctx context.Context, ln net.Listener, table *SpoofTable, config *SpoofConfig, fwd *Forwarder) error {
+	var handlers handlerGroup
+	defer ln.Close()
+	defer handlers.wait()
+	return serveTCP(ctx, nil, ln, table, config, fwd, &handlers)
+}
+
+// serveTCP implements ServeDNSTCP, tracking the goroutines serving
+// connections in handlers rather than waiting for them. Once ctx is done
+// or stop is closed, it closes ln and returns nil; connections then close
+// once the query they are answering, if any, has been answered.
+func serveTCP(ctx context.Context, stop <-chan struct{}, ln net.Listener, table *SpoofTable, config *SpoofConfig, fwd *Forwarder, handlers *handlerGroup) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		case <-done:
+		}
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || isClosed(stop) {
+				return nil
+			}
+			return err
+		}
+
+		handlers.add()
+		go func() {
+			defer handlers.done()
+			serveTCPConn(ctx, stop, conn, table, config, fwd)
+		}()
+	}
+}
+
+// serveTCPConn answers each length-prefixed query read from conn
+// until the client hangs up, goes idle, or ctx is done. Once stop is
+// closed, it hangs up after answering the query being read, if any.
+func serveTCPConn(ctx context.Context, stop <-chan struct{}, conn net.Conn, table *SpoofTable, config *SpoofConfig, fwd *Forwarder) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			conn.SetReadDeadline(aLongTimeAgo)
+			select {
+			case <-ctx.Done():
+			case <-done:
+			}
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	spoof := func(query *layers.DNS, ttl uint32) (*layers.DNS, bool) {
+		return table.spoofedResponseFrom(config.decider(), conn.RemoteAddr(), query, ttl, false)
+	}
+	scrub := table
+	if !config.victim(addrIP(conn.RemoteAddr()), nil) {
+		spoof, scrub = neverSpoof, nil
+	}
+
+	var length [2]byte
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(TCPIdleTimeout)); err != nil || isClosed(stop) {
+			return
+		}
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		start := time.Now()
+		response, decision, err := respondToQuery(query, spoof, scrub, fwd, false)
+		if err != nil {
+			return
+		}
+		config.observe(conn.RemoteAddr().String(), start, decision)
+		if response == nil {
+			// The query is dropped: hang up rather than answer it.
+			return
+		}
+		framed, err := frameTCP(response)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(framed); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// serveTestDNS runs ServeDNS on an ephemeral port until the test
+// ends, returning its address.
+func serveTestDNS(t *testing.T, table *SpoofTable, config *SpoofConfig, fwd *Forwarder) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- ServeDNS(ctx, conn, table, config, fwd) }()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-stopped:
+			if err != nil {
+				t.Errorf("ServeDNS returned unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("ServeDNS did not stop after its context was cancelled")
+		}
+	})
+	return conn.LocalAddr().String()
+}
+
+// exchangeUDP sends query to the server at addr and returns its reply.
+func exchangeUDP(t *testing.T, addr string, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no response from server: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestServeDNSSpoofs(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	addr := serveTestDNS(t, &table, nil, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+
+	response := decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "eecs388.org")))
+	if response.ID != 0x388 {
+		t.Errorf("expected response ID %#x but got %#x", 0x388, response.ID)
+	}
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected a single answer for 3.23.25.235 but got %v", response.Answers)
+	}
+}
+
+func TestServeDNSDualStack(t *testing.T) {
+	// Listened on as by RunDNSServer with an unspecified host.
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	go ServeDNS(ctx, conn, &table, nil, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		probe, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			t.Logf("skipping %s, which is not available: %v", host, err)
+			continue
+		}
+		probe.Close()
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		response := decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "eecs388.org")))
+		if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+			t.Errorf("expected a single forged answer over %s, got %v", host, response.Answers)
+		}
+	}
+}
+
+func TestServeDNSForwards(t *testing.T) {
+	upstreamResponse := []byte("real upstream response")
+	upstream, _ := fakeUpstream(t, func([]byte) []byte { return upstreamResponse })
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	addr := serveTestDNS(t, &table, nil, &Forwarder{Upstream: upstream, Timeout: time.Second})
+
+	if response := exchangeUDP(t, addr, serializeQuery(t, "umich.edu")); !bytes.Equal(response, upstreamResponse) {
+		t.Errorf("expected upstream response %q but got %q", upstreamResponse, response)
+	}
+}
+
+func TestServeDNSMalformed(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	addr := serveTestDNS(t, &table, nil, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+
+	query := serializeQuery(t, "eecs388.org")
+	// A query claiming an answer it does not carry.
+	missingAnswer := append([]byte(nil), query...)
+	missingAnswer[7] = 1
+
+	for _, v := range []struct {
+		name     string
+		query    []byte
+		question string
+	}{
+		{"truncated header", query[:5], ""},
+		{"truncated question", query[:16], ""},
+		{"missing answer", missingAnswer, "eecs388.org"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			response := decodeDNS(t, exchangeUDP(t, addr, v.query))
+			if response.ResponseCode != layers.DNSResponseCodeFormErr {
+				t.Errorf("expected response code %s but got %s", layers.DNSResponseCodeFormErr, response.ResponseCode)
+			}
+			if !response.QR || response.ID != 0x388 {
+				t.Errorf("expected a response with ID %#x but got QR %v and ID %#x", 0x388, response.QR, response.ID)
+			}
+			if got := strings.Join(QueriedDomains(response), ","); got != v.question {
+				t.Errorf("expected question %q to be echoed but got %q", v.question, got)
+			}
+		})
+	}
+
+	// A datagram too short to hold an ID goes unanswered, but the server
+	// carries on.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0x03})
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 512)); err == nil {
+		t.Errorf("expected no response to a 1-byte datagram but got %d bytes", n)
+	}
+	if response := decodeDNS(t, exchangeUDP(t, addr, query)); len(response.Answers) != 1 {
+		t.Errorf("expected the server to keep answering but got %v", response.Answers)
+	}
+}
+
+func TestServeDNSUpstreamDown(t *testing.T) {
+	var table SpoofTable
+	addr := serveTestDNS(t, &table, nil, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+
+	response := decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "umich.edu")))
+	if response.ResponseCode != layers.DNSResponseCodeServFail {
+		t.Errorf("expected response code %s but got %s", layers.DNSResponseCodeServFail, response.ResponseCode)
+	}
+	if response.ID != 0x388 {
+		t.Errorf("expected transaction ID %#x but got %#x", 0x388, response.ID)
+	}
+	if got := QueriedDomains(response); len(got) != 1 || got[0] != "umich.edu" {
+		t.Errorf("expected the question to be echoed but got %q", got)
+	}
+}
+
+func TestServeDNSConcurrent(t *testing.T) {
+	// The upstream never replies, so forwarded queries hang until
+	// they time out; spoofed ones should be answered regardless.
+	upstream, _ := fakeUpstream(t, func([]byte) []byte { return nil })
+
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	addr := serveTestDNS(t, &table, nil, &Forwarder{Upstream: upstream, Timeout: 500 * time.Millisecond})
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(serializeQuery(t, "umich.edu"))
+
+	start := time.Now()
+	decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "eecs388.org")))
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("spoofed query took %v, expected it not to wait on the forwarded one", elapsed)
+	}
+}
+
+func TestRunDNSServerBadAddress(t *testing.T) {
+	if err := RunDNSServer(context.Background(), "not an address", &SpoofTable{}, DefaultUpstream); err == nil {
+		t.Errorf("expected an error listening on a bad address")
+	}
+}
+
+func TestServeDNSTCP(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Add("umich.edu", net.ParseIP("141.211.243.251"))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- ServeDNSTCP(ctx, ln, &table, nil, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	// Both queries go out on the one connection before reading either response.
+	for _, domain := range []string{"eecs388.org", "umich.edu"} {
+		query := serializeQuery(t, domain)
+		framed := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+		if _, err := conn.Write(framed); err != nil {
+			t.Fatalf("failed to send query for %s: %v", domain, err)
+		}
+	}
+
+	for _, v := range []struct {
+		domain string
+		ip     string
+	}{
+		{"eecs388.org", "3.23.25.235"},
+		{"umich.edu", "141.211.243.251"},
+	} {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			t.Fatalf("no response length for %s: %v", v.domain, err)
+		}
+		b := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("no response for %s: %v", v.domain, err)
+		}
+		response := decodeDNS(t, b)
+		if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP(v.ip)) {
+			t.Errorf("expected a single answer for %s of %s but got %v", v.domain, v.ip, response.Answers)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("ServeDNSTCP returned unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("ServeDNSTCP did not stop after its context was cancelled")
+	}
+}
+
+// exchangeTCP sends query to the DNS-over-TCP server at addr
+// and returns its reply.
+func exchangeTCP(t *testing.T, addr string, query []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	framed := append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)
+	if _, err := conn.Write(framed); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		t.Fatalf("no response length from server: %v", err)
+	}
+	b := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("no response from server: %v", err)
+	}
+	return b
+}
+
+func TestServeDNSTruncate(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Truncate: true})
+	fwd := &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond}
+	udpAddr := serveTestDNS(t, &table, nil, fwd)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeDNSTCP(ctx, ln, &table, nil, fwd)
+
+	response := decodeDNS(t, exchangeUDP(t, udpAddr, serializeQuery(t, "eecs388.org")))
+	if !response.TC {
+		t.Errorf("expected UDP response to have the TC bit set")
+	}
+	if len(response.Answers) != 0 {
+		t.Errorf("expected no answers over UDP but got %v", response.Answers)
+	}
+
+	response = decodeDNS(t, exchangeTCP(t, ln.Addr().String(), serializeQuery(t, "eecs388.org")))
+	if response.TC {
+		t.Errorf("expected TCP response not to have the TC bit set")
+	}
+	if len(response.Answers) != 1 || !response.Answers[0].IP.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected a single answer over TCP for 3.23.25.235 but got %v", response.Answers)
+	}
+}
+
+func TestServeDNSDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Delay: delay})
+	table.Add("umich.edu", net.ParseIP("141.211.243.44"))
+	addr := serveTestDNS(t, &table, nil, &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond})
+
+	start := time.Now()
+	decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "eecs388.org")))
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("expected the response to be delayed by at least %v but it took %v", delay, elapsed)
+	}
+
+	start = time.Now()
+	decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "umich.edu")))
+	if elapsed := time.Since(start); elapsed >= delay {
+		t.Errorf("expected an undelayed response but it took %v", elapsed)
+	}
+}
+
+func TestServeDNSDelayShutdown(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Delay: time.Hour})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- ServeDNS(ctx, conn, &table, nil, &Forwarder{}) }()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(serializeQuery(t, "eecs388.org")); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	// Give the server time to pick the query up and start waiting.
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("ServeDNS returned unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeDNS did not stop while a delayed response was pending")
+	}
+}
+
+func TestServeDNSRateLimit(t *testing.T) {
+	upstreamResponse := []byte("real upstream response")
+	upstream, _ := fakeUpstream(t, func([]byte) []byte { return upstreamResponse })
+
+	for _, v := range []struct {
+		name    string
+		forward bool
+	}{
+		{"drop", false},
+		{"forward", true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			var table SpoofTable
+			table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+			config := &SpoofConfig{RateLimit: &RateLimiter{Rate: 1, Burst: 2, Forward: v.forward}}
+			addr := serveTestDNS(t, &table, config, &Forwarder{Upstream: upstream, Timeout: time.Second})
+
+			for i := 0; i < 2; i++ {
+				if response := decodeDNS(t, exchangeUDP(t, addr, serializeQuery(t, "eecs388.org"))); len(response.Answers) != 1 {
+					t.Errorf("expected query %d within the burst to be spoofed but got %v", i+1, response.Answers)
+				}
+			}
+
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial server: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, err := conn.Write(serializeQuery(t, "eecs388.org")); err != nil {
+				t.Fatalf("failed to send query: %v", err)
+			}
+			buf := make([]byte, 65535)
+			n, err := conn.Read(buf)
+			if v.forward {
+				if err != nil || !bytes.Equal(buf[:n], upstreamResponse) {
+					t.Errorf("expected the query over the limit to be forwarded but got %q, %v", buf[:n], err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("expected the query over the limit to be dropped but got a %d-byte response", n)
+			}
+		})
+	}
+}
+
+// startTestDNSServer starts s on an ephemeral port, returning its
+// address and the channel Serve's result is sent on.
+func startTestDNSServer(t *testing.T, s *DNSServer) (string, <-chan error) {
+	t.Helper()
+	if s.Addr == "" {
+		s.Addr = "127.0.0.1:0"
+	}
+	if err := s.Listen(); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Serve(context.Background()) }()
+	return s.LocalAddr().String(), stopped
+}
+
+func TestDNSServerListenTwice(t *testing.T) {
+	first := &DNSServer{Addr: "127.0.0.1:0"}
+	if err := first.Listen(); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer first.Shutdown(context.Background())
+	addr := first.LocalAddr().String()
+
+	second := &DNSServer{Addr: addr}
+	if err := second.Listen(); err == nil {
+		second.Shutdown(context.Background())
+		t.Errorf("expected a second server listening on %s to fail", addr)
+	}
+	// Even a socket asking for SO_REUSEADDR itself must not be let in
+	// to take a share of the first server's queries.
+	lc := net.ListenConfig{Control: reuseAddrControl}
+	if conn, err := lc.ListenPacket(context.Background(), "udp", addr); err == nil {
+		conn.Close()
+		t.Errorf("expected a second UDP socket on %s to fail to bind", addr)
+	}
+}
+
+func TestDNSServerShutdown(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Delay: delay})
+	s := &DNSServer{Table: &table, Forwarder: &Forwarder{Upstream: "127.0.0.1:1", Timeout: 100 * time.Millisecond}}
+	addr, stopped := startTestDNSServer(t, s)
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write(serializeQuery(t, "eecs388.org")); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	// Give the server time to pick the query up and start waiting.
+	time.Sleep(50 * time.Millisecond)
+	if n := s.activeHandlers(); n != 1 {
+		t.Fatalf("expected a single query in flight but got %d", n)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected error shutting down: %v", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Serve returned unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Shutdown")
+	}
+
+	// The delayed response was still sent before the socket was closed.
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("expected the response in flight to be sent but got %v", err)
+	}
+	if response := decodeDNS(t, buf[:n]); len(response.Answers) != 1 {
+		t.Errorf("expected a single answer but got %v", response.Answers)
+	}
+	if n := s.activeHandlers(); n != 0 {
+		t.Errorf("expected no queries in flight after Shutdown but got %d", n)
+	}
+
+	// The address is free for a new server at once.
+	restarted := &DNSServer{Addr: addr, Table: &table, Forwarder: &Forwarder{}}
+	if err := restarted.Listen(); err != nil {
+		t.Fatalf("failed to listen again on %s: %v", addr, err)
+	}
+	restarted.Shutdown(context.Background())
+}
+
+func TestDNSServerShutdownTimeout(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Delay: time.Hour})
+	s := &DNSServer{Table: &table, Forwarder: &Forwarder{}}
+	addr, stopped := startTestDNSServer(t, s)
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer client.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(serializeQuery(t, "eecs388.org")); err != nil {
+			t.Fatalf("failed to send query: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := s.activeHandlers(); n != 3 {
+		t.Fatalf("expected 3 queries in flight but got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v shutting down but got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected Shutdown to give up after its deadline but it took %v", elapsed)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Serve returned unexpected error: %v", err)
+	}
+
+	// The abandoned queries' goroutines exit rather than leak.
+	deadline := time.Now().Add(time.Second)
+	for s.activeHandlers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.activeHandlers(); n != 0 {
+		t.Errorf("expected the abandoned queries to finish but %d are still in flight", n)
+	}
+}
+
+func TestDNSServerShutdownTCP(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	s := &DNSServer{Table: &table, Forwarder: &Forwarder{}}
+	addr, stopped := startTestDNSServer(t, s)
+
+	// An idle connection does not hold up Shutdown.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	defer conn.Close()
+	framed, err := frameTCP(serializeQuery(t, "eecs388.org"))
+	if err != nil {
+		t.Fatalf("failed to frame query: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write(framed); err != nil {
+		t.Fatalf("failed to send query: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatalf("no response from server: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("unexpected error shutting down: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Serve returned unexpected error: %v", err)
+	}
+	if n := s.activeHandlers(); n != 0 {
+		t.Errorf("expected no connections open after Shutdown but got %d", n)
+	}
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// A SpoofEntry describes how questions for a domain
+// in a SpoofTable are answered.
+type SpoofEntry struct {
+	// IP is the address questions are answered with.
+	IP net.IP
+	// IPs holds further addresses questions are answered with alongside
+	// IP, one record each, for clients which pick among several.
+	IPs []net.IP
+	// Shuffle randomizes the order of the address records
+	// in each response; see SpoofTable.Rand.
+	Shuffle bool
+	// Deny answers questions with NXDOMAIN instead of an IP,
+	// so that the client cannot reach the domain at all.
+	Deny bool
+	// TXT holds the strings TXT questions are answered with, in order.
+	TXT []string
+	// PTR is the hostname reverse (PTR) questions are answered with.
+	// Entries for it are keyed by reverse names; see ReverseName.
+	PTR string
+	// Truncate answers questions over UDP with an empty, truncated (TC)
+	// response, so that the client retries over TCP and is only given
+	// the spoofed answer there; see SpoofedUDPResponse.
+	Truncate bool
+	// Delay holds back spoofed responses to questions for the domain
+	// by this long, e.g. to measure how clients retry.
+	Delay time.Duration
+	// HTTPS selects how HTTPS (type 65) questions are answered if the
+	// entry has addresses: with NODATA by default, or with a record
+	// pointing at them. Either way, the real server's ECH and ALPN
+	// config is kept from the client.
+	HTTPS HTTPSAnswer
+}
+
+// answersFor returns the answer records for question as described by e,
+// cacheable for ttl seconds.
+func (e SpoofEntry) answersFor(question layers.DNSQuestion, ttl uint32) ([]layers.DNSResourceRecord, error) {
+	switch question.Type {
+	case layers.DNSTypeTXT:
+		answer, err := AnswerTXTForQuestion(question, e.TXT, ttl)
+		if err != nil || len(e.TXT) == 0 {
+			return nil, err
+		}
+		return []layers.DNSResourceRecord{answer}, nil
+	case layers.DNSTypePTR:
+		answer, err := AnswerPTRForQuestion(question, e.PTR, ttl)
+		if err != nil || e.PTR == "" {
+			return nil, err
+		}
+		return []layers.DNSResourceRecord{answer}, nil
+	case DNSTypeHTTPS:
+		if e.HTTPS != HTTPSRecord || len(e.addresses()) == 0 {
+			return nil, nil
+		}
+		answer, err := AnswerHTTPSForQuestion(question, e.addresses(), ttl)
+		if err != nil {
+			return nil, err
+		}
+		return []layers.DNSResourceRecord{answer}, nil
+	}
+	if len(e.IPs) == 0 {
+		return DirectAnswer(question, e.IP, ttl)
+	}
+	return answersForIPs(question, e.addresses(), ttl), nil
+}
+
+// answersNoData returns whether e answers question with NODATA.
+func (e SpoofEntry) answersNoData(question layers.DNSQuestion) bool {
+	return question.Type == DNSTypeHTTPS && e.HTTPS == HTTPSNoData && len(e.addresses()) > 0
+}
+
+// addresses returns every address e answers with, IP first.
+func (e SpoofEntry) addresses() []net.IP {
+	if e.IP == nil {
+		return e.IPs
+	}
+	return append([]net.IP{e.IP}, e.IPs...)
+}
+
+// SpoofTable maps domains to how questions for them should be
+// answered, so that several hostnames can be attacked at once.
+//
+// Domains are matched as in HasQuestionForDomain, so wildcards such
+// as "*.eecs388.org" may be added. A name in the table always takes
+// precedence over a wildcard, and more specific wildcards take
+// precedence over less specific ones. Domains marked with NeverSpoof
+// take precedence over all of them.
+// The zero value is an empty table ready to use, and
+// a SpoofTable is safe for concurrent use.
+type SpoofTable struct {
+	// Types, if set, restricts spoofing to questions of these types,
+	// e.g. only A and AAAA. Otherwise any question an entry has an answer
+	// for is spoofed. It must not be changed once the table is in use.
+	Types []layers.DNSType
+	// Rand, if set, is the source the answers of entries marked Shuffle
+	// are shuffled with; otherwise math/rand's default source is used.
+	// It must not be changed once the table is in use.
+	Rand *rand.Rand
+	// SOA describes the SOA record carried by NXDOMAIN responses to
+	// questions for denied domains (see NXDomainResponseSOA).
+	// It must not be changed once the table is in use.
+	SOA NegativeSOA
+
+	mu        sync.RWMutex
+	randMu    sync.Mutex
+	entries   map[string]SpoofEntry
+	protected map[string]bool
+}
+
+// A SpoofConfig says whose queries the DNS servers, the link-local
+// responders and the Injector spoof from a SpoofTable, and how, and
+// where what they do with each query is reported. The table itself
+// only holds the rules. A nil *SpoofConfig spoofs every client's
+// queries as the table says, without limit, and reports nothing.
+// Its fields must not be changed once it is in use.
+type SpoofConfig struct {
+	// Victims, if set, restricts spoofing to queries from these clients;
+	// everyone else's are forwarded or left alone. Since the DNS servers
+	// only see IP addresses, filtering by MAC only works when capturing.
+	Victims *VictimFilter
+	// Decide, if set, decides what to do with each question instead of
+	// the table's entries, e.g. table.DefaultDecision under conditions
+	// of the caller's own. Queries from clients other than Victims are
+	// still forwarded without asking it.
+	Decide DecisionFunc
+	// RateLimit, if set, limits how many spoofed responses each client
+	// is sent by the UDP server and Injector.InjectSpoofed.
+	RateLimit *RateLimiter
+	// QueryLog, if set, is given every query decided on, along with
+	// what was done with it.
+	QueryLog *QueryLogger
+	// Metrics, if set, counts the same queries as QueryLog.
+	Metrics *Metrics
+}
+
+// victim returns whether the client with the given addresses is one
+// of c's Victims. Either address may be nil if it is not known.
+func (c *SpoofConfig) victim(ip net.IP, mac net.HardwareAddr) bool {
+	return c == nil || c.Victims.Matches(ip, mac)
+}
+
+// decider returns c's Decide, or nil if c is nil.
+func (c *SpoofConfig) decider() DecisionFunc {
+	if c == nil {
+		return nil
+	}
+	return c.Decide
+}
+
+// limiter returns c's RateLimit, or nil if c is nil.
+func (c *SpoofConfig) limiter() *RateLimiter {
+	if c == nil {
+		return nil
+	}
+	return c.RateLimit
+}
+
+// observe records the decision d on a query which came from source
+// and arrived at start in c's QueryLog and Metrics.
+func (c *SpoofConfig) observe(source string, start time.Time, d SpoofDecision) {
+	if c == nil {
+		return
+	}
+	c.QueryLog.logDecision(source, start, d)
+	c.Metrics.recordDecision(d)
+}
+
+// Add spoofs domain to point to ip, replacing any previous entry.
+func (t *SpoofTable) Add(domain string, ip net.IP) {
+	t.AddEntry(domain, SpoofEntry{IP: ip})
+}
+
+// Deny makes questions for domain be answered with NXDOMAIN,
+// replacing any previous entry.
+func (t *SpoofTable) Deny(domain string) {
+	t.AddEntry(domain, SpoofEntry{Deny: true})
+}
+
+// AddPTR makes reverse lookups of ip be answered with host,
+// replacing any previous entry for its reverse name.
+func (t *SpoofTable) AddPTR(ip net.IP, host string) {
+	t.AddEntry(ReverseName(ip), SpoofEntry{PTR: host})
+}
+
+// AddEntry spoofs domain as described by entry,
+// replacing any previous entry.
+func (t *SpoofTable) AddEntry(domain string, entry SpoofEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]SpoofEntry)
+	}
+	t.entries[normalizeDomain(domain)] = entry
+}
+
+// Replace swaps every entry in the table for entries, keyed by domain
+// as in AddEntry, in one step: concurrent lookups see either the old
+// entries or the new ones, never a mix. Domains protected by NeverSpoof
+// stay protected.
+func (t *SpoofTable) Replace(entries map[string]SpoofEntry) {
+	replaced := make(map[string]SpoofEntry, len(entries))
+	for domain, entry := range entries {
+		replaced[normalizeDomain(domain)] = entry
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = replaced
+}
+
+// Remove stops spoofing domain.
+func (t *SpoofTable) Remove(domain string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, normalizeDomain(domain))
+}
+
+// NeverSpoof protects domain (which may be a wildcard, as in Add) from
+// ever being spoofed, however the table's entries match it: queries
+// with any question for it are left for the real resolver. This guards
+// against a broad wildcard accidentally hijacking e.g. a login domain.
+func (t *SpoofTable) NeverSpoof(domain string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.protected == nil {
+		t.protected = make(map[string]bool)
+	}
+	t.protected[normalizeDomain(domain)] = true
+}
+
+// isProtected returns whether question's name
+// is protected from spoofing by NeverSpoof.
+func (t *SpoofTable) isProtected(question layers.DNSQuestion) bool {
+	name := normalizeDomain(string(question.Name))
+	if name == "" {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.protected[name] {
+		return true
+	}
+	for _, w := range wildcardsFor(name) {
+		if t.protected[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the IP address that question should be answered with,
+// and whether there is one. Denied domains, and entries with only TXT
+// or PTR answers, have no IP address; for entries with several only the
+// first is returned.
+func (t *SpoofTable) Lookup(question layers.DNSQuestion) (net.IP, bool) {
+	entry, ok := t.LookupEntry(question)
+	if !ok || entry.Deny {
+		return nil, false
+	}
+	addrs := entry.addresses()
+	if len(addrs) == 0 {
+		return nil, false
+	}
+	return addrs[0], true
+}
+
+// LookupEntry returns the entry for question's name,
+// and whether the name is in the table at all.
+func (t *SpoofTable) LookupEntry(question layers.DNSQuestion) (SpoofEntry, bool) {
+	name := normalizeDomain(string(question.Name))
+	if name == "" {
+		return SpoofEntry{}, false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if entry, ok := t.entries[name]; ok {
+		return entry, true
+	}
+	for _, w := range wildcardsFor(name) {
+		if entry, ok := t.entries[w]; ok {
+			return entry, true
+		}
+	}
+	return SpoofEntry{}, false
+}
+
+// MatchesQuery returns whether dns is a standard query with a question
+// for a domain in the table, as in HasQuestionForDomain, and none for a
+// domain protected by NeverSpoof. Malformed packets never match
+// (see questionsOf).
+func (t *SpoofTable) MatchesQuery(dns *layers.DNS) bool {
+	if !isStandardQuery(dns) {
+		return false
+	}
+	matched := false
+	for _, q := range questionsOf(dns) {
+		if t.isProtected(q) {
+			return false
+		}
+		if _, ok := t.LookupEntry(q); ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// SpoofedResponse returns a complete DNS response to query which
+// answers every question found in the table with its spoofed IP,
+// cacheable for ttl seconds. It otherwise behaves like
+// BuildSpoofedResponseTTL.
+//
+// If any question is for a denied domain, the response is instead
+// an NXDOMAIN with no answers, and if any HTTPS question is for an
+// entry answering it with NODATA (see SpoofEntry.HTTPS) and there are
+// no other answers, a NODATA response. The returned bool reports whether the
+// table had anything to say about query; if not, the response holds
+// no answers and query should be handled some other way.
+//
+// Only standard queries (QR unset, OpCode Query) for the IN class are
+// ever spoofed, so that e.g. CHAOS-class version.bind queries and
+// dynamic updates are left for the real server. Neither are queries
+// which want DNSSEC (see WantsDNSSEC), since our answers would fail
+// validation, nor queries with any question protected by NeverSpoof.
+func (t *SpoofTable) SpoofedResponse(query *layers.DNS, ttl uint32) (*layers.DNS, bool) {
+	return t.spoofedResponse(query, ttl, false)
+}
+
+// SpoofedUDPResponse is like SpoofedResponse, but for a query which
+// arrived over UDP: if any question it would spoof is for an entry
+// marked Truncate, the response is instead an empty TruncatedResponse.
+func (t *SpoofTable) SpoofedUDPResponse(query *layers.DNS, ttl uint32) (*layers.DNS, bool) {
+	return t.spoofedResponse(query, ttl, true)
+}
+
+// spoofedResponse implements SpoofedResponse and SpoofedUDPResponse
+// for a table without a Decide.
+func (t *SpoofTable) spoofedResponse(query *layers.DNS, ttl uint32, udp bool) (*layers.DNS, bool) {
+	var answers []layers.DNSResourceRecord
+	truncate, nodata := false, false
+	if !isStandardQuery(query) || WantsDNSSEC(query) {
+		return BuildResponse(query, answers), false
+	}
+	questions := uniqueQuestions(questionsOf(query))
+	for _, q := range questions {
+		if t.isProtected(q) {
+			return BuildResponse(query, nil), false
+		}
+	}
+	for _, q := range questions {
+		if q.Class != layers.DNSClassIN || !t.spoofsType(q.Type) {
+			continue
+		}
+		entry, ok := t.LookupEntry(q)
+		if !ok {
+			continue
+		}
+		if entry.Deny {
+			return NXDomainResponseSOA(query, t.SOA), true
+		}
+		nodata = nodata || entry.answersNoData(q)
+		records, err := entry.answersFor(q, ttl)
+		if err != nil {
+			continue
+		}
+		if entry.Shuffle {
+			t.shuffle(records)
+		}
+		answers = append(answers, records...)
+		truncate = truncate || (entry.Truncate && len(records) > 0)
+	}
+	if udp && truncate {
+		return TruncatedResponse(query), true
+	}
+	if nodata && len(answers) == 0 {
+		return NoDataResponseSOA(query, t.SOA), true
+	}
+	return BuildResponse(query, answers), len(answers) > 0
+}
+
+// ResponseDelay returns how long a spoofed response to query should be
+// held back: the longest Delay of the entries for its questions.
+func (t *SpoofTable) ResponseDelay(query *layers.DNS) time.Duration {
+	var delay time.Duration
+	for _, q := range questionsOf(query) {
+		if entry, ok := t.LookupEntry(q); ok && entry.Delay > delay {
+			delay = entry.Delay
+		}
+	}
+	return delay
+}
+
+// shuffle randomizes the order of answers using t.Rand.
+func (t *SpoofTable) shuffle(answers []layers.DNSResourceRecord) {
+	if t.Rand == nil {
+		rand.Shuffle(len(answers), swapAnswers(answers))
+		return
+	}
+	// Unlike the default source, a rand.Rand is not safe for concurrent use.
+	t.randMu.Lock()
+	defer t.randMu.Unlock()
+	t.Rand.Shuffle(len(answers), swapAnswers(answers))
+}
+
+// spoofsType returns whether questions of type qtype may be spoofed.
+func (t *SpoofTable) spoofsType(qtype layers.DNSType) bool {
+	if t.Types == nil {
+		return true
+	}
+	for _, allowed := range t.Types {
+		if qtype == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ScrubResponse returns the raw DNS response with every record removed
+// which conflicts with the table: any in its answer, authority or
+// additional section for a name and type the table would spoof, or for
+// a denied name, along with the RRSIG records covering them. Forwarded
+// responses can otherwise carry the real addresses of spoofed names,
+// e.g. as glue, for the client to cache over ours. The section counts
+// are fixed to match. A response with nothing to remove, or which
+// cannot be decoded, is returned as it is.
+func (t *SpoofTable) ScrubResponse(response []byte) []byte {
+	dns, ok := decodeRawDNS(response)
+	if !ok {
+		return response
+	}
+	answers, scrubbedAnswers := t.scrubRecords(dns.Answers)
+	authorities, scrubbedAuthorities := t.scrubRecords(dns.Authorities)
+	additionals, scrubbedAdditionals := t.scrubRecords(dns.Additionals)
+	if !scrubbedAnswers && !scrubbedAuthorities && !scrubbedAdditionals {
+		return response
+	}
+	dns.Answers, dns.ANCount = answers, uint16(len(answers))
+	dns.Authorities, dns.NSCount = authorities, uint16(len(authorities))
+	dns.Additionals, dns.ARCount = additionals, uint16(len(additionals))
+	scrubbed, err := SerializeDNS(dns)
+	if err != nil {
+		return response
+	}
+	return scrubbed
+}
+
+// An rrset identifies the records of one name and type.
+type rrset struct {
+	name  string
+	rtype layers.DNSType
+}
+
+// scrubRecords returns records less those which conflict with the
+// table and the RRSIG records covering them, and whether there were
+// any. An RRSIG is no use without the RRset it signs.
+func (t *SpoofTable) scrubRecords(records []layers.DNSResourceRecord) ([]layers.DNSResourceRecord, bool) {
+	scrubbed := make(map[rrset]bool)
+	for _, rr := range records {
+		if rr.Type != dnsTypeRRSIG && t.conflicts(rr) {
+			scrubbed[rrset{normalizeDomain(string(rr.Name)), rr.Type}] = true
+		}
+	}
+	if len(scrubbed) == 0 {
+		return records, false
+	}
+	kept := records[:0:0]
+	for _, rr := range records {
+		set := rrset{normalizeDomain(string(rr.Name)), rr.Type}
+		if covered, ok := rrsigCovers(rr); ok {
+			set.rtype = covered
+		}
+		if !scrubbed[set] {
+			kept = append(kept, rr)
+		}
+	}
+	return kept, true
+}
+
+// conflicts returns whether rr is for a name and type the table would
+// answer differently, if asked.
+func (t *SpoofTable) conflicts(rr layers.DNSResourceRecord) bool {
+	if rr.Class != layers.DNSClassIN || !t.spoofsType(rr.Type) {
+		return false
+	}
+	q := layers.DNSQuestion{Name: rr.Name, Type: rr.Type, Class: rr.Class}
+	if t.isProtected(q) {
+		return false
+	}
+	entry, ok := t.LookupEntry(q)
+	if !ok {
+		return false
+	}
+	if entry.Deny || entry.answersNoData(q) {
+		return true
+	}
+	records, err := entry.answersFor(q, DefaultTTL)
+	return err == nil && len(records) > 0
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func questionFor(domain string) layers.DNSQuestion {
+	return layers.DNSQuestion{
+		Name:  []byte(domain),
+		Type:  layers.DNSTypeA,
+		Class: layers.DNSClassIN,
+	}
+}
+
+func TestSpoofTableLookup(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Add("Bank.com.", net.ParseIP("10.38.8.4"))
+	table.AddEntry("txt.eecs388.org", SpoofEntry{TXT: []string{"v=spf1 -all"}})
+
+	for _, v := range []struct {
+		name     string
+		domain   string
+		expected net.IP
+	}{
+		{"exact domain", "eecs388.org", net.ParseIP("3.23.25.235")},
+		{"entry without addresses", "txt.eecs388.org", nil},
+		{"mixed-case trailing-dot domain", "EECS388.org.", net.ParseIP("3.23.25.235")},
+		{"domain added with mixed case", "bank.com", net.ParseIP("10.38.8.4")},
+		{"prefix of spoofed domain", "eecs388.orgcom", nil},
+		{"different domain", "wrong.com", nil},
+		{"root", ".", nil},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			ip, ok := table.Lookup(questionFor(v.domain))
+			if ok != (v.expected != nil) {
+				t.Fatalf("expected Lookup(%q) to report found=%v, got %v", v.domain, v.expected != nil, ok)
+			}
+			if ok && !ip.Equal(v.expected) {
+				t.Errorf("expected Lookup(%q) to return %s, got %s", v.domain, v.expected, ip)
+			}
+		})
+	}
+
+	table.Remove("EECS388.ORG")
+	if _, ok := table.Lookup(questionFor("eecs388.org")); ok {
+		t.Errorf("expected eecs388.org to be gone after Remove")
+	}
+}
+
+func TestSpoofTableWildcard(t *testing.T) {
+	var table SpoofTable
+	table.Add("*.eecs388.org", net.ParseIP("10.38.8.4"))
+	table.Add("*.api.eecs388.org", net.ParseIP("10.38.8.5"))
+	table.Add("static.api.eecs388.org", net.ParseIP("10.38.8.6"))
+
+	for _, v := range []struct {
+		name     string
+		domain   string
+		expected net.IP
+	}{
+		{"apex not listed", "eecs388.org", nil},
+		{"one-level subdomain", "login.eecs388.org", net.ParseIP("10.38.8.4")},
+		{"more specific wildcard", "v1.api.eecs388.org", net.ParseIP("10.38.8.5")},
+		{"multi-level under more specific wildcard", "x.v1.api.eecs388.org", net.ParseIP("10.38.8.5")},
+		{"exact entry beats wildcard", "static.api.eecs388.org", net.ParseIP("10.38.8.6")},
+		{"apex of more specific wildcard", "api.eecs388.org", net.ParseIP("10.38.8.4")},
+		{"near miss", "noteecs388.org", nil},
+		{"hyphenated near miss", "evil-eecs388.org", nil},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			ip, ok := table.Lookup(questionFor(v.domain))
+			if ok != (v.expected != nil) {
+				t.Fatalf("expected Lookup(%q) to report found=%v, got %v", v.domain, v.expected != nil, ok)
+			}
+			if ok && !ip.Equal(v.expected) {
+				t.Errorf("expected Lookup(%q) to return %s, got %s", v.domain, v.expected, ip)
+			}
+		})
+	}
+
+	table.Add("eecs388.org", net.ParseIP("10.38.8.7"))
+	if ip, ok := table.Lookup(questionFor("eecs388.org")); !ok || !ip.Equal(net.ParseIP("10.38.8.7")) {
+		t.Errorf("expected apex to be spoofed once listed explicitly, got %s, %v", ip, ok)
+	}
+}
+
+func TestSpoofTableConcurrent(t *testing.T) {
+	var table SpoofTable
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		domain := fmt.Sprintf("host%d.eecs388.org", i)
+		ip := net.IPv4(10, 38, 8, byte(i))
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			table.Add(domain, ip)
+		}()
+		go func() {
+			defer wg.Done()
+			if got, ok := table.Lookup(questionFor(domain)); ok && !got.Equal(ip) {
+				t.Errorf("expected Lookup(%q) to return %s, got %s", domain, ip, got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		domain := fmt.Sprintf("host%d.eecs388.org", i)
+		if _, ok := table.Lookup(questionFor(domain)); !ok {
+			t.Errorf("expected %q to be in the table", domain)
+		}
+	}
+}
+
+func TestSpoofTableSpoofedResponse(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Add("bank.com", net.ParseIP("10.38.8.4"))
+
+	query := dnsWithDomainQuestions([]string{"eecs388.org", "wrong.com", "bank.com"})
+	response, ok := table.SpoofedResponse(query, 300)
+	if !ok {
+		t.Fatalf("expected the table to spoof a query for two of its domains")
+	}
+	decoded := roundTripDNS(t, response)
+
+	if decoded.QDCount != 3 {
+		t.Errorf("expected all 3 questions to be echoed, got %d", decoded.QDCount)
+	}
+	if len(decoded.Answers) != 2 {
+		t.Fatalf("expected 2 answers, got %d", len(decoded.Answers))
+	}
+	for i, expected := range []struct {
+		name string
+		ip   net.IP
+	}{
+		{"eecs388.org", net.ParseIP("3.23.25.235")},
+		{"bank.com", net.ParseIP("10.38.8.4")},
+	} {
+		answer := decoded.Answers[i]
+		if string(answer.Name) != expected.name {
+			t.Errorf("expected answer %d for %q, got %q", i, expected.name, answer.Name)
+		}
+		if !answer.IP.Equal(expected.ip) {
+			t.Errorf("expected answer %d to point to %s, got %s", i, expected.ip, answer.IP)
+		}
+	}
+}
+
+func TestSpoofTableMultipleIPs(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{
+		IP:  net.ParseIP("3.23.25.235"),
+		IPs: []net.IP{net.ParseIP("10.38.8.4"), net.ParseIP("10.38.8.5")},
+	})
+
+	if ip, ok := table.Lookup(questionFor("eecs388.org")); !ok || !ip.Equal(net.ParseIP("3.23.25.235")) {
+		t.Errorf("expected Lookup to return the first address 3.23.25.235 but got %v", ip)
+	}
+	response, ok := table.SpoofedResponse(dnsWithDomainQuestions([]string{"eecs388.org"}), DefaultTTL)
+	if !ok {
+		t.Fatalf("expected the table to spoof a query for its domain")
+	}
+	decoded := roundTripDNS(t, response)
+	expected := []string{"3.23.25.235", "10.38.8.4", "10.38.8.5"}
+	if got := answerIPs(decoded.Answers); decoded.ANCount != 3 || strings.Join(got, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected ANCount 3 and answers %v in order, got ANCount %d and %v", expected, decoded.ANCount, got)
+	}
+}
+
+func TestSpoofTableShuffle(t *testing.T) {
+	table := SpoofTable{Rand: rand.New(rand.NewSource(388))}
+	entry := SpoofEntry{Shuffle: true}
+	for i := 1; i <= 8; i++ {
+		entry.IPs = append(entry.IPs, net.IPv4(10, 38, 8, byte(i)))
+	}
+	table.AddEntry("eecs388.org", entry)
+
+	orders := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		response, _ := table.SpoofedResponse(dnsWithDomainQuestions([]string{"eecs388.org"}), DefaultTTL)
+		got := answerIPs(response.Answers)
+		if len(got) != len(entry.IPs) {
+			t.Fatalf("expected %d answers, got %v", len(entry.IPs), got)
+		}
+		orders[strings.Join(got, " ")] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("expected the answer order to vary across responses, got %v", orders)
+	}
+}
+
+func TestSpoofTableDeny(t *testing.T) {
+	table := SpoofTable{SOA: NegativeSOA{MName: "ns.eecs388.org", TTL: 60}}
+	table.Deny("update.eecs388.org")
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	if _, ok := table.Lookup(questionFor("update.eecs388.org")); ok {
+		t.Errorf("expected Lookup to report no IP for a denied domain")
+	}
+
+	query := dnsWithDomainQuestions([]string{"update.eecs388.org"})
+	query.ID = 0x388
+	response, ok := table.SpoofedResponse(query, 300)
+	if !ok {
+		t.Fatalf("expected the table to handle a query for a denied domain")
+	}
+	decoded := roundTripDNS(t, response)
+	if decoded.ResponseCode != layers.DNSResponseCodeNXDomain {
+		t.Errorf("expected response code %s, got %s", layers.DNSResponseCodeNXDomain, decoded.ResponseCode)
+	}
+	if decoded.ANCount != 0 || len(decoded.Answers) != 0 {
+		t.Errorf("expected no answers, got ANCount %d with %d answers", decoded.ANCount, len(decoded.Answers))
+	}
+	if decoded.ID != query.ID {
+		t.Errorf("expected transaction ID %#x, got %#x", query.ID, decoded.ID)
+	}
+	if len(decoded.Questions) != 1 || string(decoded.Questions[0].Name) != "update.eecs388.org" {
+		t.Errorf("expected the question to be echoed, got %v", decoded.Questions)
+	}
+	if len(decoded.Authorities) != 1 || string(decoded.Authorities[0].SOA.MName) != "ns.eecs388.org" || decoded.Authorities[0].TTL != 60 {
+		t.Errorf("expected the table's SOA record in the authority section, got %v", decoded.Authorities)
+	}
+
+	// Unrelated domains are unaffected by the denylist.
+	response, _ = table.SpoofedResponse(dnsWithDomainQuestions([]string{"eecs388.org"}), 300)
+	if response.ResponseCode != layers.DNSResponseCodeNoErr || len(response.Answers) != 1 {
+		t.Errorf("expected a spoofed answer for eecs388.org, got %s with %d answers", response.ResponseCode, len(response.Answers))
+	}
+	if _, ok := table.SpoofedResponse(dnsWithDomainQuestions([]string{"umich.edu"}), 300); ok {
+		t.Errorf("expected the table not to handle a query for an unlisted domain")
+	}
+}
+
+func TestSpoofTableTXT(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{
+		IP:  net.ParseIP("3.23.25.235"),
+		TXT: []string{"google-site-verification=388", "v=spf1 -all", long},
+	})
+
+	query := &layers.DNS{
+		QDCount: 2,
+		Questions: []layers.DNSQuestion{
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN},
+			{Name: []byte("eecs388.org"), Type: layers.DNSTypeA, Class: layers.DNSClassIN},
+		},
+	}
+	response, ok := table.SpoofedResponse(query, 300)
+	if !ok {
+		t.Fatalf("expected the table to spoof a TXT query for one of its domains")
+	}
+	decoded := roundTripDNS(t, response)
+
+	if len(decoded.Answers) != 2 {
+		t.Fatalf("expected a TXT and an A answer, got %d answers", len(decoded.Answers))
+	}
+	txt := decoded.Answers[0]
+	if txt.Type != layers.DNSTypeTXT {
+		t.Fatalf("expected first answer to be a TXT record, got %s", txt.Type)
+	}
+	expected := []string{"google-site-verification=388", "v=spf1 -all", long[:255], long[255:]}
+	if len(txt.TXTs) != len(expected) {
+		t.Fatalf("expected %d TXT strings, got %d", len(expected), len(txt.TXTs))
+	}
+	for i, e := range expected {
+		if string(txt.TXTs[i]) != e {
+			t.Errorf("expected TXT string %d to be %q, got %q", i, e, txt.TXTs[i])
+		}
+	}
+	if decoded.Answers[1].Type != layers.DNSTypeA {
+		t.Errorf("expected A question to still get an A answer, got %s", decoded.Answers[1].Type)
+	}
+}
+
+func TestSpoofTableTXTWithoutStrings(t *testing.T) {
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	query := &layers.DNS{
+		QDCount:   1,
+		Questions: []layers.DNSQuestion{{Name: []byte("eecs388.org"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN}},
+	}
+	if _, ok := table.SpoofedResponse(query, 300); ok {
+		t.Errorf("expected a TXT question for an entry without TXT strings not to be spoofed")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	for _, v := range []struct {
+		ip       net.IP
+		expected string
+	}{
+		{net.ParseIP("3.23.25.235"), "235.25.23.3.in-addr.arpa"},
+		{net.IPv4(10, 38, 8, 4).To4(), "4.8.38.10.in-addr.arpa"},
+		{net.ParseIP("2001:db8::388"), "8.8.3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{nil, ""},
+	} {
+		if got := ReverseName(v.ip); got != v.expected {
+			t.Errorf("expected ReverseName(%s) to return %q, got %q", v.ip, v.expected, got)
+		}
+	}
+}
+
+func TestSpoofTablePTR(t *testing.T) {
+	var table SpoofTable
+	table.AddPTR(net.ParseIP("10.38.8.4"), "bank.com")
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+	ptrQuestion := func(name string) *layers.DNS {
+		return &layers.DNS{
+			QDCount:   1,
+			Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypePTR, Class: layers.DNSClassIN}},
+		}
+	}
+
+	for _, v := range []struct {
+		name     string
+		query    *layers.DNS
+		expected string
+	}{
+		{"reverse name in table", ptrQuestion("4.8.38.10.in-addr.arpa"), "bank.com"},
+		{"mixed-case reverse name", ptrQuestion("4.8.38.10.IN-ADDR.ARPA"), "bank.com"},
+		{"different reverse name", ptrQuestion("5.8.38.10.in-addr.arpa"), ""},
+		{"address in the wrong order", ptrQuestion("10.38.8.4.in-addr.arpa"), ""},
+		{"PTR question for a forward name", ptrQuestion("eecs388.org"), ""},
+		{"A question for a reverse name", dnsWithDomainQuestions([]string{"4.8.38.10.in-addr.arpa"}), ""},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			response, ok := table.SpoofedResponse(v.query, 300)
+			if v.expected == "" {
+				if ok {
+					t.Errorf("expected no spoofed answer, got %v", response.Answers)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected a spoofed PTR answer")
+			}
+			decoded := roundTripDNS(t, response)
+			if len(decoded.Answers) != 1 || decoded.Answers[0].Type != layers.DNSTypePTR {
+				t.Fatalf("expected a single PTR answer, got %v", decoded.Answers)
+			}
+			if string(decoded.Answers[0].PTR) != v.expected {
+				t.Errorf("expected PTR %q, got %q", v.expected, decoded.Answers[0].PTR)
+			}
+		})
+	}
+}
+
+func TestSpoofTableIgnoresNonStandardQueries(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("version.bind", SpoofEntry{IP: net.ParseIP("3.23.25.235"), TXT: []string{"spoofed"}})
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Deny("update.eecs388.org")
+
+	chaos := &layers.DNS{
+		OpCode:    layers.DNSOpCodeQuery,
+		QDCount:   1,
+		Questions: []layers.DNSQuestion{{Name: []byte("version.bind"), Type: layers.DNSTypeTXT, Class: layers.DNSClassCH}},
+	}
+	update := dnsWithDomainQuestions([]string{"eecs388.org"})
+	update.OpCode = layers.DNSOpCodeUpdate
+	deniedUpdate := dnsWithDomainQuestions([]string{"update.eecs388.org"})
+	deniedUpdate.OpCode = layers.DNSOpCodeUpdate
+	response := dnsWithDomainQuestions([]string{"eecs388.org"})
+	response.QR = true
+
+	for _, v := range []struct {
+		name  string
+		query *layers.DNS
+	}{
+		{"CHAOS-class query", chaos},
+		{"dynamic update", update},
+		{"dynamic update for denied domain", deniedUpdate},
+		{"response", response},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if response, ok := table.SpoofedResponse(v.query, 300); ok || len(response.Answers) != 0 {
+				t.Errorf("expected no spoofed answer, got %v", response.Answers)
+			}
+		})
+	}
+}
+
+func TestSpoofTableTypes(t *testing.T) {
+	table := SpoofTable{Types: []layers.DNSType{layers.DNSTypeA}}
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), TXT: []string{"spoofed"}})
+
+	if _, ok := table.SpoofedResponse(dnsWithDomainQuestions([]string{"eecs388.org"}), 300); !ok {
+		t.Errorf("expected an A question to be spoofed")
+	}
+	txt := &layers.DNS{
+		QDCount:   1,
+		Questions: []layers.DNSQuestion{{Name: []byte("eecs388.org"), Type: layers.DNSTypeTXT, Class: layers.DNSClassIN}},
+	}
+	if _, ok := table.SpoofedResponse(txt, 300); ok {
+		t.Errorf("expected a TXT question not to be spoofed when only A is configured")
+	}
+}
+
+func TestSpoofTableSpoofedUDPResponse(t *testing.T) {
+	var table SpoofTable
+	table.AddEntry("eecs388.org", SpoofEntry{IP: net.ParseIP("3.23.25.235"), Truncate: true})
+	table.Add("umich.edu", net.ParseIP("141.211.243.251"))
+
+	for _, v := range []struct {
+		name        string
+		domains     []string
+		truncated   bool
+		answerCount int
+	}{
+		{"truncated entry", []string{"eecs388.org"}, true, 0},
+		{"plain entry", []string{"umich.edu"}, false, 1},
+		{"mixed entries", []string{"umich.edu", "eecs388.org"}, true, 0},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			query := dnsWithDomainQuestions(v.domains)
+			response, ok := table.SpoofedUDPResponse(query, 300)
+			if !ok {
+				t.Fatalf("expected query for %v to be spoofed", v.domains)
+			}
+			if response.TC != v.truncated {
+				t.Errorf("expected TC bit %v but got %v", v.truncated, response.TC)
+			}
+			if len(response.Answers) != v.answerCount {
+				t.Errorf("expected %d answers but got %v", v.answerCount, response.Answers)
+			}
+
+			if response, _ := table.SpoofedResponse(query, 300); response.TC {
+				t.Errorf("expected SpoofedResponse never to truncate")
+			}
+		})
+	}
+}
+
+func TestSpoofTableNeverSpoof(t *testing.T) {
+	var table SpoofTable
+	table.Add("*.umich.edu", net.ParseIP("3.23.25.235"))
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	table.Deny("weblogin.umich.edu")
+	table.NeverSpoof("weblogin.umich.edu")
+	table.NeverSpoof("*.sso.umich.edu")
+
+	for _, v := range []struct {
+		name    string
+		domains []string
+		spoofed bool
+	}{
+		{"wildcard match", []string{"www.umich.edu"}, true},
+		{"protected over wildcard and deny", []string{"weblogin.umich.edu"}, false},
+		{"protected case-insensitively", []string{"WebLogin.UMich.edu"}, false},
+		{"protected wildcard", []string{"shibboleth.sso.umich.edu"}, false},
+		{"protected question alongside spoofed one", []string{"eecs388.org", "weblogin.umich.edu"}, false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			query := dnsWithDomainQuestions(v.domains)
+			if _, ok := table.SpoofedResponse(query, 300); ok != v.spoofed {
+				t.Errorf("expected query for %v to be spoofed: %v, but got %v", v.domains, v.spoofed, ok)
+			}
+			if ok := table.MatchesQuery(query); ok != v.spoofed {
+				t.Errorf("expected query for %v to match: %v, but got %v", v.domains, v.spoofed, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Record types for service binding (RFC 9460), which gopacket does not
+// know about. Browsers ask for HTTPS records alongside A and AAAA records
+// to learn e.g. which protocols (ALPN) and ECH config a server supports.
+const (
+	DNSTypeSVCB  layers.DNSType = 64
+	DNSTypeHTTPS layers.DNSType = 65
+)
+
+// An HTTPSAnswer selects how a SpoofEntry answers HTTPS questions.
+type HTTPSAnswer int
+
+const (
+	// HTTPSNoData answers HTTPS questions with no records (NODATA), so
+	// that the client goes by its A and AAAA lookups alone and is never
+	// given the real server's ECH or ALPN config.
+	HTTPSNoData HTTPSAnswer = iota
+	// HTTPSRecord answers HTTPS questions with a forged record pointing
+	// at the entry's addresses (see AnswerHTTPSForQuestion).
+	HTTPSRecord
+)
+
+// An SVCParamKey identifies a SvcParam of an SVCB or HTTPS record
+// (RFC 9460, section 14.3.2).
+type SVCParamKey uint16
+
+const (
+	SVCParamMandatory     SVCParamKey = 0
+	SVCParamALPN          SVCParamKey = 1
+	SVCParamNoDefaultALPN SVCParamKey = 2
+	SVCParamPort          SVCParamKey = 3
+	SVCParamIPv4Hint      SVCParamKey = 4
+	SVCParamECH           SVCParamKey = 5
+	SVCParamIPv6Hint      SVCParamKey = 6
+)
+
+// An SVCParam is a SvcParam of an SVCB or HTTPS record: a key and its
+// value in wire format, e.g. the 4-byte addresses of an ipv4hint.
+type SVCParam struct {
+	Key   SVCParamKey
+	Value []byte
+}
+
+// EncodeSVCB returns the RDATA of an SVCB or HTTPS record in wire format
+// (RFC 9460, section 2.2): priority, the target name, and params, which
+// are written in order of their keys as required.
+//
+// An error is returned if the target is not a valid name, if a key is
+// given twice or a value is too long, or if params are given with
+// priority 0 (AliasMode), which carries none.
+func EncodeSVCB(priority uint16, target string, params []SVCParam) ([]byte, error) {
+	if priority == 0 && len(params) > 0 {
+		return nil, errors.New("an AliasMode record cannot carry SvcParams")
+	}
+	data := make([]byte, 2, 2+len(target)+2)
+	binary.BigEndian.PutUint16(data, priority)
+	data, err := appendName(data, target)
+	if err != nil {
+		return nil, fmt.Errorf("target name: %w", err)
+	}
+
+	sorted := append([]SVCParam(nil), params...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	for i, p := range sorted {
+		if i > 0 && p.Key == sorted[i-1].Key {
+			return nil, fmt.Errorf("SvcParam key %d given more than once", p.Key)
+		}
+		if len(p.Value) > 0xffff {
+			return nil, fmt.Errorf("value of SvcParam key %d is %d bytes long", p.Key, len(p.Value))
+		}
+		var header [4]byte
+		binary.BigEndian.PutUint16(header[:], uint16(p.Key))
+		binary.BigEndian.PutUint16(header[2:], uint16(len(p.Value)))
+		data = append(append(data, header[:]...), p.Value...)
+	}
+	return data, nil
+}
+
+// appendName appends name to b in wire format, uncompressed. A trailing
+// dot is optional, and "" or "." is the root. An error is returned if a
+// label is empty or longer than 63 bytes.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return append(b, 0), nil
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > maxLabelLength {
+			return nil, fmt.Errorf("invalid label %q in %q", label, name)
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0), nil
+}
+
+// addressHints returns the ipv4hint and ipv6hint SvcParams for ips,
+// leaving out either one if ips holds no address of its family.
+func addressHints(ips []net.IP) []SVCParam {
+	var v4, v6 []byte
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4...)
+		} else if len(ip) == net.IPv6len {
+			v6 = append(v6, ip...)
+		}
+	}
+	var params []SVCParam
+	if len(v4) > 0 {
+		params = append(params, SVCParam{Key: SVCParamIPv4Hint, Value: v4})
+	}
+	if len(v6) > 0 {
+		params = append(params, SVCParam{Key: SVCParamIPv6Hint, Value: v6})
+	}
+	return params
+}
+
+// AnswerHTTPSForQuestion returns a basic HTTPS answer to question which
+// may be cached by the client for ttl seconds: priority 1, the question's
+// own name as target, and ips as address hints. It carries no ALPN or ECH
+// config, so the client connects to the hinted addresses as it would
+// with a plain A or AAAA answer.
+//
+// Since gopacket cannot serialize HTTPS records, the record's RDATA is
+// held in its Data, from which the serializers in this package write it.
+func AnswerHTTPSForQuestion(question layers.DNSQuestion, ips []net.IP, ttl uint32) (layers.DNSResourceRecord, error) {
+	if question.Type != DNSTypeHTTPS {
+		return layers.DNSResourceRecord{}, fmt.Errorf("question for %q has type %s, not HTTPS", question.Name, question.Type)
+	}
+	hints := addressHints(ips)
+	if len(hints) == 0 {
+		return layers.DNSResourceRecord{}, fmt.Errorf("no addresses to answer HTTPS question for %q with", question.Name)
+	}
+	data, err := EncodeSVCB(1, ".", hints)
+	if err != nil {
+		return layers.DNSResourceRecord{}, err
+	}
+	return layers.DNSResourceRecord{
+		Name:       question.Name,
+		Type:       DNSTypeHTTPS,
+		Class:      layers.DNSClassIN,
+		TTL:        ttl,
+		DataLength: uint16(len(data)),
+		Data:       data,
+	}, nil
+}
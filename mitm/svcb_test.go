@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestEncodeSVCB(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		priority uint16
+		target   string
+		params   []SVCParam
+		expected []byte
+		err      bool
+	}{
+		{
+			"ipv4hint", 1, ".",
+			[]SVCParam{{Key: SVCParamIPv4Hint, Value: []byte{3, 23, 25, 235}}},
+			[]byte{0, 1, 0, 0, 4, 0, 4, 3, 23, 25, 235},
+			false,
+		},
+		{
+			"params sorted by key", 1, "",
+			[]SVCParam{
+				{Key: SVCParamIPv4Hint, Value: []byte{10, 38, 8, 4}},
+				{Key: SVCParamALPN, Value: []byte{2, 'h', '2'}},
+			},
+			[]byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2', 0, 4, 0, 4, 10, 38, 8, 4},
+			false,
+		},
+		{
+			"AliasMode", 0, "svc.eecs388.org.", nil,
+			[]byte{0, 0, 3, 's', 'v', 'c', 7, 'e', 'e', 'c', 's', '3', '8', '8', 3, 'o', 'r', 'g', 0},
+			false,
+		},
+		{
+			"AliasMode with params", 0, ".",
+			[]SVCParam{{Key: SVCParamPort, Value: []byte{1, 187}}},
+			nil, true,
+		},
+		{
+			"duplicate key", 1, ".",
+			[]SVCParam{{Key: SVCParamPort, Value: []byte{1, 187}}, {Key: SVCParamPort, Value: []byte{0, 80}}},
+			nil, true,
+		},
+		{"empty label", 1, "svc..eecs388.org", nil, nil, true},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			data, err := EncodeSVCB(v.priority, v.target, v.params)
+			if v.err {
+				if err == nil {
+					t.Errorf("expected an error but got %v", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(data, v.expected) {
+				t.Errorf("expected RDATA %v but got %v", v.expected, data)
+			}
+		})
+	}
+}
+
+func TestAnswerHTTPSForQuestion(t *testing.T) {
+	q := layers.DNSQuestion{Name: []byte("eecs388.org"), Type: DNSTypeHTTPS, Class: layers.DNSClassIN}
+	answer, err := AnswerHTTPSForQuestion(q, []net.IP{net.ParseIP("3.23.25.235"), net.ParseIP("2001:db8::388")}, 60)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	query := &layers.DNS{ID: 0x388, Questions: []layers.DNSQuestion{q}}
+	decoded := roundTripDNS(t, withEDNS(BuildResponse(query, []layers.DNSResourceRecord{answer}), 1232, false))
+	if len(decoded.Answers) != 1 {
+		t.Fatalf("expected a single answer but got %v", decoded.Answers)
+	}
+	rr := decoded.Answers[0]
+	if rr.Type != DNSTypeHTTPS || string(rr.Name) != "eecs388.org" || rr.TTL != 60 {
+		t.Errorf("expected an HTTPS record for eecs388.org with TTL 60 but got %v", rr)
+	}
+	expected := []byte{0, 1, 0, 0, 4, 0, 4, 3, 23, 25, 235, 0, 6, 0, 16}
+	expected = append(expected, net.ParseIP("2001:db8::388")...)
+	if !bytes.Equal(rr.Data, expected) {
+		t.Errorf("expected RDATA %v but got %v", expected, rr.Data)
+	}
+	if len(decoded.Additionals) != 1 || decoded.Additionals[0].Type != layers.DNSTypeOPT {
+		t.Errorf("expected the OPT record to follow the HTTPS record but got %v", decoded.Additionals)
+	}
+
+	if _, err := AnswerHTTPSForQuestion(questionFor("eecs388.org"), []net.IP{net.ParseIP("3.23.25.235")}, 60); err == nil {
+		t.Errorf("expected an error answering an A question")
+	}
+	if _, err := AnswerHTTPSForQuestion(q, nil, 60); err == nil {
+		t.Errorf("expected an error answering with no addresses")
+	}
+}
+
+func TestSpoofTableHTTPS(t *testing.T) {
+	var table SpoofTable
+	table.Add("nodata.eecs388.org", net.ParseIP("3.23.25.235"))
+	table.AddEntry("record.eecs388.org", SpoofEntry{IP: net.ParseIP("10.38.8.4"), HTTPS: HTTPSRecord})
+	table.AddEntry("txt.eecs388.org", SpoofEntry{TXT: []string{"v=spf1 -all"}})
+
+	for _, v := range []struct {
+		domain  string
+		spoofed bool
+		answers int
+		soa     bool
+	}{
+		{"nodata.eecs388.org", true, 0, true},
+		{"record.eecs388.org", true, 1, false},
+		{"txt.eecs388.org", false, 0, false},
+		{"umich.edu", false, 0, false},
+	} {
+		query := dnsWithDomainQuestions([]string{v.domain})
+		query.Questions[0].Type = DNSTypeHTTPS
+		response, ok := table.SpoofedResponse(query, 300)
+		if ok != v.spoofed {
+			t.Errorf("expected the table to handle the query for %s to be %v but got %v", v.domain, v.spoofed, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		decoded := roundTripDNS(t, response)
+		if decoded.ResponseCode != layers.DNSResponseCodeNoErr || len(decoded.Answers) != v.answers {
+			t.Errorf("expected %d answers for %s but got %s with %v", v.answers, v.domain, decoded.ResponseCode, decoded.Answers)
+		}
+		if soa := len(decoded.Authorities) == 1 && decoded.Authorities[0].Type == layers.DNSTypeSOA; soa != v.soa {
+			t.Errorf("expected an SOA record in the response for %s to be %v but got %v", v.domain, v.soa, decoded.Authorities)
+		}
+	}
+
+	// The real server's HTTPS records are scrubbed either way.
+	real := func(domain string) layers.DNSResourceRecord {
+		data, err := EncodeSVCB(1, ".", []SVCParam{{Key: SVCParamALPN, Value: []byte{2, 'h', '3'}}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return layers.DNSResourceRecord{Name: []byte(domain), Type: DNSTypeHTTPS, Class: layers.DNSClassIN, TTL: 300, Data: data}
+	}
+	forwarded, err := SerializeDNS(&layers.DNS{
+		QR:      true,
+		Answers: []layers.DNSResourceRecord{real("nodata.eecs388.org"), real("record.eecs388.org"), real("umich.edu")},
+	})
+	if err != nil {
+		t.Fatalf("failed to serialize response: %v", err)
+	}
+	scrubbed := decodeDNS(t, table.ScrubResponse(forwarded))
+	if len(scrubbed.Answers) != 1 || string(scrubbed.Answers[0].Name) != "umich.edu" {
+		t.Errorf("expected only the HTTPS record for umich.edu to be kept but got %v", scrubbed.Answers)
+	}
+}
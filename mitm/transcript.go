@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// A Recorder records the transactions a Proxy intercepts, for analysis
+// once the attack is over. Record is given each request as it was sent
+// to the upstream server and the server's response, with their bodies.
+type Recorder interface {
+	Record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte)
+}
+
+// A TranscriptRecorder is a Recorder which appends each transaction to
+// an io.Writer as plain HTTP/1.1: the request line, headers and body,
+// followed by the status line, headers and body of the response. Each
+// message carries the Content-Length of its body and no Transfer-Encoding,
+// so a transcript can be read back with http.ReadRequest and
+// http.ReadResponse in turn.
+//
+// A TranscriptRecorder is safe for concurrent use. Errors writing
+// the transcript are logged, and do not stop the request being relayed.
+type TranscriptRecorder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewTranscriptRecorder returns a TranscriptRecorder which writes to w,
+// e.g. a file opened with os.O_APPEND.
+func NewTranscriptRecorder(w io.Writer) *TranscriptRecorder {
+	return &TranscriptRecorder{w: w}
+}
+
+// Record implements Recorder.
+func (t *TranscriptRecorder) Record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bw := bufio.NewWriter(t.w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	if req.Host != "" {
+		fmt.Fprintf(bw, "Host: %s\r\n", req.Host)
+	}
+	writeTranscriptMessage(bw, req.Header, reqBody)
+	fmt.Fprintf(bw, "HTTP/1.1 %s\r\n", resp.Status)
+	writeTranscriptMessage(bw, resp.Header, respBody)
+	if err := bw.Flush(); err != nil {
+		log.Printf("recording transaction: %v", err)
+	}
+}
+
+// writeTranscriptMessage writes the header and body of a message
+// as framed by a TranscriptRecorder.
+func writeTranscriptMessage(w io.Writer, header http.Header, body []byte) {
+	header = header.Clone()
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Write(w)
+	io.WriteString(w, "\r\n")
+	w.Write(body)
+}
+
+// record passes the transaction to p's Recorder, if any.
+func (p *Proxy) record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	if p.Recorder == nil {
+		return
+	}
+	p.Recorder.Record(req, reqBody, resp, respBody)
+}
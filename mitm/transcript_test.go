@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// transaction is one transaction given to a capturingRecorder.
+type transaction struct {
+	req      *http.Request
+	reqBody  []byte
+	resp     *http.Response
+	respBody []byte
+}
+
+// capturingRecorder is a Recorder which keeps every transaction in memory.
+type capturingRecorder struct {
+	transactions []transaction
+}
+
+func (r *capturingRecorder) Record(req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) {
+	r.transactions = append(r.transactions, transaction{req, reqBody, resp, respBody})
+}
+
+func TestProxyRecorder(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "received "+string(b))
+	}))
+	defer s.Close()
+
+	var recorder capturingRecorder
+	p := &Proxy{Upstream: s.URL, SpoofTo: "mallory", Recorder: &recorder}
+	r := httptest.NewRequest("POST", uri, strings.NewReader("to=alice"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(recorder.transactions) != 1 {
+		t.Fatalf("expected 1 transaction recorded but got %d", len(recorder.transactions))
+	}
+	tr := recorder.transactions[0]
+	if tr.req.Method != "POST" || tr.req.URL.Path != uri {
+		t.Errorf("expected a transaction for POST %s but got %s %s", uri, tr.req.Method, tr.req.URL.Path)
+	}
+	if tr.resp.StatusCode != http.StatusCreated {
+		t.Errorf("expected status %d but got %d", http.StatusCreated, tr.resp.StatusCode)
+	}
+	if string(tr.reqBody) != "to=mallory" || string(tr.respBody) != "received to=mallory" {
+		t.Errorf("expected the bodies exchanged with the server but got %q and %q", tr.reqBody, tr.respBody)
+	}
+}
+
+func TestTranscriptRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := NewTranscriptRecorder(&buf)
+	for _, body := range []string{"to=alice", "to=bob"} {
+		req := httptest.NewRequest("POST", "http://bank.com"+uri, nil)
+		req.Header.Set(ctsHeaderKey, "cts")
+		resp := &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{stcHeaderKey: {"stc"}, "Transfer-Encoding": {"chunked"}},
+		}
+		recorder.Record(req, []byte(body), resp, []byte("received "+body))
+	}
+
+	br := bufio.NewReader(&buf)
+	for _, body := range []string{"to=alice", "to=bob"} {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatalf("failed to read back request: %v", err)
+		}
+		b, _ := io.ReadAll(req.Body)
+		if req.Method != "POST" || req.URL.Path != uri || req.Host != "bank.com" || string(b) != body {
+			t.Errorf("expected POST %s to bank.com with body %q but got %s %s to %s with body %q",
+				uri, body, req.Method, req.URL.Path, req.Host, b)
+		}
+		if req.Header.Get(ctsHeaderKey) != "cts" {
+			t.Errorf("expected request header %s to be recorded but got %v", ctsHeaderKey, req.Header)
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("failed to read back response: %v", err)
+		}
+		b, _ = io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(b) != "received "+body {
+			t.Errorf("expected status %d with body %q but got %d with %q", http.StatusOK, "received "+body, resp.StatusCode, b)
+		}
+		if resp.Header.Get(stcHeaderKey) != "stc" {
+			t.Errorf("expected response header %s to be recorded but got %v", stcHeaderKey, resp.Header)
+		}
+	}
+	if _, err := br.Peek(1); err != io.EOF {
+		t.Errorf("expected the transcript to hold exactly 2 transactions")
+	}
+}
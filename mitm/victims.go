@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A VictimFilter picks out the clients whose queries are spoofed, so that
+// only the victim's lookups are poisoned rather than the whole network's.
+// A client is a victim if its IP address is in any of Nets or its MAC
+// address is any of MACs. An empty or nil filter makes every client a victim.
+type VictimFilter struct {
+	Nets []*net.IPNet
+	MACs []net.HardwareAddr
+}
+
+// ParseVictimFilter returns a filter for the clients in cidrs,
+// each a CIDR block such as "10.38.8.0/24" or a single IP address,
+// and those with the MAC addresses in macs.
+func ParseVictimFilter(cidrs, macs []string) (*VictimFilter, error) {
+	f := &VictimFilter{}
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid victim address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			f.Nets = append(f.Nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		f.Nets = append(f.Nets, ipnet)
+	}
+	for _, m := range macs {
+		mac, err := net.ParseMAC(m)
+		if err != nil {
+			return nil, err
+		}
+		f.MACs = append(f.MACs, mac)
+	}
+	return f, nil
+}
+
+// Matches returns whether the client with the given addresses is a
+// victim. Either address may be nil if it is not known.
+func (f *VictimFilter) Matches(ip net.IP, mac net.HardwareAddr) bool {
+	if f == nil || (len(f.Nets) == 0 && len(f.MACs) == 0) {
+		return true
+	}
+	if ip != nil {
+		for _, n := range f.Nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if mac != nil {
+		for _, m := range f.MACs {
+			if bytes.Equal(m, mac) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// packetSource returns the source IP and MAC addresses of pkt,
+// either of which is nil if pkt lacks the layer holding it.
+func packetSource(pkt gopacket.Packet) (net.IP, net.HardwareAddr) {
+	var ip net.IP
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		ip = l.SrcIP
+	case *layers.IPv6:
+		ip = l.SrcIP
+	}
+	var mac net.HardwareAddr
+	if eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		mac = eth.SrcMAC
+	}
+	return ip, mac
+}
+
+// packetAddr returns the source address of pkt, with the UDP port
+// if it has one, or nil if pkt has no IP layer.
+func packetAddr(pkt gopacket.Packet) net.Addr {
+	ip, _ := packetSource(pkt)
+	if ip == nil {
+		return nil
+	}
+	addr := &net.UDPAddr{IP: ip}
+	if udp, ok := pkt.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		addr.Port = int(udp.SrcPort)
+	}
+	return addr
+}
+
+// addrIP returns the IP address of addr, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
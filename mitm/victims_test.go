@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVictimFilterMatches(t *testing.T) {
+	victimMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x03, 0x88}
+	otherMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	f, err := ParseVictimFilter([]string{"10.38.8.0/24", "192.0.2.7", "2001:db8::/64"}, []string{victimMAC.String()})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, v := range []struct {
+		name     string
+		ip       net.IP
+		mac      net.HardwareAddr
+		expected bool
+	}{
+		{"in CIDR", net.ParseIP("10.38.8.2"), nil, true},
+		{"outside CIDR", net.ParseIP("10.38.9.2"), nil, false},
+		{"single address", net.ParseIP("192.0.2.7"), nil, true},
+		{"next to single address", net.ParseIP("192.0.2.8"), nil, false},
+		{"in IPv6 CIDR", net.ParseIP("2001:db8::388"), nil, true},
+		{"victim MAC", net.ParseIP("10.38.9.2"), victimMAC, true},
+		{"other MAC", net.ParseIP("10.38.9.2"), otherMAC, false},
+		{"no addresses", nil, nil, false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if got := f.Matches(v.ip, v.mac); got != v.expected {
+				t.Errorf("expected Matches(%v, %v) to be %v but got %v", v.ip, v.mac, v.expected, got)
+			}
+		})
+	}
+
+	var none *VictimFilter
+	if !none.Matches(net.ParseIP("10.38.9.2"), nil) {
+		t.Errorf("expected a nil filter to match every client")
+	}
+}
+
+func TestParseVictimFilterErrors(t *testing.T) {
+	for _, v := range []struct {
+		name  string
+		cidrs []string
+		macs  []string
+	}{
+		{"bad CIDR", []string{"10.38.8.0/33"}, nil},
+		{"bad address", []string{"not an address"}, nil},
+		{"bad MAC", nil, []string{"02:00:00"}},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			if _, err := ParseVictimFilter(v.cidrs, v.macs); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestServeDNSNonVictim(t *testing.T) {
+	upstreamResponse := []byte("real upstream response")
+	upstream, _ := fakeUpstream(t, func([]byte) []byte { return upstreamResponse })
+
+	victims, _ := ParseVictimFilter([]string{"10.38.8.0/24"}, nil)
+	var table SpoofTable
+	table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+	addr := serveTestDNS(t, &table, &SpoofConfig{Victims: victims}, &Forwarder{Upstream: upstream, Timeout: time.Second})
+
+	// Our queries come from 127.0.0.1, which is not a victim.
+	if response := exchangeUDP(t, addr, serializeQuery(t, "eecs388.org")); !bytes.Equal(response, upstreamResponse) {
+		t.Errorf("expected query from a non-victim to be forwarded, got %q", response)
+	}
+}
+
+func TestInjectorNonVictim(t *testing.T) {
+	for _, v := range []struct {
+		name     string
+		cidr     string
+		injected bool
+	}{
+		{"victim", "10.38.8.2", true},
+		{"non-victim", "10.38.9.0/24", false},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			victims, _ := ParseVictimFilter([]string{v.cidr}, nil)
+			var table SpoofTable
+			table.Add("eecs388.org", net.ParseIP("3.23.25.235"))
+
+			var w capturingWriter
+			in := &Injector{Writer: &w, Config: &SpoofConfig{Victims: victims}}
+			injected, err := in.InjectSpoofed(context.Background(), capturedIPv4Query(t, "eecs388.org"), &table)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if injected != v.injected {
+				t.Errorf("expected injected to be %v but got %v", v.injected, injected)
+			}
+		})
+	}
+}
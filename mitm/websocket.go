@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isWebSocketUpgrade returns whether r asks to switch
+// its connection over to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RelayWebSocket relays the WebSocket handshake r to the upstream server
+// and, once the server switches protocols, takes over the client's
+// connection and copies bytes both ways between it and the server's
+// until either side closes. If the server declines the upgrade, its
+// response is relayed as by PassthroughRequest.
+//
+// The connection may last indefinitely, so p.Timeout does not apply.
+// If the handshake cannot be relayed, the client is sent an error
+// status and the error is returned.
+func (p *Proxy) RelayWebSocket(w http.ResponseWriter, r *http.Request) error {
+	var entry RequestLogEntry
+	defer p.logRequest(r, time.Now(), &entry)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		entry.Status = http.StatusInternalServerError
+		entry.Err = errors.New("cannot take over the client connection for a WebSocket")
+		return entry.Err
+	}
+
+	req, err := p.newUpstreamRequest(r, nil)
+	if err != nil {
+		entry.Err = relayError(w, err)
+		return entry.Err
+	}
+	// These are hop-by-hop headers, but here they are the point.
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	resp, err := p.upstreamClient().Do(req)
+	if err != nil {
+		entry.Err = relayError(w, err)
+		return entry.Err
+	}
+	defer resp.Body.Close()
+	entry.Status = resp.StatusCode
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		p.rewriteResponseHeaders(r, resp.Header)
+		n, err := streamResponse(w, resp)
+		entry.BytesOut = int(n)
+		if err != nil {
+			entry.Err = fmt.Errorf("streaming response: %w", err)
+		}
+		return entry.Err
+	}
+	// The transport hands back the upgraded connection as the body.
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		entry.Err = relayError(w, errors.New("upstream connection cannot be written to after switching protocols"))
+		return entry.Err
+	}
+
+	conn, client, err := hijacker.Hijack()
+	if err != nil {
+		entry.Err = relayError(w, err)
+		return entry.Err
+	}
+	defer conn.Close()
+	fmt.Fprintf(client, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(client)
+	client.WriteString("\r\n")
+	if err := client.Flush(); err != nil {
+		entry.Err = fmt.Errorf("writing handshake response: %w", err)
+		return entry.Err
+	}
+
+	// Copy both ways until either side is done, then close both
+	// connections so that the other copy finishes too.
+	in := &countingReader{r: client.Reader}
+	out := &countingReader{r: upstream}
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, in)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, out)
+		done <- err
+	}()
+	<-done
+	conn.Close()
+	upstream.Close()
+	<-done
+	entry.BytesIn, entry.BytesOut = in.count(), int(out.count())
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webSocketAccept returns the Sec-WebSocket-Accept value
+// for the handshake key (RFC 6455, section 4.2.2).
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// echoWebSocket is a handler which accepts a WebSocket handshake, then
+// echoes a single short masked frame back unmasked, as a server would.
+func echoWebSocket(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			t.Errorf("real server expected a WebSocket handshake but got headers %v", r.Header)
+			http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("real server failed to hijack connection: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(rw, header); err != nil {
+			t.Errorf("real server failed to read frame header: %v", err)
+			return
+		}
+		payload := make([]byte, header[1]&0x7f)
+		if _, err := io.ReadFull(rw, payload); err != nil {
+			t.Errorf("real server failed to read frame payload: %v", err)
+			return
+		}
+		for i := range payload {
+			payload[i] ^= header[2+i%4]
+		}
+		rw.Write(append([]byte{header[0], byte(len(payload))}, payload...))
+		rw.Flush()
+	}
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	upstream := httptest.NewServer(echoWebSocket(t))
+	defer upstream.Close()
+	proxy := httptest.NewServer(&Proxy{Upstream: upstream.URL})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET "+uri+" HTTP/1.1\r\nHost: bank.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("failed to read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("client expected status %d but got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != webSocketAccept(key) {
+		t.Errorf("client expected Sec-WebSocket-Accept %q but got %q", webSocketAccept(key), accept)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("client expected Upgrade %q but got %q", "websocket", resp.Header.Get("Upgrade"))
+	}
+
+	// A masked text frame carrying "hello".
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x81, 0x80 | 5}, mask...)
+	for i, c := range []byte("hello") {
+		frame = append(frame, c^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	echoed := make([]byte, 7)
+	if _, err := io.ReadFull(br, echoed); err != nil {
+		t.Fatalf("failed to read echoed frame: %v", err)
+	}
+	if echoed[0] != 0x81 || echoed[1] != 5 || string(echoed[2:]) != "hello" {
+		t.Errorf("client expected an unmasked text frame carrying %q but got % x", "hello", echoed)
+	}
+}
+
+func TestProxyWebSocketDeclined(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no WebSockets here", http.StatusForbidden)
+	}))
+	defer upstream.Close()
+	proxy := httptest.NewServer(&Proxy{Upstream: upstream.URL})
+	defer proxy.Close()
+
+	req, err := http.NewRequest("GET", proxy.URL+uri, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to reach proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("client expected status %d but got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != "no WebSockets here\n" {
+		t.Errorf("client expected body %q but got %q", "no WebSockets here\n", body)
+	}
+}